@@ -1,8 +1,8 @@
 package main
 
 import (
-	"fmt"
 	"math"
+	"math/rand"
 )
 
 // SimulateGravity
@@ -15,7 +15,9 @@ func SimulateMD(initialProtein Protein, time float64, residueParameterBondValue,
 	totalTime := 0.0
 	iteration := 10 // 100
 	CheckPosition(timePoints[0])
-	fmt.Println("after first check")
+	if suggested := SuggestTimestep(&initialProtein, bondParameter); time > suggested {
+		logger.Printf("Warning: timestep %.3f fs is larger than the suggested %.3f fs, the simulation may be unstable", time, suggested)
+	}
 	for i := 0; i < iteration; i++ {
 		newProtein, _ := UpdateProtein(timePoints[len(timePoints)-1], time, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondParameter, pairtypesParameter)
 		timePoints = append(timePoints, newProtein)
@@ -103,6 +105,22 @@ func UpdateAcceleration(force *TriTuple, a *Atom) TriTuple {
 	return accel
 }
 
+// UpdateAccelerations sets the acceleration of every atom of the protein to its force
+// divided by its mass, the forces keyed by atom index as returned by EvaluateForces.
+// Atoms without a force or without a positive mass get a zero acceleration.
+func UpdateAccelerations(protein *Protein, forceMap map[int]*TriTuple) {
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			force, exist := forceMap[atom.index]
+			if !exist || force == nil || atom.mass <= 0 {
+				atom.accelerated = TriTuple{}
+				continue
+			}
+			atom.accelerated = UpdateAcceleration(force, atom)
+		}
+	}
+}
+
 func CalculateRMSD(timePoints []Protein) []float64 {
 	var RMSDValue []float64
 
@@ -125,13 +143,195 @@ func CalculateRMSD(timePoints []Protein) []float64 {
 }
 
 func CheckPosition(p Protein) {
-	fmt.Println("Check the nan position index")
 	for _, residue := range p.Residue {
 		for _, atom := range residue.Atoms {
 			if math.IsNaN(atom.position.x) || math.IsNaN(atom.position.y) || math.IsNaN(atom.position.z) {
-				fmt.Println(atom.index)
+				logger.Printf("Warning: atom %d has a NaN position", atom.index)
 			}
 
 		}
 	}
 }
+
+// typicalBondForceConstant is the force constant (kJ/mol/nm^2) SuggestTimestep assumes for a
+// bond without parameters: the bonds to hydrogen, the fastest vibrations, are of this order
+// in the force field files (about 2.8e5 for C-H and 4.6e5 for O-H in AMBER)
+const typicalBondForceConstant = 300000.0
+
+// upper bound (fs) of the timestep suggested by SuggestTimestep
+const maxSuggestedTimestep = 4.0
+
+// SuggestTimestep takes a protein and the bonded parameters and return a stable timestep
+// in fs, a tenth of the period of its fastest bond vibration. Bonds are detected by distance,
+// the period of a bond is 2*pi*sqrt(mu/k) with mu the reduced mass of the two atoms and k
+// the force constant of the bond in the parameters, typicalBondForceConstant when it has
+// none, so the stiffest bond for its mass sets the limit.
+func SuggestTimestep(protein *Protein, bonded parameterDatabase) float64 {
+	// no two atoms further apart than this are bonded by BondedByDistance
+	cutoff := 2 * largestVdwRadius() * bondDetectionFactor
+	bondParameter := bonded.withAtomCount(2)
+	units := bonded.unitSystem()
+
+	timestep := maxSuggestedTimestep
+	NewSpatialHash(protein, cutoff).Pairs(cutoff, func(atom1, atom2 *Atom, r float64) {
+		if atom1.mass <= 0 || atom2.mass <= 0 || !BondedByDistance(atom1, atom2) {
+			return
+		}
+		// the second derivative of the bond energy, in kJ/mol/nm^2
+		k := typicalBondForceConstant
+		if parameter, ok := bondParam(termParameter(nil, bondParameter, atom1, atom2)); ok && parameter.K > 0 {
+			k = 2 * units.HarmonicFactor * parameter.K * units.KJPerMolPerEnergy * math.Pow(10/units.AngstromPerLength, 2)
+		}
+		mu := atom1.mass * atom2.mass / (atom1.mass + atom2.mass)
+		// sqrt(k/mu) is in 1/ps for k in kJ/mol/nm^2 and mu in g/mol
+		period := 2 * math.Pi / math.Sqrt(k/mu) * 1000
+		if period/10 < timestep {
+			timestep = period / 10
+		}
+	})
+
+	return timestep
+}
+
+// InitializeVelocities draws the velocity of every atom from the Maxwell-Boltzmann
+// distribution at the temperature (K) and removes the net momentum of the protein.
+// Atoms without mass are left at rest.
+func InitializeVelocities(protein *Protein, temperature float64, rng *rand.Rand) {
+	var momentum TriTuple
+	totalMass := 0.0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if atom.mass <= 0 {
+				atom.velocity = TriTuple{}
+				continue
+			}
+			// kB T in kJ/mol, the unit of velocityUnit
+			sigma := math.Sqrt(GROMACSUnits.Boltzmann()*temperature/atom.mass) * velocityUnit
+			atom.velocity = TriTuple{
+				x: sigma * rng.NormFloat64(),
+				y: sigma * rng.NormFloat64(),
+				z: sigma * rng.NormFloat64(),
+			}
+			momentum.x += atom.mass * atom.velocity.x
+			momentum.y += atom.mass * atom.velocity.y
+			momentum.z += atom.mass * atom.velocity.z
+			totalMass += atom.mass
+		}
+	}
+	if totalMass == 0 {
+		return
+	}
+
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if atom.mass <= 0 {
+				continue
+			}
+			atom.velocity.x -= momentum.x / totalMass
+			atom.velocity.y -= momentum.y / totalMass
+			atom.velocity.z -= momentum.z / totalMass
+		}
+	}
+}
+
+// TotalMomentum takes a protein
+// and return the sum of mass times velocity over all atoms
+func TotalMomentum(protein *Protein) TriTuple {
+	var momentum TriTuple
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			momentum.x += atom.mass * atom.velocity.x
+			momentum.y += atom.mass * atom.velocity.y
+			momentum.z += atom.mass * atom.velocity.z
+		}
+	}
+	return momentum
+}
+
+// TotalAngularMomentum takes a protein
+// and return the sum of r x (mass * velocity) over all atoms, with r taken from the center of mass
+func TotalAngularMomentum(protein *Protein) TriTuple {
+	center := CenterOfMass(protein)
+
+	var angularMomentum TriTuple
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			r := TriTuple{
+				x: atom.position.x - center.x,
+				y: atom.position.y - center.y,
+				z: atom.position.z - center.z,
+			}
+			p := TriTuple{
+				x: atom.mass * atom.velocity.x,
+				y: atom.mass * atom.velocity.y,
+				z: atom.mass * atom.velocity.z,
+			}
+			// angular momentum r x p of the atom
+			l := BuildNormalVector(r, p)
+			angularMomentum.x += l.x
+			angularMomentum.y += l.y
+			angularMomentum.z += l.z
+		}
+	}
+	return angularMomentum
+}
+
+// KineticEnergy takes a protein and an optional unit system
+// and return the kinetic energy sum(0.5 * m * v^2) of its atoms in the energy unit
+// of the unit system, kJ/mol by default
+func KineticEnergy(protein *Protein, units ...UnitSystem) float64 {
+	return optionalUnits(units).FromKJPerMol(atomsKineticEnergy(proteinAtoms(protein)))
+}
+
+// atomsKineticEnergy return the kinetic energy of the atoms in kJ/mol
+func atomsKineticEnergy(atoms []*Atom) float64 {
+	energy := 0.0
+	for _, atom := range atoms {
+		energy += 0.5 * atom.mass * atom.velocity.dot(atom.velocity)
+	}
+	return energy / (velocityUnit * velocityUnit)
+}
+
+// Temperature takes a protein and an optional unit system
+// and return its instantaneous temperature 2*KE / (Ndf * kB) in K, with the kinetic
+// energy and kB in the energy unit of the unit system.
+// The net momentum is taken as removed, Ndf = 3N - 3 for more than one atom.
+func Temperature(protein *Protein, units ...UnitSystem) float64 {
+	count := 0
+	for _, residue := range protein.Residue {
+		count += len(residue.Atoms)
+	}
+	degreesOfFreedom := 3 * count
+	if count > 1 {
+		degreesOfFreedom -= 3
+	}
+	if degreesOfFreedom == 0 {
+		return 0.0
+	}
+	unitSystem := optionalUnits(units)
+	return 2 * KineticEnergy(protein, unitSystem) / (float64(degreesOfFreedom) * unitSystem.Boltzmann())
+}
+
+// GroupTemperatures takes a protein and groups of its atoms (solute, solvent, ...)
+// and return the instantaneous temperature of each group on its own. The three degrees
+// of freedom of the net momentum removed from the protein are shared by the groups in
+// proportion to their atoms, so that groups covering the protein average, weighted by
+// their degrees of freedom, to its Temperature. An empty group has temperature 0.
+func GroupTemperatures(protein *Protein, groups map[string][]*Atom) map[string]float64 {
+	count := len(proteinAtoms(protein))
+	kB := GROMACSUnits.Boltzmann()
+	temperatures := make(map[string]float64, len(groups))
+	for name, atoms := range groups {
+		degreesOfFreedom := 3 * float64(len(atoms))
+		if count > 1 {
+			degreesOfFreedom -= 3 * float64(len(atoms)) / float64(count)
+		}
+		if degreesOfFreedom <= 0 {
+			temperatures[name] = 0.0
+			continue
+		}
+		// atomsKineticEnergy is in kJ/mol
+		temperatures[name] = 2 * atomsKineticEnergy(atoms) / (degreesOfFreedom * kB)
+	}
+	return temperatures
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ///////////////
+// ////These function are used for analysing structures and trajectories
+// ///////////////
+
+// FindAtomByName takes a residue and an atom name
+// and return the first atom of the residue with this name, or nil
+func FindAtomByName(residue *Residue, name string) *Atom {
+	for _, atom := range residue.Atoms {
+		if atom.element == name {
+			return atom
+		}
+	}
+	return nil
+}
+
+// BackboneAtoms takes a residue
+// and return its N, CA and C atoms, or an error naming the first one missing
+func BackboneAtoms(residue *Residue) (n, ca, c *Atom, err error) {
+	atoms := [3]*Atom{}
+	for i, name := range [3]string{"N", "CA", "C"} {
+		if atoms[i] = FindAtomByName(residue, name); atoms[i] == nil {
+			return nil, nil, nil, fmt.Errorf("residue %s %d of chain %q has no backbone atom %s", residue.Name, residue.ID, residue.ChainID, name)
+		}
+	}
+	return atoms[0], atoms[1], atoms[2], nil
+}
+
+// EndToEndVector takes a protein
+// and return the vector from the N atom of the first residue to the C atom of the last residue.
+// A single-residue protein, or one missing either terminal atom, gives the zero vector.
+func EndToEndVector(protein *Protein) TriTuple {
+	if len(protein.Residue) < 2 {
+		return TriTuple{}
+	}
+
+	first := FindAtomByName(protein.Residue[0], "N")
+	last := FindAtomByName(protein.Residue[len(protein.Residue)-1], "C")
+	if first == nil || last == nil {
+		return TriTuple{}
+	}
+
+	return CalculateVector(first, last)
+}
+
+// EndToEndDistance takes a protein
+// and return the length of its end-to-end vector
+func EndToEndDistance(protein *Protein) float64 {
+	return magnitude(EndToEndVector(protein))
+}
+
+// RadialDistribution takes a protein in a periodic box, a bin width and a maximal distance
+// and return the radial distribution function g(r) together with the centers of its bins.
+// Every pair is histogrammed by its minimum-image distance and each shell is normalised
+// by the count expected for an ideal gas of the same density.
+// It fails when maxR exceeds half the smallest side of the box, where the minimum image
+// no longer holds every pair at distance r.
+func RadialDistribution(protein *Protein, box Box, binWidth, maxR float64) ([]float64, []float64, error) {
+	smallest := math.Min(box.X, math.Min(box.Y, box.Z))
+	if maxR > smallest/2 {
+		return nil, nil, fmt.Errorf("maximal distance %.3f exceeds half the smallest box side %.3f", maxR, smallest)
+	}
+	numBins := int(maxR/binWidth + 1e-9)
+	counts := make([]float64, numBins)
+
+	var atoms []*Atom
+	for _, residue := range protein.Residue {
+		atoms = append(atoms, residue.Atoms...)
+	}
+
+	ForEachPairWithin(protein, maxR, &box, func(a, b *Atom, r float64) {
+		bin := int(r / binWidth)
+		if bin < numBins {
+			counts[bin] += 2
+		}
+	})
+
+	g := make([]float64, numBins)
+	rBins := make([]float64, numBins)
+	if len(atoms) == 0 {
+		return g, rBins, nil
+	}
+	density := float64(len(atoms)) / box.Volume()
+	for k := range counts {
+		lower := float64(k) * binWidth
+		upper := lower + binWidth
+		shell := 4.0 / 3.0 * math.Pi * (upper*upper*upper - lower*lower*lower)
+		g[k] = counts[k] / (float64(len(atoms)) * density * shell)
+		rBins[k] = lower + binWidth/2
+	}
+
+	return g, rBins, nil
+}
+
+// PhiPsi holds the backbone dihedrals (degrees) of one residue,
+// HasPhi and HasPsi are false when the angle is undefined (chain ends).
+// Err tells why a residue with an incomplete backbone was skipped.
+type PhiPsi struct {
+	ResidueID int
+	Phi       float64
+	Psi       float64
+	HasPhi    bool
+	HasPsi    bool
+	Err       error
+}
+
+// RamachandranAngles takes a protein
+// and return the phi (C(i-1)-N-CA-C) and psi (N-CA-C-N(i+1)) angles of every residue.
+// Residues of different chains are not taken as neighbors, residues missing
+// N, CA or C get neither angle and carry the reason in Err.
+func RamachandranAngles(protein *Protein) []PhiPsi {
+	angles := make([]PhiPsi, len(protein.Residue))
+
+	for i, residue := range protein.Residue {
+		angles[i].ResidueID = residue.ID
+		n, ca, c, err := BackboneAtoms(residue)
+		if err != nil {
+			angles[i].Err = err
+			continue
+		}
+
+		if i > 0 && protein.Residue[i-1].ChainID == residue.ChainID {
+			if previousC := FindAtomByName(protein.Residue[i-1], "C"); previousC != nil {
+				angles[i].Phi = CalculateSignedDihedralAngle(previousC, n, ca, c)
+				angles[i].HasPhi = true
+			}
+		}
+		if i < len(protein.Residue)-1 && protein.Residue[i+1].ChainID == residue.ChainID {
+			if nextN := FindAtomByName(protein.Residue[i+1], "N"); nextN != nil {
+				angles[i].Psi = CalculateSignedDihedralAngle(n, ca, c, nextN)
+				angles[i].HasPsi = true
+			}
+		}
+	}
+
+	return angles
+}
+
+// CenterOfMass takes a protein
+// and return the mass-weighted mean position of its atoms
+func CenterOfMass(protein *Protein) TriTuple {
+	center, _ := centerOfMass(proteinAtoms(protein))
+	return center
+}
+
+// RadiusOfGyration takes a protein
+// and return its mass-weighted radius of gyration sqrt(sum(m*|r - r_com|^2) / sum(m)),
+// 0 when the atoms have no mass
+func RadiusOfGyration(protein *Protein) float64 {
+	center := CenterOfMass(protein)
+	sum, totalMass := 0.0, 0.0
+	for _, atom := range proteinAtoms(protein) {
+		d := Distance(atom.position, center)
+		sum += atom.mass * d * d
+		totalMass += atom.mass
+	}
+	if totalMass == 0 {
+		return 0.0
+	}
+	return math.Sqrt(sum / totalMass)
+}
+
+// ResidueCentersOfMass takes a protein
+// and return the mass-weighted center of every residue keyed by residue ID. A residue
+// whose atoms have no mass (unresolved elements) gets the geometric center of its atoms,
+// one without atoms is left out. IDs are expected unique, e.g. after Renumber.
+func ResidueCentersOfMass(protein *Protein) map[int]TriTuple {
+	centers := make(map[int]TriTuple)
+	for _, residue := range protein.Residue {
+		if len(residue.Atoms) == 0 {
+			continue
+		}
+		center, ok := centerOfMass(residue.Atoms)
+		if !ok {
+			center = geometricCenter(residue.Atoms)
+		}
+		centers[residue.ID] = center
+	}
+	return centers
+}
+
+// centerOfMass return the mass-weighted mean position of the atoms,
+// false with the origin when their total mass is zero
+func centerOfMass(atoms []*Atom) (TriTuple, bool) {
+	var center TriTuple
+	totalMass := 0.0
+	for _, atom := range atoms {
+		center.x += atom.mass * atom.position.x
+		center.y += atom.mass * atom.position.y
+		center.z += atom.mass * atom.position.z
+		totalMass += atom.mass
+	}
+	if totalMass == 0 {
+		return TriTuple{}, false
+	}
+
+	center.x /= totalMass
+	center.y /= totalMass
+	center.z /= totalMass
+	return center, true
+}
+
+// geometricCenter return the unweighted mean position of the atoms
+func geometricCenter(atoms []*Atom) TriTuple {
+	var center TriTuple
+	for _, atom := range atoms {
+		center.x += atom.position.x
+		center.y += atom.position.y
+		center.z += atom.position.z
+	}
+	n := float64(len(atoms))
+	return TriTuple{center.x / n, center.y / n, center.z / n}
+}
+
+// MomentOfInertia takes a protein
+// and return its inertia tensor sum(m * (r.r * I - r (x) r)) about the center of mass
+func MomentOfInertia(protein *Protein) [3][3]float64 {
+	center := CenterOfMass(protein)
+
+	var tensor [3][3]float64
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			r := [3]float64{atom.position.x - center.x, atom.position.y - center.y, atom.position.z - center.z}
+			r2 := r[0]*r[0] + r[1]*r[1] + r[2]*r[2]
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					tensor[a][b] -= atom.mass * r[a] * r[b]
+				}
+				tensor[a][a] += atom.mass * r2
+			}
+		}
+	}
+
+	return tensor
+}
+
+// PrincipalAxes takes a protein
+// and return its principal moments of inertia in ascending order and the matching axes.
+// The first axis, with the smallest moment, is the long axis of the structure.
+func PrincipalAxes(protein *Protein) ([3]float64, [3]TriTuple) {
+	moments, vectors := SymmetricEigen3(MomentOfInertia(protein))
+
+	var axes [3]TriTuple
+	for k := range vectors {
+		axes[k] = TriTuple{x: vectors[k][0], y: vectors[k][1], z: vectors[k][2]}
+	}
+	return moments, axes
+}
+
+// OrientToPrincipalAxes takes a protein, moves its center of mass to the origin
+// and rotates it so that its principal axes lie along x, y and z (smallest moment along x).
+// Atom positions are modified in place.
+func OrientToPrincipalAxes(protein *Protein) {
+	center := CenterOfMass(protein)
+	_, vectors := SymmetricEigen3(MomentOfInertia(protein))
+
+	// rows of the rotation are the principal axes, keep it a proper rotation
+	rotation := vectors
+	if determinant3(rotation) < 0 {
+		for i := range rotation[2] {
+			rotation[2][i] = -rotation[2][i]
+		}
+	}
+
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			shifted := TriTuple{
+				x: atom.position.x - center.x,
+				y: atom.position.y - center.y,
+				z: atom.position.z - center.z,
+			}
+			atom.position = rotate(rotation, shifted)
+		}
+	}
+}
+
+// AtomForce is the force on one atom, as reported by ForceReport
+type AtomForce struct {
+	Index     int
+	Force     TriTuple
+	Magnitude float64
+}
+
+// ForceReport takes a force map and a count
+// and return the topN atoms with the largest force, largest first and by index on ties
+func ForceReport(forceMap map[int]*TriTuple, topN int) []AtomForce {
+	entries := OrderedForceEntries(forceMap)
+	report := make([]AtomForce, len(entries))
+	for i, entry := range entries {
+		report[i] = AtomForce{Index: entry.Index, Force: entry.Force, Magnitude: magnitude(entry.Force)}
+	}
+
+	// entries come by index, so the stable sort keeps ties by index
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Magnitude > report[j].Magnitude })
+
+	if topN >= 0 && topN < len(report) {
+		report = report[:topN]
+	}
+	return report
+}
+
+// EnergyContribution is the energy of one bonded term or non-bonded pair, in the
+// energy unit of the bonded parameters, as reported by TopEnergyContributions.
+// Kind is "bond", "angle", "dihedral", "improper" or "nonbonded".
+type EnergyContribution struct {
+	Kind   string
+	Atoms  []*Atom
+	Energy float64
+}
+
+// TopEnergyContributions takes a protein, its topology, the parameters and a count
+// and return the n bonded terms and non-bonded pairs with the highest energy, highest
+// first, the bonded terms before the pairs on ties. A negative n returns all of them.
+// The energies are in the unit of CalculateTotalEnergy and all of them sum to it.
+func TopEnergyContributions(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase, n int) []EnergyContribution {
+	var contributions []EnergyContribution
+	topology.forEachTermEnergy(bonded, func(kind string, atoms []*Atom, energy float64) {
+		contributions = append(contributions, EnergyContribution{Kind: kind, Atoms: atoms, Energy: energy})
+	})
+	units := bonded.unitSystem()
+	_, _, pairs := CalculateTotalUnbondedEnergyForcePairs(protein, nonbonded)
+	for _, pair := range pairs {
+		contributions = append(contributions, EnergyContribution{Kind: "nonbonded", Atoms: []*Atom{pair.Atom1, pair.Atom2}, Energy: units.FromKJPerMol(pair.Energy)})
+	}
+
+	sort.SliceStable(contributions, func(i, j int) bool { return contributions[i].Energy > contributions[j].Energy })
+	if n >= 0 && n < len(contributions) {
+		contributions = contributions[:n]
+	}
+	return contributions
+}
+
+// CoordinationNumbers takes a protein, a cutoff (Angstrom) and optionally its topology
+// and return the number of other atoms closer than cutoff to every atom, keyed by index.
+// With a topology the atoms bonded to an atom are not counted.
+func CoordinationNumbers(protein *Protein, cutoff float64, topology ...*Topology) map[int]int {
+	var bonded map[*Atom][]*Atom
+	if len(topology) > 0 && topology[0] != nil {
+		bonded = topology[0].neighbors()
+	}
+
+	counts := make(map[int]int)
+	for _, atom := range proteinAtoms(protein) {
+		counts[atom.index] = 0
+	}
+	ForEachPairWithin(protein, cutoff, nil, func(a, b *Atom, r float64) {
+		for _, neighbor := range bonded[a] {
+			if neighbor == b {
+				return
+			}
+		}
+		counts[a.index]++
+		counts[b.index]++
+	})
+	return counts
+}
+
+// residues closer than this in sequence are always in contact and do not count as native contacts
+const nativeContactSeparation = 3
+
+// ResidueContactMap takes a protein and a cutoff (Angstrom)
+// and return the symmetric residue contact map: residues i and j are in contact
+// when any atom of i is closer than cutoff to any atom of j
+func ResidueContactMap(protein *Protein, cutoff float64) [][]bool {
+	contacts := make([][]bool, len(protein.Residue))
+	for i := range contacts {
+		contacts[i] = make([]bool, len(protein.Residue))
+	}
+
+	for i := 0; i < len(protein.Residue); i++ {
+		for j := i + 1; j < len(protein.Residue); j++ {
+			if residuesInContact(protein.Residue[i], protein.Residue[j], cutoff) {
+				contacts[i][j] = true
+				contacts[j][i] = true
+			}
+		}
+	}
+	return contacts
+}
+
+func residuesInContact(residue1, residue2 *Residue, cutoff float64) bool {
+	for _, atom1 := range residue1.Atoms {
+		for _, atom2 := range residue2.Atoms {
+			if Distance(atom1.position, atom2.position) < cutoff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FractionNativeContacts takes a structure, its reference (native) structure and a cutoff (Angstrom)
+// and return Q, the fraction of the residue contacts of the reference that are also present
+// in the structure. Residues less than nativeContactSeparation apart in sequence are ignored.
+// A reference without contacts gives Q = 0.
+func FractionNativeContacts(current, reference *Protein, cutoff float64) (float64, error) {
+	if len(current.Residue) != len(reference.Residue) {
+		return 0.0, fmt.Errorf("structure has %d residues, reference has %d", len(current.Residue), len(reference.Residue))
+	}
+
+	native := ResidueContactMap(reference, cutoff)
+	present := ResidueContactMap(current, cutoff)
+	total, kept := 0, 0
+	for i := range native {
+		for j := i + nativeContactSeparation; j < len(native); j++ {
+			if !native[i][j] {
+				continue
+			}
+			total++
+			if present[i][j] {
+				kept++
+			}
+		}
+	}
+	if total == 0 {
+		return 0.0, nil
+	}
+	return float64(kept) / float64(total), nil
+}
+
+// Histogram counts values in bins of equal width from Min, the values outside the
+// bins are counted in Underflow and Overflow
+type Histogram struct {
+	Min       float64
+	Width     float64
+	Counts    []int
+	Underflow int
+	Overflow  int
+}
+
+// NewHistogram returns an empty histogram with bins of the given width covering [lower, upper)
+func NewHistogram(lower, upper, width float64) Histogram {
+	return Histogram{Min: lower, Width: width, Counts: make([]int, int(math.Ceil((upper-lower)/width-1e-9)))}
+}
+
+// Add counts a value in its bin
+func (h *Histogram) Add(value float64) {
+	bin := int(math.Floor((value - h.Min) / h.Width))
+	switch {
+	case bin < 0:
+		h.Underflow++
+	case bin >= len(h.Counts):
+		h.Overflow++
+	default:
+		h.Counts[bin]++
+	}
+}
+
+// Centers return the center of every bin
+func (h Histogram) Centers() []float64 {
+	centers := make([]float64, len(h.Counts))
+	for k := range centers {
+		centers[k] = h.Min + (float64(k)+0.5)*h.Width
+	}
+	return centers
+}
+
+// bins of GeometryHistograms, a bond beyond 4 Angstrom is an overflow
+const (
+	bondHistogramMax   = 4.0
+	bondHistogramWidth = 0.05
+	angleHistogramBin  = 5.0
+)
+
+// GeometryHistograms takes a topology
+// and return the histograms of its bond lengths (Angstrom, 0.05 bins up to 4),
+// angles and dihedral angles (degrees, 5 degree bins over [0, 180]).
+// Bonds in the overflow or sparse bins far from the bulk point at a broken geometry.
+func GeometryHistograms(topology *Topology) (bondHist, angleHist, dihedralHist Histogram) {
+	bondHist = NewHistogram(0, bondHistogramMax, bondHistogramWidth)
+	// one extra bin so that 180 itself is counted
+	angleHist = NewHistogram(0, 180+angleHistogramBin, angleHistogramBin)
+	dihedralHist = NewHistogram(0, 180+angleHistogramBin, angleHistogramBin)
+
+	for _, bond := range topology.bonds {
+		bondHist.Add(Distance(bond.atom1.position, bond.atom2.position))
+	}
+	for _, angle := range topology.angles {
+		angleHist.Add(CalculateAngle(angle.atom1, angle.atom2, angle.atom3))
+	}
+	for _, dihedral := range topology.dihedrals {
+		dihedralHist.Add(CalculateDihedralAngle(dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4))
+	}
+	return bondHist, angleHist, dihedralHist
+}
+
+// EnsembleAverage takes frames with their energies (kJ/mol), a temperature (K) and an observable
+// and return the Boltzmann-weighted average sum(w_i * O_i) / sum(w_i), w_i = exp(-E_i/kT).
+// Energies are taken relative to the lowest one so the weights cannot overflow.
+// At 0 K the lowest-energy frames alone count. No frames give 0, a number of energies
+// other than the number of frames is an error.
+func EnsembleAverage(frames []*Protein, energies []float64, temperature float64, observable func(*Protein) float64) (float64, error) {
+	if len(frames) != len(energies) {
+		return 0.0, fmt.Errorf("%d frames but %d energies", len(frames), len(energies))
+	}
+	n := len(frames)
+	if n == 0 {
+		return 0.0, nil
+	}
+
+	lowest := energies[0]
+	for _, energy := range energies {
+		lowest = math.Min(lowest, energy)
+	}
+
+	kT := boltzmann * temperature
+	sum, weights := 0.0, 0.0
+	for i := 0; i < n; i++ {
+		weight := 0.0
+		if kT > 0 {
+			weight = math.Exp(-(energies[i] - lowest) / kT)
+		} else if energies[i] == lowest {
+			weight = 1.0
+		}
+		if weight == 0 {
+			continue
+		}
+		sum += weight * observable(frames[i])
+		weights += weight
+	}
+	return sum / weights, nil
+}
+
+// RMSF takes the frames of a trajectory
+// and return the root-mean-square fluctuation of every atom around its mean position,
+// keyed by atom index. Positions are compared as given, frames that should be
+// free of overall motion are aligned to the first one with RMSF(AlignFrames(frames)).
+// An atom missing from some frames is averaged over the frames that contain it.
+func RMSF(frames []*Protein) map[int]float64 {
+	sums := make(map[int]TriTuple)
+	counts := make(map[int]int)
+	for _, frame := range frames {
+		for _, residue := range frame.Residue {
+			for _, atom := range residue.Atoms {
+				sums[atom.index] = addVectors(sums[atom.index], atom.position)
+				counts[atom.index]++
+			}
+		}
+	}
+
+	deviations := make(map[int]float64)
+	for _, frame := range frames {
+		for _, residue := range frame.Residue {
+			for _, atom := range residue.Atoms {
+				mean := scaleVector(sums[atom.index], 1/float64(counts[atom.index]))
+				r := Distance(atom.position, mean)
+				deviations[atom.index] += r * r
+			}
+		}
+	}
+
+	rmsf := make(map[int]float64, len(deviations))
+	for index, deviation := range deviations {
+		rmsf[index] = math.Sqrt(deviation / float64(counts[index]))
+	}
+	return rmsf
+}
+
+// AlignFrames takes the frames of a trajectory and return copies of them
+// superimposed on the first frame with Superimpose, the frames are not changed
+func AlignFrames(frames []*Protein) []*Protein {
+	aligned := make([]*Protein, len(frames))
+	for i, frame := range frames {
+		aligned[i] = CopyProtein(frame)
+		if i > 0 {
+			Superimpose(aligned[i], frames[0])
+		}
+	}
+	return aligned
+}
+
+// Superimpose takes a mobile and a reference structure and moves the mobile one
+// rigidly onto the reference with the least-squares rotation of Kabsch. Atoms are
+// matched by index and only those present in both structures are fitted, all the
+// atoms of the mobile structure are moved. It return the RMSD of the fitted atoms
+// in Angstrom after the fit.
+func Superimpose(mobile, reference *Protein) float64 {
+	targets := make(map[int]TriTuple)
+	for _, atom := range proteinAtoms(reference) {
+		targets[atom.index] = atom.position
+	}
+	var fitted []*Atom
+	var mobileCenter, referenceCenter TriTuple
+	for _, atom := range proteinAtoms(mobile) {
+		if target, ok := targets[atom.index]; ok {
+			fitted = append(fitted, atom)
+			mobileCenter = addVectors(mobileCenter, atom.position)
+			referenceCenter = addVectors(referenceCenter, target)
+		}
+	}
+	if len(fitted) == 0 {
+		return 0
+	}
+	mobileCenter = scaleVector(mobileCenter, 1/float64(len(fitted)))
+	referenceCenter = scaleVector(referenceCenter, 1/float64(len(fitted)))
+
+	// covariance H = sum p q^T of the centered mobile p and reference q positions
+	var h [3][3]float64
+	for _, atom := range fitted {
+		p := addVectors(atom.position, scaleVector(mobileCenter, -1))
+		q := addVectors(targets[atom.index], scaleVector(referenceCenter, -1))
+		pc, qc := [3]float64{p.x, p.y, p.z}, [3]float64{q.x, q.y, q.z}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				h[i][j] += pc[i] * qc[j]
+			}
+		}
+	}
+	rotation := kabschRotation(h)
+
+	for _, atom := range proteinAtoms(mobile) {
+		atom.position = addVectors(rotate(rotation, addVectors(atom.position, scaleVector(mobileCenter, -1))), referenceCenter)
+	}
+
+	sum := 0.0
+	for _, atom := range fitted {
+		r := Distance(atom.position, targets[atom.index])
+		sum += r * r
+	}
+	return math.Sqrt(sum / float64(len(fitted)))
+}
+
+// kabschRotation takes the covariance H = U S V^T of two centered sets of positions
+// and return the proper rotation V U^T that maximizes the trace of R H. The right
+// singular vectors are the eigenvectors of H^T H, the third pair of vectors is taken as
+// the cross product of the first two so that a reflection is never returned.
+func kabschRotation(h [3][3]float64) [3][3]float64 {
+	var hth [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				hth[i][j] += h[k][i] * h[k][j]
+			}
+		}
+	}
+	eigenvalues, eigenvectors := SymmetricEigen3(hth)
+	identity := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	if eigenvalues[2] <= 0 {
+		return identity
+	}
+
+	// singular vectors by decreasing singular value, u_k = H v_k / s_k
+	var u, v [3]TriTuple
+	for k := 0; k < 2; k++ {
+		e := eigenvectors[2-k]
+		v[k] = TriTuple{x: e[0], y: e[1], z: e[2]}
+		u[k] = TriTuple{
+			x: h[0][0]*e[0] + h[0][1]*e[1] + h[0][2]*e[2],
+			y: h[1][0]*e[0] + h[1][1]*e[1] + h[1][2]*e[2],
+			z: h[2][0]*e[0] + h[2][1]*e[1] + h[2][2]*e[2],
+		}
+	}
+	u[0] = scaleVector(u[0], 1/magnitude(u[0]))
+	// the second left vector only has to be orthogonal to the first when the
+	// positions are collinear and its singular value vanishes
+	u[1] = addVectors(u[1], scaleVector(u[0], -u[1].dot(u[0])))
+	if magnitude(u[1]) < 1e-9*math.Sqrt(eigenvalues[2]) {
+		u[1] = Cross(u[0], TriTuple{x: 1})
+		if magnitude(u[1]) < 0.1 {
+			u[1] = Cross(u[0], TriTuple{y: 1})
+		}
+	}
+	u[1] = scaleVector(u[1], 1/magnitude(u[1]))
+	u[2] = Cross(u[0], u[1])
+	v[2] = Cross(v[0], v[1])
+
+	var rotation [3][3]float64
+	for k := 0; k < 3; k++ {
+		vk, uk := [3]float64{v[k].x, v[k].y, v[k].z}, [3]float64{u[k].x, u[k].y, u[k].z}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				rotation[i][j] += vk[i] * uk[j]
+			}
+		}
+	}
+	return rotation
+}
+
+// MeanSquaredDisplacement takes the frames of a trajectory and the time between them
+// and return the lag times k*dt, for k from 1 to len(frames)-1, with the mean squared
+// displacement of the atoms over each lag, averaged over every pair of frames k apart.
+// Atoms are matched across frames by index and the positions must be unwrapped, an atom
+// crossing a periodic boundary would jump by a box length.
+func MeanSquaredDisplacement(frames []*Protein, dt float64) ([]float64, []float64) {
+	var lagTimes, msd []float64
+	for lag := 1; lag < len(frames); lag++ {
+		sum, count := 0.0, 0
+		for start := 0; start+lag < len(frames); start++ {
+			later := frames[start+lag]
+			for _, atom := range proteinAtoms(frames[start]) {
+				moved, exist := later.AtomByIndex(atom.index)
+				if !exist {
+					continue
+				}
+				r := Distance(atom.position, moved.position)
+				sum += r * r
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		lagTimes = append(lagTimes, float64(lag)*dt)
+		msd = append(msd, sum/float64(count))
+	}
+	return lagTimes, msd
+}
+
+// DiffusionCoefficient takes the lag times and mean squared displacements of
+// MeanSquaredDisplacement and return the self-diffusion coefficient, the least squares
+// slope of the MSD divided by 6 (Einstein relation), in Angstrom^2 per unit of time.
+// Only the diffusive, linear part of the MSD should be given, not the ballistic start.
+func DiffusionCoefficient(lagTimes, msd []float64) float64 {
+	n := float64(len(lagTimes))
+	if len(lagTimes) < 2 || len(msd) != len(lagTimes) {
+		return 0.0
+	}
+	var sumT, sumM, sumTT, sumTM float64
+	for i, t := range lagTimes {
+		sumT += t
+		sumM += msd[i]
+		sumTT += t * t
+		sumTM += t * msd[i]
+	}
+	denominator := n*sumTT - sumT*sumT
+	if denominator == 0 {
+		return 0.0
+	}
+	return (n*sumTM - sumT*sumM) / denominator / 6
+}
+
+// AtomDisplacement is the move of one atom between two structures, as reported by CompareStructures
+type AtomDisplacement struct {
+	Index        int
+	Displacement TriTuple
+	Magnitude    float64
+}
+
+// CompareStructures takes two structures of the same atoms, matched by atom index,
+// and return the atoms that moved from before to after, largest move first and by
+// index on ties. Atoms at the same position, or missing from after, are left out.
+func CompareStructures(before, after *Protein) []AtomDisplacement {
+	positions := make(map[int]TriTuple)
+	for _, residue := range after.Residue {
+		for _, atom := range residue.Atoms {
+			positions[atom.index] = atom.position
+		}
+	}
+
+	var report []AtomDisplacement
+	for _, residue := range before.Residue {
+		for _, atom := range residue.Atoms {
+			position, exist := positions[atom.index]
+			if !exist {
+				continue
+			}
+			displacement := addVectors(position, scaleVector(atom.position, -1))
+			if length := magnitude(displacement); length > 0 {
+				report = append(report, AtomDisplacement{Index: atom.index, Displacement: displacement, Magnitude: length})
+			}
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Magnitude != report[j].Magnitude {
+			return report[i].Magnitude > report[j].Magnitude
+		}
+		return report[i].Index < report[j].Index
+	})
+	return report
+}
+
+// DipoleMoment takes a protein
+// and return its electric dipole moment sum(q * (r - center)) in e*Angstrom, with
+// positions taken from the center of mass. For a neutral protein the result does not
+// depend on the reference point; for a charged one it does, shifting the reference by d
+// changes the dipole by -Q*d, so only dipoles about the same reference are comparable.
+func DipoleMoment(protein *Protein) TriTuple {
+	center := CenterOfMass(protein)
+
+	var dipole TriTuple
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			r := addVectors(atom.position, scaleVector(center, -1))
+			dipole = addVectors(dipole, scaleVector(r, atom.charge))
+		}
+	}
+	return dipole
+}
+
+// DipoleMagnitude takes a protein
+// and return the length of its dipole moment in e*Angstrom
+func DipoleMagnitude(protein *Protein) float64 {
+	return magnitude(DipoleMoment(protein))
+}
+
+// ElectrostaticPotentialAt takes a protein and a point
+// and return the Coulomb potential sum(q_i / (4 pi epsilon r_i)) of its charges at the
+// point, in the units of CalculateElectricPotentialEnergy per elementary charge.
+// An atom right at the point is left out, its potential there is singular.
+func ElectrostaticPotentialAt(protein *Protein, point TriTuple) float64 {
+	potential := 0.0
+	for _, atom := range proteinAtoms(protein) {
+		if atom.charge == 0 {
+			continue
+		}
+		if r := Distance(atom.position, point); r > 0 {
+			potential += atom.charge / (4 * math.Pi * epsilon * r)
+		}
+	}
+	return potential
+}
+
+// PotentialGrid takes a protein, a box and a grid spacing (Angstrom)
+// and return the ElectrostaticPotentialAt of the points i*spacing, j*spacing, k*spacing
+// of the box, indexed [i][j][k], corners included
+func PotentialGrid(protein *Protein, box Box, spacing float64) [][][]float64 {
+	if spacing <= 0 {
+		return nil
+	}
+	nx, ny, nz := int(box.X/spacing)+1, int(box.Y/spacing)+1, int(box.Z/spacing)+1
+
+	grid := make([][][]float64, nx)
+	for i := range grid {
+		grid[i] = make([][]float64, ny)
+		for j := range grid[i] {
+			grid[i][j] = make([]float64, nz)
+			for k := range grid[i][j] {
+				grid[i][j][k] = ElectrostaticPotentialAt(protein, TriTuple{float64(i) * spacing, float64(j) * spacing, float64(k) * spacing})
+			}
+		}
+	}
+	return grid
+}
+
+// BoundingBox takes a protein
+// and return the lowest and highest corners of the box enclosing its atom centers
+func BoundingBox(protein *Protein) (TriTuple, TriTuple) {
+	first := true
+	var low, high TriTuple
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			p := atom.position
+			if first {
+				low, high, first = p, p, false
+				continue
+			}
+			low = TriTuple{x: math.Min(low.x, p.x), y: math.Min(low.y, p.y), z: math.Min(low.z, p.z)}
+			high = TriTuple{x: math.Max(high.x, p.x), y: math.Max(high.y, p.y), z: math.Max(high.z, p.z)}
+		}
+	}
+	return low, high
+}
+
+// MolecularVolume takes a protein and a grid spacing (Angstrom)
+// and return the volume (Angstrom^3) enclosed by its van der Waals surface: the bounding
+// box, grown by the largest radius, is cut into cubes of side gridSpacing and the cubes
+// whose center lies inside any atom sphere are summed. Smaller spacings are more accurate and slower.
+func MolecularVolume(protein *Protein, gridSpacing float64) float64 {
+	if gridSpacing <= 0 {
+		return 0.0
+	}
+	low, high := BoundingBox(protein)
+	maxRadius := 0.0
+	for _, radius := range vdwRadii {
+		maxRadius = math.Max(maxRadius, radius)
+	}
+	origin := TriTuple{x: low.x - maxRadius, y: low.y - maxRadius, z: low.z - maxRadius}
+	nx := int(math.Ceil((high.x-low.x+2*maxRadius)/gridSpacing)) + 1
+	ny := int(math.Ceil((high.y-low.y+2*maxRadius)/gridSpacing)) + 1
+	nz := int(math.Ceil((high.z-low.z+2*maxRadius)/gridSpacing)) + 1
+
+	occupied := make([]bool, nx*ny*nz)
+	count := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			radius := VdwRadius(atom)
+			if radius <= 0 {
+				continue
+			}
+			// only the cells around the atom can be inside it
+			p := atom.position
+			i0, i1 := gridRange(p.x-origin.x, radius, gridSpacing, nx)
+			j0, j1 := gridRange(p.y-origin.y, radius, gridSpacing, ny)
+			k0, k1 := gridRange(p.z-origin.z, radius, gridSpacing, nz)
+			for i := i0; i <= i1; i++ {
+				for j := j0; j <= j1; j++ {
+					for k := k0; k <= k1; k++ {
+						cell := (i*ny+j)*nz + k
+						if occupied[cell] {
+							continue
+						}
+						center := TriTuple{
+							x: origin.x + (float64(i)+0.5)*gridSpacing,
+							y: origin.y + (float64(j)+0.5)*gridSpacing,
+							z: origin.z + (float64(k)+0.5)*gridSpacing,
+						}
+						if Distance(center, p) <= radius {
+							occupied[cell] = true
+							count++
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return float64(count) * gridSpacing * gridSpacing * gridSpacing
+}
+
+// gridRange return the first and last cells of a grid of n cells that a sphere
+// at coordinate x with the given radius can reach
+func gridRange(x, radius, spacing float64, n int) (int, int) {
+	first := max(int(math.Floor((x-radius)/spacing)), 0)
+	last := min(int(math.Floor((x+radius)/spacing)), n-1)
+	return first, last
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"math"
 )
 
@@ -64,12 +63,6 @@ func AddSimpleBondConstraints(p *Protein, bondParameter parameterDatabase, resid
 											break
 										}
 
-										if atom1.index == 233 {
-											fmt.Println(atom1.position)
-										}
-										if atom2.index == 233 {
-											fmt.Println(atom1.position)
-										}
 										p.Residue[q].Atoms[i].position.x += (atom2.position.x - atom1.position.x) * correction
 										p.Residue[q].Atoms[i].position.y += (atom2.position.y - atom1.position.y) * correction
 										p.Residue[q].Atoms[i].position.z += (atom2.position.z - atom1.position.z) * correction
@@ -78,12 +71,6 @@ func AddSimpleBondConstraints(p *Protein, bondParameter parameterDatabase, resid
 										p.Residue[q].Atoms[j].position.y += (tempAtom.position.y - atom2.position.y) * correction
 										p.Residue[q].Atoms[j].position.z += (tempAtom.position.z - atom2.position.z) * correction
 										coverage = false
-										if atom1.index == 233 {
-											fmt.Println(atom1.position)
-										}
-										if atom2.index == 233 {
-											fmt.Println(atom1.position)
-										}
 									}
 
 								}
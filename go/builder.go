@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProteinBuilder assembles a Protein residue by residue, e.g.
+//
+//	protein := NewProteinBuilder().
+//		AddResidue("ALA", 1, "A").AddAtom("N", "N", 0, 0, 0).AddAtom("CA", "C", 1.46, 0, 0).
+//		Build()
+//
+// Atoms are numbered from 1 in the order they are added and get their mass from
+// the mass table. The first invalid call is kept in Err and makes Build return nil.
+type ProteinBuilder struct {
+	protein *Protein
+	ids     map[string]bool
+	count   int
+	err     error
+}
+
+// NewProteinBuilder returns a builder of an empty protein
+func NewProteinBuilder() *ProteinBuilder {
+	return &ProteinBuilder{
+		protein: &Protein{},
+		ids:     make(map[string]bool),
+	}
+}
+
+// AddResidue starts a new residue, the following atoms are added to it.
+// Residue IDs must be unique within a chain.
+func (b *ProteinBuilder) AddResidue(name string, id int, chain string) *ProteinBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	key := fmt.Sprintf("%s:%d", chain, id)
+	if b.ids[key] {
+		b.err = fmt.Errorf("residue %s %d is already in chain %q", name, id, chain)
+		return b
+	}
+	b.ids[key] = true
+
+	b.protein.Residue = append(b.protein.Residue, &Residue{Name: name, ID: id, ChainID: chain})
+	return b
+}
+
+// AddAtom adds an atom with the given name and element to the current residue
+func (b *ProteinBuilder) AddAtom(name, element string, x, y, z float64) *ProteinBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(b.protein.Residue) == 0 {
+		b.err = fmt.Errorf("atom %s added before any residue", name)
+		return b
+	}
+
+	mass, found := massTable[strings.ToUpper(element)]
+	if !found {
+		b.err = fmt.Errorf("no mass for element %s of atom %s", element, name)
+		return b
+	}
+
+	b.count++
+	residue := b.protein.Residue[len(b.protein.Residue)-1]
+	residue.Atoms = append(residue.Atoms, &Atom{
+		index:    b.count,
+		element:  name,
+		symbol:   strings.ToUpper(element),
+		position: TriTuple{x: x, y: y, z: z},
+		mass:     mass,
+	})
+	b.protein.InvalidateAtomIndex()
+	return b
+}
+
+// Err returns the first error met while building, if any
+func (b *ProteinBuilder) Err() error {
+	return b.err
+}
+
+// Build returns the protein, or nil if one of the calls was invalid
+func (b *ProteinBuilder) Build() *Protein {
+	if b.err != nil {
+		return nil
+	}
+	return b.protein
+}
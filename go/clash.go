@@ -0,0 +1,137 @@
+package main
+
+import "math"
+
+// overlap fraction used by RelaxClashes, and by PrepareAndEquilibrate when SimulationConfig.ClashOverlap is not set
+const defaultClashOverlap = 0.5
+
+// share of the displacement of a clashing atom that its bonded neighbors follow
+const clashNeighborShare = 0.5
+
+// Clash is a pair of non-bonded atoms that overlap
+type Clash struct {
+	Atom1    *Atom
+	Atom2    *Atom
+	Distance float64
+}
+
+// FindClashes takes a protein, an overlap fraction and optionally its topology
+// and return every pair of atoms closer than overlapFraction times the sum of their
+// van der Waals radii. Bonded (1-2) and angle (1-3) pairs of the topology are left out,
+// without one those of BuildTopology.
+func FindClashes(protein *Protein, overlapFraction float64, topology ...*Topology) []Clash {
+	if len(topology) > 0 && topology[0] != nil {
+		return findClashes(protein, overlapFraction, topology[0].excludedPairs())
+	}
+	return findClashes(protein, overlapFraction, BuildTopology(protein).excludedPairs())
+}
+
+// findClashes is FindClashes with the excluded pairs given, so that callers that keep
+// a topology do not rebuild it
+func findClashes(protein *Protein, overlapFraction float64, excluded map[[2]*Atom]bool) []Clash {
+	cutoff := 2 * largestVdwRadius() * overlapFraction
+	var clashes []Clash
+	NewSpatialHash(protein, cutoff).Pairs(cutoff, func(atom1, atom2 *Atom, r float64) {
+		if excluded[[2]*Atom{atom1, atom2}] {
+			return
+		}
+		if r < overlapFraction*(VdwRadius(atom1)+VdwRadius(atom2)) {
+			clashes = append(clashes, Clash{Atom1: atom1, Atom2: atom2, Distance: r})
+		}
+	})
+
+	return clashes
+}
+
+// PlanarityViolation is an improper dihedral whose atoms are further from planar than allowed
+type PlanarityViolation struct {
+	Atom1     *Atom
+	Atom2     *Atom
+	Atom3     *Atom
+	Atom4     *Atom
+	Angle     float64
+	Deviation float64
+}
+
+// CheckPlanarity takes a protein, its topology and a tolerance in degrees
+// and return every improper of the topology whose angle deviates from its reference by more than the tolerance.
+// The reference is the first improper parameter when given, otherwise the group is
+// expected to be planar (0 or 180 degrees).
+func CheckPlanarity(protein *Protein, topology *Topology, tolerance float64) []PlanarityViolation {
+	var violations []PlanarityViolation
+	if topology == nil {
+		return violations
+	}
+
+	for _, improper := range topology.impropers {
+		angle := CalculateSignedDihedralAngle(improper.atom1, improper.atom2, improper.atom3, improper.atom4)
+
+		var deviation float64
+		if len(improper.parameter) > 0 {
+			deviation = math.Abs(math.Remainder(angle-improper.parameter[0], 360))
+		} else {
+			deviation = math.Abs(angle)
+			if deviation > 90 {
+				deviation = 180 - deviation
+			}
+		}
+
+		if deviation > tolerance {
+			violations = append(violations, PlanarityViolation{
+				Atom1:     improper.atom1,
+				Atom2:     improper.atom2,
+				Atom3:     improper.atom3,
+				Atom4:     improper.atom4,
+				Angle:     angle,
+				Deviation: deviation,
+			})
+		}
+	}
+
+	return violations
+}
+
+// RelaxClashes takes a protein and an iteration cap and pushes apart the atoms of
+// every clash found by FindClashes (with defaultClashOverlap), moving each atom of
+// a pair by half the missing distance and its bonded neighbors by a share of it.
+// Atoms outside the clashes are left in place. It stops when no clash remains or
+// after maxIter rounds and return the number of clashes left.
+func RelaxClashes(protein *Protein, maxIter int) int {
+	// the bonds are those of the starting structure, atoms pushed apart keep their exclusions
+	topology := BuildTopology(protein)
+	neighbors := topology.neighbors()
+	excluded := topology.excludedPairs()
+
+	clashes := findClashes(protein, defaultClashOverlap, excluded)
+	for iteration := 0; iteration < maxIter && len(clashes) > 0; iteration++ {
+		for _, clash := range clashes {
+			separation := CalculateVector(clash.Atom1, clash.Atom2)
+			r := magnitude(separation)
+			if r == 0 {
+				// coincident atoms, any direction will do
+				separation, r = TriTuple{x: 1}, 1
+			}
+			// aim slightly past the threshold so that the pair is not found again
+			target := 1.05 * defaultClashOverlap * (VdwRadius(clash.Atom1) + VdwRadius(clash.Atom2))
+			push := scaleVector(separation, 0.5*(target-clash.Distance)/r)
+
+			displaceWithNeighbors(clash.Atom2, clash.Atom1, push, neighbors)
+			displaceWithNeighbors(clash.Atom1, clash.Atom2, scaleVector(push, -1), neighbors)
+		}
+		clashes = findClashes(protein, defaultClashOverlap, excluded)
+	}
+
+	return len(clashes)
+}
+
+// displaceWithNeighbors moves the atom and, by clashNeighborShare of the displacement, its bonded
+// neighbors other than its clash partner, which overlaps enough to look bonded by distance
+func displaceWithNeighbors(atom, partner *Atom, displacement TriTuple, neighbors map[*Atom][]*Atom) {
+	atom.position = addVectors(atom.position, displacement)
+	for _, neighbor := range neighbors[atom] {
+		if neighbor == partner {
+			continue
+		}
+		neighbor.position = addVectors(neighbor.position, scaleVector(displacement, clashNeighborShare))
+	}
+}
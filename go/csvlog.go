@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSVLogger writes the energies of a run as CSV, one row per logged step under a header
+// naming the columns and their units. The pressure column is only written when the
+// logger is made with it, i.e. for a system in a box.
+type CSVLogger struct {
+	w             *csv.Writer
+	withPressure  bool
+	units         UnitSystem
+	headerWritten bool
+}
+
+// NewCSVLogger returns a logger of CSV rows to w, with a pressure column when withPressure is set,
+// writing the energies in the energy unit of the optional unit system, kJ/mol by default
+func NewCSVLogger(w io.Writer, withPressure bool, units ...UnitSystem) *CSVLogger {
+	return &CSVLogger{w: csv.NewWriter(w), withPressure: withPressure, units: optionalUnits(units)}
+}
+
+// LogRow writes the step, the time in fs and the state, its energies in the energy unit
+// of the logger, as one row, after the header for the first one
+func (l *CSVLogger) LogRow(step int, time float64, state ThermoState) error {
+	if !l.headerWritten {
+		energyUnit := strings.ReplaceAll(l.units.EnergyUnit, "/", "_")
+		header := []string{"step", "time_fs", "potential_" + energyUnit, "kinetic_" + energyUnit, "total_" + energyUnit, "temperature_K"}
+		if l.withPressure {
+			header = append(header, "pressure_bar")
+		}
+		if err := l.w.Write(header); err != nil {
+			return err
+		}
+		l.headerWritten = true
+	}
+
+	values := []float64{time, state.PotentialEnergy, state.KineticEnergy, state.TotalEnergy, state.Temperature}
+	if l.withPressure {
+		values = append(values, state.Pressure)
+	}
+	row := []string{strconv.Itoa(step)}
+	for _, value := range values {
+		row = append(row, strconv.FormatFloat(value, 'f', 6, 64))
+	}
+	if err := l.w.Write(row); err != nil {
+		return err
+	}
+
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// logState works like LogRow with the energies of the state given in the energy unit of units
+func (l *CSVLogger) logState(step int, time float64, state ThermoState, units UnitSystem) error {
+	for _, energy := range []*float64{&state.PotentialEnergy, &state.KineticEnergy, &state.TotalEnergy} {
+		*energy = l.units.FromKJPerMol(*energy * units.KJPerMolPerEnergy)
+	}
+	return l.LogRow(step, time, state)
+}
@@ -2,6 +2,11 @@ package main
 
 const epsilon = 55.26349406 // vacuum dielectric permittivity
 
+const boltzmann = 0.0083144626 // Boltzmann constant in kJ/mol/K
+
+// velocities are in Angstrom/fs and masses in g/mol, sqrt(kJ/mol / (g/mol)) = 0.01 Angstrom/fs
+const velocityUnit = 0.01
+
 const verletCutOff = 3.5
 const verletBuffer = 0.0
 
@@ -15,18 +20,46 @@ type VerletList struct {
 	Neighbors map[*Atom][]*Atom
 	Cutoff    float64
 	Buffer    float64
+	// AtomCutoff or GroupCutoff
+	Scheme CutoffScheme
+	// periodic cell, distances are minimum-image distances when set
+	Box *Box
 }
 
 type Protein struct {
 	Name    string
 	Residue []*Residue
+	// bonds given by CONECT records, BuildTopology trusts them over distances
+	ExplicitBonds [][2]*Atom
+	// periodic cell from the CRYST1 record, nil when the file has none
+	Box *Box
+	// cache of AtomByIndex, nil until the first call
+	atomByIndex map[int]*Atom
 }
 
+// Bond is a bond between two atoms with its order, as read from a MOL file:
+// 1, 2 and 3 for single, double and triple bonds and AromaticBond for aromatic ones
+type Bond struct {
+	Atom1 *Atom
+	Atom2 *Atom
+	Order int
+}
+
+// bond order of an aromatic bond in MOL files
+const AromaticBond = 4
+
 type Residue struct {
 	Name    string
 	ID      int
 	ChainID string
 	Atoms   []*Atom
+	// first and last amino acid of its chain, set by MarkTermini
+	IsNTerminal bool
+	IsCTerminal bool
+	// rtp entry of a protonation state (HID, HISE, ...) used for the templates
+	// of the residue instead of its name, empty for the plain residue. The AMBER
+	// histidine names set by MarkVariants also find the GROMOS ones (HISD, HISA, ...)
+	Variant string
 }
 
 type Atom struct {
@@ -37,7 +70,12 @@ type Atom struct {
 	accelerated TriTuple
 	mass        float64
 	element     string
-	charge      float64
+	// element symbol in upper case when the file or builder gives one, "" when
+	// it has to be inferred from the atom name, see atomElement
+	symbol string
+	charge float64
+	// charge group of the atom, 0 when it is not part of one
+	chargeGroup int
 }
 
 type AtomChargeData struct {
@@ -54,6 +92,141 @@ type parameterPair struct {
 
 type parameterDatabase struct {
 	atomPair []*parameterPair
+	// per atom type Lennard-Jones parameters, when set the non-bonded routine
+	// combines them pairwise instead of looking up atomPair
+	ljTypes map[string]LJParam
+	// mixing rule used with ljTypes, it must match the force field the parameters come from
+	combiningRule CombiningRule
+	// pair specific parameters (CHARMM NBFIX) that override the mixing rule,
+	// keyed on the two types in sorted order, see ljExceptionKey
+	ljExceptions map[[2]string]LJParam
+	// units of the parameters, the zero value is GROMACSUnits
+	units UnitSystem
+	// how the non-bonded cutoff is applied, the zero value is AtomCutoff
+	cutoffScheme CutoffScheme
+	// explicit 1-4 pairs ([ pairs ] of an .itp) and the scale of their Coulomb term
+	pairs   []ItpPair
+	fudgeQQ float64
+}
+
+// UnitSystem describes the units force field parameters are given in.
+// Energies computed from the parameters are in EnergyUnit.
+type UnitSystem struct {
+	Name       string
+	EnergyUnit string
+	// size of the energy unit in kJ/mol
+	KJPerMolPerEnergy float64
+	// size of the length unit in Angstrom, positions are always in Angstrom
+	AngstromPerLength float64
+	// h in the harmonic terms h*k*(x - x0)^2
+	HarmonicFactor float64
+}
+
+// GROMACSUnits: kJ/mol and nm, harmonic terms 1/2*k*(x - x0)^2
+var GROMACSUnits = UnitSystem{Name: "GROMACS", EnergyUnit: "kJ/mol", KJPerMolPerEnergy: 1, AngstromPerLength: 10, HarmonicFactor: 0.5}
+
+// AMBERUnits: kcal/mol and Angstrom, harmonic terms k*(x - x0)^2
+var AMBERUnits = UnitSystem{Name: "AMBER", EnergyUnit: "kcal/mol", KJPerMolPerEnergy: 4.184, AngstromPerLength: 1, HarmonicFactor: 1}
+
+// Boltzmann returns the Boltzmann constant in the energy unit per K
+func (units UnitSystem) Boltzmann() float64 {
+	return boltzmann / units.KJPerMolPerEnergy
+}
+
+// FromKJPerMol converts an energy in kJ/mol to the energy unit
+func (units UnitSystem) FromKJPerMol(energy float64) float64 {
+	return energy / units.KJPerMolPerEnergy
+}
+
+// optionalUnits return the unit system passed to a function with an optional one,
+// GROMACSUnits when none is given
+func optionalUnits(units []UnitSystem) UnitSystem {
+	if len(units) == 0 || units[0].KJPerMolPerEnergy == 0 {
+		return GROMACSUnits
+	}
+	return units[0]
+}
+
+// unitSystem returns the units of the parameters
+func (db parameterDatabase) unitSystem() UnitSystem {
+	if db.units.KJPerMolPerEnergy == 0 {
+		return GROMACSUnits
+	}
+	return db.units
+}
+
+// WithUnits returns a copy of the database whose parameters are read in the given units
+func (db parameterDatabase) WithUnits(units UnitSystem) parameterDatabase {
+	db.units = units
+	return db
+}
+
+// WithCutoffScheme returns a copy of the database whose non-bonded interactions are cut off with the given scheme
+func (db parameterDatabase) WithCutoffScheme(scheme CutoffScheme) parameterDatabase {
+	db.cutoffScheme = scheme
+	return db
+}
+
+// WithPairs returns a copy of the database that treats the given 1-4 pairs explicitly:
+// they are left out of the cutoff based sum and added once each with their own
+// parameters and their Coulomb term scaled by fudgeQQ (0.5 in AMBER, 0.8333 in OPLS).
+// The atom indices are those of the protein, the pairs of a molecule that does not
+// start at index 1 are shifted with ShiftItpPairs first.
+func (db parameterDatabase) WithPairs(pairs []ItpPair, fudgeQQ float64) parameterDatabase {
+	db.pairs = pairs
+	db.fudgeQQ = fudgeQQ
+	return db
+}
+
+// WithLJExceptions returns a copy of the database where the given type pairs use their
+// own sigma and epsilon instead of the combining rule, in either order of the types
+func (db parameterDatabase) WithLJExceptions(exceptions map[[2]string]LJParam) parameterDatabase {
+	merged := make(map[[2]string]LJParam, len(db.ljExceptions)+len(exceptions))
+	for key, param := range db.ljExceptions {
+		merged[key] = param
+	}
+	for types, param := range exceptions {
+		merged[ljExceptionKey(types[0], types[1])] = param
+	}
+	db.ljExceptions = merged
+	return db
+}
+
+// ljExceptionKey return the key of a type pair in the exception table, the same for both orders
+func ljExceptionKey(typeI, typeJ string) [2]string {
+	if typeJ < typeI {
+		return [2]string{typeJ, typeI}
+	}
+	return [2]string{typeI, typeJ}
+}
+
+// CutoffScheme selects how the non-bonded cutoff decides which pairs interact
+type CutoffScheme int
+
+const (
+	// AtomCutoff: a pair interacts when the two atoms are within the cutoff
+	AtomCutoff CutoffScheme = iota
+	// GroupCutoff (GROMOS): a pair interacts when the centers of the charge groups of the
+	// two atoms are within the cutoff, so a whole group is in or out and no dipole is split.
+	// Atoms outside any charge group are their own group.
+	GroupCutoff
+)
+
+// CombiningRule selects how per type Lennard-Jones parameters are mixed
+type CombiningRule int
+
+const (
+	// LorentzBerthelot: sigma_ij = (sigma_i+sigma_j)/2, epsilon_ij = sqrt(epsilon_i*epsilon_j)
+	LorentzBerthelot CombiningRule = iota
+	// Geometric (OPLS): sigma_ij = sqrt(sigma_i*sigma_j), epsilon_ij = sqrt(epsilon_i*epsilon_j)
+	Geometric
+)
+
+// LJParam holds the Lennard-Jones sigma and epsilon of one atom type, in the length and
+// energy units of the database holding it
+type LJParam struct {
+	Sigma   float64
+	Epsilon float64
 }
 
 // ///
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// CachedEnergy memoises an energy function for minimizers that evaluate the same
+// trial structure several times. Structures are keyed on a hash of their positions
+// rounded to a number of decimals, and the least recently used entry is evicted
+// once the cache is full.
+type CachedEnergy struct {
+	energy    func(*Protein) float64
+	size      int
+	precision int
+	entries   map[uint64]*list.Element
+	order     *list.List
+	Hits      int
+	Misses    int
+}
+
+type cacheEntry struct {
+	key    uint64
+	energy float64
+}
+
+// NewCachedEnergy wraps an energy function (e.g. a closure around CombineEnergyAndForce)
+// with a cache of at most size entries keyed on positions rounded to precision decimals
+func NewCachedEnergy(energy func(*Protein) float64, size, precision int) *CachedEnergy {
+	return &CachedEnergy{
+		energy:    energy,
+		size:      size,
+		precision: precision,
+		entries:   make(map[uint64]*list.Element),
+		order:     list.New(),
+	}
+}
+
+// Evaluate returns the energy of the protein, from the cache when the same
+// rounded positions have been evaluated before
+func (c *CachedEnergy) Evaluate(p *Protein) float64 {
+	key := c.positionKey(p)
+	if element, exist := c.entries[key]; exist {
+		c.Hits++
+		c.order.MoveToFront(element)
+		return element.Value.(*cacheEntry).energy
+	}
+
+	c.Misses++
+	energy := c.energy(p)
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, energy: energy})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	return energy
+}
+
+// positionKey hashes the rounded positions of every atom of the protein
+func (c *CachedEnergy) positionKey(p *Protein) uint64 {
+	hash := fnv.New64a()
+	scale := math.Pow10(c.precision)
+	var buffer [8]byte
+	for _, residue := range p.Residue {
+		for _, atom := range residue.Atoms {
+			for _, value := range []float64{atom.position.x, atom.position.y, atom.position.z} {
+				binary.LittleEndian.PutUint64(buffer[:], uint64(int64(math.Round(value*scale))))
+				hash.Write(buffer[:])
+			}
+		}
+	}
+	return hash.Sum64()
+}
@@ -0,0 +1,104 @@
+package main
+
+// ///////////////
+// ////External forces added to the force field, for steered MD and field-response runs
+// ///////////////
+
+// ExternalForce adds a force that does not come from the force field to the force map
+// of EvaluateForces, in the units of that map (kJ/mol/Angstrom times forceUnit)
+type ExternalForce interface {
+	Apply(forceMap map[int]*TriTuple, protein *Protein)
+}
+
+// ExternalEnergy is an external force that also knows its potential energy: EnergyForce
+// adds the force like Apply and return the energy in kJ/mol, which RunSimulation then
+// adds to the potential energy it logs. The restraints and the uniform forces are.
+type ExternalEnergy interface {
+	ExternalForce
+	EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64
+}
+
+// UniformForce pulls the selected atoms, all of them when Atoms is nil,
+// with the same constant force in kJ/mol/Angstrom
+type UniformForce struct {
+	Force TriTuple
+	Atoms map[int]bool
+}
+
+// ElectricField pushes every charged atom with the force qE, the field is
+// in kJ/mol/Angstrom per elementary charge (1 V/nm = 9.6485 kJ/mol/nm/e)
+type ElectricField struct {
+	Field TriTuple
+}
+
+// UniformAcceleration accelerates every atom by the same amount in Angstrom/fs^2
+// (e.g. gravity), the force m*a is proportional to the mass
+type UniformAcceleration struct {
+	Acceleration TriTuple
+}
+
+// EnergyForce adds the force to the selected atoms and return its energy -F.r in kJ/mol
+func (u UniformForce) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	energy := 0.0
+	for _, atom := range proteinAtoms(protein) {
+		if u.Atoms == nil || u.Atoms[atom.index] {
+			addForce(forceMap, atom, u.Force)
+			energy -= u.Force.dot(atom.position)
+		}
+	}
+	return energy
+}
+
+// EnergyForce adds qE to every charged atom and return its energy -qE.r in kJ/mol
+func (e ElectricField) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	energy := 0.0
+	for _, atom := range proteinAtoms(protein) {
+		if atom.charge != 0 {
+			force := scaleVector(e.Field, atom.charge)
+			addForce(forceMap, atom, force)
+			energy -= force.dot(atom.position)
+		}
+	}
+	return energy
+}
+
+// EnergyForce adds m*a to every atom, directly in the units of the force map,
+// and return its energy -m*a.r in kJ/mol
+func (u UniformAcceleration) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	energy := 0.0
+	for _, atom := range proteinAtoms(protein) {
+		force := scaleVector(u.Acceleration, atom.mass/forceUnit)
+		addForce(forceMap, atom, force)
+		energy -= force.dot(atom.position)
+	}
+	return energy
+}
+
+// Apply adds the force to the selected atoms
+func (u UniformForce) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	u.EnergyForce(protein, forceMap)
+}
+
+// Apply adds qE to every charged atom
+func (e ElectricField) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	e.EnergyForce(protein, forceMap)
+}
+
+// Apply adds m*a to every atom, directly in the units of the force map
+func (u UniformAcceleration) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	u.EnergyForce(protein, forceMap)
+}
+
+// applyExternalForces adds every external force to the force map
+// and return the energy (kJ/mol) of those that are an ExternalEnergy
+func applyExternalForces(forceMap map[int]*TriTuple, protein *Protein, external []ExternalForce) float64 {
+	energy := 0.0
+	for _, force := range external {
+		if withEnergy, ok := force.(ExternalEnergy); ok {
+			energy += withEnergy.EnergyForce(protein, forceMap)
+			continue
+		}
+		force.Apply(forceMap, protein)
+	}
+	return energy
+}
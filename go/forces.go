@@ -0,0 +1,225 @@
+package main
+
+import "math"
+
+// forceUnit converts a force in kJ/mol/Angstrom to the g/mol*Angstrom/fs^2 the
+// integrator divides by the mass (1 kJ/mol = 1e-4 g/mol*Angstrom^2/fs^2)
+const forceUnit = 1e-4
+
+// EvaluateForces takes a topology and the bonded and non-bonded parameters
+// and return the total energy (CalculateTotalEnergy, in the energy unit of the bonded
+// UnitSystem) with the force on every
+// atom keyed by atom index, in the units UpdateAcceleration expects.
+// The bonded forces are the analytic gradients of the bonded energy terms.
+// When a ForceBuffer is given the forces are written to it and the returned map is
+// the one of the buffer, overwritten by the next call with the same buffer.
+func EvaluateForces(topology *Topology, bonded, nonbonded parameterDatabase, buffer ...*ForceBuffer) (float64, map[int]*TriTuple) {
+	return evaluateForces(topology, bonded, nonbonded, true, buffer...)
+}
+
+// evaluateForces is EvaluateForces, the energy is only computed when withEnergy is set
+// and 0 is returned otherwise
+func evaluateForces(topology *Topology, bonded, nonbonded parameterDatabase, withEnergy bool, buffer ...*ForceBuffer) (float64, map[int]*TriTuple) {
+	var forceMap map[int]*TriTuple
+	if len(buffer) > 0 && buffer[0] != nil {
+		forceMap = buffer[0].reset()
+	} else {
+		forceMap = make(map[int]*TriTuple)
+	}
+
+	unbondedEnergy, _ := addUnbondedForces(topology.Protein, nonbonded, forceMap, unbondedTerms{energy: withEnergy, forces: true})
+	for _, force := range forceMap {
+		force.x *= forceUnit
+		force.y *= forceUnit
+		force.z *= forceUnit
+	}
+	for _, atom := range topology.atoms() {
+		if _, exist := forceMap[atom.index]; !exist {
+			forceMap[atom.index] = &TriTuple{}
+		}
+	}
+
+	topology.addBondedForces(bonded, forceMap)
+	if !withEnergy {
+		return 0.0, forceMap
+	}
+	return topology.bondedEnergy(bonded) + bonded.unitSystem().FromKJPerMol(unbondedEnergy), forceMap
+}
+
+// ForceBuffer holds a force map whose entries are allocated once and reused by every
+// EvaluateForces call it is given to, so that a simulation loop does not allocate
+// a force per atom and per step
+type ForceBuffer struct {
+	forces  map[int]*TriTuple
+	storage []TriTuple
+}
+
+// NewForceBuffer returns a buffer with one entry per atom of the protein
+func NewForceBuffer(protein *Protein) *ForceBuffer {
+	count := 0
+	for _, residue := range protein.Residue {
+		count += len(residue.Atoms)
+	}
+
+	buffer := &ForceBuffer{forces: make(map[int]*TriTuple, count), storage: make([]TriTuple, count)}
+	i := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			buffer.forces[atom.index] = &buffer.storage[i]
+			i++
+		}
+	}
+	return buffer
+}
+
+// reset zeroes every force of the buffer and return its map
+func (buffer *ForceBuffer) reset() map[int]*TriTuple {
+	for i := range buffer.storage {
+		buffer.storage[i] = TriTuple{}
+	}
+	// entries added later for atoms the buffer was not built for are not in storage
+	if len(buffer.forces) > len(buffer.storage) {
+		for _, force := range buffer.forces {
+			*force = TriTuple{}
+		}
+	}
+	return buffer.forces
+}
+
+// addBondedForces adds minus the gradient of every bonded term to the force map
+func (t *Topology) addBondedForces(bonded parameterDatabase, forceMap map[int]*TriTuple) {
+	bondParameter := bonded.withAtomCount(2)
+	angleParameter := bonded.withAtomCount(3)
+	dihedralParameter := bonded.withAtomCount(4)
+	units := bonded.unitSystem()
+	// the derivatives below are in the energy unit of the parameters, force in kJ/mol/Angstrom
+	toKJPerMol := units.KJPerMolPerEnergy
+
+	for _, bond := range t.bonds {
+		parameter, ok := bondParam(termParameter(bond.parameter, bondParameter, bond.atom1, bond.atom2))
+		if !ok {
+			continue
+		}
+		r := Distance(bond.atom1.position, bond.atom2.position)
+		if r == 0 {
+			continue
+		}
+		dEdr := parameter.Derivative(r, units) * toKJPerMol
+		direction := scaleVector(CalculateVector(bond.atom2, bond.atom1), 1/r)
+		addForce(forceMap, bond.atom1, scaleVector(direction, -dEdr))
+		addForce(forceMap, bond.atom2, scaleVector(direction, dEdr))
+	}
+
+	for _, angle := range t.angles {
+		parameter, ok := angleParam(termParameter(angle.parameter, angleParameter, angle.atom1, angle.atom2, angle.atom3))
+		if !ok {
+			continue
+		}
+		gradient1, gradient3, ok := angleGradient(angle.atom1, angle.atom2, angle.atom3)
+		if !ok {
+			continue
+		}
+		dEdTheta := parameter.Derivative(CalculateAngle(angle.atom1, angle.atom2, angle.atom3)/180*math.Pi, units) * toKJPerMol
+		addForce(forceMap, angle.atom1, scaleVector(gradient1, -dEdTheta))
+		addForce(forceMap, angle.atom3, scaleVector(gradient3, -dEdTheta))
+		addForce(forceMap, angle.atom2, scaleVector(addVectors(gradient1, gradient3), dEdTheta))
+	}
+
+	for _, dihedral := range t.dihedrals {
+		parameter, ok := dihedralParam(termParameter(dihedral.parameter, dihedralParameter, dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4))
+		if !ok {
+			continue
+		}
+		phi := CalculateSignedDihedralAngle(dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4) / 180 * math.Pi
+		dEdPhi := parameter.Derivative(phi) * toKJPerMol
+		addDihedralForces(forceMap, dEdPhi, dihedral)
+	}
+
+	for _, improper := range t.impropers {
+		parameter, ok := angleParam(termParameter(improper.parameter, dihedralParameter, improper.atom1, improper.atom2, improper.atom3, improper.atom4))
+		if !ok {
+			continue
+		}
+		dEdXi := parameter.Derivative(improperAngle(improper, parameter), units) * toKJPerMol
+		addDihedralForces(forceMap, dEdXi, improper)
+	}
+}
+
+// angleGradient return the gradient of the angle atom1-atom2-atom3 (radians) with respect
+// to the positions of atom1 and atom3, the gradient for atom2 is minus their sum.
+// It reports false for a straight or degenerate angle where the gradient is undefined.
+func angleGradient(atom1, atom2, atom3 *Atom) (TriTuple, TriTuple, bool) {
+	a := CalculateVector(atom2, atom1)
+	c := CalculateVector(atom2, atom3)
+	lengthA, lengthC := magnitude(a), magnitude(c)
+	if lengthA == 0 || lengthC == 0 {
+		return TriTuple{}, TriTuple{}, false
+	}
+	cosine := a.dot(c) / (lengthA * lengthC)
+	sine := math.Sqrt(1 - cosine*cosine)
+	if sine < 1e-8 {
+		return TriTuple{}, TriTuple{}, false
+	}
+
+	// d(theta)/dr1 = -1/sin(theta) * (c/(|a||c|) - cos(theta)*a/|a|^2)
+	gradient1 := scaleVector(addVectors(scaleVector(c, 1/(lengthA*lengthC)), scaleVector(a, -cosine/(lengthA*lengthA))), -1/sine)
+	gradient3 := scaleVector(addVectors(scaleVector(a, 1/(lengthA*lengthC)), scaleVector(c, -cosine/(lengthC*lengthC))), -1/sine)
+	return gradient1, gradient3, true
+}
+
+// addDihedralForces adds -dE/dphi times the gradient of the signed dihedral angle
+// of the term to the force map
+func addDihedralForces(forceMap map[int]*TriTuple, dEdPhi float64, term dihedralTerm) {
+	gradient1, gradient2, gradient3, gradient4, ok := dihedralGradient(term.atom1, term.atom2, term.atom3, term.atom4)
+	if !ok {
+		return
+	}
+	addForce(forceMap, term.atom1, scaleVector(gradient1, -dEdPhi))
+	addForce(forceMap, term.atom2, scaleVector(gradient2, -dEdPhi))
+	addForce(forceMap, term.atom3, scaleVector(gradient3, -dEdPhi))
+	addForce(forceMap, term.atom4, scaleVector(gradient4, -dEdPhi))
+}
+
+// dihedralGradient returns the gradient of CalculateSignedDihedralAngle in radians with
+// respect to the position of each of the four atoms (Blondel and Karplus), the four add
+// up to zero. ok is false when three of the atoms are collinear and the angle is undefined
+func dihedralGradient(atom1, atom2, atom3, atom4 *Atom) (gradient1, gradient2, gradient3, gradient4 TriTuple, ok bool) {
+	f := CalculateVector(atom2, atom1)
+	g := CalculateVector(atom3, atom2)
+	h := CalculateVector(atom3, atom4)
+	a := Cross(f, g)
+	b := Cross(h, g)
+	lengthG := magnitude(g)
+	a2, b2 := a.dot(a), b.dot(b)
+	if lengthG == 0 || a2 == 0 || b2 == 0 {
+		return
+	}
+
+	gradient1 = scaleVector(a, -lengthG/a2)
+	gradient4 = scaleVector(b, lengthG/b2)
+	fg := f.dot(g) / (a2 * lengthG)
+	hg := h.dot(g) / (b2 * lengthG)
+	gradient2 = addVectors(scaleVector(gradient1, -1), addVectors(scaleVector(a, fg), scaleVector(b, -hg)))
+	gradient3 = addVectors(scaleVector(gradient4, -1), addVectors(scaleVector(a, -fg), scaleVector(b, hg)))
+	return gradient1, gradient2, gradient3, gradient4, true
+}
+
+// addForce adds a force in kJ/mol/Angstrom to the entry of the atom in the force map
+func addForce(forceMap map[int]*TriTuple, atom *Atom, force TriTuple) {
+	entry, exist := forceMap[atom.index]
+	if !exist {
+		entry = &TriTuple{}
+		forceMap[atom.index] = entry
+	}
+	entry.x += force.x * forceUnit
+	entry.y += force.y * forceUnit
+	entry.z += force.z * forceUnit
+}
+
+func scaleVector(vector TriTuple, factor float64) TriTuple {
+	return TriTuple{x: vector.x * factor, y: vector.y * factor, z: vector.z * factor}
+}
+
+func addVectors(vector1, vector2 TriTuple) TriTuple {
+	return TriTuple{x: vector1.x + vector2.x, y: vector1.y + vector2.y, z: vector1.z + vector2.z}
+}
@@ -13,13 +13,19 @@ func CalculateAnglePotentialEnergy(k, theta, theta_0 float64) float64 {
 	return 0.5 * k * (theta - theta_0) / 180 * math.Pi * (theta - theta_0) / 180 * math.Pi
 }
 
+// CalculateProperDihedralAngleEnergy return 0.5*kd*(1 + cos(pn*phi - phase)) with phi in radians,
+// signed as CalculateSignedDihedralAngle, and phase in degrees as in the parameter files.
+// For an integer multiplicity pn the energy does not change when phi is shifted by a full
+// turn, so it is the same for a dihedral given in any DihedralConvention.
 func CalculateProperDihedralAngleEnergy(kd, phi, pn, phase float64) float64 {
 	return 0.5 * kd * (1 + math.Cos(pn*phi-phase/180*math.Pi))
 }
 
+// CalculateAngle returns the angle atom1-atom2-atom3 in degrees in [0, 180],
+// between the vectors from the vertex atom2 to atom1 and to atom3
 func CalculateAngle(atom1, atom2, atom3 *Atom) float64 {
-	vector1 := CalculateVector(atom1, atom2)
-	vector2 := CalculateVector(atom3, atom2)
+	vector1 := CalculateVector(atom2, atom1)
+	vector2 := CalculateVector(atom2, atom3)
 
 	upperValue := vector1.dot(vector2)
 	lowerValue := Distance(atom1.position, atom2.position) * Distance(atom2.position, atom3.position)
@@ -37,10 +43,22 @@ func Distance(p1, p2 TriTuple) float64 {
 
 }
 
+// two atoms closer than bondDetectionFactor times the sum of their van der Waals
+// radii are taken as covalently bonded (C-H 1.74, C-C 2.04, H...H 1.44 Angstrom)
+const bondDetectionFactor = 0.6
+
+// BondedByDistance reports whether two atoms are close enough to be covalently bonded
+func BondedByDistance(atom1, atom2 *Atom) bool {
+	return Distance(atom1.position, atom2.position) < bondDetectionFactor*(VdwRadius(atom1)+VdwRadius(atom2))
+}
+
+// CalculateDihedralAngle returns the unsigned dihedral angle of four atoms in degrees in [0, 180].
+// It uses the bond vectors of CalculateSignedDihedralAngle, atom2 - atom1, atom3 - atom2
+// and atom4 - atom3, and returns the absolute value of that angle.
 func CalculateDihedralAngle(atom1, atom2, atom3, atom4 *Atom) float64 {
-	vector1 := CalculateVector(atom2, atom1)
-	vector2 := CalculateVector(atom3, atom2)
-	vector3 := CalculateVector(atom4, atom3)
+	vector1 := CalculateVector(atom1, atom2)
+	vector2 := CalculateVector(atom2, atom3)
+	vector3 := CalculateVector(atom3, atom4)
 
 	plane1 := BuildNormalVector(vector1, vector2)
 	plane2 := BuildNormalVector(vector2, vector3)
@@ -52,6 +70,57 @@ func CalculateDihedralAngle(atom1, atom2, atom3, atom4 *Atom) float64 {
 	return math.Abs(angle * (180 / math.Pi))
 }
 
+// CalculateSignedDihedralAngle returns the IUPAC dihedral angle of four atoms in degrees
+// in (-180, 180], positive when atom4 is rotated clockwise from atom1 looking from
+// atom2 to atom3. CalculateDihedralAngle returns its absolute value.
+func CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4 *Atom) float64 {
+	vector1 := CalculateVector(atom1, atom2)
+	vector2 := CalculateVector(atom2, atom3)
+	vector3 := CalculateVector(atom3, atom4)
+
+	plane1 := BuildNormalVector(vector1, vector2)
+	plane2 := BuildNormalVector(vector2, vector3)
+
+	x := plane1.dot(plane2)
+	y := magnitude(vector2) * vector1.dot(plane2)
+
+	return math.Atan2(y, x) * (180 / math.Pi)
+}
+
+// DihedralConvention is the range dihedral angles are reported in
+type DihedralConvention int
+
+const (
+	// Signed180 is the IUPAC range (-180, 180] of CalculateSignedDihedralAngle
+	Signed180 DihedralConvention = iota
+	// Unsigned360 is the range [0, 360) used by some tools and parameter files,
+	// angles of the signed convention below 0 are shifted by a full turn
+	Unsigned360
+)
+
+// NormalizeDihedral takes an angle in degrees and a convention
+// and return the same angle expressed in the range of the convention
+func NormalizeDihedral(angle float64, convention DihedralConvention) float64 {
+	switch convention {
+	case Unsigned360:
+		angle = math.Mod(angle, 360)
+		if angle < 0 {
+			angle += 360
+		}
+		// -0 and the rounding of tiny negative angles
+		if angle >= 360 || angle == 0 {
+			angle = 0
+		}
+		return angle
+	default:
+		angle = math.Remainder(angle, 360)
+		if angle <= -180 {
+			angle += 360
+		}
+		return angle
+	}
+}
+
 func BuildNormalVector(vector1, vector2 TriTuple) TriTuple {
 	var normVector TriTuple
 	normVector.x = vector1.y*vector2.z - vector1.z*vector2.y
@@ -65,6 +134,21 @@ func (vector1 TriTuple) dot(vector2 TriTuple) float64 {
 	return vector1.x*vector2.x + vector1.y*vector2.y + vector1.z*vector2.z
 }
 
+// RoundTo rounds x to the given number of decimals, halfway cases away from zero
+func RoundTo(x float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	return math.Round(x*scale) / scale
+}
+
+// RoundTo rounds every component of the vector to the given number of decimals
+func (vector TriTuple) RoundTo(decimals int) TriTuple {
+	return TriTuple{
+		x: RoundTo(vector.x, decimals),
+		y: RoundTo(vector.y, decimals),
+		z: RoundTo(vector.z, decimals),
+	}
+}
+
 func magnitude(vector TriTuple) float64 {
 	return math.Sqrt(vector.x*vector.x + vector.y*vector.y + vector.z*vector.z)
 }
@@ -75,8 +159,6 @@ func CombineEnergyAndForce(p *Protein, residueParameterBondValue, residueParamet
 
 	// Calculate total energy and forces of unbonded interactions
 	unbondedEnergy, unbondedForceMap := CalculateTotalUnbondedEnergyForce(p, nonbondParameter)
-	fmt.Println("bondedEnergy is:", bondedEnergy)
-	fmt.Println("unbondedEnergy is:", unbondedEnergy)
 	// Combine energies
 	totalEnergy := bondedEnergy + unbondedEnergy
 	// Create a total force map
@@ -107,7 +189,9 @@ func CombineEnergyAndForce(p *Protein, residueParameterBondValue, residueParamet
 	return totalEnergy, totalForceMap
 }
 
-func PerformEnergyMinimization(currentProtein *Protein, residueParameterBondValue, residueParameterOtherValue map[string]residueParameter, bondParameter, angleParameter, dihedralParameter, nonbondParameter, pairtypesParameter parameterDatabase) *Protein {
+// PerformEnergyMinimization runs steepest descent on the protein,
+// the atoms set in frozen (e.g. solvent) are held fixed
+func PerformEnergyMinimization(currentProtein *Protein, residueParameterBondValue, residueParameterOtherValue map[string]residueParameter, bondParameter, angleParameter, dihedralParameter, nonbondParameter, pairtypesParameter parameterDatabase, frozen map[int]bool) *Protein {
 	iteration := 50
 	// set maximum displacement
 	h := 0.01
@@ -115,16 +199,14 @@ func PerformEnergyMinimization(currentProtein *Protein, residueParameterBondValu
 	for i := 0; i < iteration; i++ {
 		// Combine energies and forces
 		totalEnergy, totalForceMap := CombineEnergyAndForce(currentProtein, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondParameter, pairtypesParameter)
-		fmt.Printf("Iteration %d: Total Energy = %f\n", i, totalEnergy)
 
 		tempProtein := CopyProtein(currentProtein)
 
 		// Perform SteepestDescent, update positions in protein
-		SteepestDescent(tempProtein, h, totalForceMap)
+		SteepestDescent(tempProtein, h, totalForceMap, frozen)
 
 		// Calculate total energy of updated protein
 		newTotalEnergy, _ := CombineEnergyAndForce(tempProtein, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondParameter, pairtypesParameter)
-		fmt.Printf("Iteration %d: New Total Energy = %f\n", i, newTotalEnergy)
 
 		// If total energy decreases, accept the changes of positions and increase maximum displacement h
 		// Otherwise, reject the changes in positions and decrease maximum displacement h
@@ -132,7 +214,7 @@ func PerformEnergyMinimization(currentProtein *Protein, residueParameterBondValu
 			currentProtein = tempProtein
 			h *= 1.2
 		} else {
-			h *= 0.2 * h
+			h *= 0.2
 		}
 	}
 
@@ -154,7 +236,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 		// Calculate bondstretch energy
 		// range over each bond
 
-		for _, bondPairs := range residueParameterBondValue[residue.Name].bonds {
+		for _, bondPairs := range residueParameterBondValue[templateName(residue, residueParameterBondValue)].bonds {
 			for i := 0; i < len(residue.Atoms)-1; i++ {
 				atom1 := residue.Atoms[i]
 				if atom1.element == (*bondPairs).atoms[0] {
@@ -264,7 +346,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 
 		}
 
-		for _, angleTris := range residueParameterOtherValue[residue.Name].angles {
+		for _, angleTris := range residueParameterOtherValue[templateName(residue, residueParameterOtherValue)].angles {
 			if (*angleTris).atoms[0][0] == '-' {
 				if w != 0 {
 					for a := range p.Residue[w-1].Atoms {
@@ -465,7 +547,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 			}
 		}
 
-		for _, dihedralValues := range residueParameterOtherValue[residue.Name].dihedrals {
+		for _, dihedralValues := range residueParameterOtherValue[templateName(residue, residueParameterOtherValue)].dihedrals {
 			if (*dihedralValues).atoms[0] == "-CA" && w != 0 {
 				for i := range p.Residue[w-1].Atoms {
 					if p.Residue[w-1].Atoms[i].element == "CA" {
@@ -476,7 +558,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 							if p.Residue[w].Atoms[j].element == (*dihedralValues).atoms[2] {
 								atom3 := p.Residue[w].Atoms[j]
 								atom4 := p.Residue[w].Atoms[j+1]
-								phi := CalculateDihedralAngle(atom1, atom2, atom3, atom4)
+								phi := CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4) / 180 * math.Pi
 								if math.IsNaN(phi) {
 									continue
 								}
@@ -552,7 +634,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 						atom2 := residue.Atoms[0]
 						atom3 := residue.Atoms[1]
 						atom4 := residue.Atoms[2]
-						phi := CalculateDihedralAngle(atom1, atom2, atom3, atom4)
+						phi := CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4) / 180 * math.Pi
 						if math.IsNaN(phi) {
 							continue
 						}
@@ -629,7 +711,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 									for l := k + 1; l < len(residue.Atoms); l++ {
 										if residue.Atoms[l].element == (*dihedralValues).atoms[3] {
 											atom4 := residue.Atoms[l]
-											phi := CalculateDihedralAngle(atom1, atom2, atom3, atom4)
+											phi := CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4) / 180 * math.Pi
 											if math.IsNaN(phi) {
 												continue
 											}
@@ -696,7 +778,7 @@ func CalculateTotalEnergyForce(p *Protein, residueParameterBondValue, residuePar
 
 									if (*dihedralValues).atoms[3] == "+N" && w != len(p.Residue)-1 {
 										atom4 := p.Residue[w+1].Atoms[0]
-										phi := CalculateDihedralAngle(atom1, atom2, atom3, atom4)
+										phi := CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4) / 180 * math.Pi
 										if math.IsNaN(phi) {
 											continue
 										}
@@ -846,15 +928,21 @@ func SearchParameter(value int, parameterData parameterDatabase, atoms ...*Atom)
 	return []float64{0.0}
 }
 
-func SteepestDescent(protein *Protein, h float64, forceMap map[int]*TriTuple) *Protein {
+// SteepestDescent moves every atom along its force by a step of length h.
+// Atoms whose index is set in frozen keep their positions, but they still
+// take part in the energy and forces seen by the mobile atoms.
+func SteepestDescent(protein *Protein, h float64, forceMap map[int]*TriTuple, frozen map[int]bool) *Protein {
 	for i := range protein.Residue {
 		for j := range protein.Residue[i].Atoms {
+			if frozen[protein.Residue[i].Atoms[j].index] {
+				continue
+			}
 			_, exist := forceMap[protein.Residue[i].Atoms[j].index+1]
 			if exist {
 				force := forceMap[protein.Residue[i].Atoms[j].index+1]
 
 				if math.IsNaN(force.x) {
-					fmt.Println(true)
+					logger.Printf("Warning: atom %d has a NaN force", protein.Residue[i].Atoms[j].index)
 				}
 				magn := magnitude(*force)
 				if magn == 0 || math.IsNaN(magn) {
@@ -873,6 +961,40 @@ func SteepestDescent(protein *Protein, h float64, forceMap map[int]*TriTuple) *P
 
 }
 
+// SteepestDescentWithForces moves every atom along its own force, taken from
+// forceMap[atom.index], scaled so that the atom under the largest force moves by h.
+// Atoms whose index is set in frozen keep their positions and do not set the scale.
+func SteepestDescentWithForces(protein *Protein, forceMap map[int]*TriTuple, h float64, frozen map[int]bool) *Protein {
+	maxForce := 0.0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if frozen[atom.index] {
+				continue
+			}
+			if force, exist := forceMap[atom.index]; exist {
+				maxForce = math.Max(maxForce, magnitude(*force))
+			}
+		}
+	}
+	if maxForce == 0 || math.IsNaN(maxForce) || math.IsInf(maxForce, 0) {
+		return protein
+	}
+
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			force, exist := forceMap[atom.index]
+			if !exist || frozen[atom.index] {
+				continue
+			}
+			atom.position.x += force.x * h / maxForce
+			atom.position.y += force.y * h / maxForce
+			atom.position.z += force.z * h / maxForce
+		}
+	}
+
+	return protein
+}
+
 func CalculateBondForce(k, r, r_0 float64, atom1, atom2 *Atom) TriTuple {
 	bondLen := Distance(atom1.position, atom2.position)
 	unitVector := TriTuple{
@@ -894,6 +1016,49 @@ func CalculateBondForce(k, r, r_0 float64, atom1, atom2 *Atom) TriTuple {
 
 }
 
+// BondEnergyPoint is one sample of a bond energy scan
+type BondEnergyPoint struct {
+	R      float64
+	Energy float64
+}
+
+// BondForcePoint is one sample of a bond force scan
+type BondForcePoint struct {
+	R     float64
+	Force float64
+}
+
+// ScanBond samples CalculateBondStretchEnergy at steps evenly spaced bond lengths
+// from rMin to rMax (Angstrom). As in the energy function r_0 is in nm,
+// so the well has its minimum at r = 10*r_0.
+func ScanBond(k, r_0 float64, rMin, rMax float64, steps int) []BondEnergyPoint {
+	points := make([]BondEnergyPoint, steps)
+	for i := range points {
+		r := scanPosition(rMin, rMax, steps, i)
+		points[i] = BondEnergyPoint{R: r, Energy: CalculateBondStretchEnergy(k, r, r_0)}
+	}
+	return points
+}
+
+// ScanBondForce samples the magnitude of CalculateBondForce like ScanBond
+func ScanBondForce(k, r_0 float64, rMin, rMax float64, steps int) []BondForcePoint {
+	points := make([]BondForcePoint, steps)
+	var atom1, atom2 Atom
+	for i := range points {
+		r := scanPosition(rMin, rMax, steps, i)
+		atom2.position.x = r
+		points[i] = BondForcePoint{R: r, Force: magnitude(CalculateBondForce(k, r, r_0, &atom1, &atom2))}
+	}
+	return points
+}
+
+func scanPosition(rMin, rMax float64, steps, i int) float64 {
+	if steps < 2 {
+		return rMin
+	}
+	return rMin + (rMax-rMin)*float64(i)/float64(steps-1)
+}
+
 func CalculateAngleForce(k, theta, theta_0 float64, atom1, atom2, atom3 *Atom) (TriTuple, TriTuple, TriTuple) {
 	der_that_cos := (-1) * (1 / math.Sin(theta/180*math.Pi))
 	der_U_thate := k * (theta - theta_0) / 180 * math.Pi
@@ -948,50 +1113,19 @@ func DerivateAnglePositionZ(atom1, atom2, atom3 *Atom, theta float64) float64 {
 	return 1 / Distance(atom1.position, atom2.position) * ((atom3.position.z-atom2.position.z)/Distance(atom3.position, atom2.position) - (atom1.position.z-atom2.position.z)/Distance(atom1.position, atom2.position)*math.Cos(theta))
 }
 
+// CalculateProperDihedralsForce returns the forces on the four atoms of a proper dihedral
+// with the energy of CalculateProperDihedralAngleEnergy, phi is the signed angle in radians
+// of CalculateSignedDihedralAngle. The forces are -dU/dphi times the gradient of phi, scaled
+// by 1e-6 as the other legacy bonded forces, and add up to zero.
 func CalculateProperDihedralsForce(kd, phi, pn, phase float64, atom1, atom2, atom3, atom4 *Atom) (TriTuple, TriTuple, TriTuple, TriTuple) {
-	der_U_phi := -0.5 * kd * pn * math.Sin((pn*phi - phase/180*math.Pi))
-	der_phi_cos := -1 / math.Sin(phi)
-
-	if math.IsNaN(der_phi_cos) || math.IsNaN(der_U_phi) {
+	der_U_phi := -0.5 * kd * pn * math.Sin(pn*phi-phase/180*math.Pi)
+	gradient1, gradient2, gradient3, gradient4, ok := dihedralGradient(atom1, atom2, atom3, atom4)
+	if !ok || math.IsNaN(der_U_phi) {
 		return TriTuple{x: 0.0, y: 0.0, z: 0.0}, TriTuple{x: 0.0, y: 0.0, z: 0.0}, TriTuple{x: 0.0, y: 0.0, z: 0.0}, TriTuple{x: 0.0, y: 0.0, z: 0.0}
 	}
 
-	vector12 := CalculateVector(atom2, atom1)
-	vector32 := CalculateVector(atom2, atom3)
-	vector43 := CalculateVector(atom3, atom4)
-
-	v_t := Cross(vector12, vector32)
-	v_u := Cross(vector43, vector32)
-
-	der_cos_tx, der_cos_ty, der_cos_tz := CalculateDerivate(v_t, v_u, phi)
-	der_cos_ux, der_cos_uy, der_cos_uz := CalculateDerivate(v_u, v_t, phi)
-
-	force_i := TriTuple{
-		x: der_U_phi * der_phi_cos * (der_cos_ty*(-vector32.z) + der_cos_tz*vector32.y) / math.Pow10(6),
-		y: der_U_phi * der_phi_cos * (der_cos_tz*(-vector32.x) + der_cos_tx*vector32.z) / math.Pow10(6),
-		z: der_U_phi * der_phi_cos * (der_cos_tx*(-vector32.y) + der_cos_ty*vector32.x) / math.Pow10(6),
-	}
-
-	force_j := TriTuple{
-		x: der_U_phi * der_phi_cos * (der_cos_ty*(-vector12.z+vector32.z) + der_cos_tz*(-vector32.y+vector12.y)) / math.Pow10(6),
-		y: der_U_phi * der_phi_cos * (der_cos_tz*(-vector12.x+vector32.x) + der_cos_tx*(-vector32.z+vector12.z)) / math.Pow10(6),
-		z: der_U_phi * der_phi_cos * (der_cos_tx*(-vector12.y+vector32.y) + der_cos_ty*(-vector32.x+vector12.x)) / math.Pow10(6),
-	}
-
-	force_k := TriTuple{
-		x: der_U_phi * der_phi_cos * (der_cos_ty*vector12.z - der_cos_tz*vector12.y + der_cos_uy*(vector32.z+vector43.z) - der_cos_uz*(vector32.y+vector43.y)) / math.Pow10(6),
-		y: der_U_phi * der_phi_cos * (der_cos_tz*vector12.x - der_cos_tx*vector12.z + der_cos_uz*(vector32.x+vector43.x) - der_cos_ux*(vector32.z+vector43.z)) / math.Pow10(6),
-		z: der_U_phi * der_phi_cos * (der_cos_tx*vector12.y - der_cos_ty*vector12.z + der_cos_ux*(vector32.y+vector43.y) - der_cos_uy*(vector32.x+vector43.x)) / math.Pow10(6),
-	}
-
-	force_l := TriTuple{
-		x: der_U_phi * der_phi_cos * (der_cos_uy*(-vector32.z) + der_cos_uz*vector32.y) / math.Pow10(6),
-		y: der_U_phi * der_phi_cos * (der_cos_uz*(-vector32.x) + der_cos_ux*vector32.z) / math.Pow10(6),
-		z: der_U_phi * der_phi_cos * (der_cos_ux*(-vector32.y) + der_cos_uy*vector32.x) / math.Pow10(6),
-	}
-
-	return force_i, force_j, force_k, force_l
-
+	scale := -der_U_phi / math.Pow10(6)
+	return scaleVector(gradient1, scale), scaleVector(gradient2, scale), scaleVector(gradient3, scale), scaleVector(gradient4, scale)
 }
 
 func CalculateDerivate(v1, v2 TriTuple, phi float64) (float64, float64, float64) {
@@ -1000,23 +1134,36 @@ func CalculateDerivate(v1, v2 TriTuple, phi float64) (float64, float64, float64)
 		(1 / magnitude(v1)) * (v2.z/magnitude(v2) - v1.z/magnitude(v1)*math.Cos(phi))
 }
 
+// Cross returns the cross product v1 x v2
 func Cross(v1, v2 TriTuple) TriTuple {
-	return TriTuple{
-		x: v1.x * v2.x,
-		y: v1.y * v2.y,
-		z: v1.z * v2.z,
-	}
+	return BuildNormalVector(v1, v2)
 }
 
 func CopyProtein(currentProtein *Protein) *Protein {
 	var newProtein Protein
 	newProtein.Name = currentProtein.Name
+	if currentProtein.Box != nil {
+		box := *currentProtein.Box
+		newProtein.Box = &box
+	}
 
 	newProtein.Residue = make([]*Residue, len(currentProtein.Residue))
 	for i := range currentProtein.Residue {
 		newProtein.Residue[i] = CopyResidue(currentProtein.Residue[i])
 	}
 
+	if len(currentProtein.ExplicitBonds) > 0 {
+		copies := make(map[*Atom]*Atom)
+		for i, residue := range currentProtein.Residue {
+			for j, atom := range residue.Atoms {
+				copies[atom] = newProtein.Residue[i].Atoms[j]
+			}
+		}
+		for _, bond := range currentProtein.ExplicitBonds {
+			newProtein.ExplicitBonds = append(newProtein.ExplicitBonds, [2]*Atom{copies[bond[0]], copies[bond[1]]})
+		}
+	}
+
 	return &newProtein
 }
 
@@ -1025,6 +1172,9 @@ func CopyResidue(currRes *Residue) *Residue {
 	newRes.Name = currRes.Name
 	newRes.ID = currRes.ID
 	newRes.ChainID = currRes.ChainID
+	newRes.IsNTerminal = currRes.IsNTerminal
+	newRes.IsCTerminal = currRes.IsCTerminal
+	newRes.Variant = currRes.Variant
 
 	newRes.Atoms = make([]*Atom, len(currRes.Atoms))
 	for i := range currRes.Atoms {
@@ -1042,7 +1192,9 @@ func CopyAtom(currAtom *Atom) *Atom {
 	newAtom.velocity = CopyTriTuple(currAtom.velocity)
 	newAtom.accelerated = CopyTriTuple(currAtom.accelerated)
 	newAtom.element = currAtom.element
+	newAtom.symbol = currAtom.symbol
 	newAtom.charge = currAtom.charge
+	newAtom.chargeGroup = currAtom.chargeGroup
 	newAtom.index = currAtom.index
 	return &newAtom
 }
@@ -1056,6 +1208,100 @@ func CopyTriTuple(tri TriTuple) TriTuple {
 	return newTri
 }
 
+// ProteinsEqual compares the structure and every field of two proteins, including the
+// box and the explicit bonds, the numeric fields within tol, and returns a description
+// of the first difference
+func ProteinsEqual(a, b *Protein, tol float64) (bool, string) {
+	if a.Name != b.Name {
+		return false, fmt.Sprintf("protein name %q != %q", a.Name, b.Name)
+	}
+	if (a.Box == nil) != (b.Box == nil) {
+		return false, fmt.Sprintf("box %v != %v", a.Box, b.Box)
+	}
+	if a.Box != nil && (math.Abs(a.Box.X-b.Box.X) > tol || math.Abs(a.Box.Y-b.Box.Y) > tol || math.Abs(a.Box.Z-b.Box.Z) > tol) {
+		return false, fmt.Sprintf("box %v != %v", *a.Box, *b.Box)
+	}
+	if len(a.Residue) != len(b.Residue) {
+		return false, fmt.Sprintf("residue count %d != %d", len(a.Residue), len(b.Residue))
+	}
+
+	for i := range a.Residue {
+		resA, resB := a.Residue[i], b.Residue[i]
+		if resA.Name != resB.Name || resA.ID != resB.ID || resA.ChainID != resB.ChainID {
+			return false, fmt.Sprintf("residue %d: %s %d %s != %s %d %s", i, resA.Name, resA.ID, resA.ChainID, resB.Name, resB.ID, resB.ChainID)
+		}
+		if resA.IsNTerminal != resB.IsNTerminal || resA.IsCTerminal != resB.IsCTerminal {
+			return false, fmt.Sprintf("residue %d: terminal N %v C %v != N %v C %v", i, resA.IsNTerminal, resA.IsCTerminal, resB.IsNTerminal, resB.IsCTerminal)
+		}
+		if resA.Variant != resB.Variant {
+			return false, fmt.Sprintf("residue %d: variant %q != %q", i, resA.Variant, resB.Variant)
+		}
+		if len(resA.Atoms) != len(resB.Atoms) {
+			return false, fmt.Sprintf("residue %d: atom count %d != %d", i, len(resA.Atoms), len(resB.Atoms))
+		}
+
+		for j := range resA.Atoms {
+			if equal, diff := atomsEqual(resA.Atoms[j], resB.Atoms[j], tol); !equal {
+				return false, fmt.Sprintf("residue %d atom %d: %s", i, j, diff)
+			}
+		}
+	}
+
+	// the explicit bonds are compared by the indices of their atoms
+	if len(a.ExplicitBonds) != len(b.ExplicitBonds) {
+		return false, fmt.Sprintf("explicit bond count %d != %d", len(a.ExplicitBonds), len(b.ExplicitBonds))
+	}
+	for i := range a.ExplicitBonds {
+		bondA, bondB := a.ExplicitBonds[i], b.ExplicitBonds[i]
+		if bondA[0].index != bondB[0].index || bondA[1].index != bondB[1].index {
+			return false, fmt.Sprintf("explicit bond %d: %d-%d != %d-%d", i, bondA[0].index, bondA[1].index, bondB[0].index, bondB[1].index)
+		}
+	}
+
+	return true, ""
+}
+
+func atomsEqual(a, b *Atom, tol float64) (bool, string) {
+	if a.index != b.index {
+		return false, fmt.Sprintf("index %d != %d", a.index, b.index)
+	}
+	if a.element != b.element {
+		return false, fmt.Sprintf("element %s != %s", a.element, b.element)
+	}
+	if math.Abs(a.mass-b.mass) > tol {
+		return false, fmt.Sprintf("mass %v != %v", a.mass, b.mass)
+	}
+	if a.symbol != b.symbol {
+		return false, fmt.Sprintf("element symbol %s != %s", a.symbol, b.symbol)
+	}
+	if math.Abs(a.charge-b.charge) > tol {
+		return false, fmt.Sprintf("charge %v != %v", a.charge, b.charge)
+	}
+	if a.chargeGroup != b.chargeGroup {
+		return false, fmt.Sprintf("charge group %d != %d", a.chargeGroup, b.chargeGroup)
+	}
+
+	tuples := []struct {
+		name string
+		a, b TriTuple
+	}{
+		{"position", a.position, b.position},
+		{"velocity", a.velocity, b.velocity},
+		{"force", a.force, b.force},
+		{"acceleration", a.accelerated, b.accelerated},
+	}
+	for _, tuple := range tuples {
+		if math.Abs(tuple.a.x-tuple.b.x) > tol || math.Abs(tuple.a.y-tuple.b.y) > tol || math.Abs(tuple.a.z-tuple.b.z) > tol {
+			return false, fmt.Sprintf("%s %v != %v", tuple.name, tuple.a, tuple.b)
+		}
+	}
+
+	return true, ""
+}
+
+// CalculateVector returns the vector from atom1 to atom2, atom2 - atom1.
+// Its length is Distance(atom1.position, atom2.position), CalculateVector(atom2, atom1)
+// is its opposite; every caller takes the tail atom first.
 func CalculateVector(atom1, atom2 *Atom) TriTuple {
 	var vector TriTuple
 	vector.x = (atom2.position.x - atom1.position.x)
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/csv"
 	"fmt"
+	"io"
 	"io/fs"
 	"math"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // //////////
@@ -242,9 +248,9 @@ func TestCalculateDerivate(t *testing.T) {
 		phi := convertStringToFloatSlice(pair[0])[0]
 		// function
 		der1, der2, der3 := CalculateDerivate(v1, v2, phi)
-		der1 = math.Round(der1*math.Pow10(4)) / math.Pow10(4)
-		der2 = math.Round(der2*math.Pow10(4)) / math.Pow10(4)
-		der3 = math.Round(der3*math.Pow10(4)) / math.Pow10(4)
+		der1 = RoundTo(der1, 4)
+		der2 = RoundTo(der2, 4)
+		der3 = RoundTo(der3, 4)
 
 		// read output
 		out, _ := readFileline("Tests/CalculateDerivate" + "/output/" + outputFiles[i].Name())
@@ -380,7 +386,7 @@ func TestCalculateAngle(t *testing.T) {
 		var realResult float64
 		realResult = convertStringToFloatSlice(out[0])[0]
 
-		if realResult != math.Round(result) {
+		if RoundTo(realResult, 0) != RoundTo(result, 0) {
 			t.Errorf("CalculateAngle() = %v, want %v", result, realResult)
 		}
 
@@ -421,7 +427,7 @@ func TestCalculateDihedralAngle(t *testing.T) {
 		var realResult float64
 		realResult = convertStringToFloatSlice(out[0])[0]
 
-		if realResult != math.Round(result) {
+		if RoundTo(realResult, 0) != RoundTo(result, 0) {
 			t.Errorf("CalculateDihedralAngle() = %v, want %v", result, realResult)
 		}
 
@@ -448,7 +454,7 @@ func TestCalculateBondStretchEnergy(t *testing.T) {
 		var realResult float64
 		realResult = convertStringToFloatSlice(out[0])[0]
 
-		if realResult != math.Round(result) {
+		if RoundTo(realResult, 0) != RoundTo(result, 0) {
 			t.Errorf("CalculateBondStretchEnergy() = %v, want %v", result, realResult)
 		}
 
@@ -510,6 +516,63 @@ func TestCalculateProperDihedralAngleEnergy(t *testing.T) {
 	}
 }
 
+// AssertNetForceZero fails the test when the forces of one interaction do not sum to
+// zero within tol, an internal term cannot push the system as a whole
+func AssertNetForceZero(t *testing.T, tol float64, forces ...TriTuple) {
+	t.Helper()
+	var net TriTuple
+	for _, force := range forces {
+		net.x += force.x
+		net.y += force.y
+		net.z += force.z
+	}
+	if math.Abs(net.x) > tol || math.Abs(net.y) > tol || math.Abs(net.z) > tol {
+		t.Errorf("net force of %v = %v, want 0", forces, net)
+	}
+}
+
+// angstromUnits is kJ/mol with Angstrom lengths, for the tests whose Lennard-Jones
+// parameters are given in the same unit as the positions
+var angstromUnits = UnitSystem{Name: "kJ/mol Angstrom", EnergyUnit: "kJ/mol", KJPerMolPerEnergy: 1, AngstromPerLength: 1, HarmonicFactor: 0.5}
+
+// conservationBonded is the force field of the conservation tests, by atom name:
+// bonds [b0 (nm) kb], angles [theta0 k] and dihedrals [phase kd pn]
+var conservationBonded = parameterDatabase{atomPair: []*parameterPair{
+	{atomName: []string{"N", "N"}, Function: 1, parameter: []float64{0.110, 300000}},
+	{atomName: []string{"O", "H"}, Function: 1, parameter: []float64{0.09572, 502416}},
+	{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.153, 224262}},
+	{atomName: []string{"H", "O", "H"}, Function: 1, parameter: []float64{104.52, 628.02}},
+	{atomName: []string{"C", "C", "C"}, Function: 1, parameter: []float64{111, 530}},
+	{atomName: []string{"C", "C", "C", "C"}, Function: 1, parameter: []float64{0, 5.9, 3}},
+}}
+
+// RunConservationTest runs the protein built by setup for steps NVE steps of dt (fs) with
+// RunSimulation, the bonds found by distance and conservationBonded, and fails the test
+// when the total energy drifts more than tolerance (kJ/mol) from its initial value
+func RunConservationTest(t *testing.T, setup func() *Protein, steps int, dt, tolerance float64) {
+	t.Helper()
+	protein := setup()
+	cfg := SimulationConfig{BondParameter: conservationBonded, Timestep: dt, Steps: 1}
+	totalEnergy := func(p *Protein) float64 {
+		return CalculateTotalEnergy(BuildTopology(p), conservationBonded, parameterDatabase{}) + KineticEnergy(p)
+	}
+
+	initial := totalEnergy(protein)
+	if KineticEnergy(protein) == 0 && initial == 0 {
+		t.Fatalf("the system has no energy to conserve")
+	}
+	for step := 1; step <= steps; step++ {
+		next, err := RunSimulation(protein, cfg)
+		if err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+		protein = next
+		if drift := totalEnergy(protein) - initial; math.Abs(drift) > tolerance {
+			t.Fatalf("step %d: total energy drifted by %v kJ/mol from %v, tolerance %v", step, drift, initial, tolerance)
+		}
+	}
+}
+
 func TestCalculateBondForce(t *testing.T) {
 	inputFiles := ReadDirectory("Tests/CalculateBondForce" + "/input")
 	outputFiles := ReadDirectory("Tests/CalculateBondForce" + "/output")
@@ -533,15 +596,16 @@ func TestCalculateBondForce(t *testing.T) {
 		r := Distance(atom1.position, atom2.position)
 		// function
 		result := CalculateBondForce(k, r, r_0, &atom1, &atom2)
+		AssertNetForceZero(t, 1e-12, result, CalculateBondForce(k, r, r_0, &atom2, &atom1))
 		// read output
 		out, _ := readFileline("Tests/CalculateBondForce" + "/output/" + outputFiles[i].Name())
 		var realResult TriTuple
-		realResult.x = math.Round(convertStringToFloatSlice(out[0])[0] * math.Pow10(4))
-		realResult.y = math.Round(convertStringToFloatSlice(out[0])[1] * math.Pow10(4))
-		realResult.z = math.Round(convertStringToFloatSlice(out[0])[2] * math.Pow10(4))
+		realResult.x = convertStringToFloatSlice(out[0])[0]
+		realResult.y = convertStringToFloatSlice(out[0])[1]
+		realResult.z = convertStringToFloatSlice(out[0])[2]
 
-		if realResult.x != math.Round(result.x*math.Pow10(4)) || realResult.y != math.Round(result.y*math.Pow10(4)) || realResult.z != math.Round(result.z*math.Pow10(4)) {
-			t.Errorf("CalculateBondForce() = %v(%v ,%v, %v), want %v", result, math.Round(result.x*math.Pow10(4)), math.Round(result.y*math.Pow10(4)), math.Round(result.z*math.Pow10(4)), realResult)
+		if realResult.RoundTo(4) != result.RoundTo(4) {
+			t.Errorf("CalculateBondForce() = %v(%v), want %v", result, result.RoundTo(4), realResult)
 		}
 
 	}
@@ -575,15 +639,9 @@ func TestCalculateAngleForce(t *testing.T) {
 		theta := CalculateAngle(&atom1, &atom2, &atom3)
 		// function
 		result1, result2, result3 := CalculateAngleForce(k, theta, theta_0, &atom1, &atom2, &atom3)
-		result1.x = math.Round(result1.x*math.Pow10(8)) / math.Pow10(8)
-		result1.y = math.Round(result1.y*math.Pow10(8)) / math.Pow10(8)
-		result1.z = math.Round(result1.z*math.Pow10(8)) / math.Pow10(8)
-		result2.x = math.Round(result2.x*math.Pow10(8)) / math.Pow10(8)
-		result2.y = math.Round(result2.y*math.Pow10(8)) / math.Pow10(8)
-		result2.z = math.Round(result2.z*math.Pow10(8)) / math.Pow10(8)
-		result3.x = math.Round(result3.x*math.Pow10(8)) / math.Pow10(8)
-		result3.y = math.Round(result3.y*math.Pow10(8)) / math.Pow10(8)
-		result3.z = math.Round(result3.z*math.Pow10(8)) / math.Pow10(8)
+		result1 = result1.RoundTo(8)
+		result2 = result2.RoundTo(8)
+		result3 = result3.RoundTo(8)
 
 		// read output
 		out, _ := readFileline("Tests/CalculateAngleForce" + "/output/" + outputFiles[i].Name())
@@ -600,6 +658,7 @@ func TestCalculateAngleForce(t *testing.T) {
 		realResult3.y = convertStringToFloatSlice(out[2])[1]
 		realResult3.z = convertStringToFloatSlice(out[2])[2]
 
+		AssertNetForceZero(t, 1e-7, result1, result2, result3)
 		if result1 != realResult1 || result2 != realResult2 || result3 != realResult3 {
 			t.Errorf("CalculateAngleForce() = (%v ,%v, %v), want (%v, %v, %v)", result1, result2, result3, realResult1, realResult2, realResult3)
 		}
@@ -632,7 +691,7 @@ func TestDerivateAnglePositionX(t *testing.T) {
 
 		theta := CalculateAngle(&atom1, &atom2, &atom3)
 		// function
-		result := math.Round(DerivateAnglePositionX(&atom1, &atom2, &atom3, theta)*math.Pow10(4)) / math.Pow10(4)
+		result := RoundTo(DerivateAnglePositionX(&atom1, &atom2, &atom3, theta), 4)
 		// read output
 		out, _ := readFileline("Tests/DerivateAnglePositionX" + "/output/" + outputFiles[i].Name())
 		var realResult float64
@@ -670,7 +729,7 @@ func TestDerivateAnglePositionY(t *testing.T) {
 
 		theta := CalculateAngle(&atom1, &atom2, &atom3)
 		// function
-		result := math.Round(DerivateAnglePositionY(&atom1, &atom2, &atom3, theta)*math.Pow10(4)) / math.Pow10(4)
+		result := RoundTo(DerivateAnglePositionY(&atom1, &atom2, &atom3, theta), 4)
 		// read output
 		out, _ := readFileline("Tests/DerivateAnglePositionY" + "/output/" + outputFiles[i].Name())
 		var realResult float64
@@ -708,7 +767,7 @@ func TestDerivateAnglePositionZ(t *testing.T) {
 
 		theta := CalculateAngle(&atom1, &atom2, &atom3)
 		// function
-		result := math.Round(DerivateAnglePositionZ(&atom1, &atom2, &atom3, theta)*math.Pow10(4)) / math.Pow10(4)
+		result := RoundTo(DerivateAnglePositionZ(&atom1, &atom2, &atom3, theta), 4)
 		// read output
 		out, _ := readFileline("Tests/DerivateAnglePositionZ" + "/output/" + outputFiles[i].Name())
 		var realResult float64
@@ -753,22 +812,14 @@ func TestCalculateProperDihedralsForce(t *testing.T) {
 		atom4.position.y = convertStringToFloatSlice(pair[4])[1]
 		atom4.position.z = convertStringToFloatSlice(pair[4])[2]
 
-		phi := CalculateDihedralAngle(&atom1, &atom2, &atom3, &atom4)
+		phi := CalculateSignedDihedralAngle(&atom1, &atom2, &atom3, &atom4) / 180 * math.Pi
 		// function
 		result1, result2, result3, result4 := CalculateProperDihedralsForce(kd, phi, pn, phase, &atom1, &atom2, &atom3, &atom4)
 
-		result1.x = math.Round(result1.x*math.Pow10(8)) / math.Pow10(8)
-		result1.y = math.Round(result1.y*math.Pow10(8)) / math.Pow10(8)
-		result1.z = math.Round(result1.z*math.Pow10(8)) / math.Pow10(8)
-		result2.x = math.Round(result2.x*math.Pow10(8)) / math.Pow10(8)
-		result2.y = math.Round(result2.y*math.Pow10(8)) / math.Pow10(8)
-		result2.z = math.Round(result2.z*math.Pow10(8)) / math.Pow10(8)
-		result3.x = math.Round(result3.x*math.Pow10(8)) / math.Pow10(8)
-		result3.y = math.Round(result3.y*math.Pow10(8)) / math.Pow10(8)
-		result3.z = math.Round(result3.z*math.Pow10(8)) / math.Pow10(8)
-		result4.x = math.Round(result4.x*math.Pow10(8)) / math.Pow10(8)
-		result4.y = math.Round(result4.y*math.Pow10(8)) / math.Pow10(8)
-		result4.z = math.Round(result4.z*math.Pow10(8)) / math.Pow10(8)
+		result1 = result1.RoundTo(8)
+		result2 = result2.RoundTo(8)
+		result3 = result3.RoundTo(8)
+		result4 = result4.RoundTo(8)
 
 		// read output
 		out, _ := readFileline("Tests/CalculateProperDihedralsForce" + "/output/" + outputFiles[i].Name())
@@ -796,6 +847,4816 @@ func TestCalculateProperDihedralsForce(t *testing.T) {
 	}
 }
 
+func TestCalculateVirialTensor(t *testing.T) {
+	// six atoms on the axes of an octahedron, far enough apart in index to not be excluded
+	offsets := []TriTuple{{1.5, 0, 0}, {-1.5, 0, 0}, {0, 1.5, 0}, {0, -1.5, 0}, {0, 0, 1.5}, {0, 0, -1.5}}
+	var residue Residue
+	for i, offset := range offsets {
+		residue.Atoms = append(residue.Atoms, &Atom{
+			index:    4*i + 1,
+			position: offset,
+			velocity: TriTuple{x: offset.x / 15, y: offset.y / 15, z: offset.z / 15},
+			mass:     39.948,
+			element:  "AR",
+		})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"AR", "AR"}, Function: 1, parameter: []float64{6.2e-3, 9.7e-6}}}}
+
+	_, forceMap, pairs := CalculateTotalUnbondedEnergyForcePairs(&protein, nonbonded)
+	if len(pairs) != 15 {
+		t.Fatalf("CalculateTotalUnbondedEnergyForcePairs() reported %d pairs, want 15", len(pairs))
+	}
+
+	tensor := CalculateVirialTensor(&protein, forceMap)
+	diagonal := tensor[0][0]
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 3; b++ {
+			if a == b {
+				if math.Abs(tensor[a][b]-diagonal) > 1e-9*math.Abs(diagonal) {
+					t.Errorf("CalculateVirialTensor()[%d][%d] = %v, want %v", a, b, tensor[a][b], diagonal)
+				}
+			} else if math.Abs(tensor[a][b]) > 1e-9*math.Abs(diagonal) {
+				t.Errorf("CalculateVirialTensor()[%d][%d] = %v, want 0", a, b, tensor[a][b])
+			}
+		}
+	}
+
+	// without velocities the atomic and pair forms of the virial agree
+	for _, atom := range residue.Atoms {
+		atom.velocity = TriTuple{}
+	}
+	atomic := CalculateVirialTensor(&protein, forceMap)
+	pair := PairVirialTensor(pairs)
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 3; b++ {
+			if math.Abs(atomic[a][b]-pair[a][b]) > 1e-9*math.Abs(atomic[0][0]) {
+				t.Errorf("PairVirialTensor()[%d][%d] = %v, want %v", a, b, pair[a][b], atomic[a][b])
+			}
+		}
+	}
+
+	if p := ScalarPressure(tensor, 2.0); math.Abs(p-diagonal/2.0) > 1e-9*math.Abs(diagonal) {
+		t.Errorf("ScalarPressure() = %v, want %v", p, diagonal/2.0)
+	}
+}
+
+func TestSteepestDescentFrozen(t *testing.T) {
+	frozenAtom := &Atom{index: 1, position: TriTuple{0.0, 0.0, 0.0}, element: "AR", mass: 39.948}
+	mobileAtom := &Atom{index: 5, position: TriTuple{1.0, 0.0, 0.0}, element: "AR", mass: 39.948}
+	protein := Protein{Residue: []*Residue{{Name: "AR", ID: 1, Atoms: []*Atom{frozenAtom, mobileAtom}}}}
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"AR", "AR"}, Function: 1, parameter: []float64{1e-3, 1e-2}}}}.WithUnits(angstromUnits)
+
+	energy, unbondedForceMap := CalculateTotalUnbondedEnergyForce(&protein, nonbonded)
+	// SteepestDescent reads the force of an atom from forceMap[index+1]
+	forceMap := map[int]*TriTuple{
+		frozenAtom.index + 1: unbondedForceMap[frozenAtom.index],
+		mobileAtom.index + 1: unbondedForceMap[mobileAtom.index],
+	}
+
+	SteepestDescent(&protein, 0.1, forceMap, map[int]bool{frozenAtom.index: true})
+
+	if frozenAtom.position != (TriTuple{0.0, 0.0, 0.0}) {
+		t.Errorf("SteepestDescent() moved frozen atom to %v", frozenAtom.position)
+	}
+	if mobileAtom.position.x <= 1.0 {
+		t.Errorf("SteepestDescent() mobile atom at %v, want it pushed away from the frozen atom", mobileAtom.position)
+	}
+
+	// the frozen atom is still part of the system, so the repulsion drops as the pair separates
+	newEnergy, _ := CalculateTotalUnbondedEnergyForce(&protein, nonbonded)
+	r := Distance(frozenAtom.position, mobileAtom.position)
+	want := 2 * CalculateLJPotentialEnergy(1e-3, 1e-2, r)
+	if newEnergy >= energy || math.Abs(newEnergy-want) > 1e-12 {
+		t.Errorf("CalculateTotalUnbondedEnergyForce() after minimization = %v, want %v (below %v)", newEnergy, want, energy)
+	}
+}
+
+func TestElementFromAtomName(t *testing.T) {
+	tests := []struct {
+		name    string
+		element string
+	}{
+		{"CA", "C"},  // carbon alpha, not calcium
+		{"NA", "N"},  // nitrogen alpha, not sodium
+		{"HB", "H"},  // hydrogen beta
+		{"HB1", "H"}, // numbered hydrogen
+		{"1HG2", "H"},
+		{"CL", "CL"},
+		{"MG", "MG"},
+		{"FE", "FE"},
+		{"SG", "S"},
+		{"OXT", "O"},
+		{"N", "N"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if result := ElementFromAtomName(test.name); result != test.element {
+			t.Errorf("ElementFromAtomName(%q) = %q, want %q", test.name, result, test.element)
+		}
+	}
+}
+
+func TestUpdateMassesWarning(t *testing.T) {
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	defer SetLogOutput(os.Stderr)
+
+	protein := Protein{Residue: []*Residue{{Name: "UNK", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "CA"},
+		{index: 2, element: "XE"},
+	}}}}
+	protein.UpdateMasses(massTable)
+
+	if protein.Residue[0].Atoms[0].mass != massTable["C"] {
+		t.Errorf("UpdateMasses() mass of CA = %v, want %v", protein.Residue[0].Atoms[0].mass, massTable["C"])
+	}
+	if !strings.Contains(buffer.String(), "Mass not found for element XE") {
+		t.Errorf("UpdateMasses() logged %q, want a missing mass warning for XE", buffer.String())
+	}
+	if strings.Contains(buffer.String(), "CA") {
+		t.Errorf("UpdateMasses() logged %q, want no warning for CA", buffer.String())
+	}
+}
+
+func TestCheckAssignedChargesWarning(t *testing.T) {
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	defer SetLogOutput(os.Stderr)
+
+	protein := Protein{Residue: []*Residue{{Name: "ALA", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "N", charge: -0.5},
+		{index: 2, element: "CA", charge: 0.3},
+	}}}}
+	CheckAssignedCharges(&protein, map[string]map[string]float64{"ALA": {"N": -0.5, "CA": 0.14}})
+
+	if !strings.Contains(buffer.String(), "Warning: discrepancy found: Residue ALA, Atom CA") {
+		t.Errorf("CheckAssignedCharges() logged %q, want the discrepancy of CA", buffer.String())
+	}
+	if strings.Contains(buffer.String(), "Atom N,") {
+		t.Errorf("CheckAssignedCharges() logged %q, want nothing for N", buffer.String())
+	}
+}
+
+func TestEndToEndDistance(t *testing.T) {
+	first := Residue{Name: "GLY", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "N", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 2, element: "CA", position: TriTuple{1.0, 1.0, 0.0}},
+		{index: 3, element: "C", position: TriTuple{2.0, 0.0, 0.0}},
+	}}
+	last := Residue{Name: "GLY", ID: 2, Atoms: []*Atom{
+		{index: 4, element: "N", position: TriTuple{3.0, 0.0, 0.0}},
+		{index: 5, element: "CA", position: TriTuple{4.0, 1.0, 0.0}},
+		{index: 6, element: "C", position: TriTuple{6.0, 8.0, 0.0}},
+	}}
+
+	protein := Protein{Residue: []*Residue{&first, &last}}
+	if result := EndToEndVector(&protein); result != (TriTuple{6.0, 8.0, 0.0}) {
+		t.Errorf("EndToEndVector() = %v, want %v", result, TriTuple{6.0, 8.0, 0.0})
+	}
+	if result := EndToEndDistance(&protein); result != 10.0 {
+		t.Errorf("EndToEndDistance() = %v, want 10", result)
+	}
+
+	single := Protein{Residue: []*Residue{&first}}
+	if result := EndToEndDistance(&single); result != 0.0 {
+		t.Errorf("EndToEndDistance() of a single residue = %v, want 0", result)
+	}
+}
+
+func TestWithVelocityFile(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/WithVelocityFile/input/protein.pdb", WithVelocityFile("Tests/WithVelocityFile/input/velocities.txt"))
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+
+	velocities, _ := ReadTriTuples("Tests/WithVelocityFile/input/velocities.txt")
+	atoms := protein.Residue[0].Atoms
+	if len(atoms) != len(velocities) {
+		t.Fatalf("readProteinFromFile() read %d atoms, want %d", len(atoms), len(velocities))
+	}
+	for i, atom := range atoms {
+		if atom.velocity != velocities[i] {
+			t.Errorf("atom %d velocity = %v, want %v", atom.index, atom.velocity, velocities[i])
+		}
+	}
+
+	_, err = readProteinFromFile("Tests/WithVelocityFile/input/protein.pdb", WithVelocityFile("Tests/WithVelocityFile/input/velocities_short.txt"))
+	if err == nil {
+		t.Errorf("readProteinFromFile() with too few velocities returned no error")
+	}
+}
+
+func TestRadialDistribution(t *testing.T) {
+	// simple cubic lattice with spacing 1 filling a periodic box of side 4
+	var residue Residue
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				residue.Atoms = append(residue.Atoms, &Atom{
+					index:    len(residue.Atoms) + 1,
+					position: TriTuple{float64(i) + 0.5, float64(j) + 0.5, float64(k) + 0.5},
+				})
+			}
+		}
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+
+	g, r, err := RadialDistribution(&protein, Box{X: 4, Y: 4, Z: 4}, 0.1, 1.9)
+	if err != nil {
+		t.Fatalf("RadialDistribution() error = %v", err)
+	}
+	if len(g) != 19 || len(r) != 19 {
+		t.Fatalf("RadialDistribution() returned %d and %d bins, want 19", len(g), len(r))
+	}
+
+	latticeDistances := []float64{1.0, math.Sqrt(2), math.Sqrt(3)}
+	for k := range g {
+		isPeak := false
+		for _, d := range latticeDistances {
+			if int(d/0.1) == k {
+				isPeak = true
+			}
+		}
+		if isPeak && g[k] <= 1.0 {
+			t.Errorf("g(%v) = %v, want a peak", r[k], g[k])
+		}
+		if !isPeak && g[k] != 0.0 {
+			t.Errorf("g(%v) = %v, want 0 between lattice shells", r[k], g[k])
+		}
+	}
+
+	// beyond half the box a pair is seen at its minimum image only, g(r) would fall off
+	if _, _, err := RadialDistribution(&protein, Box{X: 4, Y: 4, Z: 4}, 0.1, 2.5); err == nil {
+		t.Errorf("RadialDistribution() accepted a maximal distance beyond half the box")
+	}
+}
+
+func TestProteinsEqual(t *testing.T) {
+	protein := Protein{Name: "dipeptide", Residue: []*Residue{
+		{Name: "ALA", ID: 1, ChainID: "A", Atoms: []*Atom{
+			{index: 1, element: "N", position: TriTuple{0.0, 0.0, 0.0}, mass: 14.0067, charge: -0.3},
+			{index: 2, element: "CA", position: TriTuple{1.5, 0.0, 0.0}, velocity: TriTuple{0.1, 0.0, 0.0}, mass: 12.0107, charge: 0.2},
+		}},
+		{Name: "GLY", ID: 2, ChainID: "A", Atoms: []*Atom{
+			{index: 3, element: "N", position: TriTuple{3.0, 0.0, 0.0}, mass: 14.0067, charge: -0.3},
+		}},
+	}}
+
+	copied := CopyProtein(&protein)
+	if equal, diff := ProteinsEqual(&protein, copied, 1e-12); !equal {
+		t.Errorf("ProteinsEqual() of a copy = false (%s), want true", diff)
+	}
+
+	copied.Residue[1].Atoms[0].charge = 0.5
+	equal, diff := ProteinsEqual(&protein, copied, 1e-12)
+	if equal {
+		t.Errorf("ProteinsEqual() with a different charge = true, want false")
+	}
+	if !strings.Contains(diff, "residue 1 atom 0: charge") {
+		t.Errorf("ProteinsEqual() difference = %q, want it to report the charge of residue 1 atom 0", diff)
+	}
+
+	protein.Box = &Box{X: 30, Y: 30, Z: 30}
+	protein.ExplicitBonds = [][2]*Atom{{protein.Residue[0].Atoms[0], protein.Residue[0].Atoms[1]}}
+	changes := map[string]func(*Protein){
+		"charge group":   func(p *Protein) { p.Residue[0].Atoms[1].chargeGroup = 2 },
+		"element symbol": func(p *Protein) { p.Residue[0].Atoms[1].symbol = "N" },
+		"terminal":       func(p *Protein) { p.Residue[0].IsNTerminal = true },
+		"variant":        func(p *Protein) { p.Residue[0].Variant = "NALA" },
+		"box":            func(p *Protein) { p.Box.Z = 31 },
+		"explicit bond":  func(p *Protein) { p.ExplicitBonds[0][1] = p.Residue[1].Atoms[0] },
+	}
+	for want, change := range changes {
+		copied := CopyProtein(&protein)
+		if equal, diff := ProteinsEqual(&protein, copied, 1e-12); !equal {
+			t.Fatalf("ProteinsEqual() of a copy with a box and bonds = false (%s), want true", diff)
+		}
+		change(copied)
+		if equal, diff := ProteinsEqual(&protein, copied, 1e-12); equal || !strings.Contains(diff, want) {
+			t.Errorf("ProteinsEqual() after changing the %s = %v, %q", want, equal, diff)
+		}
+	}
+}
+
+func TestFindClashes(t *testing.T) {
+	residue := Residue{Name: "UNK", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "C", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 2, element: "C", position: TriTuple{1.5, 0.0, 0.0}},   // bonded to atom 1
+		{index: 3, element: "C", position: TriTuple{0.75, 1.3, 0.0}},  // bonded to atom 2, a 1-3 pair with atom 1
+		{index: 5, element: "O", position: TriTuple{-0.8, -0.6, 0.0}}, // inside the VdW radius of atom 1 and bonded to nothing
+		{index: 9, element: "N", position: TriTuple{20.0, 0.0, 0.0}},
+		{index: 13, element: "N", position: TriTuple{20.0, 4.0, 0.0}}, // well separated from atom 9
+	}}
+	protein := Protein{Residue: []*Residue{&residue}}
+	// explicit bonds, atom 5 would be bonded to atom 1 by distance
+	protein.ExplicitBonds = [][2]*Atom{{residue.Atoms[0], residue.Atoms[1]}, {residue.Atoms[1], residue.Atoms[2]}}
+
+	clashes := FindClashes(&protein, 0.7)
+	if len(clashes) != 1 {
+		t.Fatalf("FindClashes() returned %d clashes, want 1: %v", len(clashes), clashes)
+	}
+	if clashes[0].Atom1.index != 1 || clashes[0].Atom2.index != 5 {
+		t.Errorf("FindClashes()[0] = %d-%d, want 1-5", clashes[0].Atom1.index, clashes[0].Atom2.index)
+	}
+	if clashes[0].Distance != 1.0 {
+		t.Errorf("FindClashes()[0].Distance = %v, want 1", clashes[0].Distance)
+	}
+
+	// with a topology given, its bonds and angles are the ones left out
+	topology := NewTopology(&protein)
+	topology.AddBond(residue.Atoms[0], residue.Atoms[1])
+	topology.AddBond(residue.Atoms[1], residue.Atoms[2])
+	topology.AddBond(residue.Atoms[0], residue.Atoms[3])
+	topology.AddAngle(residue.Atoms[0], residue.Atoms[1], residue.Atoms[2])
+	if clashes := FindClashes(&protein, 0.7, topology); len(clashes) != 0 {
+		t.Errorf("FindClashes() with the bond 1-5 in the topology returned %d clashes, want none", len(clashes))
+	}
+
+	// the bonds and angles of a real structure are not clashes
+	calmodulin, err := readProteinFromFile("../data/calmodulin_noCA.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	if clashes := FindClashes(&calmodulin, defaultClashOverlap); len(clashes) != 0 {
+		clash := clashes[0]
+		t.Errorf("FindClashes() on calmodulin returned %d clashes, first %s %d - %s %d at %v", len(clashes), clash.Atom1.element, clash.Atom1.index, clash.Atom2.element, clash.Atom2.index, clash.Distance)
+	}
+}
+
+func TestReadChains(t *testing.T) {
+	// both chains hold a single GLY 1, only the TER record separates them
+	protein, err := readProteinFromFile("Tests/ReadChains/input/protein.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	if len(protein.Residue) != 2 {
+		t.Fatalf("readProteinFromFile() read %d residues, want 2", len(protein.Residue))
+	}
+	for i, residue := range protein.Residue {
+		if residue.Name != "GLY" || len(residue.Atoms) != 3 {
+			t.Errorf("residue %d = %s with %d atoms, want GLY with 3 atoms", i, residue.Name, len(residue.Atoms))
+		}
+	}
+	if protein.Residue[1].Atoms[0].index != 5 {
+		t.Errorf("second residue starts with atom %d, want 5", protein.Residue[1].Atoms[0].index)
+	}
+}
+
+func TestSuggestTimestep(t *testing.T) {
+	hydrogen := Protein{Residue: []*Residue{{Name: "MET", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "C", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 2, element: "H", position: TriTuple{1.09, 0.0, 0.0}},
+	}}}}
+	hydrogen.UpdateMasses(massTable)
+	heavy := Protein{Residue: []*Residue{{Name: "ETH", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "C", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 2, element: "C", position: TriTuple{1.54, 0.0, 0.0}},
+	}}}}
+	heavy.UpdateMasses(massTable)
+
+	hydrogenStep := SuggestTimestep(&hydrogen, parameterDatabase{})
+	heavyStep := SuggestTimestep(&heavy, parameterDatabase{})
+	if hydrogenStep > 1.5 {
+		t.Errorf("SuggestTimestep() with a C-H bond = %v fs, want about 1 fs", hydrogenStep)
+	}
+	if heavyStep <= 2*hydrogenStep {
+		t.Errorf("SuggestTimestep() with a C-C bond = %v fs, want well above the C-H value %v fs", heavyStep, hydrogenStep)
+	}
+
+	// the force constant of the parameters, the same C-H bond in kJ/mol/nm^2 and in kcal/mol/Angstrom^2
+	gromacs := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "H"}, Function: 1, parameter: []float64{0.109, 284512}}}}
+	amber := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "H"}, Function: 1, parameter: []float64{1.09, 340}}}}.WithUnits(AMBERUnits)
+	gromacsStep, amberStep := SuggestTimestep(&hydrogen, gromacs), SuggestTimestep(&hydrogen, amber)
+	wantStep := 2 * math.Pi * math.Sqrt(reducedMass(hydrogen.Residue[0].Atoms[0], hydrogen.Residue[0].Atoms[1])/284512) * 100
+	if math.Abs(gromacsStep-wantStep) > 1e-9 || math.Abs(amberStep-wantStep) > 1e-9 {
+		t.Errorf("SuggestTimestep() with the C-H parameters = %v fs and %v fs, want %v fs", gromacsStep, amberStep, wantStep)
+	}
+	stiff := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.154, 4 * typicalBondForceConstant}}}}
+	if step := SuggestTimestep(&heavy, stiff); math.Abs(step-heavyStep/2) > 1e-9 {
+		t.Errorf("SuggestTimestep() with a C-C bond four times stiffer = %v fs, want half of %v fs", step, heavyStep)
+	}
+}
+
+func TestCombineLJ(t *testing.T) {
+	perType := map[string]LJParam{
+		"C": {Sigma: 0.34, Epsilon: 0.36},
+		"O": {Sigma: 0.30, Epsilon: 0.64},
+	}
+
+	// sigma = 0.32, epsilon = sqrt(0.36*0.64) = 0.48
+	A, B := CombineLJ("C", "O", perType)
+	wantA := 4 * 0.48 * math.Pow(0.32, 12)
+	wantB := 4 * 0.48 * math.Pow(0.32, 6)
+	if math.Abs(A-wantA) > 1e-12*wantA || math.Abs(B-wantB) > 1e-12*wantB {
+		t.Errorf("CombineLJ() = (%v, %v), want (%v, %v)", A, B, wantA, wantB)
+	}
+
+	// the non-bonded routine uses the combined coefficients when per type data is given
+	protein := Protein{Residue: []*Residue{{Name: "UNK", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "C", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 5, element: "O", position: TriTuple{0.3, 0.0, 0.0}},
+	}}}}
+	energy, _ := CalculateTotalUnbondedEnergyForce(&protein, parameterDatabase{ljTypes: perType}.WithUnits(angstromUnits))
+	if want := 2 * CalculateLJPotentialEnergy(wantB, wantA, 0.3); math.Abs(energy-want) > 1e-12 {
+		t.Errorf("CalculateTotalUnbondedEnergyForce() = %v, want %v", energy, want)
+	}
+}
+
+func TestCombiningRule(t *testing.T) {
+	paramI := LJParam{Sigma: 0.2, Epsilon: 0.25}
+	paramJ := LJParam{Sigma: 0.8, Epsilon: 1.0}
+
+	lorentzBerthelot := LorentzBerthelot.Combine(paramI, paramJ)
+	geometric := Geometric.Combine(paramI, paramJ)
+	if math.Abs(lorentzBerthelot.Sigma-0.5) > 1e-12 || math.Abs(lorentzBerthelot.Epsilon-0.5) > 1e-12 {
+		t.Errorf("LorentzBerthelot.Combine() = %v, want {0.5 0.5}", lorentzBerthelot)
+	}
+	if math.Abs(geometric.Sigma-0.4) > 1e-12 || math.Abs(geometric.Epsilon-0.5) > 1e-12 {
+		t.Errorf("Geometric.Combine() = %v, want {0.4 0.5}", geometric)
+	}
+
+	// the non-bonded routine honours the rule of the database
+	perType := map[string]LJParam{"C": paramI, "O": paramJ}
+	protein := Protein{Residue: []*Residue{{Name: "UNK", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "C", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 5, element: "O", position: TriTuple{0.45, 0.0, 0.0}},
+	}}}}
+	for _, rule := range []CombiningRule{LorentzBerthelot, Geometric} {
+		energy, _ := CalculateTotalUnbondedEnergyForce(&protein, parameterDatabase{ljTypes: perType, combiningRule: rule}.WithUnits(angstromUnits))
+		A, B := CombineLJWithRule("C", "O", perType, rule)
+		if want := 2 * CalculateLJPotentialEnergy(B, A, 0.45); math.Abs(energy-want) > 1e-12 {
+			t.Errorf("CalculateTotalUnbondedEnergyForce() with rule %d = %v, want %v", rule, energy, want)
+		}
+	}
+}
+
+func TestRemoveHydrogens(t *testing.T) {
+	protein := Protein{Residue: []*Residue{{Name: "ALA", ID: 1, ChainID: "A", Atoms: []*Atom{
+		{index: 1, element: "N"},
+		{index: 2, element: "H"},
+		{index: 3, element: "CA"},
+		{index: 4, element: "HA"},
+		{index: 5, element: "CB"},
+		{index: 6, element: "HB1"},
+		{index: 7, element: "HB2"},
+		{index: 8, element: "HB3"},
+		{index: 9, element: "C"},
+		{index: 10, element: "O"},
+	}}}}
+	protein.UpdateMasses(massTable)
+
+	stripped := RemoveHydrogens(&protein)
+	atoms := stripped.Residue[0].Atoms
+	names := []string{"N", "CA", "CB", "C", "O"}
+	if len(atoms) != len(names) {
+		t.Fatalf("RemoveHydrogens() kept %d atoms, want %d", len(atoms), len(names))
+	}
+	for i, atom := range atoms {
+		if atom.element != names[i] || atom.index != i+1 {
+			t.Errorf("RemoveHydrogens() atom %d = %s (index %d), want %s (index %d)", i, atom.element, atom.index, names[i], i+1)
+		}
+		if atom.mass != massTable[ElementFromAtomName(names[i])] {
+			t.Errorf("RemoveHydrogens() atom %s mass = %v", atom.element, atom.mass)
+		}
+	}
+
+	// the input is left untouched
+	if len(protein.Residue[0].Atoms) != 10 || protein.Residue[0].Atoms[2].index != 3 {
+		t.Errorf("RemoveHydrogens() modified its input")
+	}
+}
+
+func TestScanBond(t *testing.T) {
+	// C-H bond, b0 = 0.109 nm so the minimum is at 1.09 Angstrom
+	points := ScanBond(284512.0, 0.109, 0.89, 1.29, 41)
+	forces := ScanBondForce(284512.0, 0.109, 0.89, 1.29, 41)
+	if len(points) != 41 || len(forces) != 41 {
+		t.Fatalf("ScanBond() returned %d and %d points, want 41", len(points), len(forces))
+	}
+
+	minimum := 0
+	for i := range points {
+		if points[i].Energy < points[minimum].Energy {
+			minimum = i
+		}
+	}
+	if minimum != 20 || math.Abs(points[minimum].R-1.09) > 1e-9 {
+		t.Errorf("ScanBond() minimum at r = %v, want 1.09", points[minimum].R)
+	}
+	if forces[20].Force > 1e-9 {
+		t.Errorf("ScanBondForce() at r_0 = %v, want 0", forces[20].Force)
+	}
+
+	for i := 1; i <= 20; i++ {
+		below, above := points[20-i].Energy, points[20+i].Energy
+		if math.Abs(below-above) > 1e-9*above {
+			t.Errorf("ScanBond() energy at r_0-%d = %v, at r_0+%d = %v, want symmetric", i, below, i, above)
+		}
+		if math.Abs(forces[20-i].Force-forces[20+i].Force) > 1e-9*forces[20+i].Force {
+			t.Errorf("ScanBondForce() at r_0-%d = %v, at r_0+%d = %v, want symmetric", i, forces[20-i].Force, i, forces[20+i].Force)
+		}
+	}
+}
+
+func TestParameterJSON(t *testing.T) {
+	db, err := ReadParameterFile("Tests/ParameterJSON/input/bondtypes.itp")
+	if err != nil {
+		t.Fatalf("ReadParameterFile() error = %v", err)
+	}
+	if len(db.atomPair) != 11 {
+		t.Fatalf("ReadParameterFile() read %d pairs, want 11", len(db.atomPair))
+	}
+
+	filePath := t.TempDir() + "/bondtypes.json"
+	if err := WriteParameterJSON(db, filePath); err != nil {
+		t.Fatalf("WriteParameterJSON() error = %v", err)
+	}
+	reloaded, err := ReadParameterJSON(filePath)
+	if err != nil {
+		t.Fatalf("ReadParameterJSON() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(db, reloaded) {
+		t.Errorf("ReadParameterJSON() = %v, want %v", reloaded, db)
+	}
+
+	// the units, cutoff scheme and explicit pairs survive the round trip too
+	pairs := []ItpPair{{Atom1: 1, Atom2: 4, Function: 1}, {Atom1: 2, Atom2: 5, Function: 1, Parameter: []float64{0.0012, 2.1e-6}}}
+	db = db.WithUnits(AMBERUnits).WithCutoffScheme(GroupCutoff).WithPairs(pairs, 0.8333)
+	if err := WriteParameterJSON(db, filePath); err != nil {
+		t.Fatalf("WriteParameterJSON() error = %v", err)
+	}
+	if reloaded, err = ReadParameterJSON(filePath); err != nil || !reflect.DeepEqual(db, reloaded) {
+		t.Errorf("ReadParameterJSON() = %v, %v, want %v", reloaded, err, db)
+	}
+}
+
+func TestLoadProteinsConcurrent(t *testing.T) {
+	paths := []string{
+		"Tests/LoadProteinsConcurrent/input/asp.pdb",
+		"Tests/LoadProteinsConcurrent/input/missing.pdb",
+		"Tests/LoadProteinsConcurrent/input/ala.pdb",
+		"Tests/LoadProteinsConcurrent/input/gly.pdb",
+		"Tests/LoadProteinsConcurrent/input/asp.pdb",
+	}
+	names := []string{"ASP", "", "ALA", "GLY", "ASP"}
+
+	proteins, errs := LoadProteinsConcurrent(paths, 3)
+	if len(proteins) != len(paths) || len(errs) != len(paths) {
+		t.Fatalf("LoadProteinsConcurrent() returned %d proteins and %d errors, want %d", len(proteins), len(errs), len(paths))
+	}
+	for i := range paths {
+		if names[i] == "" {
+			if errs[i] == nil || proteins[i] != nil {
+				t.Errorf("LoadProteinsConcurrent() for %s = (%v, %v), want an error", paths[i], proteins[i], errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("LoadProteinsConcurrent() for %s error = %v", paths[i], errs[i])
+			continue
+		}
+		if proteins[i].Residue[0].Name != names[i] {
+			t.Errorf("LoadProteinsConcurrent()[%d] = %s, want %s", i, proteins[i].Residue[0].Name, names[i])
+		}
+	}
+}
+
+func TestCachedEnergy(t *testing.T) {
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"AR", "AR"}, Function: 1, parameter: []float64{1e-3, 1e-2}}}}
+	protein := Protein{Residue: []*Residue{{Name: "AR", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "AR", position: TriTuple{0.0, 0.0, 0.0}},
+		{index: 5, element: "AR", position: TriTuple{1.2, 0.0, 0.0}},
+	}}}}
+	calls := 0
+	cache := NewCachedEnergy(func(p *Protein) float64 {
+		calls++
+		energy, _ := CalculateTotalUnbondedEnergyForce(p, nonbonded)
+		return energy
+	}, 2, 6)
+
+	first := cache.Evaluate(&protein)
+	second := cache.Evaluate(CopyProtein(&protein))
+	if calls != 1 || cache.Hits != 1 || second != first {
+		t.Errorf("CachedEnergy.Evaluate() at identical coordinates: %d calls, %d hits, want 1 call and 1 hit", calls, cache.Hits)
+	}
+
+	protein.Residue[0].Atoms[1].position.x += 0.01
+	if perturbed := cache.Evaluate(&protein); calls != 2 || cache.Misses != 2 || perturbed == first {
+		t.Errorf("CachedEnergy.Evaluate() after moving an atom: %d calls, %d misses, want 2 and 2", calls, cache.Misses)
+	}
+
+	// a third structure evicts the least recently used one (the first)
+	protein.Residue[0].Atoms[1].position.x += 0.01
+	cache.Evaluate(&protein)
+	protein.Residue[0].Atoms[1].position.x -= 0.02
+	cache.Evaluate(&protein)
+	if calls != 4 {
+		t.Errorf("CachedEnergy.Evaluate() after eviction: %d calls, want 4", calls)
+	}
+}
+
+func TestReadItpAtoms(t *testing.T) {
+	atoms, err := ReadItpAtoms("Tests/ReadItpAtoms/input/topol.itp")
+	if err != nil {
+		t.Fatalf("ReadItpAtoms() error = %v", err)
+	}
+
+	want := []ItpAtom{
+		{1, "N3", 1, "ALA", "N", 1, 0.1414, 14.01},
+		{2, "H", 1, "ALA", "H1", 2, 0.1997, 1.008},
+		{3, "CT", 1, "ALA", "CA", 3, 0.0962, 12.01},
+		{4, "C", 1, "ALA", "C", 4, 0.6163, 12.01},
+		{5, "O", 1, "ALA", "O", 5, -0.5722, 16},
+	}
+	if !reflect.DeepEqual(atoms, want) {
+		t.Errorf("ReadItpAtoms() = %v, want %v", atoms, want)
+	}
+
+	protein := Protein{Residue: []*Residue{{Name: "ALA", ID: 1, Atoms: []*Atom{
+		{index: 1, element: "N"}, {index: 2, element: "H1"}, {index: 3, element: "CA"}, {index: 4, element: "C"}, {index: 5, element: "O"},
+	}}}}
+	if err := protein.ApplyItpAtoms(atoms); err != nil {
+		t.Fatalf("ApplyItpAtoms() error = %v", err)
+	}
+	for i, atom := range protein.Residue[0].Atoms {
+		if atom.charge != want[i].Charge || atom.mass != want[i].Mass {
+			t.Errorf("ApplyItpAtoms() atom %s = (%v, %v), want (%v, %v)", atom.element, atom.charge, atom.mass, want[i].Charge, want[i].Mass)
+		}
+	}
+}
+
+func TestInitializeVelocitiesSeed(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/LoadProteinsConcurrent/input/asp.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+
+	first := CopyProtein(&protein)
+	InitializeVelocities(first, 300, NewRNG(42))
+	second := CopyProtein(&protein)
+	InitializeVelocities(second, 300, NewRNG(42))
+	other := CopyProtein(&protein)
+	InitializeVelocities(other, 300, NewRNG(7))
+
+	if equal, diff := ProteinsEqual(first, second, 0); !equal {
+		t.Errorf("InitializeVelocities() with the same seed differ: %s", diff)
+	}
+	if equal, _ := ProteinsEqual(first, other, 0); equal {
+		t.Errorf("InitializeVelocities() with different seeds gave identical velocities")
+	}
+
+	var momentum TriTuple
+	for _, atom := range first.Residue[0].Atoms {
+		momentum.x += atom.mass * atom.velocity.x
+		momentum.y += atom.mass * atom.velocity.y
+		momentum.z += atom.mass * atom.velocity.z
+	}
+	if magnitude(momentum) > 1e-12 {
+		t.Errorf("InitializeVelocities() left a net momentum of %v", momentum)
+	}
+}
+
+func TestRamachandranAngles(t *testing.T) {
+	// phi of the middle residue is -60 by construction: C(0,1,0) N(0,0,0) CA(1.5,0,0) C(1.5,cos(-60),sin(-60))
+	protein := Protein{Residue: []*Residue{
+		{Name: "GLY", ID: 1, ChainID: "A", Atoms: []*Atom{
+			{index: 1, element: "N", position: TriTuple{-1.2, 2.1, 0.3}},
+			{index: 2, element: "CA", position: TriTuple{-1.0, 1.5, -0.4}},
+			{index: 3, element: "C", position: TriTuple{0.0, 1.0, 0.0}},
+		}},
+		{Name: "ALA", ID: 2, ChainID: "A", Atoms: []*Atom{
+			{index: 4, element: "N", position: TriTuple{0.0, 0.0, 0.0}},
+			{index: 5, element: "CA", position: TriTuple{1.5, 0.0, 0.0}},
+			{index: 6, element: "CB", position: TriTuple{2.0, 1.0, 1.0}},
+			{index: 7, element: "C", position: TriTuple{1.5, 0.5, -math.Sqrt(3) / 2}},
+		}},
+		{Name: "GLY", ID: 3, ChainID: "A", Atoms: []*Atom{
+			{index: 8, element: "N", position: TriTuple{2.7, 0.9, -1.3}},
+			{index: 9, element: "CA", position: TriTuple{3.1, 2.2, -1.9}},
+			{index: 10, element: "C", position: TriTuple{4.5, 2.3, -2.2}},
+		}},
+	}}
+
+	angles := RamachandranAngles(&protein)
+	if len(angles) != 3 {
+		t.Fatalf("RamachandranAngles() returned %d residues, want 3", len(angles))
+	}
+	if angles[0].HasPhi || !angles[0].HasPsi || !angles[2].HasPhi || angles[2].HasPsi {
+		t.Errorf("RamachandranAngles() terminal residues = %v, %v, want phi undefined first and psi undefined last", angles[0], angles[2])
+	}
+
+	middle := angles[1]
+	if middle.ResidueID != 2 || !middle.HasPhi || !middle.HasPsi {
+		t.Fatalf("RamachandranAngles()[1] = %v, want both angles of residue 2", middle)
+	}
+	if math.Abs(middle.Phi+60) > 1e-9 {
+		t.Errorf("phi = %v, want -60", middle.Phi)
+	}
+
+	// the magnitudes agree with the unsigned dihedral
+	atoms := protein.Residue[1].Atoms
+	psi := CalculateDihedralAngle(atoms[0], atoms[1], atoms[3], protein.Residue[2].Atoms[0])
+	if math.Abs(math.Abs(middle.Psi)-psi) > 1e-9 {
+		t.Errorf("|psi| = %v, want %v", math.Abs(middle.Psi), psi)
+	}
+	phi := CalculateDihedralAngle(protein.Residue[0].Atoms[2], atoms[0], atoms[1], atoms[3])
+	if math.Abs(math.Abs(middle.Phi)-phi) > 1e-9 {
+		t.Errorf("|phi| = %v, want %v", math.Abs(middle.Phi), phi)
+	}
+}
+
+func TestSteepestDescentWithForces(t *testing.T) {
+	// both atoms are pulled towards a minimum at the origin, the first twice as hard
+	protein := Protein{Residue: []*Residue{{Name: "UNK", ID: 1, Atoms: []*Atom{
+		{index: 3, position: TriTuple{2.0, 0.0, 0.0}},
+		{index: 7, position: TriTuple{0.0, -1.0, 0.0}},
+		{index: 9, position: TriTuple{5.0, 5.0, 5.0}},
+	}}}}
+	forceMap := map[int]*TriTuple{
+		3: {x: -2.0, y: 0.0, z: 0.0},
+		7: {x: 0.0, y: 1.0, z: 0.0},
+	}
+
+	SteepestDescentWithForces(&protein, forceMap, 0.1, nil)
+
+	atoms := protein.Residue[0].Atoms
+	if math.Abs(atoms[0].position.x-1.9) > 1e-12 || atoms[0].position.y != 0.0 {
+		t.Errorf("SteepestDescentWithForces() atom 3 at %v, want (1.9, 0, 0)", atoms[0].position)
+	}
+	if math.Abs(atoms[1].position.y+0.95) > 1e-12 || atoms[1].position.x != 0.0 {
+		t.Errorf("SteepestDescentWithForces() atom 7 at %v, want (0, -0.95, 0)", atoms[1].position)
+	}
+	if atoms[2].position != (TriTuple{5.0, 5.0, 5.0}) {
+		t.Errorf("SteepestDescentWithForces() moved atom 9 without a force to %v", atoms[2].position)
+	}
+
+	// a frozen atom stays put and the largest force on the mobile atoms sets the step
+	SteepestDescentWithForces(&protein, forceMap, 0.1, map[int]bool{3: true})
+	if math.Abs(atoms[0].position.x-1.9) > 1e-12 {
+		t.Errorf("SteepestDescentWithForces() moved the frozen atom 3 to %v", atoms[0].position)
+	}
+	if math.Abs(atoms[1].position.y+0.85) > 1e-12 {
+		t.Errorf("SteepestDescentWithForces() atom 7 at %v, want (0, -0.85, 0)", atoms[1].position)
+	}
+}
+
+func TestWrapIntoBox(t *testing.T) {
+	box := Box{X: 10, Y: 10, Z: 10}
+	protein := Protein{Residue: []*Residue{{Name: "NA", ID: 1, Atoms: []*Atom{
+		{index: 1, position: TriTuple{12.5, -3.0, 4.0}},
+	}}}}
+
+	WrapIntoBox(&protein, box)
+	if result := protein.Residue[0].Atoms[0].position; math.Abs(result.x-2.5) > 1e-12 || math.Abs(result.y-7.0) > 1e-12 || result.z != 4.0 {
+		t.Errorf("WrapIntoBox() = %v, want (2.5, 7, 4)", result)
+	}
+}
+
+func TestWrapWhole(t *testing.T) {
+	box := Box{X: 10, Y: 10, Z: 10}
+	// a diatomic straddling the x boundary and a lone ion outside the box
+	atom1 := &Atom{index: 1, element: "C", position: TriTuple{10.4, 5.0, 5.0}}
+	atom2 := &Atom{index: 2, element: "O", position: TriTuple{9.2, 5.0, 5.0}}
+	ion := &Atom{index: 3, element: "CL", position: TriTuple{-1.0, 5.0, 5.0}}
+	protein := Protein{Residue: []*Residue{{Name: "CO", ID: 1, Atoms: []*Atom{atom1, atom2}}, {Name: "CL", ID: 2, Atoms: []*Atom{ion}}}}
+	topology := NewTopology(&protein)
+	topology.AddBond(atom1, atom2)
+
+	WrapWhole(topology, box)
+
+	if math.Abs(atom1.position.x-0.4) > 1e-12 {
+		t.Errorf("WrapWhole() reference atom at %v, want x = 0.4", atom1.position)
+	}
+	if d := Distance(atom1.position, atom2.position); math.Abs(d-1.2) > 1e-12 {
+		t.Errorf("WrapWhole() bond length = %v, want 1.2", d)
+	}
+	if math.Abs(ion.position.x-9.0) > 1e-12 {
+		t.Errorf("WrapWhole() ion at %v, want x = 9", ion.position)
+	}
+
+	// wrapping atom by atom splits the molecule
+	atom1.position.x, atom2.position.x = 10.4, 9.2
+	WrapIntoBox(&protein, box)
+	if d := Distance(atom1.position, atom2.position); math.Abs(d-1.2) < 1e-9 {
+		t.Errorf("WrapIntoBox() kept the molecule whole, want it split")
+	}
+}
+
+func TestPrincipalAxes(t *testing.T) {
+	// a rod of carbons along (1, 1, 0) with a small spread along z
+	var residue Residue
+	for i := -5; i <= 5; i++ {
+		residue.Atoms = append(residue.Atoms, &Atom{
+			index:    len(residue.Atoms) + 1,
+			position: TriTuple{float64(i) + 3, float64(i) - 2, 0.3*float64(i%2) + 1},
+			mass:     12.0107,
+		})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+
+	inertia := MomentOfInertia(&protein)
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 3; b++ {
+			if math.Abs(inertia[a][b]-inertia[b][a]) > 1e-9 {
+				t.Errorf("MomentOfInertia() is not symmetric: %v", inertia)
+			}
+		}
+	}
+
+	moments, axes := PrincipalAxes(&protein)
+	if !(moments[0] <= moments[1] && moments[1] <= moments[2]) {
+		t.Errorf("PrincipalAxes() moments = %v, want ascending", moments)
+	}
+
+	// the rod spins easily about its own direction: the smallest moment belongs to the long axis
+	long := TriTuple{x: 1 / math.Sqrt(2), y: 1 / math.Sqrt(2)}
+	if math.Abs(math.Abs(axes[0].dot(long))-1) > 1e-3 {
+		t.Errorf("PrincipalAxes() long axis = %v, want along %v", axes[0], long)
+	}
+	// and the two other axes are perpendicular to it, with much larger moments
+	if math.Abs(axes[2].dot(long)) > 1e-3 || moments[2] < 10*moments[0] {
+		t.Errorf("PrincipalAxes() largest moment %v along %v, want perpendicular to the rod", moments[2], axes[2])
+	}
+}
+
+func TestOrientToPrincipalAxes(t *testing.T) {
+	positions := []TriTuple{{1, 2, 3}, {2.5, 3.1, 2.2}, {4.2, 3.9, 1.0}, {5.0, 5.5, 0.4}, {3.3, 1.7, 2.9}}
+	masses := []float64{12.0107, 15.9994, 14.0067, 12.0107, 1.00794}
+	var residue Residue
+	for i, position := range positions {
+		residue.Atoms = append(residue.Atoms, &Atom{index: i + 1, position: position, mass: masses[i]})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+
+	before := make([][]float64, len(residue.Atoms))
+	for i, a1 := range residue.Atoms {
+		for _, a2 := range residue.Atoms {
+			before[i] = append(before[i], Distance(a1.position, a2.position))
+		}
+	}
+
+	OrientToPrincipalAxes(&protein)
+
+	for i, a1 := range residue.Atoms {
+		for j, a2 := range residue.Atoms {
+			if d := Distance(a1.position, a2.position); math.Abs(d-before[i][j]) > 1e-9 {
+				t.Errorf("distance %d-%d = %v after orientation, want %v", i+1, j+1, d, before[i][j])
+			}
+		}
+	}
+
+	center := CenterOfMass(&protein)
+	if math.Abs(center.x)+math.Abs(center.y)+math.Abs(center.z) > 1e-9 {
+		t.Errorf("CenterOfMass() = %v after orientation, want origin", center)
+	}
+
+	inertia := MomentOfInertia(&protein)
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 3; b++ {
+			if a != b && math.Abs(inertia[a][b]) > 1e-9 {
+				t.Errorf("inertia[%d][%d] = %v after orientation, want 0", a, b, inertia[a][b])
+			}
+		}
+	}
+	if !(inertia[0][0] <= inertia[1][1] && inertia[1][1] <= inertia[2][2]) {
+		t.Errorf("inertia diagonal = %v, %v, %v, want ascending", inertia[0][0], inertia[1][1], inertia[2][2])
+	}
+}
+
+func TestLJTailCorrection(t *testing.T) {
+	// a simple cubic lattice of argon-like atoms with spacing 1
+	const n, spacing, cutoff = 6, 1.0, 7.5
+	var residue Residue
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				residue.Atoms = append(residue.Atoms, &Atom{
+					index:    len(residue.Atoms) + 1,
+					element:  "AR",
+					position: TriTuple{float64(i) * spacing, float64(j) * spacing, float64(k) * spacing},
+				})
+			}
+		}
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+	box := Box{X: n * spacing, Y: n * spacing, Z: n * spacing}
+	db := parameterDatabase{ljTypes: map[string]LJParam{"AR": {Sigma: 0.34, Epsilon: 0.996}}}.WithUnits(angstromUnits)
+
+	correction := LJTailCorrection(&protein, box, cutoff, db)
+	if correction >= 0 {
+		t.Fatalf("LJTailCorrection() = %v, want negative", correction)
+	}
+
+	// reference: the dispersion energy per atom that the cutoff drops, summed over the lattice;
+	// the cutoff is several spacings long so the lattice looks uniform beyond it
+	_, c6 := CombineLJ("AR", "AR", db.ljTypes)
+	reference := 0.0
+	const extent = 40
+	for i := -extent; i <= extent; i++ {
+		for j := -extent; j <= extent; j++ {
+			for k := -extent; k <= extent; k++ {
+				r := spacing * math.Sqrt(float64(i*i+j*j+k*k))
+				if r > cutoff && r <= extent*spacing {
+					reference -= 0.5 * c6 / math.Pow(r, 6)
+				}
+			}
+		}
+	}
+	reference *= float64(len(residue.Atoms))
+
+	if math.Abs(correction-reference) > 0.05*math.Abs(reference) {
+		t.Errorf("LJTailCorrection() = %v, want %v within 5%%", correction, reference)
+	}
+}
+
+func TestAtomsWithin(t *testing.T) {
+	rng := NewRNG(7)
+	var residue Residue
+	for i := 0; i < 500; i++ {
+		residue.Atoms = append(residue.Atoms, &Atom{
+			index:    i + 1,
+			position: TriTuple{rng.Float64()*30 - 10, rng.Float64() * 30, rng.Float64()*30 + 5},
+		})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+
+	// built for every call, or shared between the calls and rebuilt after the atoms move
+	hash := NewSpatialHash(&protein, 4)
+	for _, shared := range []bool{false, true, true} {
+		if shared {
+			for _, atom := range residue.Atoms {
+				atom.position.x += rng.Float64() - 0.5
+			}
+			hash.Rebuild()
+		}
+		for _, radius := range []float64{0.5, 3.0, 7.5, 50.0} {
+			center := TriTuple{4.2, 13.1, 20.7}
+			got := AtomsWithin(&protein, center, radius)
+			if shared {
+				got = AtomsWithin(&protein, center, radius, hash)
+			}
+
+			var want []*Atom
+			for _, atom := range residue.Atoms {
+				if Distance(center, atom.position) < radius {
+					want = append(want, atom)
+				}
+			}
+			if len(got) != len(want) {
+				t.Fatalf("AtomsWithin(radius %v, shared hash %v) returned %d atoms, want %d", radius, shared, len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("AtomsWithin(radius %v, shared hash %v)[%d] = atom %d, want atom %d", radius, shared, i, got[i].index, want[i].index)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckPlanarity(t *testing.T) {
+	// benzene in the xy plane: six ring carbons and their hydrogens
+	var residue Residue
+	ring := make([]*Atom, 6)
+	hydrogens := make([]*Atom, 6)
+	for i := 0; i < 6; i++ {
+		angle := float64(i) * math.Pi / 3
+		ring[i] = &Atom{index: i + 1, element: "CG", position: TriTuple{1.39 * math.Cos(angle), 1.39 * math.Sin(angle), 0}}
+		hydrogens[i] = &Atom{index: i + 7, element: "HG", position: TriTuple{2.48 * math.Cos(angle), 2.48 * math.Sin(angle), 0}}
+	}
+	residue.Atoms = append(ring, hydrogens...)
+	protein := Protein{Residue: []*Residue{&residue}}
+
+	topology := NewTopology(&protein)
+	for i := 0; i < 6; i++ {
+		topology.AddImproper(ring[i], ring[(i+5)%6], ring[(i+1)%6], hydrogens[i])
+	}
+
+	if violations := CheckPlanarity(&protein, topology, 5); len(violations) != 0 {
+		t.Fatalf("CheckPlanarity() on a flat ring = %v, want none", violations)
+	}
+
+	// pucker one carbon out of the plane
+	ring[2].position.z = 0.5
+	violations := CheckPlanarity(&protein, topology, 5)
+	if len(violations) == 0 {
+		t.Fatal("CheckPlanarity() on a puckered ring reported no violation")
+	}
+
+	found := false
+	for _, violation := range violations {
+		if violation.Deviation <= 5 {
+			t.Errorf("violation %v is within the tolerance", violation)
+		}
+		if violation.Atom1 == ring[2] {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("CheckPlanarity() did not report the improper centred on the puckered atom")
+	}
+}
+
+// HarmonicBondSystem builds a carbon and an oxygen atom on the x axis joined by a harmonic
+// bond of force constant k (kJ/mol/Angstrom^2) and length r0 (Angstrom), stretched by
+// displacement. The energy is k/2 * displacement^2 and, with the reduced mass mu in
+// g/mol, the period of the vibration is 2*pi*sqrt(mu/k) = 2*pi*sqrt(1e4*mu/k) fs.
+func HarmonicBondSystem(k, r0, displacement float64) (*Protein, *Topology) {
+	protein := NewProteinBuilder().
+		AddResidue("CO", 1, "A").
+		AddAtom("C", "C", 0, 0, 0).
+		AddAtom("O", "O", r0+displacement, 0, 0).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	topology := NewTopology(protein)
+	// GROMACS units: nm and kJ/mol/nm^2
+	topology.AddBond(atoms[0], atoms[1], r0/10, k*100)
+	return protein, topology
+}
+
+// reducedMass return m1*m2/(m1+m2) of the two atoms
+func reducedMass(atom1, atom2 *Atom) float64 {
+	return atom1.mass * atom2.mass / (atom1.mass + atom2.mass)
+}
+
+// velocityVerletStep advances the atoms of the topology by one step of dt (fs)
+// with the forces of its terms, the accelerations must be up to date
+func velocityVerletStep(topology *Topology, dt float64) {
+	atoms := topology.atoms()
+	for _, atom := range atoms {
+		atom.position = UpdatePosition(atom, atom.accelerated, atom.velocity, dt)
+	}
+	_, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	for _, atom := range atoms {
+		oldAcceleration := atom.accelerated
+		atom.accelerated = UpdateAcceleration(forceMap[atom.index], atom)
+		atom.velocity = UpdateVelocity(atom, oldAcceleration, dt)
+	}
+}
+
+func TestHarmonicBondForce(t *testing.T) {
+	const k, r0, displacement = 300.0, 1.2, 0.15
+	protein, topology := HarmonicBondSystem(k, r0, displacement)
+	atoms := protein.Residue[0].Atoms
+
+	energy, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	if want := k / 2 * displacement * displacement; math.Abs(energy-want) > 1e-9 {
+		t.Errorf("energy = %v, want k/2 d^2 = %v", energy, want)
+	}
+	// the stretched bond pulls the oxygen back towards the carbon with k*d
+	pull := forceMap[atoms[1].index]
+	if want := (TriTuple{x: -k * displacement * forceUnit}); Distance(*pull, want) > 1e-12 {
+		t.Errorf("force on the oxygen = %v, want %v", *pull, want)
+	}
+	AssertNetForceZero(t, 1e-15, *forceMap[atoms[0].index], *pull)
+}
+
+func TestHarmonicBondPeriod(t *testing.T) {
+	const k, r0, displacement, dt = 300.0, 1.2, 0.1, 0.05
+	protein, topology := HarmonicBondSystem(k, r0, displacement)
+	atoms := protein.Residue[0].Atoms
+	period := 2 * math.Pi * math.Sqrt(1e4*reducedMass(atoms[0], atoms[1])/k)
+
+	_, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	UpdateAccelerations(protein, forceMap)
+
+	// started at rest at its turning point, the bond is back at its largest stretch
+	// every period: time the first two maxima by the sign change of the bond velocity
+	var maxima []float64
+	previous := 0.0
+	for step := 1; len(maxima) < 2 && float64(step)*dt < 3*period; step++ {
+		velocityVerletStep(topology, dt)
+		stretch := atoms[1].velocity.x - atoms[0].velocity.x
+		if previous > 0 && stretch <= 0 {
+			maxima = append(maxima, float64(step)*dt)
+		}
+		previous = stretch
+	}
+	if len(maxima) < 2 {
+		t.Fatalf("found %d maxima of the bond length in 3 periods", len(maxima))
+	}
+	if got := maxima[1] - maxima[0]; math.Abs(got-period) > 2*dt {
+		t.Errorf("period = %v fs, want 2 pi sqrt(mu/k) = %v fs", got, period)
+	}
+}
+
+func TestTotalMomentumConserved(t *testing.T) {
+	// a stretched harmonic bond, spinning and drifting
+	protein, topology := HarmonicBondSystem(300, 1.2, 0.2)
+	atom1, atom2 := protein.Residue[0].Atoms[0], protein.Residue[0].Atoms[1]
+	atom2.position = TriTuple{1.4, 0.1, 0.2}
+	atom1.velocity = TriTuple{0.001, 0.002, 0}
+	atom2.velocity = TriTuple{-0.003, -0.001, 0.002}
+	const dt = 0.5
+
+	momentum := TotalMomentum(protein)
+	angularMomentum := TotalAngularMomentum(protein)
+	wantMomentum := TriTuple{
+		x: atom1.mass*atom1.velocity.x + atom2.mass*atom2.velocity.x,
+		y: atom1.mass*atom1.velocity.y + atom2.mass*atom2.velocity.y,
+		z: atom1.mass*atom1.velocity.z + atom2.mass*atom2.velocity.z,
+	}
+	if Distance(momentum, wantMomentum) > 1e-12 {
+		t.Fatalf("TotalMomentum() = %v, want %v", momentum, wantMomentum)
+	}
+
+	_, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	UpdateAccelerations(protein, forceMap)
+	for step := 0; step < 2000; step++ {
+		velocityVerletStep(topology, dt)
+	}
+
+	if d := Distance(TotalMomentum(protein), momentum); d > 1e-9 {
+		t.Errorf("TotalMomentum() drifted by %v", d)
+	}
+	if d := Distance(TotalAngularMomentum(protein), angularMomentum); d > 1e-6*magnitude(angularMomentum) {
+		t.Errorf("TotalAngularMomentum() = %v, want %v", TotalAngularMomentum(protein), angularMomentum)
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	tests := []struct {
+		x        float64
+		decimals int
+		want     float64
+	}{
+		{1.23456, 2, 1.23},
+		{1.23556, 2, 1.24},
+		{-1.23456, 2, -1.23},
+		{-1.23556, 2, -1.24},
+		// ties go away from zero
+		{0.5, 0, 1},
+		{-0.5, 0, -1},
+		{2.5, 0, 3},
+		{-2.5, 0, -3},
+		{0.125, 2, 0.13},
+		{-0.125, 2, -0.13},
+		{1234.5, -2, 1200},
+		{45.0000001, 0, 45},
+	}
+
+	for _, test := range tests {
+		if got := RoundTo(test.x, test.decimals); got != test.want {
+			t.Errorf("RoundTo(%v, %d) = %v, want %v", test.x, test.decimals, got, test.want)
+		}
+	}
+
+	vector := TriTuple{x: 0.123456789, y: -0.987654321, z: 0.00005}
+	want := TriTuple{x: 0.1235, y: -0.9877, z: 0.0001}
+	if got := vector.RoundTo(4); got != want {
+		t.Errorf("TriTuple.RoundTo(4) = %v, want %v", got, want)
+	}
+}
+
+func TestEvaluateTrajectoryEnergies(t *testing.T) {
+	// a bonded pair and three argon atoms, atom 5 is far enough in index from atom 1 to interact
+	var residue Residue
+	names := []string{"CA", "CB", "AR", "AR", "AR"}
+	for i, name := range names {
+		residue.Atoms = append(residue.Atoms, &Atom{index: i + 1, element: name, position: TriTuple{float64(i) * 10, 0, 0}})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+	topology := NewTopology(&protein)
+	topology.AddBond(residue.Atoms[0], residue.Atoms[1], 0.153, 334720)
+
+	nonbonded := parameterDatabase{ljTypes: map[string]LJParam{
+		"CA": {Sigma: 3.4, Epsilon: 0.36},
+		"CB": {Sigma: 3.4, Epsilon: 0.36},
+		"AR": {Sigma: 3.4, Epsilon: 0.99},
+	}}
+
+	var buffer bytes.Buffer
+	writer := NewTrajectoryWriter(&buffer)
+	for step := 0; step < 4; step++ {
+		frame := CopyProtein(&protein)
+		atoms := frame.Residue[0].Atoms
+		atoms[1].position = TriTuple{1.53, 0, 0}
+		if step == 2 {
+			// atom 5 lands on top of atom 1
+			atoms[4].position = TriTuple{0.8, 0.3, 0}
+		}
+		if err := writer.WriteFrame(frame, step*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	energies, err := EvaluateTrajectoryEnergies(NewTrajectoryReader(&buffer), topology, parameterDatabase{}, nonbonded)
+	if err != nil {
+		t.Fatalf("EvaluateTrajectoryEnergies() error: %v", err)
+	}
+	if len(energies) != 4 {
+		t.Fatalf("EvaluateTrajectoryEnergies() returned %d energies, want 4", len(energies))
+	}
+	for i, energy := range energies {
+		if i != 2 && math.Abs(energy) > 1e-6 {
+			t.Errorf("energy of frame %d = %v, want 0", i, energy)
+		}
+	}
+	if energies[2] < 1e3 {
+		t.Errorf("energy of the clashing frame = %v, want a spike", energies[2])
+	}
+	if residue.Atoms[4].position != (TriTuple{40, 0, 0}) {
+		t.Errorf("topology positions were not restored: %v", residue.Atoms[4].position)
+	}
+
+	// a frame with the wrong number of atoms is an error
+	buffer.Reset()
+	writer.WriteFrame(&Protein{Residue: []*Residue{{Atoms: residue.Atoms[:3]}}}, 0)
+	if _, err := EvaluateTrajectoryEnergies(NewTrajectoryReader(&buffer), topology, parameterDatabase{}, nonbonded); err == nil {
+		t.Error("EvaluateTrajectoryEnergies() with a short frame returned no error")
+	}
+}
+
+func TestTrajectoryRoundTrip(t *testing.T) {
+	protein := Protein{Residue: []*Residue{{Atoms: []*Atom{
+		{index: 1, element: "N", position: TriTuple{1.5, -2.25, 3.125}},
+		{index: 2, element: "CA", position: TriTuple{-0.000001, 10, 7.75}},
+	}}}}
+
+	var buffer bytes.Buffer
+	writer := NewTrajectoryWriter(&buffer)
+	writer.WriteFrame(&protein, 0)
+	writer.WriteFrame(&protein, 25)
+
+	reader := NewTrajectoryReader(&buffer)
+	for _, step := range []int{0, 25} {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame() error: %v", err)
+		}
+		if frame.Step != step {
+			t.Errorf("frame step = %d, want %d", frame.Step, step)
+		}
+		if !reflect.DeepEqual(frame.Names, []string{"N", "CA"}) {
+			t.Errorf("frame names = %v, want [N CA]", frame.Names)
+		}
+		for i, atom := range protein.Residue[0].Atoms {
+			if Distance(frame.Positions[i], atom.position) > 1e-6 {
+				t.Errorf("frame position %d = %v, want %v", i, frame.Positions[i], atom.position)
+			}
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame() after the last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestProteinBuilder(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).
+		AddAtom("CA", "C", 1.458, 0, 0).
+		AddAtom("C", "C", 2.009, 1.42, 0).
+		AddAtom("O", "O", 1.251, 2.390, 0).
+		AddAtom("CB", "C", 1.988, -0.773, -1.199).
+		AddResidue("GLY", 2, "A").
+		AddAtom("N", "N", 3.332, 1.536, 0).
+		AddAtom("CA", "C", 3.970, 2.845, 0).
+		AddAtom("C", "C", 5.486, 2.691, 0).
+		AddAtom("O", "O", 6.009, 1.581, 0).
+		Build()
+	if protein == nil {
+		t.Fatal("Build() returned nil for a valid dipeptide")
+	}
+
+	if len(protein.Residue) != 2 || protein.Residue[0].Name != "ALA" || protein.Residue[1].Name != "GLY" {
+		t.Fatalf("Build() residues = %v, want ALA and GLY", protein.Residue)
+	}
+	if len(protein.Residue[0].Atoms) != 5 || len(protein.Residue[1].Atoms) != 4 {
+		t.Errorf("Build() atom counts = %d, %d, want 5, 4", len(protein.Residue[0].Atoms), len(protein.Residue[1].Atoms))
+	}
+	if protein.Residue[1].ID != 2 || protein.Residue[1].ChainID != "A" {
+		t.Errorf("second residue = %d %q, want 2 \"A\"", protein.Residue[1].ID, protein.Residue[1].ChainID)
+	}
+
+	wantMasses := map[string]float64{"N": 14.0067, "CA": 12.0107, "C": 12.0107, "O": 15.9994, "CB": 12.0107}
+	index := 1
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if atom.index != index {
+				t.Errorf("atom %s index = %d, want %d", atom.element, atom.index, index)
+			}
+			if atom.mass != wantMasses[atom.element] {
+				t.Errorf("atom %s mass = %v, want %v", atom.element, atom.mass, wantMasses[atom.element])
+			}
+			index++
+		}
+	}
+
+	// residue IDs are unique per chain only
+	builder := NewProteinBuilder().AddResidue("ALA", 1, "A").AddResidue("ALA", 1, "B")
+	if builder.Err() != nil {
+		t.Errorf("same ID in two chains: Err() = %v", builder.Err())
+	}
+	builder.AddResidue("GLY", 1, "A").AddAtom("N", "N", 0, 0, 0)
+	if builder.Err() == nil || builder.Build() != nil {
+		t.Error("duplicate residue ID in a chain was accepted")
+	}
+	if NewProteinBuilder().AddAtom("N", "N", 0, 0, 0).Build() != nil {
+		t.Error("atom without a residue was accepted")
+	}
+}
+
+func TestDeduplicateAtoms(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).
+		AddAtom("CA", "C", 1.458, 0, 0).
+		AddAtom("C", "C", 2.009, 1.42, 0).
+		// the residue split went wrong and C was read a second time in a residue of its own
+		AddResidue("ALA", 2, "A").
+		AddAtom("C", "C", 2.0091, 1.4201, 0).
+		AddResidue("GLY", 3, "A").
+		AddAtom("N", "N", 3.332, 1.536, 0).
+		// a different atom at the same place is not a duplicate
+		AddAtom("CA", "C", 3.332, 1.536, 0).
+		Build()
+
+	if removed := DeduplicateAtoms(protein, 0.01); removed != 1 {
+		t.Fatalf("DeduplicateAtoms() = %d, want 1", removed)
+	}
+
+	count := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			count++
+			if atom.index != count {
+				t.Errorf("atom %s index = %d, want %d", atom.element, atom.index, count)
+			}
+		}
+	}
+	if count != 5 {
+		t.Errorf("%d atoms left, want 5", count)
+	}
+	if len(protein.Residue) != 2 || protein.Residue[0].Atoms[2].position != (TriTuple{2.009, 1.42, 0}) {
+		t.Errorf("DeduplicateAtoms() did not keep the first copy and drop the empty residue: %v", protein.Residue)
+	}
+
+	if removed := DeduplicateAtoms(protein, 0.01); removed != 0 {
+		t.Errorf("second DeduplicateAtoms() = %d, want 0", removed)
+	}
+}
+
+func TestBuildTopologyBonds(t *testing.T) {
+	protein, err := readProteinFromFile("../data/calmodulin_noCA.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+
+	// the bonds found through the spatial hash are those of a check of every pair
+	want := make(map[[2]*Atom]bool)
+	atoms := proteinAtoms(&protein)
+	for i := range atoms {
+		for j := i + 1; j < len(atoms); j++ {
+			if BondedByDistance(atoms[i], atoms[j]) {
+				want[[2]*Atom{atoms[i], atoms[j]}] = true
+			}
+		}
+	}
+	got := make(map[[2]*Atom]bool)
+	BuildTopology(&protein).ForEachBond(func(atom1, atom2 *Atom, parameter []float64) {
+		got[[2]*Atom{atom1, atom2}] = true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildTopology() found %d bonds, a check of every pair %d", len(got), len(want))
+	}
+}
+
+func TestReadConect(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/ReadConect/input/ligand.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error: %v", err)
+	}
+	if len(protein.Residue) != 1 || len(protein.Residue[0].Atoms) != 5 {
+		t.Fatalf("readProteinFromFile() read %v, want one residue of 5 HETATM records", protein.Residue)
+	}
+	if len(protein.ExplicitBonds) != 5 {
+		t.Fatalf("ExplicitBonds = %d bonds, want 5", len(protein.ExplicitBonds))
+	}
+
+	names := func(atom1, atom2 *Atom) string {
+		if atom1.element > atom2.element {
+			atom1, atom2 = atom2, atom1
+		}
+		return atom1.element + "-" + atom2.element
+	}
+
+	// C2-C4 is 2.6 Angstrom long, only the CONECT record makes it a bond
+	topology := BuildTopology(&protein)
+	var got []string
+	for _, bond := range topology.bonds {
+		got = append(got, names(bond.atom1, bond.atom2))
+	}
+	sort.Strings(got)
+	want := []string{"C1-C2", "C1-C3", "C1-O1", "C2-C3", "C2-C4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildTopology() bonds = %v, want %v", got, want)
+	}
+
+	// the bonds follow the atoms through a copy
+	copied := CopyProtein(&protein)
+	if copied.ExplicitBonds[0][0] != copied.Residue[0].Atoms[0] {
+		t.Error("CopyProtein() explicit bonds point to the original atoms")
+	}
+	filtered := FilterAtoms(&protein, func(atom *Atom) bool { return atom.element != "O1" })
+	if len(filtered.ExplicitBonds) != 4 {
+		t.Errorf("FilterAtoms() kept %d explicit bonds, want 4", len(filtered.ExplicitBonds))
+	}
+}
+
+func TestForEachPairWithin(t *testing.T) {
+	rng := NewRNG(11)
+	box := Box{X: 20, Y: 16, Z: 9}
+	var residue Residue
+	for i := 0; i < 300; i++ {
+		residue.Atoms = append(residue.Atoms, &Atom{
+			index: i + 1,
+			// some atoms lie outside the primary cell
+			position: TriTuple{rng.Float64()*30 - 5, rng.Float64() * box.Y, rng.Float64()*box.Z*2 - box.Z},
+		})
+	}
+	protein := Protein{Residue: []*Residue{&residue}}
+	atoms := residue.Atoms
+
+	for _, cutoff := range []float64{2.0, 4.0, 4.5} {
+		for _, periodic := range []bool{false, true} {
+			distance := func(p1, p2 TriTuple) float64 { return Distance(p1, p2) }
+			var pbc *Box
+			if periodic {
+				pbc = &box
+				distance = func(p1, p2 TriTuple) float64 { return PeriodicDistance(p1, p2, box) }
+			}
+
+			want := make(map[[2]int]float64)
+			for i := 0; i < len(atoms)-1; i++ {
+				for j := i + 1; j < len(atoms); j++ {
+					if r := distance(atoms[i].position, atoms[j].position); r < cutoff {
+						want[[2]int{atoms[i].index, atoms[j].index}] = r
+					}
+				}
+			}
+
+			got := make(map[[2]int]float64)
+			ForEachPairWithin(&protein, cutoff, pbc, func(a, b *Atom, r float64) {
+				key := [2]int{a.index, b.index}
+				if _, seen := got[key]; seen {
+					t.Errorf("cutoff %v periodic %v: pair %v visited twice", cutoff, periodic, key)
+				}
+				got[key] = r
+			})
+
+			if len(got) != len(want) {
+				t.Errorf("cutoff %v periodic %v: %d pairs visited, want %d", cutoff, periodic, len(got), len(want))
+			}
+			for key, r := range want {
+				if math.Abs(got[key]-r) > 1e-12 {
+					t.Errorf("cutoff %v periodic %v: pair %v at %v, want %v", cutoff, periodic, key, got[key], r)
+				}
+			}
+		}
+	}
+}
+
+func TestTotalCharge(t *testing.T) {
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	defer SetLogOutput(os.Stderr)
+
+	// the charges of a lysine side chain end: NZ and its three hydrogens carry +1
+	chargeData := map[string]map[string]float64{
+		"LYS": {"CE": 0.127, "NZ": 0.129, "HZ1": 0.248, "HZ2": 0.248, "HZ3": 0.248},
+	}
+	protein := NewProteinBuilder().
+		AddResidue("LYS", 1, "A").
+		AddAtom("CE", "C", 0, 0, 0).
+		AddAtom("NZ", "N", 1.5, 0, 0).
+		AddAtom("HZ1", "H", 2.0, 0.9, 0).
+		AddAtom("HZ2", "H", 2.0, -0.5, 0.8).
+		AddAtom("HZ3", "H", 2.0, -0.5, -0.8).
+		Build()
+	protein.AssignChargesToProtein(chargeData)
+
+	if total := TotalCharge(protein); math.Abs(total-1.0) > 1e-9 {
+		t.Errorf("TotalCharge() = %v, want 1", total)
+	}
+	if !CheckNetCharge(protein, 0.01) || buffer.Len() != 0 {
+		t.Errorf("CheckNetCharge() warned on an integral charge: %q", buffer.String())
+	}
+
+	// HZ3 is misnamed, AssignChargesToProtein silently gives it no charge
+	protein.Residue[0].Atoms[4].element = "HZ4"
+	protein.AssignChargesToProtein(chargeData)
+	if total := TotalCharge(protein); math.Abs(total-0.752) > 1e-9 {
+		t.Errorf("TotalCharge() = %v, want 0.752", total)
+	}
+	if CheckNetCharge(protein, 0.01) {
+		t.Error("CheckNetCharge() accepted a net charge of 0.752")
+	}
+	if !strings.Contains(buffer.String(), "net charge 0.7520") {
+		t.Errorf("warning = %q, want it to report the net charge", buffer.String())
+	}
+}
+
+func TestForceReport(t *testing.T) {
+	forceMap := make(map[int]*TriTuple)
+	for i := 1; i <= 50; i++ {
+		forceMap[i] = &TriTuple{0.01 * float64(i%7), -0.02, 0.005}
+	}
+	forceMap[17] = &TriTuple{300, 400, 0}
+	forceMap[42] = &TriTuple{0, 0, -1000}
+	forceMap[8] = &TriTuple{0, -500, 0}
+	// same magnitude as atom 8, reported after it
+	forceMap[33] = &TriTuple{500, 0, 0}
+
+	report := ForceReport(forceMap, 4)
+	wantIndex := []int{42, 8, 17, 33}
+	wantMagnitude := []float64{1000, 500, 500, 500}
+	if len(report) != len(wantIndex) {
+		t.Fatalf("ForceReport() returned %d atoms, want %d", len(report), len(wantIndex))
+	}
+	for i, atomForce := range report {
+		if atomForce.Index != wantIndex[i] || math.Abs(atomForce.Magnitude-wantMagnitude[i]) > 1e-9 {
+			t.Errorf("ForceReport()[%d] = atom %d (%v), want atom %d (%v)", i, atomForce.Index, atomForce.Magnitude, wantIndex[i], wantMagnitude[i])
+		}
+		if atomForce.Force != *forceMap[atomForce.Index] {
+			t.Errorf("ForceReport()[%d] force = %v, want %v", i, atomForce.Force, *forceMap[atomForce.Index])
+		}
+	}
+
+	if all := ForceReport(forceMap, 100); len(all) != 50 {
+		t.Errorf("ForceReport(100) returned %d atoms, want all 50", len(all))
+	}
+}
+
+func TestReadCryst1(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/ReadCryst1/input/box.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error: %v", err)
+	}
+	if protein.Box == nil {
+		t.Fatal("readProteinFromFile() did not read the CRYST1 box")
+	}
+	if want := (Box{X: 42.5, Y: 38.25, Z: 51}); *protein.Box != want {
+		t.Errorf("Box = %v, want %v", *protein.Box, want)
+	}
+	if copied := CopyProtein(&protein); copied.Box == protein.Box || *copied.Box != *protein.Box {
+		t.Error("CopyProtein() did not copy the box")
+	}
+
+	if _, err := readProteinFromFile("Tests/ReadCryst1/input/triclinic.pdb"); err == nil {
+		t.Error("readProteinFromFile() accepted a non-orthorhombic cell")
+	}
+
+	// the unitary cell of non-crystallographic structures is no box
+	box, err := parseCryst1("CRYST1    1.000    1.000    1.000  90.00  90.00  90.00 P 1           1")
+	if err != nil || box != nil {
+		t.Errorf("parseCryst1() of the unitary cell = %v, %v, want no box", box, err)
+	}
+
+	// files without CRYST1 have no box
+	protein, err = readProteinFromFile("Tests/ReadConect/input/ligand.pdb")
+	if err != nil || protein.Box != nil {
+		t.Errorf("readProteinFromFile() without CRYST1 = %v, %v, want no box", protein.Box, err)
+	}
+}
+
+func TestEvaluateForcesFiniteDifference(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0.1, 1.3, -0.2).
+		AddAtom("C2", "C", 0.0, 0.0, 0.0).
+		AddAtom("C3", "C", 1.45, -0.2, 0.1).
+		AddAtom("O4", "O", 2.1, 0.4, 1.2).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1], 0.153, 334720)
+	topology.AddBond(atoms[1], atoms[2], 0.147, 300000)
+	topology.AddBond(atoms[2], atoms[3], 0.143, 250000)
+	topology.AddAngle(atoms[0], atoms[1], atoms[2], 111, 530)
+	topology.AddAngle(atoms[1], atoms[2], atoms[3], 109.5, 460)
+	topology.AddDihedral(atoms[0], atoms[1], atoms[2], atoms[3], 0, 5.9, 3)
+	topology.AddImproper(atoms[1], atoms[0], atoms[2], atoms[3], 35.26, 167)
+
+	energy, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	if want := CalculateTotalEnergy(topology, parameterDatabase{}, parameterDatabase{}); math.Abs(energy-want) > 1e-9 {
+		t.Errorf("EvaluateForces() energy = %v, want %v", energy, want)
+	}
+
+	const h = 1e-6
+	var forces []TriTuple
+	for _, atom := range atoms {
+		coordinates := []*float64{&atom.position.x, &atom.position.y, &atom.position.z}
+		var gradient [3]float64
+		for d, coordinate := range coordinates {
+			original := *coordinate
+			*coordinate = original + h
+			plus := CalculateTotalEnergy(topology, parameterDatabase{}, parameterDatabase{})
+			*coordinate = original - h
+			minus := CalculateTotalEnergy(topology, parameterDatabase{}, parameterDatabase{})
+			*coordinate = original
+			gradient[d] = (plus - minus) / (2 * h)
+		}
+
+		force := forceMap[atom.index]
+		got := [3]float64{force.x / forceUnit, force.y / forceUnit, force.z / forceUnit}
+		for d := range got {
+			if math.Abs(got[d]+gradient[d]) > 1e-4*math.Max(1, math.Abs(gradient[d])) {
+				t.Errorf("atom %d force[%d] = %v kJ/mol/A, want %v", atom.index, d, got[d], -gradient[d])
+			}
+		}
+		forces = append(forces, *force)
+	}
+	AssertNetForceZero(t, 1e-12, forces...)
+}
+
+func TestThermodynamics(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 1.0, 1.0, 1.0).
+		AddAtom("O2", "O", 2.6, 1.2, 0.9).
+		AddAtom("H3", "H", 3.1, 2.0, 1.1).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	atoms[0].velocity = TriTuple{0.002, -0.001, 0.0005}
+	atoms[1].velocity = TriTuple{-0.001, 0.0015, 0.0}
+	atoms[2].velocity = TriTuple{0.004, 0.003, -0.006}
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1], 0.143, 250000)
+	topology.AddBond(atoms[1], atoms[2], 0.096, 310000)
+	topology.AddAngle(atoms[0], atoms[1], atoms[2], 108.5, 460)
+	box := Box{X: 20, Y: 20, Z: 20}
+
+	state := Thermodynamics(protein, topology, parameterDatabase{}, parameterDatabase{}, &box)
+
+	potential, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+	if state.PotentialEnergy != potential || potential <= 0 {
+		t.Errorf("PotentialEnergy = %v, want %v", state.PotentialEnergy, potential)
+	}
+
+	// 0.5*m*v^2 by hand, 1 g/mol*(Angstrom/fs)^2 = 1e4 kJ/mol
+	kinetic := 0.0
+	for _, atom := range atoms {
+		kinetic += 0.5 * atom.mass * (atom.velocity.x*atom.velocity.x + atom.velocity.y*atom.velocity.y + atom.velocity.z*atom.velocity.z) * 1e4
+	}
+	if math.Abs(state.KineticEnergy-kinetic) > 1e-9 || math.Abs(KineticEnergy(protein)-kinetic) > 1e-9 {
+		t.Errorf("KineticEnergy = %v, want %v", state.KineticEnergy, kinetic)
+	}
+	if math.Abs(state.TotalEnergy-(potential+kinetic)) > 1e-9 {
+		t.Errorf("TotalEnergy = %v, want %v", state.TotalEnergy, potential+kinetic)
+	}
+	// three atoms with the momentum removed have six degrees of freedom
+	if temperature := 2 * kinetic / (6 * boltzmann); math.Abs(state.Temperature-temperature) > 1e-9 {
+		t.Errorf("Temperature = %v, want %v", state.Temperature, temperature)
+	}
+
+	pressure := ScalarPressure(CalculateVirialTensor(protein, forceMap), box.Volume()) * barPerPressureUnit
+	if math.Abs(state.Pressure-pressure) > 1e-9*math.Abs(pressure) {
+		t.Errorf("Pressure = %v, want %v", state.Pressure, pressure)
+	}
+	if Thermodynamics(protein, topology, parameterDatabase{}, parameterDatabase{}, nil).Pressure != 0 {
+		t.Error("Pressure without a box is not zero")
+	}
+}
+
+func TestDihedralNetForce(t *testing.T) {
+	inputFiles := ReadDirectory("Tests/CalculateProperDihedralsForce" + "/input")
+
+	for _, inputFile := range inputFiles {
+		pair, _ := readFileline("Tests/CalculateProperDihedralsForce/" + "input/" + inputFile.Name())
+		kd := convertStringToFloatSlice(pair[0])[0]
+		pn := convertStringToFloatSlice(pair[0])[1]
+		phase := convertStringToFloatSlice(pair[0])[2]
+
+		builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+		for i := 1; i <= 4; i++ {
+			position := convertStringToFloatSlice(pair[i])
+			builder.AddAtom(fmt.Sprintf("C%d", i), "C", position[0], position[1], position[2])
+		}
+		protein := builder.Build()
+		atoms := protein.Residue[0].Atoms
+
+		phi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3]) / 180 * math.Pi
+		force1, force2, force3, force4 := CalculateProperDihedralsForce(kd, phi, pn, phase, atoms[0], atoms[1], atoms[2], atoms[3])
+		AssertNetForceZero(t, 1e-15, force1, force2, force3, force4)
+
+		topology := NewTopology(protein)
+		topology.AddDihedral(atoms[0], atoms[1], atoms[2], atoms[3], phase, kd, pn)
+		topology.AddImproper(atoms[0], atoms[1], atoms[2], atoms[3], 0, kd)
+
+		_, forceMap := EvaluateForces(topology, parameterDatabase{}, parameterDatabase{})
+		var forces []TriTuple
+		for _, atom := range atoms {
+			forces = append(forces, *forceMap[atom.index])
+		}
+		AssertNetForceZero(t, 1e-12, forces...)
+	}
+}
+
+func TestTopologyIterators(t *testing.T) {
+	// ethanol: C-C, C-O, O-H and five C-H bonds
+	protein := NewProteinBuilder().
+		AddResidue("EOH", 1, "A").
+		AddAtom("C1", "C", -1.168, -0.400, 0.000).
+		AddAtom("C2", "C", 0.000, 0.558, 0.000).
+		AddAtom("O", "O", 1.190, -0.217, 0.000).
+		AddAtom("HO", "H", 1.946, 0.376, 0.000).
+		AddAtom("H11", "H", -2.113, 0.144, 0.000).
+		AddAtom("H12", "H", -1.127, -1.038, 0.884).
+		AddAtom("H13", "H", -1.127, -1.038, -0.884).
+		AddAtom("H21", "H", -0.041, 1.203, 0.886).
+		AddAtom("H22", "H", -0.041, 1.203, -0.886).
+		Build()
+	topology := BuildTopology(protein)
+
+	bonds := 0
+	topology.ForEachBond(func(atom1, atom2 *Atom, parameter []float64) {
+		bonds++
+		if Distance(atom1.position, atom2.position) > 1.6 {
+			t.Errorf("bond %s-%s is %v long", atom1.element, atom2.element, Distance(atom1.position, atom2.position))
+		}
+	})
+	if bonds != 8 {
+		t.Errorf("ForEachBond() visited %d bonds, want 8", bonds)
+	}
+
+	// 13 angles: 6 around each carbon and 1 around O
+	angles := 0
+	topology.ForEachAngle(func(atom1, atom2, atom3 *Atom, parameter []float64) { angles++ })
+	if angles != 13 {
+		t.Errorf("ForEachAngle() visited %d angles, want 13", angles)
+	}
+
+	// H1x-C1-C2-{O,H21,H22} and {C1,H21,H22}-C2-O-HO
+	dihedrals := 0
+	topology.ForEachDihedral(func(atom1, atom2, atom3, atom4 *Atom, parameter []float64) { dihedrals++ })
+	if dihedrals != 12 {
+		t.Errorf("ForEachDihedral() visited %d dihedrals, want 12", dihedrals)
+	}
+
+	topology.AddImproper(protein.Residue[0].Atoms[1], protein.Residue[0].Atoms[0], protein.Residue[0].Atoms[2], protein.Residue[0].Atoms[7], 35.26, 167)
+	topology.ForEachImproper(func(atom1, atom2, atom3, atom4 *Atom, parameter []float64) {
+		if atom1.element != "C2" || !reflect.DeepEqual(parameter, []float64{35.26, 167}) {
+			t.Errorf("ForEachImproper() gave %s with %v", atom1.element, parameter)
+		}
+	})
+}
+
+func TestUpdateAccelerations(t *testing.T) {
+	protein := Protein{Residue: []*Residue{{Atoms: []*Atom{
+		{index: 1, mass: 12.0107},
+		{index: 2, mass: 1.0079},
+		// a virtual site without mass
+		{index: 3, mass: 0},
+		// no force for this one
+		{index: 4, mass: 15.9994, accelerated: TriTuple{1, 1, 1}},
+	}}}}
+	forceMap := map[int]*TriTuple{
+		1: {x: 0.0120107, y: -0.0240214, z: 0},
+		2: {x: 0, y: 0.0010079, z: 0.0050395},
+		3: {x: 5, y: 5, z: 5},
+	}
+
+	UpdateAccelerations(&protein, forceMap)
+
+	want := []TriTuple{{0.001, -0.002, 0}, {0, 0.001, 0.005}, {0, 0, 0}, {0, 0, 0}}
+	for i, atom := range protein.Residue[0].Atoms {
+		if Distance(atom.accelerated, want[i]) > 1e-12 {
+			t.Errorf("atom %d acceleration = %v, want %v", atom.index, atom.accelerated, want[i])
+		}
+		if math.IsInf(atom.accelerated.x, 0) || math.IsNaN(atom.accelerated.x) {
+			t.Errorf("atom %d acceleration is not finite: %v", atom.index, atom.accelerated)
+		}
+	}
+}
+
+func TestPeriodicVerletList(t *testing.T) {
+	// the default cutoff of 3.5 needs a box of at least 7 on every side
+	if _, err := NewPeriodicVerletList(Box{X: 20, Y: 6.5, Z: 20}); err == nil {
+		t.Error("NewPeriodicVerletList() accepted a box smaller than twice the cutoff")
+	}
+
+	verletList, err := NewPeriodicVerletList(Box{X: 10, Y: 10, Z: 10})
+	if err != nil {
+		t.Fatalf("NewPeriodicVerletList() error: %v", err)
+	}
+	verletList.Buffer = 1.6
+	if verletList.Validate() == nil {
+		t.Error("Validate() accepted a cutoff plus buffer larger than half the box")
+	}
+	if verletList.BuildVerlet(&Protein{}) == nil {
+		t.Error("BuildVerlet() accepted a cutoff plus buffer larger than half the box")
+	}
+	verletList.Buffer = 0.5
+	if err := verletList.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+
+	// atoms 1 and 5 are 1 apart through the boundary
+	protein := Protein{Residue: []*Residue{{Atoms: []*Atom{
+		{index: 1, position: TriTuple{0.5, 5, 5}},
+		{index: 2, position: TriTuple{3, 1, 1}},
+		{index: 3, position: TriTuple{5, 1, 9}},
+		{index: 4, position: TriTuple{3, 9, 1}},
+		{index: 5, position: TriTuple{9.5, 5, 5}},
+	}}}}
+	if err := verletList.BuildVerlet(&protein); err != nil {
+		t.Fatalf("BuildVerlet() error: %v", err)
+	}
+	neighbors := verletList.Neighbors[protein.Residue[0].Atoms[0]]
+	if len(neighbors) != 1 || neighbors[0].index != 5 {
+		t.Errorf("periodic neighbours of atom 1 = %v, want atom 5", neighbors)
+	}
+}
+
+func TestCoarseGrain(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", -0.966, 0.493, 1.500).
+		AddAtom("CA", "C", 0.257, 0.418, 0.692).
+		AddAtom("C", "C", -0.094, 0.017, -0.716).
+		AddAtom("O", "O", -1.056, -0.682, -0.923).
+		AddAtom("CB", "C", 1.204, -0.620, 1.296).
+		AddAtom("HB1", "H", 2.134, -0.646, 0.728).
+		AddAtom("HB2", "H", 0.718, -1.595, 1.246).
+		AddAtom("HB3", "H", 1.405, -0.361, 2.335).
+		AddResidue("GLY", 2, "A").
+		AddAtom("N", "N", 0.737, 0.341, -1.684).
+		AddAtom("CA", "C", 0.499, 0.008, -3.078).
+		AddAtom("C", "C", 1.760, 0.300, -3.873).
+		AddAtom("O", "O", 2.787, 0.659, -3.298).
+		// the glycine hydrogens are named HA2 and HA3 in PDB files and belong to the backbone
+		AddAtom("HA2", "H", -0.351, 0.584, -3.438).
+		AddAtom("HA3", "H", 0.279, -1.052, -3.196).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	atoms[0].charge, atoms[3].charge, atoms[4].charge = -0.3, -0.5, 0.1
+
+	coarse := CoarseGrain(protein, BackboneSidechainScheme)
+
+	if len(coarse.Residue) != 2 || len(coarse.Residue[0].Atoms) != 2 || len(coarse.Residue[1].Atoms) != 1 {
+		t.Fatalf("CoarseGrain() residues = %v, want ALA with BB and SC and GLY with BB", coarse.Residue)
+	}
+
+	centroid := func(group []*Atom) (TriTuple, float64) {
+		var center TriTuple
+		mass := 0.0
+		for _, atom := range group {
+			center.x += atom.mass * atom.position.x
+			center.y += atom.mass * atom.position.y
+			center.z += atom.mass * atom.position.z
+			mass += atom.mass
+		}
+		return TriTuple{center.x / mass, center.y / mass, center.z / mass}, mass
+	}
+
+	backbone, sidechain := coarse.Residue[0].Atoms[0], coarse.Residue[0].Atoms[1]
+	wantBB, massBB := centroid(atoms[:4])
+	wantSC, massSC := centroid(atoms[4:])
+	if backbone.element != "BB" || Distance(backbone.position, wantBB) > 1e-12 || math.Abs(backbone.mass-massBB) > 1e-12 {
+		t.Errorf("BB bead = %s %v %v, want BB %v %v", backbone.element, backbone.position, backbone.mass, wantBB, massBB)
+	}
+	if sidechain.element != "SC" || Distance(sidechain.position, wantSC) > 1e-12 || math.Abs(sidechain.mass-massSC) > 1e-12 {
+		t.Errorf("SC bead = %s %v %v, want SC %v %v", sidechain.element, sidechain.position, sidechain.mass, wantSC, massSC)
+	}
+	if math.Abs(backbone.charge+0.8) > 1e-12 || math.Abs(sidechain.charge-0.1) > 1e-12 {
+		t.Errorf("bead charges = %v, %v, want -0.8, 0.1", backbone.charge, sidechain.charge)
+	}
+	if coarse.Residue[1].Atoms[0].index != 3 {
+		t.Errorf("GLY bead index = %d, want 3", coarse.Residue[1].Atoms[0].index)
+	}
+	if wantGly, massGly := centroid(protein.Residue[1].Atoms); Distance(coarse.Residue[1].Atoms[0].position, wantGly) > 1e-12 || math.Abs(coarse.Residue[1].Atoms[0].mass-massGly) > 1e-12 {
+		t.Errorf("GLY BB bead = %v %v, want %v %v", coarse.Residue[1].Atoms[0].position, coarse.Residue[1].Atoms[0].mass, wantGly, massGly)
+	}
+}
+
+func TestUnitSystems(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0, 0, 0).
+		AddAtom("C2", "C", 1.61, 0.2, 0).
+		AddAtom("O3", "O", 2.3, 1.5, 0.1).
+		Build()
+	atoms := protein.Residue[0].Atoms
+
+	// the same bond and angle in GROMACS (kJ/mol, nm, 1/2 k) and AMBER (kcal/mol, Angstrom, k) units
+	gromacs := NewTopology(protein)
+	gromacs.AddBond(atoms[0], atoms[1], 0.1526, 259408)
+	gromacs.AddAngle(atoms[0], atoms[1], atoms[2], 109.5, 418.4)
+	amber := NewTopology(protein)
+	amber.AddBond(atoms[0], atoms[1], 1.526, 259408/(2*4.184*100))
+	amber.AddAngle(atoms[0], atoms[1], atoms[2], 109.5, 418.4/(2*4.184))
+
+	energyGROMACS, forcesGROMACS := EvaluateForces(gromacs, parameterDatabase{}, parameterDatabase{})
+	energyAMBER, forcesAMBER := EvaluateForces(amber, parameterDatabase{}.WithUnits(AMBERUnits), parameterDatabase{})
+
+	if energyGROMACS <= 0 || math.Abs(energyGROMACS/energyAMBER-4.184) > 1e-9 {
+		t.Errorf("energies %v kJ/mol and %v kcal/mol, want a ratio of 4.184", energyGROMACS, energyAMBER)
+	}
+	if math.Abs(AMBERUnits.FromKJPerMol(energyGROMACS)-energyAMBER) > 1e-9 {
+		t.Errorf("FromKJPerMol(%v) = %v, want %v", energyGROMACS, AMBERUnits.FromKJPerMol(energyGROMACS), energyAMBER)
+	}
+	// the forces drive the same motion whatever the units of the parameters
+	for _, atom := range atoms {
+		if Distance(*forcesGROMACS[atom.index], *forcesAMBER[atom.index]) > 1e-12 {
+			t.Errorf("atom %d force %v with GROMACS units, %v with AMBER units", atom.index, *forcesGROMACS[atom.index], *forcesAMBER[atom.index])
+		}
+	}
+
+	if math.Abs(GROMACSUnits.Boltzmann()/AMBERUnits.Boltzmann()-4.184) > 1e-12 {
+		t.Errorf("Boltzmann() = %v and %v, want a ratio of 4.184", GROMACSUnits.Boltzmann(), AMBERUnits.Boltzmann())
+	}
+}
+
+func TestFractionNativeContacts(t *testing.T) {
+	// a compact chain of ten residues on a 3 Angstrom helix-like coil, then the same chain stretched out
+	build := func(compact bool) *Protein {
+		builder := NewProteinBuilder()
+		for i := 0; i < 10; i++ {
+			builder.AddResidue("GLY", i+1, "A")
+			position := TriTuple{x: 38 * float64(i)}
+			if compact {
+				angle := float64(i) * 100 / 180 * math.Pi
+				position = TriTuple{x: 2.3 * math.Cos(angle), y: 2.3 * math.Sin(angle), z: 1.5 * float64(i)}
+			}
+			builder.AddAtom("CA", "C", position.x, position.y, position.z)
+		}
+		if err := builder.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return builder.Build()
+	}
+	native := build(true)
+	expanded := build(false)
+
+	if q, err := FractionNativeContacts(native, native, 6.5); err != nil || q != 1 {
+		t.Errorf("Q of the native structure = %v, %v, want 1", q, err)
+	}
+	if q, err := FractionNativeContacts(expanded, native, 6.5); err != nil || q > 0.05 {
+		t.Errorf("Q of the expanded structure = %v, %v, want about 0", q, err)
+	}
+
+	native.Residue = native.Residue[:9]
+	if _, err := FractionNativeContacts(expanded, native, 6.5); err == nil {
+		t.Errorf("expected an error for mismatched residue counts")
+	}
+}
+
+func TestTypedParameters(t *testing.T) {
+	// representative rows of ffbonded.itp: [ bondtypes ], [ angletypes ] and [ dihedraltypes ]
+	bondRow := parameterPair{atomName: []string{"C", "O"}, Function: 1, parameter: []float64{0.1229, 476976.0}}
+	angleRow := parameterPair{atomName: []string{"CT", "C", "O"}, Function: 1, parameter: []float64{120.4, 669.44}}
+	dihedralRow := parameterPair{atomName: []string{"X", "C", "CT", "X"}, Function: 9, parameter: []float64{180.0, 4.6024, 2}}
+
+	bond, ok := bondRow.BondParam()
+	if !ok || bond != (BondParam{K: 476976.0, R0: 0.1229}) {
+		t.Fatalf("BondParam() = %+v, %v", bond, ok)
+	}
+	if got, want := bond.Energy(1.25, GROMACSUnits), CalculateBondStretchEnergy(476976.0, 1.25, 0.1229); math.Abs(got-want) > 1e-9 {
+		t.Errorf("bond energy = %v, want %v", got, want)
+	}
+
+	angle, ok := angleRow.AngleParam()
+	if !ok || angle.K != 669.44 || math.Abs(angle.Theta0-120.4/180*math.Pi) > 1e-12 {
+		t.Fatalf("AngleParam() = %+v, %v", angle, ok)
+	}
+	if got, want := angle.Energy(115.0/180*math.Pi, GROMACSUnits), CalculateAnglePotentialEnergy(669.44, 115.0, 120.4); math.Abs(got-want) > 1e-9 {
+		t.Errorf("angle energy = %v, want %v", got, want)
+	}
+
+	dihedral, ok := dihedralRow.DihedralParam()
+	if !ok || dihedral.Kd != 4.6024 || dihedral.Pn != 2 || math.Abs(dihedral.Phase-math.Pi) > 1e-12 {
+		t.Fatalf("DihedralParam() = %+v, %v", dihedral, ok)
+	}
+	phi := 0.7
+	if got, want := dihedral.Energy(phi), CalculateProperDihedralAngleEnergy(4.6024, phi, 2, 180.0); math.Abs(got-want) > 1e-12 {
+		t.Errorf("dihedral energy = %v, want %v", got, want)
+	}
+	const h = 1e-6
+	if got, want := dihedral.Derivative(phi), (dihedral.Energy(phi+h)-dihedral.Energy(phi-h))/(2*h); math.Abs(got-want) > 1e-6 {
+		t.Errorf("dihedral derivative = %v, want %v", got, want)
+	}
+
+	// rows that are too short are rejected instead of indexed out of range
+	if _, ok := (&parameterPair{parameter: []float64{180.0, 4.6}}).DihedralParam(); ok {
+		t.Errorf("expected a two column row to be rejected as a dihedral")
+	}
+}
+
+func TestPrepareAndEquilibrate(t *testing.T) {
+	SetLogOutput(io.Discard)
+	defer SetLogOutput(os.Stderr)
+
+	// a zigzag chain of five carbons with C-C bonds of 1.53 Angstrom
+	builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+	for i := 0; i < 5; i++ {
+		builder.AddAtom("C", "C", 1.26*float64(i), 0.87*float64(i%2), 0)
+	}
+	protein := builder.Build()
+
+	cfg := SimulationConfig{
+		BondParameter:      parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.1526, 259408}}}},
+		AngleParameter:     parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C", "C"}, Function: 1, parameter: []float64{109.5, 400}}}},
+		NonbondedParameter: parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{6e-3, 1e-5}}}},
+		Timestep:           0.5,
+		Steps:              400,
+		Temperature:        300,
+		TauT:               20,
+		Seed:               7,
+	}
+
+	equilibrated, err := PrepareAndEquilibrate(protein, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFinite(equilibrated); err != nil {
+		t.Fatal(err)
+	}
+	if temperature := Temperature(equilibrated); temperature <= 0 || temperature > 1000 {
+		t.Errorf("final temperature = %v K, want near 300 K", temperature)
+	}
+	// the bonds survive the run
+	topology := BuildTopology(equilibrated)
+	topology.ForEachBond(func(atom1, atom2 *Atom, parameter []float64) {
+		if r := Distance(atom1.position, atom2.position); r < 1.3 || r > 1.8 {
+			t.Errorf("bond %d-%d is %v Angstrom after equilibration", atom1.index, atom2.index, r)
+		}
+	})
+	if len(protein.Residue[0].Atoms) != len(equilibrated.Residue[0].Atoms) || protein.Residue[0].Atoms[1].position.y != 0.87 {
+		t.Errorf("PrepareAndEquilibrate modified its input")
+	}
+
+	// a clash the minimizer cannot remove stops the pipeline before the dynamics
+	clashing := NewProteinBuilder().AddResidue("MOL", 1, "A")
+	for i := 0; i < 5; i++ {
+		clashing.AddAtom("C", "C", 1.26*float64(i), 0.87*float64(i%2), 0)
+	}
+	clashing.AddAtom("C", "C", 0.3, 0.4, 0.2)
+	clashed := clashing.Build()
+	// the chain is bonded explicitly so that the extra carbon is not bonded by distance
+	chain := clashed.Residue[0].Atoms
+	for i := 0; i < 4; i++ {
+		clashed.ExplicitBonds = append(clashed.ExplicitBonds, [2]*Atom{chain[i], chain[i+1]})
+	}
+	cfg.Frozen = map[int]bool{1: true, 6: true}
+	if _, err := PrepareAndEquilibrate(clashed, cfg); err == nil {
+		t.Errorf("expected an error for a clash left after minimization")
+	}
+
+	// a shipped structure with the force field of main has no clashes once its bonds are excluded
+	alanine, err := readProteinFromFile("../data/test.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	fieldCfg := SimulationConfig{Timestep: 0.5, Steps: 10, Temperature: 300, TauT: 20, Seed: 7}
+	if fieldCfg.ResidueBonds, err = ReadAminoAcidsPara("../data/aminoacids_revised.rtp"); err != nil {
+		t.Fatal(err)
+	}
+	if fieldCfg.ResidueOther, err = ReadAminoAcidsPara("../data/aminoacids.rtp"); err != nil {
+		t.Fatal(err)
+	}
+	for file, db := range map[string]*parameterDatabase{
+		"ffbonded_bondtypes.itp":         &fieldCfg.BondParameter,
+		"ffbonded_angletypes.itp":        &fieldCfg.AngleParameter,
+		"ffbonded_dihedraltypes.itp":     &fieldCfg.DihedralParameter,
+		"ffnonbonded_nonbond_params.itp": &fieldCfg.NonbondedParameter,
+		"ffnonbonded_pairtypes.itp":      &fieldCfg.PairtypesParameter,
+	} {
+		if *db, err = ReadParameterFile("../data/" + file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := PrepareAndEquilibrate(&alanine, fieldCfg); err != nil {
+		t.Errorf("PrepareAndEquilibrate() on test.pdb error = %v", err)
+	}
+}
+
+func TestRMSF(t *testing.T) {
+	// three fixed atoms and one oscillating along x with amplitude 2 Angstrom
+	var frames []*Protein
+	for i := 0; i < 40; i++ {
+		builder := NewProteinBuilder().AddResidue("ALA", 1, "A")
+		builder.AddAtom("N", "N", 0, 0, 0)
+		builder.AddAtom("CA", "C", 1.46, 0, 0)
+		builder.AddAtom("C", "C", 2, 1.4, 0)
+		builder.AddAtom("CB", "C", 2+2*math.Sin(2*math.Pi*float64(i)/40), -1, 0.5)
+		frames = append(frames, builder.Build())
+	}
+
+	rmsf := RMSF(frames)
+	if len(rmsf) != 4 {
+		t.Fatalf("RMSF has %d atoms, want 4", len(rmsf))
+	}
+	for index := 1; index <= 3; index++ {
+		if rmsf[index] > 1e-12 {
+			t.Errorf("RMSF of fixed atom %d = %v, want 0", index, rmsf[index])
+		}
+	}
+	// the RMS of 2*sin over whole periods is sqrt(2)
+	if math.Abs(rmsf[4]-math.Sqrt2) > 1e-9 {
+		t.Errorf("RMSF of the oscillating atom = %v, want %v", rmsf[4], math.Sqrt2)
+	}
+}
+
+func TestRelaxClashes(t *testing.T) {
+	// a chain of carbons 1.5 Angstrom apart, then an oxygen dropped 0.75 Angstrom from the first carbon
+	builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+	for i := 0; i < 8; i++ {
+		builder.AddAtom("C", "C", 1.5*float64(i), 0, 0)
+	}
+	builder.AddAtom("O", "O", -0.4, 0.6, 0.2)
+	protein := builder.Build()
+	// bond the chain explicitly, by distance the oxygen would be bonded to the first carbon
+	atoms := protein.Residue[0].Atoms
+	for i := 0; i < 7; i++ {
+		protein.ExplicitBonds = append(protein.ExplicitBonds, [2]*Atom{atoms[i], atoms[i+1]})
+	}
+	if clashes := FindClashes(protein, defaultClashOverlap); len(clashes) != 1 {
+		t.Fatalf("setup has %d clashes, want 1", len(clashes))
+	}
+	before := CopyProtein(protein)
+
+	if left := RelaxClashes(protein, 20); left != 0 {
+		t.Fatalf("RelaxClashes left %d clashes", left)
+	}
+	if clashes := FindClashes(protein, defaultClashOverlap); len(clashes) != 0 {
+		t.Errorf("%d clashes after RelaxClashes", len(clashes))
+	}
+
+	// the clashing atoms and the neighbors of the first carbon move, the rest of the chain stays put
+	for i, atom := range protein.Residue[0].Atoms {
+		moved := Distance(atom.position, before.Residue[0].Atoms[i].position)
+		if i >= 2 && i < 8 && moved > 1e-12 {
+			t.Errorf("distant atom %d moved by %v", atom.index, moved)
+		}
+		if moved > 1.5 {
+			t.Errorf("atom %d moved by %v", atom.index, moved)
+		}
+	}
+
+	// a real structure has no clashes, its bonds are not pushed apart
+	calmodulin, err := readProteinFromFile("../data/calmodulin_noCA.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	bonds := BuildTopology(&calmodulin)
+	lengths := make(map[[2]*Atom]float64)
+	bonds.ForEachBond(func(atom1, atom2 *Atom, parameter []float64) {
+		lengths[[2]*Atom{atom1, atom2}] = Distance(atom1.position, atom2.position)
+	})
+	if left := RelaxClashes(&calmodulin, 20); left != 0 {
+		t.Errorf("RelaxClashes on calmodulin left %d clashes", left)
+	}
+	for pair, length := range lengths {
+		if r := Distance(pair[0].position, pair[1].position); math.Abs(r-length) > 0.01 {
+			t.Errorf("bond %d-%d went from %v to %v Angstrom", pair[0].index, pair[1].index, length, r)
+		}
+	}
+}
+
+func TestEnergyGradient(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0.1, -0.2, 0.05).
+		AddAtom("C2", "C", 1.58, 0.1, 0).
+		AddAtom("C3", "C", 2.1, 1.52, 0.3).
+		AddAtom("O4", "O", 3.4, 1.7, 1.1).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1], 0.1526, 259408)
+	topology.AddBond(atoms[1], atoms[2], 0.1526, 259408)
+	topology.AddBond(atoms[2], atoms[3], 0.1229, 476976)
+	topology.AddAngle(atoms[0], atoms[1], atoms[2], 109.5, 418.4)
+	topology.AddAngle(atoms[1], atoms[2], atoms[3], 120.4, 669.44)
+	topology.AddDihedral(atoms[0], atoms[1], atoms[2], atoms[3], 0, 4.6, 3)
+	topology.AddImproper(atoms[0], atoms[1], atoms[2], atoms[3], 10, 43.9)
+
+	// the gradient is in the energy unit of the bonded parameters, kJ/mol or kcal/mol
+	positions := PositionsToSlice(protein)
+	for _, bonded := range []parameterDatabase{{}, parameterDatabase{}.WithUnits(AMBERUnits)} {
+		gradient := EnergyGradient(protein, topology, bonded, parameterDatabase{})
+		if len(gradient) != 12 || len(positions) != 12 {
+			t.Fatalf("gradient of %d and positions of %d values, want 12", len(gradient), len(positions))
+		}
+
+		const h = 1e-6
+		for i := range positions {
+			shifted := append([]float64(nil), positions...)
+			shifted[i] = positions[i] + h
+			if err := SetPositionsFromSlice(protein, shifted); err != nil {
+				t.Fatal(err)
+			}
+			plus := CalculateTotalEnergy(topology, bonded, parameterDatabase{})
+			shifted[i] = positions[i] - h
+			SetPositionsFromSlice(protein, shifted)
+			minus := CalculateTotalEnergy(topology, bonded, parameterDatabase{})
+
+			numeric := (plus - minus) / (2 * h)
+			if math.Abs(gradient[i]-numeric) > 1e-4*math.Max(1, math.Abs(numeric)) {
+				t.Errorf("%s gradient[%d] = %v, finite difference %v", bonded.unitSystem().Name, i, gradient[i], numeric)
+			}
+		}
+		SetPositionsFromSlice(protein, positions)
+	}
+
+	if err := SetPositionsFromSlice(protein, positions[:9]); err == nil {
+		t.Errorf("expected an error for a slice of the wrong length")
+	}
+}
+
+func TestMinimizeLBFGS(t *testing.T) {
+	// a zigzag chain of ten carbons with every coordinate shifted by up to 0.3 Angstrom
+	build := func() (*Protein, *Topology) {
+		rng := NewRNG(3)
+		builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+		for i := 0; i < 10; i++ {
+			builder.AddAtom("C", "C", 1.26*float64(i)+0.6*(rng.Float64()-0.5), 0.87*float64(i%2)+0.6*(rng.Float64()-0.5), 0.6*(rng.Float64()-0.5))
+		}
+		protein := builder.Build()
+		return protein, BuildTopology(protein)
+	}
+	bonded := parameterDatabase{atomPair: []*parameterPair{
+		{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.1526, 259408}},
+		{atomName: []string{"C", "C", "C"}, Function: 1, parameter: []float64{109.5, 400}},
+		{atomName: []string{"X", "C", "C", "X"}, Function: 9, parameter: []float64{0, 1.2, 3}},
+	}}
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{6e-3, 1e-5}}}}
+
+	protein, topology := build()
+	start := CalculateTotalEnergy(topology, bonded, nonbonded)
+	evaluations := minimizeLBFGS(protein, topology, bonded, nonbonded, 40, 8, nil)
+	lbfgsEnergy := CalculateTotalEnergy(topology, bonded, nonbonded)
+	if !(lbfgsEnergy < start) {
+		t.Fatalf("L-BFGS energy %v, started at %v", lbfgsEnergy, start)
+	}
+
+	// steepest descent with an adaptive step, one energy evaluation per trial step
+	protein, topology = build()
+	energy, forceMap := EvaluateForces(topology, bonded, nonbonded)
+	h := 0.01
+	for i := 1; i < evaluations; i++ {
+		positions := PositionsToSlice(protein)
+		SteepestDescentWithForces(protein, forceMap, h, nil)
+		newEnergy, newForceMap := EvaluateForces(topology, bonded, nonbonded)
+		if newEnergy < energy {
+			energy, forceMap = newEnergy, newForceMap
+			h *= 1.2
+		} else {
+			SetPositionsFromSlice(protein, positions)
+			h *= 0.5
+		}
+	}
+
+	if !(lbfgsEnergy < energy) {
+		t.Errorf("after %d evaluations L-BFGS reached %v, steepest descent %v", evaluations, lbfgsEnergy, energy)
+	}
+	if returned := MinimizeLBFGS(protein, topology, bonded, nonbonded, 40, 8, nil); returned != protein {
+		t.Errorf("MinimizeLBFGS did not return its protein")
+	}
+
+	// the frozen atoms stay where they are while the others relax
+	protein, topology = build()
+	atoms := protein.Residue[0].Atoms
+	frozen := map[int]bool{atoms[0].index: true, atoms[5].index: true}
+	start = CalculateTotalEnergy(topology, bonded, nonbonded)
+	first, middle := atoms[0].position, atoms[5].position
+	MinimizeLBFGS(protein, topology, bonded, nonbonded, 40, 8, frozen)
+	if atoms[0].position != first || atoms[5].position != middle {
+		t.Errorf("MinimizeLBFGS moved the frozen atoms to %v and %v", atoms[0].position, atoms[5].position)
+	}
+	if energy := CalculateTotalEnergy(topology, bonded, nonbonded); !(energy < start) {
+		t.Errorf("L-BFGS with frozen atoms reached %v, started at %v", energy, start)
+	}
+}
+
+func TestTrajectoryStride(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C", "C", 0, 0, 0).
+		AddAtom("C", "C", 1.6, 0, 0).
+		Build()
+	protein.Residue[0].Atoms[0].velocity = TriTuple{x: -0.001}
+
+	var buffer bytes.Buffer
+	writer := NewTrajectoryWriter(&buffer)
+	writer.Stride = 10
+	writer.Precision = 3
+	cfg := SimulationConfig{
+		BondParameter: parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.1526, 259408}}}},
+		Timestep:      0.5,
+		Steps:         100,
+		Trajectory:    writer,
+	}
+	if _, err := RunSimulation(protein, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewTrajectoryReader(strings.NewReader(buffer.String()))
+	var steps []int
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, frame.Step)
+	}
+	want := []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("frames written at steps %v, want %v", steps, want)
+	}
+
+	// three decimals per coordinate
+	lines := strings.Split(buffer.String(), "\n")
+	if fields := strings.Fields(lines[2]); len(fields) != 4 || len(fields[1])-strings.Index(fields[1], ".")-1 != 3 {
+		t.Errorf("atom line %q, want coordinates with 3 decimals", lines[2])
+	}
+}
+
+func TestNormalizeDihedral(t *testing.T) {
+	tests := []struct {
+		angle    float64
+		signed   float64
+		unsigned float64
+	}{
+		{0, 0, 0},
+		{60, 60, 60},
+		{-60, -60, 300},
+		{180, 180, 180},
+		{-180, 180, 180},
+		{270, -90, 270},
+		{-450, -90, 270},
+		{720, 0, 0},
+	}
+	for _, test := range tests {
+		if got := NormalizeDihedral(test.angle, Signed180); math.Abs(got-test.signed) > 1e-12 {
+			t.Errorf("NormalizeDihedral(%v, Signed180) = %v, want %v", test.angle, got, test.signed)
+		}
+		if got := NormalizeDihedral(test.angle, Unsigned360); math.Abs(got-test.unsigned) > 1e-12 {
+			t.Errorf("NormalizeDihedral(%v, Unsigned360) = %v, want %v", test.angle, got, test.unsigned)
+		}
+		// converting back gives the signed angle again
+		if got := NormalizeDihedral(NormalizeDihedral(test.angle, Unsigned360), Signed180); math.Abs(got-test.signed) > 1e-12 {
+			t.Errorf("round trip of %v = %v, want %v", test.angle, got, test.signed)
+		}
+	}
+
+	// the energy of a term does not depend on the convention its angle is given in
+	for _, signed := range []float64{-170, -95, -30, 0, 45, 120, 180} {
+		unsigned := NormalizeDihedral(signed, Unsigned360)
+		for _, pn := range []float64{1, 2, 3} {
+			for _, phase := range []float64{0, 180} {
+				e1 := CalculateProperDihedralAngleEnergy(4.6, signed/180*math.Pi, pn, phase)
+				e2 := CalculateProperDihedralAngleEnergy(4.6, unsigned/180*math.Pi, pn, phase)
+				if math.Abs(e1-e2) > 1e-12 {
+					t.Errorf("energy at %v = %v but %v at %v (pn %v, phase %v)", signed, e1, e2, unsigned, pn, phase)
+				}
+				// a term with phase 0 or 180 is symmetric, the sign of the angle does not matter
+				if e3 := CalculateProperDihedralAngleEnergy(4.6, -signed/180*math.Pi, pn, phase); math.Abs(e1-e3) > 1e-12 {
+					t.Errorf("energy at %v = %v but %v at %v (pn %v, phase %v)", signed, e1, e3, -signed, pn, phase)
+				}
+			}
+		}
+	}
+}
+
+// argonLattice builds n*n*n argon atoms on a cubic lattice with the given spacing
+func argonLattice(n int, spacing float64) *Protein {
+	builder := NewProteinBuilder().AddResidue("AR", 1, "A")
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				builder.AddAtom("AR", "AR", spacing*float64(i), spacing*float64(j), spacing*float64(k))
+			}
+		}
+	}
+	return builder.Build()
+}
+
+var argonNonbonded = parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"AR", "AR"}, Function: 1, parameter: []float64{6.2e-3, 9.7e-6}}}}
+
+func TestForceBuffer(t *testing.T) {
+	protein := argonLattice(4, 3.3)
+	topology := NewTopology(protein)
+	atoms := protein.Residue[0].Atoms
+	topology.AddBond(atoms[0], atoms[1], 0.35, 1000)
+	buffer := NewForceBuffer(protein)
+
+	for round := 0; round < 2; round++ {
+		freshEnergy, fresh := EvaluateForces(topology, parameterDatabase{}, argonNonbonded)
+		bufferedEnergy, buffered := EvaluateForces(topology, parameterDatabase{}, argonNonbonded, buffer)
+		if freshEnergy != bufferedEnergy || len(fresh) != len(buffered) {
+			t.Fatalf("round %d: energy %v with %d forces, buffered %v with %d", round, freshEnergy, len(fresh), bufferedEnergy, len(buffered))
+		}
+		for index, force := range fresh {
+			if *force != *buffered[index] {
+				t.Errorf("round %d: force on atom %d is %v, buffered %v", round, index, *force, *buffered[index])
+			}
+		}
+		// move an atom so that the second round starts from stale forces in the buffer
+		atoms[5].position.x += 0.2
+	}
+
+	freshAllocations := testing.AllocsPerRun(10, func() { EvaluateForces(topology, parameterDatabase{}, argonNonbonded) })
+	bufferedAllocations := testing.AllocsPerRun(10, func() { EvaluateForces(topology, parameterDatabase{}, argonNonbonded, buffer) })
+	if bufferedAllocations >= freshAllocations {
+		t.Errorf("%v allocations per call with a buffer, %v without", bufferedAllocations, freshAllocations)
+	}
+}
+
+func BenchmarkEvaluateForces(b *testing.B) {
+	topology := NewTopology(argonLattice(6, 3.3))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EvaluateForces(topology, parameterDatabase{}, argonNonbonded)
+	}
+}
+
+func BenchmarkEvaluateForcesBuffered(b *testing.B) {
+	protein := argonLattice(6, 3.3)
+	topology := NewTopology(protein)
+	buffer := NewForceBuffer(protein)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EvaluateForces(topology, parameterDatabase{}, argonNonbonded, buffer)
+	}
+}
+
+func TestCompareStructures(t *testing.T) {
+	before := argonLattice(3, 4)
+	after := CopyProtein(before)
+	atoms := after.Residue[0].Atoms
+	atoms[4].position.x += 0.5
+	atoms[10].position = addVectors(atoms[10].position, TriTuple{x: 0.6, y: -0.8})
+	atoms[20].position.z -= 0.7
+
+	report := CompareStructures(before, after)
+	want := []AtomDisplacement{
+		{Index: atoms[10].index, Displacement: TriTuple{x: 0.6, y: -0.8}, Magnitude: 1},
+		{Index: atoms[20].index, Displacement: TriTuple{z: -0.7}, Magnitude: 0.7},
+		{Index: atoms[4].index, Displacement: TriTuple{x: 0.5}, Magnitude: 0.5},
+	}
+	if len(report) != len(want) {
+		t.Fatalf("CompareStructures reported %d atoms, want %d: %+v", len(report), len(want), report)
+	}
+	for i := range want {
+		if report[i].Index != want[i].Index || Distance(report[i].Displacement, want[i].Displacement) > 1e-9 || math.Abs(report[i].Magnitude-want[i].Magnitude) > 1e-9 {
+			t.Errorf("report[%d] = %+v, want %+v", i, report[i], want[i])
+		}
+	}
+}
+
+func TestReadMolFile(t *testing.T) {
+	protein, bonds, err := ReadMolFile("Tests/ReadMolFile/input/benzene.mol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protein.Name != "benzene" || len(protein.Residue) != 1 || len(protein.Residue[0].Atoms) != 6 {
+		t.Fatalf("read %q with %d residues, want benzene with one residue of 6 atoms", protein.Name, len(protein.Residue))
+	}
+	for i, atom := range protein.Residue[0].Atoms {
+		if atom.index != i+1 || ElementFromAtomName(atom.element) != "C" || atom.mass != massTable["C"] {
+			t.Errorf("atom %d: index %d, name %s, mass %v", i, atom.index, atom.element, atom.mass)
+		}
+		if r := magnitude(atom.position); math.Abs(r-1.397) > 1e-3 {
+			t.Errorf("atom %s is %v Angstrom from the ring center, want 1.397", atom.element, r)
+		}
+	}
+
+	if len(bonds) != 6 || len(protein.ExplicitBonds) != 6 {
+		t.Fatalf("read %d bonds and %d explicit bonds, want 6", len(bonds), len(protein.ExplicitBonds))
+	}
+	for _, bond := range bonds {
+		if bond.Order != AromaticBond {
+			t.Errorf("bond %s-%s has order %d, want aromatic", bond.Atom1.element, bond.Atom2.element, bond.Order)
+		}
+		if r := Distance(bond.Atom1.position, bond.Atom2.position); math.Abs(r-1.397) > 1e-3 {
+			t.Errorf("bond %s-%s is %v Angstrom long", bond.Atom1.element, bond.Atom2.element, r)
+		}
+	}
+
+	if _, _, err := ReadMolFile("Tests/ReadMolFile/input/missing.mol"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	// two-letter elements keep their element and mass, coordinates are read by column
+	ions, _, err := ReadMolFile("Tests/ReadMolFile/input/ions.mol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name, element string
+		mass          float64
+	}{{"Na1", "NA", 22.990}, {"Ca2", "CA", 40.078}, {"Se3", "SE", 78.971}, {"Cl4", "CL", 35.453}}
+	for i, atom := range ions.Residue[0].Atoms {
+		if atom.element != want[i].name || atomElement(atom) != want[i].element || atom.mass != want[i].mass {
+			t.Errorf("atom %d = %s (%s, %v), want %s (%s, %v)", i+1, atom.element, atomElement(atom), atom.mass, want[i].name, want[i].element, want[i].mass)
+		}
+	}
+	if position := ions.Residue[0].Atoms[1].position; position != (TriTuple{x: -1000, y: -1000, z: 1.5}) {
+		t.Errorf("Ca2 at %v, want (-1000, -1000, 1.5)", position)
+	}
+}
+
+func TestDipoleMoment(t *testing.T) {
+	// +0.5e and -0.5e separated by 2 Angstrom along z
+	protein := NewProteinBuilder().
+		AddResidue("ION", 1, "A").
+		AddAtom("N", "N", 1, 1, 0.3).
+		AddAtom("O", "O", 1, 1, 2.3).
+		Build()
+	protein.Residue[0].Atoms[0].charge = 0.5
+	protein.Residue[0].Atoms[1].charge = -0.5
+
+	if dipole := DipoleMoment(protein); Distance(dipole, TriTuple{z: -1}) > 1e-12 {
+		t.Errorf("DipoleMoment = %v, want (0, 0, -1)", dipole)
+	}
+	if got := DipoleMagnitude(protein); math.Abs(got-1) > 1e-12 {
+		t.Errorf("DipoleMagnitude = %v, want q*d = 1", got)
+	}
+
+	// a neutral dipole does not depend on where the protein is
+	for _, atom := range protein.Residue[0].Atoms {
+		atom.position = addVectors(atom.position, TriTuple{x: 5, y: -3, z: 12})
+	}
+	if got := DipoleMagnitude(protein); math.Abs(got-1) > 1e-12 {
+		t.Errorf("DipoleMagnitude after a translation = %v, want 1", got)
+	}
+}
+
+func TestScoreRotamers(t *testing.T) {
+	serine := func() *Protein {
+		return NewProteinBuilder().
+			AddResidue("SER", 1, "A").
+			AddAtom("N", "N", -0.53, 1.36, 0).
+			AddAtom("CA", "C", 0, 0, 0).
+			AddAtom("C", "C", 1.52, 0, 0).
+			AddAtom("CB", "C", -0.53, -0.77, -1.21).
+			AddAtom("OG", "O", -0.2, -0.2, -2.45).
+			AddResidue("HOH", 2, "A").
+			AddAtom("OW", "O", 0, 0, 0).
+			Build()
+	}
+
+	// chi1 is set to the value of the rotamer and only the side chain moves
+	protein := serine()
+	residue := protein.Residue[0]
+	if err := ApplyRotamer(residue, Rotamer{Name: "m", Chi: []float64{-65}}); err != nil {
+		t.Fatal(err)
+	}
+	chi1 := CalculateSignedDihedralAngle(residue.Atoms[0], residue.Atoms[1], residue.Atoms[3], residue.Atoms[4])
+	if math.Abs(chi1+65) > 1e-9 {
+		t.Errorf("chi1 = %v after applying -65", chi1)
+	}
+	if cb := residue.Atoms[3].position; Distance(cb, TriTuple{x: -0.53, y: -0.77, z: -1.21}) > 1e-12 {
+		t.Errorf("CB moved to %v", cb)
+	}
+
+	// a water sits 1 Angstrom from where OG goes for chi1 = 60
+	protein = serine()
+	ApplyRotamer(protein.Residue[0], Rotamer{Chi: []float64{60}})
+	og := protein.Residue[0].Atoms[4].position
+	protein = serine()
+	protein.Residue[1].Atoms[0].position = addVectors(og, TriTuple{x: 1})
+
+	library := RotamerLibrary{"SER": {{Name: "p", Chi: []float64{60}}, {Name: "t", Chi: []float64{180}}}}
+	nonbonded := parameterDatabase{ljTypes: map[string]LJParam{"CB": {Sigma: 0.34, Epsilon: 0.36}, "OG": {Sigma: 0.31, Epsilon: 0.65}, "OW": {Sigma: 0.32, Epsilon: 0.64}}}
+	scores := ScoreRotamers(protein, 1, library, nonbonded)
+	if len(scores) != 2 {
+		t.Fatalf("ScoreRotamers returned %d scores, want 2", len(scores))
+	}
+	if scores[0].Rotamer.Name != "t" || scores[1].Rotamer.Name != "p" || !(scores[0].Energy < scores[1].Energy) {
+		t.Errorf("scores %+v, want the clashing rotamer p last", scores)
+	}
+	if og := protein.Residue[0].Atoms[4].position; og.x != -0.2 || og.y != -0.2 {
+		t.Errorf("ScoreRotamers moved OG of its input to %v", og)
+	}
+
+	// a rotamer without chi angles leaves a residue missing CB unchanged, it has no side chain to score
+	protein = serine()
+	protein.Residue[0].Atoms = protein.Residue[0].Atoms[:3]
+	if scores := ScoreRotamers(protein, 1, RotamerLibrary{"SER": {{Name: "none"}}}, nonbonded); len(scores) != 0 {
+		t.Errorf("ScoreRotamers() without CB = %+v, want no scores", scores)
+	}
+}
+
+func TestRunMonteCarlo(t *testing.T) {
+	// one atom in an isotropic harmonic well, E = 0.5*k*r^2 follows a Gamma(3/2, kT) distribution
+	protein := NewProteinBuilder().AddResidue("ION", 1, "A").AddAtom("O", "O", 0, 0, 0).Build()
+	const k = 10.0 // kJ/mol/Angstrom^2
+	energyFunc := func(p *Protein) float64 {
+		r := p.Residue[0].Atoms[0].position
+		return 0.5 * k * r.dot(r)
+	}
+
+	temperature := 300.0
+	result := RunMonteCarlo(protein, energyFunc, []MCMove{DisplaceAtomMove(0.6)}, 200000, temperature, NewRNG(11))
+	if result.Accepted+result.Rejected != 200000 || len(result.Energies) != 200000 {
+		t.Fatalf("%d accepted and %d rejected moves, %d energies", result.Accepted, result.Rejected, len(result.Energies))
+	}
+	if ratio := result.AcceptanceRatio(); ratio < 0.2 || ratio > 0.9 {
+		t.Errorf("acceptance ratio %v", ratio)
+	}
+
+	// skip the start, then compare the mean 3/2 kT and the variance 3/2 (kT)^2
+	samples := result.Energies[10000:]
+	mean, variance := 0.0, 0.0
+	for _, energy := range samples {
+		mean += energy
+	}
+	mean /= float64(len(samples))
+	for _, energy := range samples {
+		variance += (energy - mean) * (energy - mean)
+	}
+	variance /= float64(len(samples))
+
+	kT := boltzmann * temperature
+	if math.Abs(mean/(1.5*kT)-1) > 0.05 {
+		t.Errorf("mean energy %v, want %v", mean, 1.5*kT)
+	}
+	if math.Abs(variance/(1.5*kT*kT)-1) > 0.1 {
+		t.Errorf("energy variance %v, want %v", variance, 1.5*kT*kT)
+	}
+	if got := energyFunc(protein); got != result.Energies[len(result.Energies)-1] {
+		t.Errorf("protein left at energy %v, last sampled %v", got, result.Energies[len(result.Energies)-1])
+	}
+}
+
+func TestFindDisulfides(t *testing.T) {
+	// cysteines 2 and 7 are bridged, cysteine 12 is 4 Angstrom away
+	protein := NewProteinBuilder().
+		AddResidue("CYS", 2, "A").AddAtom("CB", "C", 0, 0, 0).AddAtom("SG", "S", 1.81, 0, 0).
+		AddResidue("ALA", 3, "A").AddAtom("CB", "C", 0, 5, 0).
+		AddResidue("CYS", 7, "A").AddAtom("CB", "C", 4.5, 1.7, 0).AddAtom("SG", "S", 3.84, 0, 0).
+		AddResidue("CYS", 12, "A").AddAtom("CB", "C", -4.2, -1.4, 0).AddAtom("SG", "S", -2.2, 0, 0).
+		Build()
+
+	disulfides := FindDisulfides(protein, 2.2)
+	if len(disulfides) != 1 {
+		t.Fatalf("found %d disulfides, want 1: %+v", len(disulfides), disulfides)
+	}
+	if disulfides[0].Residue1.ID != 2 || disulfides[0].Residue2.ID != 7 || math.Abs(disulfides[0].Distance-2.03) > 1e-9 {
+		t.Errorf("disulfide %d-%d at %v Angstrom, want 2-7 at 2.03", disulfides[0].Residue1.ID, disulfides[0].Residue2.ID, disulfides[0].Distance)
+	}
+
+	topology := NewTopology(protein)
+	topology.AddDisulfides(disulfides, 0.204, 209200)
+	topology.AddDisulfides(disulfides)
+	count := 0
+	topology.ForEachBond(func(atom1, atom2 *Atom, parameter []float64) {
+		count++
+		if atom1 != disulfides[0].SG1 || atom2 != disulfides[0].SG2 || !reflect.DeepEqual(parameter, []float64{0.204, 209200}) {
+			t.Errorf("bond %s-%s %v, want the SG-SG bond", atom1.element, atom2.element, parameter)
+		}
+	})
+	if count != 1 {
+		t.Errorf("topology has %d bonds, want the single SG-SG bond", count)
+	}
+}
+
+func TestMolecularVolume(t *testing.T) {
+	protein := NewProteinBuilder().AddResidue("MOL", 1, "A").AddAtom("C", "C", 0.3, -1.2, 4).Build()
+	radius := VdwRadius(protein.Residue[0].Atoms[0])
+	exact := 4.0 / 3.0 * math.Pi * radius * radius * radius
+
+	previous := math.Inf(1)
+	for _, spacing := range []float64{0.5, 0.2, 0.05} {
+		relative := math.Abs(MolecularVolume(protein, spacing)/exact - 1)
+		if relative > previous+0.01 {
+			t.Errorf("relative error %v at spacing %v, %v at the coarser spacing", relative, spacing, previous)
+		}
+		previous = relative
+	}
+	if previous > 0.01 {
+		t.Errorf("relative error %v at spacing 0.05, want below 1%%", previous)
+	}
+
+	// two overlapping atoms are counted once
+	protein = NewProteinBuilder().AddResidue("MOL", 1, "A").AddAtom("C", "C", 0, 0, 0).AddAtom("C", "C", 0, 0, 0).Build()
+	if got := MolecularVolume(protein, 0.05); math.Abs(got/exact-1) > 0.01 {
+		t.Errorf("volume of two coincident atoms %v, want %v", got, exact)
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	// chain A with a gap in its numbering, then chains B and C
+	builder := NewProteinBuilder()
+	for _, residue := range []struct {
+		id    int
+		chain string
+	}{{5, "A"}, {6, "A"}, {10, "A"}, {1, "B"}, {2, "B"}, {40, "C"}, {41, "C"}} {
+		builder.AddResidue("GLY", residue.id, residue.chain).AddAtom("CA", "C", 0, 0, float64(residue.id))
+	}
+	protein := builder.Build()
+
+	Renumber(protein, 1, map[string]string{"B": "H", "C": "L"})
+
+	var got []string
+	for _, residue := range protein.Residue {
+		got = append(got, fmt.Sprintf("%s%d", residue.ChainID, residue.ID))
+	}
+	want := []string{"A1", "A2", "A3", "H1", "H2", "L1", "L2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renumbered residues %v, want %v", got, want)
+	}
+
+	// chains mapped to the same label are numbered as one
+	Renumber(protein, 100, map[string]string{"H": "A"})
+	got = got[:0]
+	for _, residue := range protein.Residue {
+		got = append(got, fmt.Sprintf("%s%d", residue.ChainID, residue.ID))
+	}
+	want = []string{"A100", "A101", "A102", "A103", "A104", "L100", "L101"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renumbered residues %v, want %v", got, want)
+	}
+}
+
+func TestSpatialHash(t *testing.T) {
+	rng := NewRNG(5)
+	builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+	for i := 0; i < 200; i++ {
+		builder.AddAtom("C", "C", 20*rng.Float64(), 20*rng.Float64(), 20*rng.Float64())
+	}
+	protein := builder.Build()
+	atoms := protein.Residue[0].Atoms
+
+	bruteForce := func(center TriTuple, radius float64) []*Atom {
+		var result []*Atom
+		for _, atom := range atoms {
+			if Distance(center, atom.position) < radius {
+				result = append(result, atom)
+			}
+		}
+		return result
+	}
+
+	hash := NewSpatialHash(protein, 3)
+	for _, radius := range []float64{1.5, 3, 7.2} {
+		for i := 0; i < 20; i++ {
+			center := TriTuple{x: 20 * rng.Float64(), y: 20 * rng.Float64(), z: 20 * rng.Float64()}
+			if got, want := hash.Query(center, radius), bruteForce(center, radius); !reflect.DeepEqual(got, want) {
+				t.Errorf("Query(%v, %v) found %d atoms, brute force %d", center, radius, len(got), len(want))
+			}
+		}
+	}
+
+	pairs := 0
+	hash.Pairs(4, func(a, b *Atom, r float64) {
+		if a.index >= b.index || math.Abs(r-Distance(a.position, b.position)) > 1e-12 || r >= 4 {
+			t.Errorf("pair %d-%d at %v", a.index, b.index, r)
+		}
+		pairs++
+	})
+	want := 0
+	for i := range atoms {
+		want += len(bruteForce(atoms[i].position, 4)) - 1
+	}
+	if pairs != want/2 {
+		t.Errorf("Pairs visited %d pairs, brute force %d", pairs, want/2)
+	}
+
+	// a moved atom is found at its new place once the hash is rebuilt
+	target := TriTuple{x: 50, y: 50, z: 50}
+	atoms[17].position = target
+	if got := hash.Query(target, 1); len(got) != 0 {
+		t.Errorf("stale hash found %d atoms at the new position", len(got))
+	}
+	hash.Rebuild()
+	if got := hash.Query(target, 1); len(got) != 1 || got[0] != atoms[17] {
+		t.Errorf("rebuilt hash found %v at the new position, want atom %d", got, atoms[17].index)
+	}
+}
+
+func TestTerminalCharges(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/Termini/input/trialanine.pdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protein.Residue) != 4 {
+		t.Fatalf("read %d residues, want 3 alanines and a water", len(protein.Residue))
+	}
+	for i, want := range [][2]bool{{true, false}, {false, false}, {false, true}, {false, false}} {
+		residue := protein.Residue[i]
+		if residue.IsNTerminal != want[0] || residue.IsCTerminal != want[1] {
+			t.Errorf("residue %s %d: N-terminal %v, C-terminal %v, want %v", residue.Name, residue.ID, residue.IsNTerminal, residue.IsCTerminal, want)
+		}
+	}
+
+	chargeData := map[string]map[string]float64{
+		"ALA":  {"N": -0.4157, "CA": 0.0337, "C": 0.5973, "O": -0.5679},
+		"NALA": {"N": 0.1414, "CA": 0.0962},
+		"CALA": {"C": 0.7731, "O": -0.8055, "OXT": -0.8055},
+		"HOH":  {"O": -0.834},
+	}
+	protein.AssignChargesToProtein(chargeData)
+	charges := func(residue *Residue) map[string]float64 {
+		result := make(map[string]float64)
+		for _, atom := range residue.Atoms {
+			result[atom.element] = atom.charge
+		}
+		return result
+	}
+
+	want := []map[string]float64{
+		{"N": 0.1414, "CA": 0.0962, "C": 0.5973, "O": -0.5679},
+		{"N": -0.4157, "CA": 0.0337, "C": 0.5973, "O": -0.5679},
+		{"N": -0.4157, "CA": 0.0337, "C": 0.7731, "O": -0.8055, "OXT": -0.8055},
+		{"O": -0.834},
+	}
+	for i := range want {
+		if got := charges(protein.Residue[i]); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("residue %d charges %v, want %v", protein.Residue[i].ID, got, want[i])
+		}
+	}
+}
+
+func TestInteractionEnergy(t *testing.T) {
+	// P1 and P2 1 Angstrom apart, Q 3 Angstrom from P1 and 2*sqrt(2) from P2,
+	// R 3.2 Angstrom from P1 and 4.2 from P2, beyond the 3.5 Angstrom cutoff
+	protein := NewProteinBuilder().
+		AddResidue("LIG", 1, "A").
+		AddAtom("P", "C", 0, 0, 0).
+		AddAtom("P", "C", 0, 1, 0).
+		AddResidue("POC", 2, "A").
+		AddAtom("Q", "O", 0, 1, 2*math.Sqrt2).
+		AddAtom("R", "O", 0, -3.2, 0).
+		Build()
+	ligand, pocket := protein.Residue[0].Atoms, protein.Residue[1].Atoms
+	ligand[0].charge, ligand[1].charge, pocket[0].charge, pocket[1].charge = 0.4, -0.2, -0.5, 0.3
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{
+		{atomName: []string{"P", "Q"}, Function: 1, parameter: []float64{1e-3, 1e-6}},
+		// the pair inside the ligand must not count
+		{atomName: []string{"P", "P"}, Function: 1, parameter: []float64{1e3, 1e3}},
+	}}.WithUnits(angstromUnits)
+
+	lj, coulomb := InteractionEnergy(ligand, pocket, nonbonded)
+
+	r1, r2, r3 := 3.0, 2*math.Sqrt2, 3.2
+	wantLJ := math.Abs(1e-6/math.Pow(r1, 12)-1e-3/math.Pow(r1, 6)) + math.Abs(1e-6/math.Pow(r2, 12)-1e-3/math.Pow(r2, 6))
+	wantCoulomb := 0.4*0.5/(4*math.Pi*epsilon*r1) + 0.2*0.5/(4*math.Pi*epsilon*r2) + 0.4*0.3/(4*math.Pi*epsilon*r3)
+	if math.Abs(lj-wantLJ) > 1e-15 {
+		t.Errorf("Lennard-Jones energy %v, want %v", lj, wantLJ)
+	}
+	if math.Abs(coulomb-wantCoulomb) > 1e-15 {
+		t.Errorf("Coulomb energy %v, want %v", coulomb, wantCoulomb)
+	}
+
+	// with the ligand one charge group centered at y = 0.5, R is 3.7 Angstrom away and drops out
+	ligand[0].chargeGroup, ligand[1].chargeGroup = 1, 1
+	nonbonded.cutoffScheme = GroupCutoff
+	if _, coulomb := InteractionEnergy(ligand, pocket, nonbonded); math.Abs(coulomb-(wantCoulomb-0.4*0.3/(4*math.Pi*epsilon*r3))) > 1e-15 {
+		t.Errorf("Coulomb energy with charge groups %v, want %v", coulomb, wantCoulomb-0.4*0.3/(4*math.Pi*epsilon*r3))
+	}
+}
+
+func TestRamachandranAnglesMissingCA(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("GLY", 1, "A").
+		AddAtom("N", "N", -1.2, 2.1, 0.3).AddAtom("CA", "C", -1.0, 1.5, -0.4).AddAtom("C", "C", 0.0, 1.0, 0.0).
+		AddResidue("ALA", 2, "A").
+		AddAtom("N", "N", 0.0, 0.0, 0.0).AddAtom("CB", "C", 2.0, 1.0, 1.0).AddAtom("C", "C", 1.5, 0.5, -0.9).
+		AddResidue("GLY", 3, "A").
+		AddAtom("N", "N", 2.7, 0.9, -1.3).AddAtom("CA", "C", 3.1, 2.2, -1.9).AddAtom("C", "C", 4.5, 2.3, -2.2).
+		Build()
+
+	angles := RamachandranAngles(protein)
+	if len(angles) != 3 {
+		t.Fatalf("RamachandranAngles() returned %d residues, want 3", len(angles))
+	}
+
+	skipped := angles[1]
+	if skipped.HasPhi || skipped.HasPsi || skipped.Err == nil {
+		t.Fatalf("RamachandranAngles()[1] = %+v, want residue 2 skipped with a reason", skipped)
+	}
+	if !strings.Contains(skipped.Err.Error(), "CA") {
+		t.Errorf("reason %q does not name the missing CA", skipped.Err)
+	}
+
+	// the neighbors still use the N and C atoms of residue 2
+	if angles[0].Err != nil || !angles[0].HasPsi || angles[2].Err != nil || !angles[2].HasPhi {
+		t.Errorf("RamachandranAngles() neighbors = %+v, %+v, want psi of residue 1 and phi of residue 3", angles[0], angles[2])
+	}
+}
+
+func TestGroupCutoff(t *testing.T) {
+	// the dipole Q1-Q2 straddles the 3.5 Angstrom cutoff around P, its center at 3.4 is inside
+	protein := NewProteinBuilder().
+		AddResidue("ION", 1, "A").
+		AddAtom("P", "C", 0, 0, 0).
+		AddAtom("F1", "C", -100, 0, 0).AddAtom("F2", "C", -101, 0, 0).AddAtom("F3", "C", -102, 0, 0).
+		AddResidue("DIP", 2, "A").
+		AddAtom("Q1", "O", 2.9, 0, 0).AddAtom("Q2", "O", 3.9, 0, 0).
+		Build()
+	protein.AssignChargeGroups(map[string]map[string]AtomChargeData{
+		"ION": {"P": {ChargeGroup: 1}, "F1": {ChargeGroup: 2}, "F2": {ChargeGroup: 2}, "F3": {ChargeGroup: 2}},
+		"DIP": {"Q1": {ChargeGroup: 1}, "Q2": {ChargeGroup: 1}},
+	})
+	p, q1, q2 := protein.Residue[0].Atoms[0], protein.Residue[1].Atoms[0], protein.Residue[1].Atoms[1]
+	if q1.chargeGroup != q2.chargeGroup || q1.chargeGroup == p.chargeGroup {
+		t.Fatalf("charge groups P %d, Q1 %d, Q2 %d, want Q1 and Q2 in one group apart from P", p.chargeGroup, q1.chargeGroup, q2.chargeGroup)
+	}
+	p.charge, q1.charge, q2.charge = 1, -0.5, 0.5
+
+	// every pair is summed from both of its atoms
+	near := 2 * CalculateElectricPotentialEnergy(p, q1, 2.9)
+	far := 2 * CalculateElectricPotentialEnergy(p, q2, 3.9)
+
+	atomEnergy, _ := CalculateTotalUnbondedEnergyForce(protein, parameterDatabase{})
+	if math.Abs(atomEnergy-near) > 1e-12 {
+		t.Errorf("atom based energy %v, want only P-Q1 %v", atomEnergy, near)
+	}
+
+	groupEnergy, forces := CalculateTotalUnbondedEnergyForce(protein, parameterDatabase{}.WithCutoffScheme(GroupCutoff))
+	if math.Abs(groupEnergy-(near+far)) > 1e-12 {
+		t.Errorf("group based energy %v, want the whole group %v", groupEnergy, near+far)
+	}
+	if forces[q2.index].x == 0 {
+		t.Errorf("Q2 feels no force with the group based cutoff")
+	}
+}
+
+func TestOrderedAtomsAndForces(t *testing.T) {
+	protein := &Protein{Residue: []*Residue{
+		{Name: "B", ID: 2, Atoms: []*Atom{{index: 7}, {index: 3}}},
+		{Name: "A", ID: 1, Atoms: []*Atom{{index: 5}, {index: 1}, {index: 4}}},
+	}}
+	var indices []int
+	for _, atom := range OrderedAtoms(protein) {
+		indices = append(indices, atom.index)
+	}
+	if !reflect.DeepEqual(indices, []int{1, 3, 4, 5, 7}) {
+		t.Errorf("OrderedAtoms() indices = %v, want [1 3 4 5 7]", indices)
+	}
+
+	forceMap := make(map[int]*TriTuple)
+	for _, index := range []int{9, 2, 6, 4, 8} {
+		forceMap[index] = &TriTuple{x: float64(index)}
+	}
+	forceMap[5] = nil
+	for run := 0; run < 10; run++ {
+		entries := OrderedForceEntries(forceMap)
+		if len(entries) != 5 {
+			t.Fatalf("OrderedForceEntries() returned %d entries, want 5", len(entries))
+		}
+		for i, entry := range entries {
+			want := []int{2, 4, 6, 8, 9}[i]
+			if entry.Index != want || entry.Force.x != float64(want) {
+				t.Fatalf("OrderedForceEntries()[%d] = %+v, want index %d", i, entry, want)
+			}
+		}
+	}
+}
+
+func TestConservationHarmonicBond(t *testing.T) {
+	// a stretched N2 molecule oscillating along its bond
+	RunConservationTest(t, func() *Protein {
+		return NewProteinBuilder().
+			AddResidue("N2", 1, "A").
+			AddAtom("N", "N", 0, 0, 0).
+			AddAtom("N", "N", 1.18, 0.05, 0).
+			Build()
+	}, 500, 0.2, 0.05)
+}
+
+func TestConservationAngle(t *testing.T) {
+	// a bent and spinning water molecule, bonds and angle are both off their minimum
+	RunConservationTest(t, func() *Protein {
+		protein := NewProteinBuilder().
+			AddResidue("HOH", 1, "A").
+			AddAtom("O", "O", 0, 0, 0).
+			AddAtom("H", "H", 0.98, 0, 0).
+			AddAtom("H", "H", -0.2, 0.93, 0.05).
+			Build()
+		atoms := protein.Residue[0].Atoms
+		atoms[1].velocity = TriTuple{0, 0.01, 0}
+		atoms[2].velocity = TriTuple{-0.01, 0, 0.003}
+		return protein
+	}, 1000, 0.1, 0.05)
+}
+
+func TestConservationButane(t *testing.T) {
+	// a carbon chain with bonds, angles and a dihedral, started away from every minimum
+	RunConservationTest(t, func() *Protein {
+		protein := NewProteinBuilder().
+			AddResidue("BUT", 1, "A").
+			AddAtom("C", "C", 0, 0, 0).
+			AddAtom("C", "C", 1.55, 0, 0).
+			AddAtom("C", "C", 2.05, 1.42, 0).
+			AddAtom("C", "C", 3.55, 1.6, 0.7).
+			Build()
+		atoms := protein.Residue[0].Atoms
+		atoms[0].velocity = TriTuple{0, 0, 0.005}
+		atoms[3].velocity = TriTuple{0, -0.004, 0}
+		return protein
+	}, 1000, 0.2, 0.05)
+}
+
+func TestFragments(t *testing.T) {
+	// a water molecule and a methanol molecule 6 Angstrom apart, listed interleaved
+	protein := NewProteinBuilder().
+		AddResidue("HOH", 1, "A").
+		AddAtom("O", "O", 0, 0, 0).
+		AddAtom("H1", "H", 0.96, 0, 0).
+		AddResidue("MOH", 2, "A").
+		AddAtom("C", "C", 6, 0, 0).
+		AddAtom("O", "O", 7.43, 0, 0).
+		AddResidue("HOH", 3, "A").
+		AddAtom("H2", "H", -0.24, 0.93, 0).
+		Build()
+
+	fragments := Fragments(BuildTopology(protein))
+	if len(fragments) != 2 {
+		t.Fatalf("Fragments() returned %d fragments, want 2", len(fragments))
+	}
+
+	var got [][]int
+	for _, fragment := range fragments {
+		var indices []int
+		for _, atom := range fragment {
+			indices = append(indices, atom.index)
+		}
+		sort.Ints(indices)
+		got = append(got, indices)
+	}
+	if want := [][]int{{1, 2, 5}, {3, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fragments() atoms = %v, want %v", got, want)
+	}
+}
+
+func TestReadItpPairs(t *testing.T) {
+	pairs, err := ReadItpPairs("Tests/ReadItpPairs/input/butanol.itp")
+	if err != nil {
+		t.Fatalf("ReadItpPairs() error: %v", err)
+	}
+	want := []ItpPair{
+		{Atom1: 1, Atom2: 4, Function: 1, Parameter: []float64{1.1e-03, 1.2e-06}},
+		{Atom1: 2, Atom2: 5, Function: 1},
+	}
+	if !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("ReadItpPairs() = %+v, want %+v", pairs, want)
+	}
+
+	// atoms 1 and 5 are four apart and within the cutoff, listing them makes the
+	// pair count once with its own parameters instead of the non-bonded ones
+	protein := NewProteinBuilder().
+		AddResidue("BUT", 1, "A").
+		AddAtom("C1", "C", 0, 0, 0).
+		AddAtom("C2", "C", 1.5, 0, 0).
+		AddAtom("C3", "C", 2.0, 1.4, 0).
+		AddAtom("O4", "O", 1.2, 2.5, 0).
+		AddAtom("H5", "H", 0.3, 2.2, 0).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{
+		{atomName: []string{"C1", "H5"}, Function: 1, parameter: []float64{5e-3, 5e-6}},
+		{atomName: []string{"H5", "C1"}, Function: 1, parameter: []float64{5e-3, 5e-6}},
+	}}.WithUnits(angstromUnits)
+	r := Distance(atoms[0].position, atoms[4].position)
+
+	energy, _ := CalculateTotalUnbondedEnergyForce(protein, nonbonded)
+	// the cutoff based sum visits the pair from both atoms
+	if want := 2 * CalculateLJPotentialEnergy(5e-3, 5e-6, r); math.Abs(energy-want) > 1e-15 {
+		t.Fatalf("energy without pairs = %v, want %v", energy, want)
+	}
+
+	explicit := []ItpPair{{Atom1: 1, Atom2: 5, Function: 1, Parameter: []float64{1.1e-3, 1.2e-6}}}
+	energy, forceMap := CalculateTotalUnbondedEnergyForce(protein, nonbonded.WithPairs(explicit, 0.5))
+	if want := CalculateLJPotentialEnergy(1.1e-3, 1.2e-6, r); math.Abs(energy-want) > 1e-15 {
+		t.Errorf("energy with explicit pairs = %v, want %v", energy, want)
+	}
+	AssertNetForceZero(t, 1e-15, *forceMap[1], *forceMap[5])
+	if *forceMap[1] == (TriTuple{}) {
+		t.Errorf("the explicit pair exerts no force")
+	}
+}
+
+func TestDeltaEnergyForMove(t *testing.T) {
+	protein := argonLattice(3, 3.4)
+	atoms := protein.Residue[0].Atoms
+	for i, atom := range atoms {
+		atom.charge = 0.2 * float64(i%3-1)
+	}
+	// a bonded chain through the first atoms of the lattice
+	chain := func(protein *Protein) *Topology {
+		atoms := protein.Residue[0].Atoms
+		topology := NewTopology(protein)
+		topology.AddBond(atoms[0], atoms[1], 3.4, 300)
+		topology.AddBond(atoms[1], atoms[2], 3.4, 300)
+		topology.AddBond(atoms[2], atoms[5], 3.4, 300)
+		topology.AddAngle(atoms[0], atoms[1], atoms[2], 180, 60)
+		topology.AddAngle(atoms[1], atoms[2], atoms[5], 90, 60)
+		topology.AddDihedral(atoms[0], atoms[1], atoms[2], atoms[5], 0, 4.6, 3)
+		topology.AddImproper(atoms[1], atoms[0], atoms[2], atoms[4], 0, 43.9)
+		return topology
+	}
+	topology := chain(protein)
+	bonded := parameterDatabase{}.WithUnits(AMBERUnits)
+	nonbonded := argonNonbonded.WithPairs([]ItpPair{{Atom1: 2, Atom2: 9, Function: 1, Parameter: []float64{1e-3, 1e-6}}}, 0.5)
+	rng := NewRNG(5)
+
+	energy := CalculateTotalEnergy(topology, bonded, nonbonded)
+	for move := 0; move < 30; move++ {
+		// the pair and chain atoms are moved too so the explicit pair and bonded terms are exercised
+		atom := atoms[[]int{1, 8, 2, rng.Intn(len(atoms))}[move%4]]
+		oldPos := atom.position
+		atom.position.x += 1.2 * (2*rng.Float64() - 1)
+		atom.position.y += 1.2 * (2*rng.Float64() - 1)
+		atom.position.z += 1.2 * (2*rng.Float64() - 1)
+
+		delta := DeltaEnergyForMove(topology, atom.index, oldPos, bonded, nonbonded)
+		newEnergy := CalculateTotalEnergy(topology, bonded, nonbonded)
+		if want := newEnergy - energy; math.Abs(delta-want) > 1e-9*math.Max(1, math.Abs(want)) {
+			t.Fatalf("move %d of atom %d: DeltaEnergyForMove() = %v, want %v", move, atom.index, delta, want)
+		}
+		energy = newEnergy
+	}
+
+	// the incremental run follows the full energy evaluations move for move
+	full := CopyProtein(protein)
+	fullTopology := chain(full)
+	energyFunc := func(p *Protein) float64 { return CalculateTotalEnergy(fullTopology, bonded, nonbonded) }
+	moves := []MCMove{DisplaceAtomMove(0.3)}
+	want := runMonteCarlo(full, energyFunc, nil, moves, 500, AMBERUnits.Boltzmann()*300, NewRNG(9))
+	got := RunMonteCarloForceField(protein, topology, bonded, nonbonded, moves, 500, 300, NewRNG(9))
+	if got.Accepted != want.Accepted || got.Accepted == 0 || got.Rejected == 0 {
+		t.Fatalf("RunMonteCarloForceField() accepted %d and rejected %d moves, want %d accepted", got.Accepted, got.Rejected, want.Accepted)
+	}
+	for step := range want.Energies {
+		if math.Abs(got.Energies[step]-want.Energies[step]) > 1e-6*math.Max(1, math.Abs(want.Energies[step])) {
+			t.Fatalf("step %d energy = %v, want %v", step, got.Energies[step], want.Energies[step])
+		}
+	}
+	if final := CalculateTotalEnergy(topology, bonded, nonbonded); math.Abs(final-got.Energies[len(got.Energies)-1]) > 1e-6*math.Max(1, math.Abs(final)) {
+		t.Errorf("final energy %v, the run ended at %v", final, got.Energies[len(got.Energies)-1])
+	}
+}
+
+func TestLJExceptions(t *testing.T) {
+	exceptions, err := ReadNonbondParams("Tests/ReadNonbondParams/input/ions.itp")
+	if err != nil {
+		t.Fatalf("ReadNonbondParams() error: %v", err)
+	}
+	if want := map[[2]string]LJParam{{"CLA", "SOD"}: {Sigma: 3.31, Epsilon: 0.35}}; !reflect.DeepEqual(exceptions, want) {
+		t.Fatalf("ReadNonbondParams() = %v, want %v", exceptions, want)
+	}
+
+	types := map[string]LJParam{"SOD": {Sigma: 2.51, Epsilon: 0.196}, "CLA": {Sigma: 4.04, Epsilon: 0.628}, "OT": {Sigma: 3.15, Epsilon: 0.636}}
+	db := parameterDatabase{ljTypes: types}.WithUnits(angstromUnits).WithLJExceptions(exceptions)
+
+	// the ions are 4 indices apart so the Verlet list keeps their pairs
+	builder := NewProteinBuilder().AddResidue("ION", 1, "A")
+	for i, name := range []string{"SOD", "CLA", "OT"} {
+		builder.AddAtom(name, "C", 3*float64(i), 0, 0)
+		for k := 0; k < 3; k++ {
+			builder.AddAtom("X", "C", 100*float64(i+1), 10*float64(k), 0)
+		}
+	}
+	protein := builder.Build()
+	sod, cla, ot := protein.Residue[0].Atoms[0], protein.Residue[0].Atoms[4], protein.Residue[0].Atoms[8]
+
+	A, B := ljCoefficients(LJParam{Sigma: 3.31, Epsilon: 0.35})
+	for _, pair := range [][2]*Atom{{sod, cla}, {cla, sod}} {
+		if got := db.ljParameters(pair[0], pair[1]); !reflect.DeepEqual(got, []float64{B, A}) {
+			t.Errorf("ljParameters(%s, %s) = %v, want the override %v", pair[0].element, pair[1].element, got, []float64{B, A})
+		}
+	}
+	A, B = CombineLJWithRule("SOD", "OT", types, LorentzBerthelot)
+	if got := db.ljParameters(sod, ot); !reflect.DeepEqual(got, []float64{B, A}) {
+		t.Errorf("ljParameters(SOD, OT) = %v, want the combined %v", got, []float64{B, A})
+	}
+
+	// SOD-CLA and CLA-OT are within the cutoff, each counted from both atoms
+	energy, _ := CalculateTotalUnbondedEnergyForce(protein, db)
+	A1, B1 := ljCoefficients(exceptions[[2]string{"CLA", "SOD"}])
+	A2, B2 := CombineLJWithRule("CLA", "OT", types, LorentzBerthelot)
+	want := 2 * (CalculateLJPotentialEnergy(B1, A1, 3) + CalculateLJPotentialEnergy(B2, A2, 3))
+	if math.Abs(energy-want) > 1e-12*want {
+		t.Errorf("CalculateTotalUnbondedEnergyForce() = %v, want %v", energy, want)
+	}
+
+	filePath := t.TempDir() + "/ions.json"
+	if err := WriteParameterJSON(db, filePath); err != nil {
+		t.Fatalf("WriteParameterJSON() error = %v", err)
+	}
+	if reloaded, err := ReadParameterJSON(filePath); err != nil || !reflect.DeepEqual(reloaded.ljExceptions, db.ljExceptions) {
+		t.Errorf("ReadParameterJSON() exceptions = %v, %v, want %v", reloaded.ljExceptions, err, db.ljExceptions)
+	}
+}
+
+func TestProgressReporter(t *testing.T) {
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	defer SetLogOutput(os.Stderr)
+
+	// a fake clock advancing 2 seconds per step
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reporter := NewProgressReporter(5)
+	reporter.Now = func() time.Time { return clock }
+
+	reporter.Start(20)
+	for step := 1; step <= 20; step++ {
+		clock = clock.Add(2 * time.Second)
+		reporter.Step(step)
+		if step == 5 {
+			if elapsed, eta := reporter.Estimate(step); elapsed != 10*time.Second || eta != 30*time.Second {
+				t.Errorf("Estimate(5) = %v, %v, want 10s elapsed and 30s left", elapsed, eta)
+			}
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("reporter wrote %d lines, want one every 5 steps: %q", len(lines), buffer.String())
+	}
+	if lines[0] != "step 5/20, 10s elapsed, ETA 30s" || lines[3] != "step 20/20, 40s elapsed, ETA 0s" {
+		t.Errorf("reports = %q", lines)
+	}
+
+	// a reporter without a clock falls back to time.Now
+	buffer.Reset()
+	zero := &ProgressReporter{Every: 100}
+	zero.Start(100)
+	zero.Step(100)
+	if elapsed, _ := zero.Estimate(100); elapsed < 0 || elapsed > time.Minute {
+		t.Errorf("elapsed time of the zero-value reporter = %v", elapsed)
+	}
+	if !strings.HasPrefix(buffer.String(), "step 100/100,") {
+		t.Errorf("zero-value reporter wrote %q", buffer.String())
+	}
+}
+
+func TestEnsembleAverage(t *testing.T) {
+	frames := []*Protein{{Name: "low"}, {Name: "high"}}
+	observable := func(p *Protein) float64 {
+		if p.Name == "low" {
+			return 1.0
+		}
+		return 3.0
+	}
+	const temperature = 300.0
+	kT := boltzmann * temperature
+
+	// E2 - E1 = kT ln 2, so the low frame weighs twice the high one: (2*1 + 3) / 3
+	energies := []float64{-5000, -5000 + kT*math.Log(2)}
+	if got, err := EnsembleAverage(frames, energies, temperature, observable); err != nil || math.Abs(got-5.0/3.0) > 1e-12 {
+		t.Errorf("EnsembleAverage() = %v, %v, want %v", got, err, 5.0/3.0)
+	}
+
+	// exp(-E/kT) of either energy alone overflows, the average is the low frame
+	energies = []float64{-1e6, -1e6 + 1e5}
+	if got, _ := EnsembleAverage(frames, energies, temperature, observable); math.IsNaN(got) || math.Abs(got-1) > 1e-12 {
+		t.Errorf("EnsembleAverage() with large energies = %v, want 1", got)
+	}
+	if got, _ := EnsembleAverage(frames, []float64{2, 1}, 0, observable); got != 3 {
+		t.Errorf("EnsembleAverage() at 0 K = %v, want the lowest-energy frame 3", got)
+	}
+	if _, err := EnsembleAverage(frames, []float64{2}, temperature, observable); err == nil {
+		t.Error("EnsembleAverage() accepted 2 frames with 1 energy")
+	}
+}
+
+func TestResidueCentersOfMass(t *testing.T) {
+	protein := &Protein{Residue: []*Residue{
+		{Name: "HOH", ID: 7, Atoms: []*Atom{
+			{index: 1, element: "O", mass: 16, position: TriTuple{0, 0, 0}},
+			{index: 2, element: "H1", mass: 1, position: TriTuple{1, 0, 0}},
+			{index: 3, element: "H2", mass: 1, position: TriTuple{0, 1, 0}},
+		}},
+		// masses not resolved
+		{Name: "UNK", ID: 8, Atoms: []*Atom{
+			{index: 4, element: "X1", position: TriTuple{2, 2, 2}},
+			{index: 5, element: "X2", position: TriTuple{4, 2, 0}},
+		}},
+		{Name: "EMP", ID: 9},
+	}}
+
+	centers := ResidueCentersOfMass(protein)
+	if len(centers) != 2 {
+		t.Fatalf("ResidueCentersOfMass() = %v, want 2 residues", centers)
+	}
+	// (16*0 + 1*1 + 1*0) / 18 along x and y
+	if want := (TriTuple{1.0 / 18, 1.0 / 18, 0}); Distance(centers[7], want) > 1e-12 {
+		t.Errorf("center of residue 7 = %v, want %v", centers[7], want)
+	}
+	if want := (TriTuple{3, 2, 1}); Distance(centers[8], want) > 1e-12 {
+		t.Errorf("center of massless residue 8 = %v, want the geometric center %v", centers[8], want)
+	}
+}
+
+func TestUnbondedSplitPaths(t *testing.T) {
+	protein := argonLattice(3, 3.4)
+	for i, atom := range proteinAtoms(protein) {
+		atom.charge = 0.3 * float64(i%3-1)
+	}
+	nonbonded := argonNonbonded.WithPairs([]ItpPair{{Atom1: 2, Atom2: 9, Function: 1}}, 0.5)
+
+	energy, forceMap := CalculateTotalUnbondedEnergyForce(protein, nonbonded)
+	if got := UnbondedEnergyOnly(protein, nonbonded); got != energy {
+		t.Errorf("UnbondedEnergyOnly() = %v, want %v", got, energy)
+	}
+	forces := UnbondedForcesOnly(protein, nonbonded)
+	if len(forces) != len(forceMap) {
+		t.Fatalf("UnbondedForcesOnly() has %d atoms, want %d", len(forces), len(forceMap))
+	}
+	for index, force := range forceMap {
+		if got := forces[index]; got == nil || *got != *force {
+			t.Errorf("UnbondedForcesOnly()[%d] = %v, want %v", index, got, *force)
+		}
+	}
+}
+
+func BenchmarkUnbondedEnergyForce(b *testing.B) {
+	protein := argonLattice(6, 3.3)
+	for i := 0; i < b.N; i++ {
+		CalculateTotalUnbondedEnergyForce(protein, argonNonbonded)
+	}
+}
+
+func BenchmarkUnbondedForcesOnly(b *testing.B) {
+	protein := argonLattice(6, 3.3)
+	for i := 0; i < b.N; i++ {
+		UnbondedForcesOnly(protein, argonNonbonded)
+	}
+}
+
+func BenchmarkUnbondedEnergyOnly(b *testing.B) {
+	protein := argonLattice(6, 3.3)
+	for i := 0; i < b.N; i++ {
+		UnbondedEnergyOnly(protein, argonNonbonded)
+	}
+}
+
+func TestMasslessPolicy(t *testing.T) {
+	// a harmonic bond whose second atom lost its mass, e.g. an unknown element
+	protein, _ := HarmonicBondSystem(300, 1.2, 0.2)
+	massless := protein.Residue[0].Atoms[1]
+	massless.mass = 0
+	massless.velocity = TriTuple{0.01, 0, 0}
+	bond := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "O"}, Function: 1, parameter: []float64{0.12, 30000}}}}
+	cfg := SimulationConfig{BondParameter: bond, Timestep: 0.5, Steps: 50, Massless: RejectMassless}
+
+	if _, err := RunSimulation(protein, cfg); err == nil || !strings.Contains(err.Error(), "O 2") {
+		t.Errorf("RunSimulation() error = %v, want the massless atom O 2 rejected", err)
+	}
+	if _, err := PrepareAndEquilibrate(protein, cfg); err == nil {
+		t.Errorf("PrepareAndEquilibrate() accepted a massless atom")
+	}
+
+	cfg.Massless = FixMassless
+	final, err := RunSimulation(protein, cfg)
+	if err != nil {
+		t.Fatalf("RunSimulation() error = %v", err)
+	}
+	atoms := final.Residue[0].Atoms
+	if atoms[1].position != massless.position {
+		t.Errorf("massless atom moved from %v to %v", massless.position, atoms[1].position)
+	}
+	if atoms[0].position == protein.Residue[0].Atoms[0].position {
+		t.Errorf("the atom with a mass was not integrated")
+	}
+}
+
+func TestGeometryHistograms(t *testing.T) {
+	// a planar zigzag: bonds 1.02, 1.52, 1.33, angles 90 and 120, trans dihedral
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("N", "N", 0, 1.02, 0).
+		AddAtom("CA", "C", 0, 0, 0).
+		AddAtom("C", "C", 1.52, 0, 0).
+		AddAtom("O", "O", 1.52+1.33*0.5, -1.33*math.Sqrt(3)/2, 0).
+		AddResidue("ION", 2, "A").
+		AddAtom("NA", "C", 20, 0, 0).
+		Build()
+	atoms := proteinAtoms(protein)
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1])
+	topology.AddBond(atoms[1], atoms[2])
+	topology.AddBond(atoms[2], atoms[3])
+	// a broken bond stretched across the box
+	topology.AddBond(atoms[3], atoms[4])
+	topology.deriveAnglesAndDihedrals()
+
+	bonds, angles, dihedrals := GeometryHistograms(topology)
+	centers := bonds.Centers()
+	for _, length := range []float64{1.02, 1.52, 1.33} {
+		bin := int(length / 0.05)
+		if bonds.Counts[bin] != 1 || math.Abs(centers[bin]-length) > 0.025 {
+			t.Errorf("bond of %v Angstrom: bin %d centered on %v holds %d bonds, want 1", length, bin, centers[bin], bonds.Counts[bin])
+		}
+	}
+	if bonds.Overflow != 1 {
+		t.Errorf("bond overflow = %d, want the broken bond", bonds.Overflow)
+	}
+
+	// 90 and 120 degree angles fall in the bins starting there
+	if angles.Counts[18] != 1 || angles.Counts[24] != 1 || angles.Centers()[18] != 92.5 {
+		t.Errorf("angle counts = %v, want one in the 90 and one in the 120 bin", angles.Counts)
+	}
+	// the chain, broken bond included, lies in a plane with both dihedrals trans
+	if dihedrals.Counts[36] != 2 {
+		t.Errorf("dihedral counts = %v, want both trans dihedrals in the 180 bin", dihedrals.Counts)
+	}
+}
+
+func TestReduceTrajectory(t *testing.T) {
+	// a molecule swelling frame by frame
+	var buffer bytes.Buffer
+	writer := NewTrajectoryWriter(&buffer)
+	var radii []float64
+	for step := 0; step < 5; step++ {
+		scale := 1 + 0.25*float64(step)
+		frame := NewProteinBuilder().
+			AddResidue("HOH", 1, "A").
+			AddAtom("O", "O", 0, 0, 0).
+			AddAtom("H1", "H", 0.96*scale, 0, 0).
+			AddAtom("H2", "H", -0.24*scale, 0.93*scale, 0).
+			Build()
+		radii = append(radii, RadiusOfGyration(frame))
+		if err := writer.WriteFrame(frame, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type meanAccumulator struct {
+		sum   float64
+		count int
+	}
+	mean, err := ReduceTrajectory(NewTrajectoryReader(&buffer), meanAccumulator{}, func(acc meanAccumulator, frame *Protein) meanAccumulator {
+		return meanAccumulator{sum: acc.sum + RadiusOfGyration(frame), count: acc.count + 1}
+	})
+	if err != nil {
+		t.Fatalf("ReduceTrajectory() error: %v", err)
+	}
+
+	want := 0.0
+	for _, radius := range radii {
+		want += radius / float64(len(radii))
+	}
+	if mean.count != 5 || math.Abs(mean.sum/float64(mean.count)-want) > 1e-6 {
+		t.Errorf("mean radius of gyration over %d frames = %v, want %v over 5", mean.count, mean.sum/float64(mean.count), want)
+	}
+
+	// a truncated trajectory stops with the frames folded so far
+	count, err := ReduceTrajectory(NewTrajectoryReader(strings.NewReader("1\nstep=0\nO 0 0 0\n2\nstep=1\nO 0 0 0\n")), 0, func(acc int, frame *Protein) int { return acc + 1 })
+	if err == nil || count != 1 {
+		t.Errorf("ReduceTrajectory() on a truncated trajectory = %d, %v, want 1 frame and an error", count, err)
+	}
+}
+
+func TestVectorConventions(t *testing.T) {
+	rng := NewRNG(3)
+	randomAtom := func() *Atom {
+		return &Atom{position: TriTuple{4*rng.Float64() - 2, 4*rng.Float64() - 2, 4*rng.Float64() - 2}}
+	}
+
+	a, b := &Atom{position: TriTuple{1, 2, 3}}, &Atom{position: TriTuple{4, 0, 3.5}}
+	if got, want := CalculateVector(a, b), (TriTuple{3, -2, 0.5}); got != want {
+		t.Errorf("CalculateVector(a, b) = %v, want b - a = %v", got, want)
+	}
+
+	for trial := 0; trial < 20; trial++ {
+		a1, a2, a3, a4 := randomAtom(), randomAtom(), randomAtom(), randomAtom()
+
+		forward, backward := CalculateVector(a1, a2), CalculateVector(a2, a1)
+		if forward != scaleVector(backward, -1) {
+			t.Errorf("CalculateVector(a, b) = %v is not the opposite of CalculateVector(b, a) = %v", forward, backward)
+		}
+		if math.Abs(magnitude(forward)-Distance(a1.position, a2.position)) > 1e-12 {
+			t.Errorf("|CalculateVector| = %v, Distance = %v", magnitude(forward), Distance(a1.position, a2.position))
+		}
+
+		// the angle does not depend on the order of its end atoms
+		if math.Abs(CalculateAngle(a1, a2, a3)-CalculateAngle(a3, a2, a1)) > 1e-9 {
+			t.Errorf("CalculateAngle() differs when reversed: %v, %v", CalculateAngle(a1, a2, a3), CalculateAngle(a3, a2, a1))
+		}
+		// the unsigned dihedral is the magnitude of the signed one, also read backwards
+		signed := CalculateSignedDihedralAngle(a1, a2, a3, a4)
+		for _, unsigned := range []float64{CalculateDihedralAngle(a1, a2, a3, a4), CalculateDihedralAngle(a4, a3, a2, a1)} {
+			if math.Abs(unsigned-math.Abs(signed)) > 1e-6 {
+				t.Errorf("CalculateDihedralAngle() = %v, want |%v|", unsigned, signed)
+			}
+		}
+		if reversed := CalculateSignedDihedralAngle(a4, a3, a2, a1); math.Abs(reversed-signed) > 1e-6 {
+			t.Errorf("signed dihedral read backwards = %v, want %v", reversed, signed)
+		}
+	}
+
+	// pinned direction: a right angle and a +90 dihedral (atom4 clockwise from atom1 seen along 2->3)
+	atom1, atom2 := &Atom{position: TriTuple{0, 1, 0}}, &Atom{position: TriTuple{0, 0, 0}}
+	atom3, atom4 := &Atom{position: TriTuple{1, 0, 0}}, &Atom{position: TriTuple{1, 0, 1}}
+	if got := CalculateAngle(atom1, atom2, atom3); math.Abs(got-90) > 1e-9 {
+		t.Errorf("CalculateAngle() = %v, want 90", got)
+	}
+	if got := CalculateSignedDihedralAngle(atom1, atom2, atom3, atom4); math.Abs(got-90) > 1e-9 {
+		t.Errorf("CalculateSignedDihedralAngle() = %v, want +90", got)
+	}
+}
+
+func TestExternalForces(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("NAC", 1, "A").
+		AddAtom("NA", "C", 0, 0, 0).
+		AddAtom("CL", "O", 5, 0, 0).
+		Build()
+	ion, neutral := protein.Residue[0].Atoms[0], protein.Residue[0].Atoms[1]
+	ion.charge = -0.8
+	field := TriTuple{2.5, 0, -1}
+
+	forceMap := map[int]*TriTuple{ion.index: {x: 1e-4}, neutral.index: {}}
+	ElectricField{Field: field}.Apply(forceMap, protein)
+	if want := (TriTuple{x: 1e-4 - 0.8*2.5*forceUnit, z: 0.8 * forceUnit}); Distance(*forceMap[ion.index], want) > 1e-15 {
+		t.Errorf("force on the ion = %v, want its force plus qE = %v", *forceMap[ion.index], want)
+	}
+	if *forceMap[neutral.index] != (TriTuple{}) {
+		t.Errorf("the field pushed a neutral atom: %v", *forceMap[neutral.index])
+	}
+
+	pull := UniformForce{Force: TriTuple{0, 3, 0}, Atoms: map[int]bool{neutral.index: true}}
+	pull.Apply(forceMap, protein)
+	if want := (TriTuple{y: 3 * forceUnit}); Distance(*forceMap[neutral.index], want) > 1e-15 {
+		t.Errorf("pulled atom force = %v, want %v", *forceMap[neutral.index], want)
+	}
+
+	// gravity gives every atom the same acceleration in a simulation
+	cfg := SimulationConfig{Timestep: 1, Steps: 10, External: []ExternalForce{UniformAcceleration{Acceleration: TriTuple{z: -1e-4}}}}
+	final, err := RunSimulation(protein, cfg)
+	if err != nil {
+		t.Fatalf("RunSimulation() error = %v", err)
+	}
+	for i, atom := range final.Residue[0].Atoms {
+		// z = a t^2 / 2 after 10 fs
+		if drop := protein.Residue[0].Atoms[i].position.z - atom.position.z; math.Abs(drop-0.5e-4*100) > 1e-12 {
+			t.Errorf("atom %d fell %v Angstrom, want 0.005", atom.index, drop)
+		}
+	}
+
+	// the energies of the uniform forces are -F.r
+	forceMap = map[int]*TriTuple{}
+	if energy, want := pull.EnergyForce(protein, forceMap), -3*neutral.position.y; math.Abs(energy-want) > 1e-12 {
+		t.Errorf("energy of the pull = %v, want %v", energy, want)
+	}
+	if energy, want := (ElectricField{Field: field}).EnergyForce(protein, forceMap), 0.8*field.dot(ion.position); math.Abs(energy-want) > 1e-12 {
+		t.Errorf("energy of the field = %v, want %v", energy, want)
+	}
+
+	// in a simulation the potential energy of gravity turns into kinetic energy
+	var states []ThermoState
+	cfg.EnergyLog = func(step int, state ThermoState) { states = append(states, state) }
+	if _, err := RunSimulation(protein, cfg); err != nil {
+		t.Fatalf("RunSimulation() error = %v", err)
+	}
+	last := states[len(states)-1]
+	if last.PotentialEnergy >= 0 || math.Abs(last.TotalEnergy-states[0].TotalEnergy) > 1e-6*math.Abs(last.PotentialEnergy) {
+		t.Errorf("gravity after 10 fs: potential %v, total %v and %v at the first step, want a negative potential and a conserved total", last.PotentialEnergy, last.TotalEnergy, states[0].TotalEnergy)
+	}
+}
+
+func TestDistanceRestraint(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("C", "C", 0, 0, 0).
+		AddAtom("O", "O", 0, 0, 6).
+		AddAtom("N", "N", 0, 4, 6).
+		Build()
+	atoms := protein.Residue[0].Atoms
+
+	restraint := DistanceRestraint{AtomI: atoms[0].index, AtomJ: atoms[1].index, K: 10, R0: 4}
+	forceMap := map[int]*TriTuple{}
+	if energy := restraint.EnergyForce(protein, forceMap); math.Abs(energy-0.5*10*2*2) > 1e-12 {
+		t.Errorf("energy = %v, want 20", energy)
+	}
+	// stretched by 2 Angstrom along z: atom I is pulled up, atom J down, by k*2
+	if want := (TriTuple{z: 20 * forceUnit}); Distance(*forceMap[atoms[0].index], want) > 1e-15 {
+		t.Errorf("force on atom I = %v, want %v", *forceMap[atoms[0].index], want)
+	}
+	if sum := addVectors(*forceMap[atoms[0].index], *forceMap[atoms[1].index]); magnitude(sum) > 1e-15 {
+		t.Errorf("restraint forces are not equal and opposite, sum = %v", sum)
+	}
+	if _, exist := forceMap[atoms[2].index]; exist {
+		t.Errorf("the restraint pushed an atom it does not name")
+	}
+
+	// the restraint pulls the atoms toward R0 in a simulation
+	cfg := SimulationConfig{Timestep: 1, Steps: 20, External: []ExternalForce{restraint}}
+	final, err := RunSimulation(protein, cfg)
+	if err != nil {
+		t.Fatalf("RunSimulation() error = %v", err)
+	}
+	if r := Distance(final.Residue[0].Atoms[0].position, final.Residue[0].Atoms[1].position); r >= 6 || r < 4 {
+		t.Errorf("restrained distance after 20 fs = %v, want between 4 and 6", r)
+	}
+
+	// the logged potential energy is the restraint energy, so the total energy is conserved
+	var states []ThermoState
+	cfg.Timestep = 0.1
+	cfg.EnergyLog = func(step int, state ThermoState) { states = append(states, state) }
+	if _, err := RunSimulation(protein, cfg); err != nil {
+		t.Fatalf("RunSimulation() error = %v", err)
+	}
+	if states[0].PotentialEnergy < 19 {
+		t.Errorf("potential energy at the first step = %v, want the restraint energy of about 20", states[0].PotentialEnergy)
+	}
+	for i, state := range states {
+		if math.Abs(state.TotalEnergy-states[0].TotalEnergy) > 1e-3*states[0].TotalEnergy {
+			t.Errorf("total energy at step %d = %v, %v at the first step", i+1, state.TotalEnergy, states[0].TotalEnergy)
+		}
+	}
+
+	// center of mass groups, the forces are shared by mass and still sum to zero
+	group := CenterOfMassRestraint{GroupI: []int{atoms[0].index}, GroupJ: []int{atoms[1].index, atoms[2].index}, K: 10, R0: 4}
+	forceMap = map[int]*TriTuple{}
+	centerJ, _ := centerOfMass(atoms[1:])
+	r := Distance(atoms[0].position, centerJ)
+	if energy := group.EnergyForce(protein, forceMap); math.Abs(energy-5*(r-4)*(r-4)) > 1e-12 {
+		t.Errorf("center of mass energy = %v, want %v", energy, 5*(r-4)*(r-4))
+	}
+	AssertNetForceZero(t, 1e-15, *forceMap[atoms[0].index], *forceMap[atoms[1].index], *forceMap[atoms[2].index])
+	ratio := magnitude(*forceMap[atoms[1].index]) / magnitude(*forceMap[atoms[2].index])
+	if want := atoms[1].mass / atoms[2].mass; math.Abs(ratio-want) > 1e-12 {
+		t.Errorf("group force ratio = %v, want the mass ratio %v", ratio, want)
+	}
+}
+
+func TestOutputIntervals(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C", "C", 0, 0, 0).
+		AddAtom("C", "C", 1.6, 0, 0).
+		Build()
+	protein.Residue[0].Atoms[0].velocity = TriTuple{x: -0.001}
+
+	var buffer bytes.Buffer
+	var logged []int
+	var energies []float64
+	cfg := SimulationConfig{
+		BondParameter:      parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.1526, 259408}}}},
+		Timestep:           0.5,
+		Steps:              100,
+		Trajectory:         NewTrajectoryWriter(&buffer),
+		TrajectoryInterval: 20,
+		EnergyLogInterval:  5,
+		EnergyLog: func(step int, state ThermoState) {
+			logged = append(logged, step)
+			energies = append(energies, state.TotalEnergy)
+		},
+	}
+	if _, err := RunSimulation(protein, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logged) != 20 || logged[0] != 5 || logged[19] != 100 {
+		t.Errorf("energy logged at steps %v, want 20 logs every 5 steps", logged)
+	}
+	for _, energy := range energies {
+		if energy == 0 || math.Abs(energy-energies[0]) > 1e-2*math.Abs(energies[0]) {
+			t.Errorf("logged total energies are not conserved: %v", energies)
+			break
+		}
+	}
+
+	frames, err := ReduceTrajectory(NewTrajectoryReader(strings.NewReader(buffer.String())), []int(nil), func(steps []int, frame *Protein) []int {
+		return append(steps, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 5 {
+		t.Errorf("trajectory has %d frames, want 5", len(frames))
+	}
+}
+
+func TestSymmetricEigen3(t *testing.T) {
+	// R diag(1, 2, 5) R^T has the columns of R as eigenvectors
+	rotation := axisRotation(TriTuple{1 / math.Sqrt(3), 1 / math.Sqrt(3), 1 / math.Sqrt(3)}, 0.7)
+	diagonal := [3]float64{5, 1, 2}
+	var rotated [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				rotated[i][j] += rotation[i][k] * diagonal[k] * rotation[j][k]
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		matrix [3][3]float64
+		values [3]float64
+	}{
+		{"rotated diagonal", rotated, [3]float64{1, 2, 5}},
+		{"two equal eigenvalues", [3][3]float64{{2, 1, 0}, {1, 2, 0}, {0, 0, 3}}, [3]float64{1, 3, 3}},
+		{"three equal eigenvalues", [3][3]float64{{7, 0, 0}, {0, 7, 0}, {0, 0, 7}}, [3]float64{7, 7, 7}},
+		{"singular", [3][3]float64{{1, 1, 1}, {1, 1, 1}, {1, 1, 1}}, [3]float64{0, 0, 3}},
+	}
+	for _, test := range tests {
+		values, vectors := SymmetricEigen3(test.matrix)
+		for k := 0; k < 3; k++ {
+			if math.Abs(values[k]-test.values[k]) > 1e-12 {
+				t.Errorf("%s: eigenvalues = %v, want %v", test.name, values, test.values)
+				break
+			}
+		}
+		for k := 0; k < 3; k++ {
+			// m v = lambda v
+			for i := 0; i < 3; i++ {
+				mv := test.matrix[i][0]*vectors[k][0] + test.matrix[i][1]*vectors[k][1] + test.matrix[i][2]*vectors[k][2]
+				if math.Abs(mv-values[k]*vectors[k][i]) > 1e-12 {
+					t.Errorf("%s: %v is not an eigenvector of eigenvalue %v", test.name, vectors[k], values[k])
+					break
+				}
+			}
+			// orthonormal
+			for l := 0; l < 3; l++ {
+				dot := vectors[k][0]*vectors[l][0] + vectors[k][1]*vectors[l][1] + vectors[k][2]*vectors[l][2]
+				want := 0.0
+				if k == l {
+					want = 1
+				}
+				if math.Abs(dot-want) > 1e-12 {
+					t.Errorf("%s: eigenvectors %d and %d have dot product %v, want %v", test.name, k, l, dot, want)
+				}
+			}
+		}
+	}
+}
+
+func TestTopEnergyContributions(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0, 0, 0).
+		AddAtom("C2", "C", 1.53, 0, 0).
+		AddAtom("C3", "C", 2.0, 1.45, 0).
+		AddAtom("C4", "C", 4.6, 1.45, 0).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1], 0.153, 224262)
+	topology.AddBond(atoms[1], atoms[2], 0.153, 224262)
+	// stretched by more than an Angstrom
+	topology.AddBond(atoms[2], atoms[3], 0.153, 224262)
+	topology.AddAngle(atoms[0], atoms[1], atoms[2], 109.5, 400)
+	topology.AddAngle(atoms[1], atoms[2], atoms[3], 109.5, 400)
+
+	top := TopEnergyContributions(protein, topology, parameterDatabase{}, parameterDatabase{}, 3)
+	if len(top) != 3 {
+		t.Fatalf("got %d contributions, want 3", len(top))
+	}
+	if top[0].Kind != "bond" || top[0].Atoms[0] != atoms[2] || top[0].Atoms[1] != atoms[3] {
+		t.Errorf("highest contribution = %s %v, want the stretched bond C3-C4", top[0].Kind, top[0].Atoms)
+	}
+	if want := CalculateBondStretchEnergy(224262, 2.6, 0.153); math.Abs(top[0].Energy-want) > 1e-6*want {
+		t.Errorf("bad bond energy = %v, want %v", top[0].Energy, want)
+	}
+	for i := 1; i < len(top); i++ {
+		if top[i].Energy > top[i-1].Energy {
+			t.Errorf("contributions are not sorted: %v then %v", top[i-1].Energy, top[i].Energy)
+		}
+	}
+
+	total := 0.0
+	for _, contribution := range TopEnergyContributions(protein, topology, parameterDatabase{}, parameterDatabase{}, -1) {
+		total += contribution.Energy
+	}
+	if want := topology.bondedEnergy(parameterDatabase{}); math.Abs(total-want) > 1e-9*want {
+		t.Errorf("contributions sum to %v, want the bonded energy %v", total, want)
+	}
+
+	// with non-bonded pairs and AMBER units, the pairs in kcal/mol like the bonds
+	protein = NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0, 0, 0).
+		AddAtom("C2", "C", 1.53, 0, 0).
+		AddAtom("C3", "C", 2.0, 1.45, 0).
+		AddAtom("C4", "C", 3.4, 1.9, 0).
+		AddAtom("C5", "C", 0.3, 3.2, 0).
+		AddAtom("C6", "C", 1.6, 3.4, 0.8).
+		Build()
+	atoms = protein.Residue[0].Atoms
+	for i, atom := range atoms {
+		atom.charge = 0.2 - 0.1*float64(i%3)
+	}
+	topology = NewTopology(protein)
+	for i := 0; i < len(atoms)-1; i++ {
+		topology.AddBond(atoms[i], atoms[i+1], 1.53, 310)
+	}
+	amber := parameterDatabase{}.WithUnits(AMBERUnits)
+	nonbonded := parameterDatabase{ljTypes: map[string]LJParam{"C": {Sigma: 3.4, Epsilon: 0.1}}}.WithUnits(AMBERUnits)
+
+	total, pairCount := 0.0, 0
+	for _, contribution := range TopEnergyContributions(protein, topology, amber, nonbonded, -1) {
+		total += contribution.Energy
+		if contribution.Kind == "nonbonded" {
+			pairCount++
+		}
+	}
+	if pairCount == 0 {
+		t.Fatal("the test system has no non-bonded pair")
+	}
+	if want := CalculateTotalEnergy(topology, amber, nonbonded); math.Abs(total-want) > 1e-9*math.Abs(want) {
+		t.Errorf("contributions sum to %v kcal/mol, want the total energy %v kcal/mol", total, want)
+	}
+}
+
+func TestLoadParametersCached(t *testing.T) {
+	data, err := os.ReadFile("Tests/ParameterJSON/input/bondtypes.itp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/bondtypes.itp"
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := LoadParametersCached(path)
+	if err != nil {
+		t.Fatalf("LoadParametersCached() error = %v", err)
+	}
+	if len(parsed.atomPair) != 11 {
+		t.Fatalf("LoadParametersCached() read %d pairs, want 11", len(parsed.atomPair))
+	}
+	if _, err := os.Stat(path + parameterCacheSuffix); err != nil {
+		t.Fatalf("no cache written next to the source: %v", err)
+	}
+
+	// a fresh cache is read instead of the source, so a changed cache shows through
+	cached := parameterDatabase{atomPair: parsed.atomPair[:1]}
+	if err := WriteParameterJSON(cached, path+parameterCacheSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := LoadParametersCached(path); err != nil || len(db.atomPair) != 1 {
+		t.Errorf("second load read %d pairs, %v, want the 1 pair of the cache", len(db.atomPair), err)
+	}
+
+	// touching the source makes the cache stale
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := LoadParametersCached(path); err != nil || !reflect.DeepEqual(db, parsed) {
+		t.Errorf("load after touching the source = %d pairs, %v, want the reparsed %d pairs", len(db.atomPair), err, len(parsed.atomPair))
+	}
+	if db, err := ReadParameterJSON(path + parameterCacheSuffix); err != nil || len(db.atomPair) != 11 {
+		t.Errorf("stale cache was not rewritten, it holds %d pairs, %v", len(db.atomPair), err)
+	}
+}
+
+func TestPDBTrajectory(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).
+		AddAtom("CA", "C", 1.458, 0, 0).
+		Build()
+	protein.Name = "dipeptide"
+
+	var buffer bytes.Buffer
+	writer := NewTrajectoryWriter(&buffer)
+	writer.Format = PDBTrajectory
+	for step := 1; step <= 3; step++ {
+		protein.Residue[0].Atoms[1].position.x += 0.1
+		if err := writer.WriteFrame(protein, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var models []string
+	headers, endmdl, atoms := 0, 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		switch {
+		case strings.HasPrefix(line, "HEADER"):
+			headers++
+			if len(models) > 0 {
+				t.Errorf("header written after model %d", len(models))
+			}
+		case strings.HasPrefix(line, "MODEL"):
+			models = append(models, line)
+		case line == "ENDMDL":
+			endmdl++
+			if endmdl != len(models) {
+				t.Errorf("ENDMDL %d does not close a model", endmdl)
+			}
+		case strings.HasPrefix(line, "ATOM"):
+			atoms++
+			if endmdl != len(models)-1 {
+				t.Errorf("ATOM record outside a model: %q", line)
+			}
+		}
+	}
+
+	if want := []string{"MODEL        1", "MODEL        2", "MODEL        3"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("models = %q, want %q", models, want)
+	}
+	if headers != 1 || endmdl != 3 || atoms != 6 {
+		t.Errorf("got %d headers, %d ENDMDL and %d atoms, want 1, 3 and 6", headers, endmdl, atoms)
+	}
+	if !strings.Contains(buffer.String(), "   1.758") {
+		t.Errorf("last model does not hold the moved atom:\n%s", buffer.String())
+	}
+}
+
+func TestReadAminoAcidsParaVariants(t *testing.T) {
+	residues, err := ReadAminoAcidsPara("Tests/ReadAminoAcidsPara/input/histidine.rtp")
+	if err != nil {
+		t.Fatalf("ReadAminoAcidsPara() error = %v", err)
+	}
+	for _, name := range []string{"HIS", "HID", "HIE", "HIP"} {
+		if _, exist := residues[name]; !exist {
+			t.Errorf("entry %s not loaded", name)
+		}
+	}
+	if got := len(residues["HIP"].atoms); got != 7 {
+		t.Errorf("HIP has %d atoms, want 7", got)
+	}
+
+	charges := RtpCharges(residues)
+	if charges["HID"]["ND1"] != -0.38110 || charges["HIS"]["ND1"] != -0.54320 || charges["HIP"]["HE2"] != 0.39110 {
+		t.Errorf("ND1 charges HID %v HIS %v and HIP HE2 %v, want -0.3811, -0.5432 and 0.3911",
+			charges["HID"]["ND1"], charges["HIS"]["ND1"], charges["HIP"]["HE2"])
+	}
+	if _, exist := charges["HIS"]["HD1"]; exist {
+		t.Errorf("HD1 of HID leaked into the base HIS entry")
+	}
+
+	protein := NewProteinBuilder().
+		AddResidue("HIS", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).
+		AddAtom("ND1", "N", 1, 0, 0).
+		AddAtom("HD1", "H", 2, 0, 0).
+		AddResidue("HIS", 2, "A").
+		AddAtom("N", "N", 5, 0, 0).
+		AddAtom("ND1", "N", 6, 0, 0).
+		Build()
+	for _, residue := range protein.Residue {
+		residue.Variant = HistidineVariant(residue)
+	}
+	if protein.Residue[0].Variant != "HID" || protein.Residue[1].Variant != "" {
+		t.Fatalf("variants = %q, %q, want HID and none", protein.Residue[0].Variant, protein.Residue[1].Variant)
+	}
+
+	protein.AssignChargesToProtein(charges)
+	if got := protein.Residue[0].Atoms[1].charge; got != -0.38110 {
+		t.Errorf("ND1 of the HID residue has charge %v, want -0.3811", got)
+	}
+	if got := protein.Residue[0].Atoms[2].charge; got != 0.36490 {
+		t.Errorf("HD1 of the HID residue has charge %v, want 0.3649", got)
+	}
+	if got := protein.Residue[1].Atoms[1].charge; got != -0.54320 {
+		t.Errorf("ND1 of the plain HIS residue has charge %v, want -0.5432", got)
+	}
+
+	// the reader marks the variants, the shipped templates name them the GROMOS way
+	calmodulin, err := readProteinFromFile("../data/calmodulin_noCA.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	var his107 *Residue
+	for _, residue := range calmodulin.Residue {
+		if residue.ID == 107 {
+			his107 = residue
+		}
+	}
+	if his107 == nil || his107.Name != "HIS" || his107.Variant != "HID" {
+		t.Fatalf("residue 107 = %+v, want HIS with the HID variant", his107)
+	}
+	for file, want := range map[string]string{"aminoacids.rtp": "HISA", "aminoacids_revised.rtp": "HISD"} {
+		templates, err := ReadAminoAcidsPara("../data/" + file)
+		if err != nil {
+			t.Fatalf("ReadAminoAcidsPara(%s) error = %v", file, err)
+		}
+		if got := templateName(his107, templates); got != want {
+			t.Errorf("templateName() of HIS 107 in %s = %s, want %s", file, got, want)
+		}
+	}
+}
+
+func TestGroupTemperatures(t *testing.T) {
+	builder := NewProteinBuilder().AddResidue("SOL", 1, "A")
+	for i := 0; i < 20; i++ {
+		builder.AddAtom("C", "C", float64(i)*4, 0, 0)
+	}
+	protein := builder.Build()
+	atoms := protein.Residue[0].Atoms
+	InitializeVelocities(protein, 300, NewRNG(7))
+
+	solute, solvent := atoms[:10], atoms[10:]
+	// the solvent runs twice as fast, four times as hot
+	for _, atom := range solvent {
+		atom.velocity = scaleVector(atom.velocity, 2)
+	}
+
+	temperatures := GroupTemperatures(protein, map[string][]*Atom{"solute": solute, "solvent": solvent, "empty": nil})
+	soluteT := 2 * atomsKineticEnergy(solute) / ((30 - 1.5) * boltzmann)
+	if math.Abs(temperatures["solute"]-soluteT) > 1e-9 {
+		t.Errorf("solute temperature = %v, want %v", temperatures["solute"], soluteT)
+	}
+	if temperatures["solvent"] <= temperatures["solute"] {
+		t.Errorf("solvent temperature %v is not above the solute %v", temperatures["solvent"], temperatures["solute"])
+	}
+	if temperatures["empty"] != 0 {
+		t.Errorf("empty group temperature = %v, want 0", temperatures["empty"])
+	}
+
+	// the groups cover the protein, their weighted mean is its temperature
+	mean := (28.5*temperatures["solute"] + 28.5*temperatures["solvent"]) / 57
+	if math.Abs(mean-Temperature(protein)) > 1e-9 {
+		t.Errorf("weighted mean of the groups = %v, want the temperature %v", mean, Temperature(protein))
+	}
+}
+
+func TestCoordinationNumbers(t *testing.T) {
+	// a center with six atoms on the axes at 1.5 Angstrom, 2.1 apart from each other
+	builder := NewProteinBuilder().AddResidue("CLU", 1, "A").AddAtom("C0", "C", 0, 0, 0)
+	for _, p := range []TriTuple{{1.5, 0, 0}, {-1.5, 0, 0}, {0, 1.5, 0}, {0, -1.5, 0}, {0, 0, 1.5}, {0, 0, -1.5}} {
+		builder.AddAtom("C", "C", p.x, p.y, p.z)
+	}
+	protein := builder.Build()
+	atoms := protein.Residue[0].Atoms
+
+	counts := CoordinationNumbers(protein, 1.8)
+	if counts[atoms[0].index] != 6 {
+		t.Errorf("center coordination = %d, want 6", counts[atoms[0].index])
+	}
+	for _, atom := range atoms[1:] {
+		if counts[atom.index] != 1 {
+			t.Errorf("edge atom %d coordination = %d, want 1", atom.index, counts[atom.index])
+		}
+	}
+
+	// a larger cutoff reaches the four edge atoms at 2.1 Angstrom
+	counts = CoordinationNumbers(protein, 2.5)
+	if counts[atoms[0].index] != 6 || counts[atoms[1].index] != 5 {
+		t.Errorf("coordination with cutoff 2.5 = %d and %d, want 6 and 5", counts[atoms[0].index], counts[atoms[1].index])
+	}
+
+	// bonded neighbors are left out with a topology
+	topology := NewTopology(protein)
+	topology.AddBond(atoms[0], atoms[1])
+	counts = CoordinationNumbers(protein, 1.8, topology)
+	if counts[atoms[0].index] != 5 || counts[atoms[1].index] != 0 {
+		t.Errorf("coordination without bonded neighbors = %d and %d, want 5 and 0", counts[atoms[0].index], counts[atoms[1].index])
+	}
+}
+
+func TestSoftCoreLJ(t *testing.T) {
+	// sigma 3.4, epsilon 0.996 in Angstrom and kJ/mol
+	A, B := ljCoefficients(LJParam{Sigma: 3.4, Epsilon: 0.996})
+	alpha := 0.5
+
+	at := func(r float64) (*Atom, *Atom) {
+		return &Atom{}, &Atom{position: TriTuple{x: r}}
+	}
+
+	// full coupling is the plain Lennard-Jones
+	for _, r := range []float64{3.0, 3.8, 6.0} {
+		plain := A/math.Pow(r, 12) - B/math.Pow(r, 6)
+		if got := CalculateSoftCoreLJPotentialEnergy(B, A, r, 1, alpha); math.Abs(got-plain) > 1e-12*math.Abs(plain) {
+			t.Errorf("energy at lambda 1, r %v = %v, want %v", r, got, plain)
+		}
+		a1, a2 := at(r)
+		if got, want := CalculateSoftCoreLJForce(a1, a2, B, A, r, 1, alpha), CalculateLJForce(a1, a2, B, A, r); Distance(got, want) > 1e-12*magnitude(want) {
+			t.Errorf("force at lambda 1, r %v = %v, want %v", r, got, want)
+		}
+	}
+
+	// intermediate coupling stays finite down to r = 0
+	for _, r := range []float64{1.0, 0.1, 1e-4, 0} {
+		energy := CalculateSoftCoreLJPotentialEnergy(B, A, r, 0.5, alpha)
+		a1, a2 := at(r)
+		force := CalculateSoftCoreLJForce(a1, a2, B, A, r, 0.5, alpha)
+		if math.IsNaN(energy) || math.IsInf(energy, 0) || energy > 100 || math.IsNaN(force.x) || math.IsInf(force.x, 0) {
+			t.Errorf("lambda 0.5, r %v: energy %v and force %v are not finite and bounded", r, energy, force)
+		}
+	}
+	if got := CalculateSoftCoreLJPotentialEnergy(B, A, 0.5, 0, alpha); got != 0 {
+		t.Errorf("energy at lambda 0 = %v, want 0", got)
+	}
+
+	// the force is minus the gradient of the energy
+	h := 1e-6
+	for _, lambda := range []float64{0.2, 0.5, 0.9} {
+		for _, r := range []float64{0.5, 2.5, 3.8} {
+			a1, a2 := at(r)
+			dVdr := (CalculateSoftCoreLJPotentialEnergy(B, A, r+h, lambda, alpha) - CalculateSoftCoreLJPotentialEnergy(B, A, r-h, lambda, alpha)) / (2 * h)
+			// a1 at the origin and a2 on +x, so the force on a1 is dV/dr along x
+			if got := CalculateSoftCoreLJForce(a1, a2, B, A, r, lambda, alpha).x; math.Abs(got-dVdr) > 1e-6*math.Max(1, math.Abs(dVdr)) {
+				t.Errorf("lambda %v, r %v: force %v, want dV/dr %v", lambda, r, got, dVdr)
+			}
+		}
+	}
+}
+
+func TestCSVLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewCSVLogger(&buffer, true)
+	states := []ThermoState{
+		{PotentialEnergy: -1234.5, KineticEnergy: 310.25, TotalEnergy: -924.25, Temperature: 298.15, Pressure: 1.01325},
+		{PotentialEnergy: -1230.125, KineticEnergy: 306.5, TotalEnergy: -923.625, Temperature: 294.6, Pressure: -12.5},
+	}
+	for i, state := range states {
+		if err := logger.LogRow(10*(i+1), 5*float64(i+1), state); err != nil {
+			t.Fatalf("LogRow() error = %v", err)
+		}
+	}
+
+	records, err := csv.NewReader(strings.NewReader(buffer.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("log is not valid CSV: %v", err)
+	}
+	header := []string{"step", "time_fs", "potential_kJ_mol", "kinetic_kJ_mol", "total_kJ_mol", "temperature_K", "pressure_bar"}
+	if len(records) != 3 || !reflect.DeepEqual(records[0], header) {
+		t.Fatalf("log = %q, want the header and 2 rows", records)
+	}
+	if want := []string{"10", "5.000000", "-1234.500000", "310.250000", "-924.250000", "298.150000", "1.013250"}; !reflect.DeepEqual(records[1], want) {
+		t.Errorf("first row = %q, want %q", records[1], want)
+	}
+	for _, field := range records[2][1:] {
+		if _, err := strconv.ParseFloat(field, 64); err != nil {
+			t.Errorf("field %q does not parse: %v", field, err)
+		}
+	}
+
+	// a run without a box logs every EnergyLogInterval-th step without pressure
+	protein := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C", "C", 0, 0, 0).
+		AddAtom("C", "C", 1.6, 0, 0).
+		Build()
+	buffer.Reset()
+	cfg := SimulationConfig{
+		BondParameter:     parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{0.1526, 259408}}}},
+		Timestep:          0.5,
+		Steps:             30,
+		EnergyLogInterval: 10,
+		CSVLog:            NewCSVLogger(&buffer, false),
+	}
+	if _, err := RunSimulation(protein, cfg); err != nil {
+		t.Fatal(err)
+	}
+	records, err = csv.NewReader(strings.NewReader(buffer.String())).ReadAll()
+	if err != nil || len(records) != 4 || len(records[0]) != 6 {
+		t.Fatalf("simulation log = %q, %v, want a 6 column header and 3 rows", records, err)
+	}
+	if records[3][0] != "30" || records[3][1] != "15.000000" {
+		t.Errorf("last row starts with step %s at %s fs, want 30 at 15", records[3][0], records[3][1])
+	}
+
+	// a run in AMBER units logged in kcal/mol and in kJ/mol, the header says which
+	logged := func(units ...UnitSystem) [][]string {
+		var buffer bytes.Buffer
+		cfg := SimulationConfig{
+			BondParameter:     parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{1.526, 310}}}}.WithUnits(AMBERUnits),
+			Timestep:          0.5,
+			Steps:             10,
+			EnergyLogInterval: 10,
+			CSVLog:            NewCSVLogger(&buffer, false, units...),
+		}
+		if _, err := RunSimulation(protein, cfg); err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(strings.NewReader(buffer.String())).ReadAll()
+		if err != nil || len(records) != 2 {
+			t.Fatalf("simulation log = %q, %v, want a header and a row", records, err)
+		}
+		return records
+	}
+	kcal, kJ := logged(AMBERUnits), logged()
+	if kcal[0][2] != "potential_kcal_mol" || kJ[0][2] != "potential_kJ_mol" {
+		t.Errorf("potential columns %q and %q, want potential_kcal_mol and potential_kJ_mol", kcal[0][2], kJ[0][2])
+	}
+	for column := 2; column <= 4; column++ {
+		inKcal, _ := strconv.ParseFloat(kcal[1][column], 64)
+		inKJ, _ := strconv.ParseFloat(kJ[1][column], 64)
+		if inKcal == 0 || math.Abs(inKJ-4.184*inKcal) > 1e-5*math.Abs(inKJ) {
+			t.Errorf("%s = %v and %s = %v, want a factor 4.184", kJ[0][column], inKJ, kcal[0][column], inKcal)
+		}
+	}
+}
+
+func TestDihedralRestraint(t *testing.T) {
+	build := func(angle float64) *Protein {
+		rad := angle / 180 * math.Pi
+		return NewProteinBuilder().
+			AddResidue("ALA", 1, "A").
+			AddAtom("C", "C", 1.5, 0, 0).
+			AddAtom("N", "N", 0, 0, 0).
+			AddAtom("CA", "C", 0, 0, 1.5).
+			AddAtom("C", "C", 1.5*math.Cos(rad), 1.5*math.Sin(rad), 1.5).
+			Build()
+	}
+	protein := build(170)
+	atoms := protein.Residue[0].Atoms
+	phi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3])
+	restraint := func(lower, upper float64) DihedralRestraint {
+		return DihedralRestraint{AtomI: atoms[0].index, AtomJ: atoms[1].index, AtomK: atoms[2].index, AtomL: atoms[3].index, Lower: lower, Upper: upper, K: 50}
+	}
+
+	// inside the window, also one across 180 degrees or the full turn, nothing happens
+	for _, r := range []DihedralRestraint{restraint(phi-20, phi+20), restraint(150, -150), restraint(-180, 180)} {
+		forceMap := map[int]*TriTuple{}
+		if energy := r.EnergyForce(protein, forceMap); energy != 0 || len(forceMap) != 0 {
+			t.Errorf("window [%v, %v] around %v: energy %v and forces %v, want none", r.Lower, r.Upper, phi, energy, forceMap)
+		}
+	}
+
+	// outside a helical window the restraint pulls the dihedral back
+	helix := restraint(-70, -40)
+	forceMap := map[int]*TriTuple{}
+	energy := helix.EnergyForce(protein, forceMap)
+	if energy <= 0 {
+		t.Fatalf("energy outside the window = %v, want positive", energy)
+	}
+	AssertNetForceZero(t, 1e-12, *forceMap[atoms[0].index], *forceMap[atoms[1].index], *forceMap[atoms[2].index], *forceMap[atoms[3].index])
+
+	// the forces are minus the gradient of the energy
+	h := 1e-6
+	for _, atom := range atoms {
+		for axis := 0; axis < 3; axis++ {
+			shift := func(delta float64) float64 {
+				moved := CopyProtein(protein)
+				position := &moved.Residue[0].Atoms[atom.index-1].position
+				switch axis {
+				case 0:
+					position.x += delta
+				case 1:
+					position.y += delta
+				default:
+					position.z += delta
+				}
+				return helix.EnergyForce(moved, map[int]*TriTuple{})
+			}
+			want := -(shift(h) - shift(-h)) / (2 * h) * forceUnit
+			got := []float64{forceMap[atom.index].x, forceMap[atom.index].y, forceMap[atom.index].z}[axis]
+			if math.Abs(got-want) > 1e-6*forceUnit {
+				t.Errorf("atom %d axis %d: force %v, want %v", atom.index, axis, got, want)
+			}
+		}
+	}
+
+	// a small step along the force moves the dihedral toward the window
+	moved := build(170)
+	for _, atom := range moved.Residue[0].Atoms {
+		atom.position = addVectors(atom.position, scaleVector(*forceMap[atom.index], 1e-3/forceUnit/50))
+	}
+	if after := helix.EnergyForce(moved, map[int]*TriTuple{}); after >= energy {
+		t.Errorf("energy after a step along the force = %v, want below %v", after, energy)
+	}
+}
+
+func TestAtomByIndex(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/ReadChains/input/protein.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if found, exist := protein.AtomByIndex(atom.index); !exist || found != atom {
+				t.Errorf("AtomByIndex(%d) = %v, %v, want the atom %s", atom.index, found, exist, atom.element)
+			}
+		}
+	}
+	if _, exist := protein.AtomByIndex(0); exist {
+		t.Errorf("AtomByIndex(0) found an atom")
+	}
+
+	// dropping the first residue and renumbering shifts the indices
+	second := protein.Residue[1].Atoms[0]
+	protein.Residue = protein.Residue[1:]
+	protein.Reindex()
+	if found, exist := protein.AtomByIndex(1); !exist || found != second {
+		t.Errorf("AtomByIndex(1) after reindexing = %v, %v, want the N of the second residue", found, exist)
+	}
+	if _, exist := protein.AtomByIndex(6); exist {
+		t.Errorf("AtomByIndex(6) found a removed atom")
+	}
+
+	// atoms renumbered by hand are found again once the map is invalidated
+	for _, atom := range protein.Residue[0].Atoms {
+		atom.index += 100
+	}
+	protein.InvalidateAtomIndex()
+	if found, exist := protein.AtomByIndex(101); !exist || found != second {
+		t.Errorf("AtomByIndex(101) after renumbering = %v, %v, want the N of the second residue", found, exist)
+	}
+	// and added ones too
+	added := &Atom{index: 200, element: "O"}
+	protein.Residue[0].Atoms = append(protein.Residue[0].Atoms, added)
+	protein.InvalidateAtomIndex()
+	if found, exist := protein.AtomByIndex(200); !exist || found != added {
+		t.Errorf("AtomByIndex(200) after adding an atom = %v, %v, want it", found, exist)
+	}
+
+	// an atom replaced by one with another index, the atom count is unchanged
+	replaced := protein.Residue[0].Atoms[1]
+	protein.Residue[0].Atoms[1] = &Atom{index: 300, element: "CA"}
+	protein.InvalidateAtomIndex()
+	if found, exist := protein.AtomByIndex(replaced.index); exist {
+		t.Errorf("AtomByIndex(%d) after replacing the atom = %v, want no atom", replaced.index, found)
+	}
+	if found, exist := protein.AtomByIndex(300); !exist || found != protein.Residue[0].Atoms[1] {
+		t.Errorf("AtomByIndex(300) after replacing an atom = %v, %v, want the new atom", found, exist)
+	}
+
+	// atoms added through the builder after a lookup are found
+	builder := NewProteinBuilder().AddResidue("GLY", 1, "A").AddAtom("N", "N", 0, 0, 0)
+	built := builder.Build()
+	built.AtomByIndex(1)
+	builder.AddAtom("CA", "C", 1.46, 0, 0)
+	if found, exist := built.AtomByIndex(2); !exist || found.element != "CA" {
+		t.Errorf("AtomByIndex(2) after AddAtom = %v, %v, want the CA", found, exist)
+	}
+}
+
+func TestGenerateConformers(t *testing.T) {
+	// two opposite ions with neutral atoms between them, beyond the 3-bond exclusion
+	protein := NewProteinBuilder().
+		AddResidue("ION", 1, "A").
+		AddAtom("NA", "NA", 0, 0, 0).
+		AddAtom("C1", "C", 0, 2, 0).
+		AddAtom("C2", "C", 0, 4, 0).
+		AddAtom("C3", "C", 0, 6, 0).
+		AddAtom("CL", "CL", 2.5, 0, 0).
+		Build()
+	atoms := protein.Residue[0].Atoms
+	atoms[0].charge, atoms[4].charge = 1, -1
+	// soft bonds at their length along the chain, the Coulomb energy of the ions dominates
+	bonded := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"X", "X"}, Function: 1, parameter: []float64{0.2, 1000}}}}
+	nonbonded := parameterDatabase{ljTypes: map[string]LJParam{"NA": {Sigma: 0.2, Epsilon: 0.1}, "CL": {Sigma: 0.2, Epsilon: 0.1}}}
+	topology := BuildTopology(protein)
+	energy := func(p *Protein) float64 {
+		return CalculateTotalEnergy(topology.onProtein(p), bonded, nonbonded)
+	}
+	reference := energy(protein)
+	if reference == 0 {
+		t.Fatal("the ions have no energy, the test does not probe the cutoff")
+	}
+
+	tight := GenerateConformers(protein, bonded, nonbonded, 200, 0.3, 0, NewRNG(3))
+	loose := GenerateConformers(protein, bonded, nonbonded, 200, 0.3, 1, NewRNG(3))
+	if len(tight) == 0 || len(tight) >= len(loose) || len(loose) > 200 {
+		t.Errorf("kept %d conformers with the tight cutoff and %d with the loose one, want 0 < tight < loose <= 200", len(tight), len(loose))
+	}
+	for _, conformer := range tight {
+		if e := energy(conformer); e-reference >= 0 {
+			t.Errorf("conformer energy %v is not below the reference %v", e, reference)
+		}
+	}
+	for _, conformer := range loose {
+		for i, atom := range conformer.Residue[0].Atoms {
+			if shift := Distance(atom.position, atoms[i].position); shift > 0.3+1e-12 {
+				t.Errorf("atom %d moved by %v, more than 0.3", atom.index, shift)
+			}
+		}
+	}
+	if atoms[4].position != (TriTuple{x: 2.5}) {
+		t.Errorf("the input protein was moved to %v", atoms[4].position)
+	}
+
+	// a stiff bond just short of the detection distance: a copy that stretches it further
+	// keeps the bond and its energy, it must not pass for unbonded
+	pair := NewProteinBuilder().
+		AddResidue("MOL", 1, "A").
+		AddAtom("C1", "C", 0, 0, 0).
+		AddAtom("C2", "C", 2.02, 0, 0).
+		Build()
+	if !BondedByDistance(pair.Residue[0].Atoms[0], pair.Residue[0].Atoms[1]) {
+		t.Fatal("the two carbons are not bonded at 2.02 Angstrom")
+	}
+	stiff := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"X", "X"}, Function: 1, parameter: []float64{0.2, 1e6}}}}
+	if CalculateTotalEnergy(BuildTopology(pair), stiff, parameterDatabase{}) == 0 {
+		t.Fatal("the bond has no energy, the test does not probe it")
+	}
+	stretched := 0
+	for _, copied := range GenerateConformersWith(pair, func(*Protein) float64 { return 0 }, 100, 0.3, 1, NewRNG(5)) {
+		if !BondedByDistance(copied.Residue[0].Atoms[0], copied.Residue[0].Atoms[1]) {
+			stretched++
+		}
+	}
+	if stretched == 0 {
+		t.Fatal("no copy stretches the bond past the detection distance")
+	}
+	for _, conformer := range GenerateConformers(pair, stiff, parameterDatabase{}, 100, 0.3, 0, NewRNG(5)) {
+		if atoms := conformer.Residue[0].Atoms; !BondedByDistance(atoms[0], atoms[1]) {
+			t.Errorf("kept a conformer with the bond stretched to %v Angstrom", Distance(atoms[0].position, atoms[1].position))
+		}
+	}
+}
+
+func TestElectrostaticPotential(t *testing.T) {
+	protein := NewProteinBuilder().AddResidue("ION", 1, "A").AddAtom("NA", "C", 1, 1, 1).Build()
+	ion := protein.Residue[0].Atoms[0]
+	ion.charge = 1
+
+	point := TriTuple{1, 1, 3}
+	want := 1 / (4 * math.Pi * epsilon * 2)
+	if got := ElectrostaticPotentialAt(protein, point); math.Abs(got-want) > 1e-15 {
+		t.Errorf("potential 2 Angstrom from +1 = %v, want %v", got, want)
+	}
+	// a probe charge at the point has the Coulomb energy of the pair
+	probe := &Atom{charge: 0.5, position: point}
+	if got, energy := 0.5*ElectrostaticPotentialAt(protein, point), CalculateElectricPotentialEnergy(ion, probe, 2); math.Abs(got-energy) > 1e-15 {
+		t.Errorf("probe energy = %v, want the Coulomb energy %v", got, energy)
+	}
+
+	ion.charge = -1
+	if got := ElectrostaticPotentialAt(protein, point); math.Abs(got+want) > 1e-15 {
+		t.Errorf("potential of -1 = %v, want %v", got, -want)
+	}
+
+	grid := PotentialGrid(protein, Box{X: 2, Y: 2, Z: 2}, 1)
+	if len(grid) != 3 || len(grid[0]) != 3 || len(grid[0][0]) != 3 {
+		t.Fatalf("grid is %dx%dx%d, want 3x3x3", len(grid), len(grid[0]), len(grid[0][0]))
+	}
+	if got, want := grid[0][1][1], -1/(4*math.Pi*epsilon); math.Abs(got-want) > 1e-15 {
+		t.Errorf("grid point 1 Angstrom from the ion = %v, want %v", got, want)
+	}
+	if grid[1][1][1] != 0 {
+		t.Errorf("grid point on the ion = %v, want 0", grid[1][1][1])
+	}
+	if grid[0][0][0] != grid[2][2][2] {
+		t.Errorf("opposite corners differ: %v and %v", grid[0][0][0], grid[2][2][2])
+	}
+}
+
+func TestMeanSquaredDisplacement(t *testing.T) {
+	// ballistic: one atom at constant velocity, MSD = (v t)^2
+	var ballistic []*Protein
+	for i := 0; i < 6; i++ {
+		ballistic = append(ballistic, NewProteinBuilder().AddResidue("ION", 1, "A").AddAtom("O", "O", 0.3*float64(i), 0, 0).Build())
+	}
+	lagTimes, msd := MeanSquaredDisplacement(ballistic, 2)
+	if len(lagTimes) != 5 || lagTimes[0] != 2 || lagTimes[4] != 10 {
+		t.Fatalf("lag times = %v, want 2 to 10", lagTimes)
+	}
+	for k, value := range msd {
+		if want := math.Pow(0.3*float64(k+1), 2); math.Abs(value-want) > 1e-12 {
+			t.Errorf("ballistic MSD at lag %d = %v, want %v", k+1, value, want)
+		}
+	}
+
+	// diffusive: random walks of steps +-a per axis, MSD = 3 a^2 k and D = a^2 / (2 dt)
+	const atoms, steps, a, dt = 400, 40, 0.1, 1.0
+	rng := NewRNG(5)
+	positions := make([]TriTuple, atoms)
+	var diffusive []*Protein
+	for step := 0; step < steps; step++ {
+		builder := NewProteinBuilder().AddResidue("SOL", 1, "A")
+		for i := range positions {
+			builder.AddAtom("O", "O", positions[i].x, positions[i].y, positions[i].z)
+			for _, c := range []*float64{&positions[i].x, &positions[i].y, &positions[i].z} {
+				*c += a * float64(2*rng.Intn(2)-1)
+			}
+		}
+		diffusive = append(diffusive, builder.Build())
+	}
+	lagTimes, msd = MeanSquaredDisplacement(diffusive, dt)
+	for _, k := range []int{1, 5, 10} {
+		if want := 3 * a * a * float64(k); math.Abs(msd[k-1]-want) > 0.1*want {
+			t.Errorf("diffusive MSD at lag %d = %v, want about %v", k, msd[k-1], want)
+		}
+	}
+	if d, want := DiffusionCoefficient(lagTimes[:10], msd[:10]), a*a/(2*dt); math.Abs(d-want) > 0.1*want {
+		t.Errorf("DiffusionCoefficient() = %v, want about %v", d, want)
+	}
+}
+
+func TestCalculateProperDihedralsForceFiniteDifference(t *testing.T) {
+	inputFiles := ReadDirectory("Tests/CalculateProperDihedralsForce" + "/input")
+
+	for _, inputFile := range inputFiles {
+		pair, _ := readFileline("Tests/CalculateProperDihedralsForce/" + "input/" + inputFile.Name())
+		kd := convertStringToFloatSlice(pair[0])[0]
+		pn := convertStringToFloatSlice(pair[0])[1]
+		phase := convertStringToFloatSlice(pair[0])[2]
+
+		atoms := make([]*Atom, 4)
+		for i := range atoms {
+			position := convertStringToFloatSlice(pair[i+1])
+			atoms[i] = &Atom{position: TriTuple{x: position[0], y: position[1], z: position[2]}}
+		}
+		if Distance(atoms[0].position, atoms[1].position) == 0 {
+			continue
+		}
+		energy := func() float64 {
+			phi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3]) / 180 * math.Pi
+			return CalculateProperDihedralAngleEnergy(kd, phi, pn, phase)
+		}
+
+		phi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3]) / 180 * math.Pi
+		force1, force2, force3, force4 := CalculateProperDihedralsForce(kd, phi, pn, phase, atoms[0], atoms[1], atoms[2], atoms[3])
+		forces := []TriTuple{force1, force2, force3, force4}
+		AssertNetForceZero(t, 1e-15, forces...)
+
+		const h = 1e-6
+		for i, atom := range atoms {
+			coordinates := []*float64{&atom.position.x, &atom.position.y, &atom.position.z}
+			got := [3]float64{forces[i].x, forces[i].y, forces[i].z}
+			for d, coordinate := range coordinates {
+				original := *coordinate
+				*coordinate = original + h
+				plus := energy()
+				*coordinate = original - h
+				minus := energy()
+				*coordinate = original
+				gradient := (plus - minus) / (2 * h)
+				if want := -gradient / math.Pow10(6); math.Abs(got[d]-want) > 1e-6*math.Max(1e-6, math.Abs(want)) {
+					t.Errorf("%s atom %d force[%d] = %v, want %v", inputFile.Name(), i+1, d, got[d], want)
+				}
+			}
+		}
+	}
+}
+
+func TestAlignFrames(t *testing.T) {
+	// the same four atoms turned about a tilted axis and shifted in every frame
+	reference := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).
+		AddAtom("CA", "C", 1.46, 0, 0).
+		AddAtom("C", "C", 2, 1.4, 0).
+		AddAtom("CB", "C", 2, -1, 0.5).
+		Build()
+	axis := TriTuple{x: 1, y: 2, z: 2}
+	axis = scaleVector(axis, 1/magnitude(axis))
+	var frames []*Protein
+	for i := 0; i < 10; i++ {
+		frame := CopyProtein(reference)
+		rotation := axisRotation(axis, 0.3*float64(i))
+		for _, atom := range proteinAtoms(frame) {
+			atom.position = addVectors(rotate(rotation, atom.position), TriTuple{x: float64(i), y: -0.5 * float64(i), z: 2})
+		}
+		frames = append(frames, frame)
+	}
+
+	if rmsf := RMSF(frames); rmsf[1] < 0.5 {
+		t.Errorf("RMSF of the unaligned frames = %v, want the rigid motion to show", rmsf)
+	}
+	aligned := AlignFrames(frames)
+	for index, value := range RMSF(aligned) {
+		if value > 1e-9 {
+			t.Errorf("RMSF of atom %d after AlignFrames = %v, want 0", index, value)
+		}
+	}
+	for i, atom := range proteinAtoms(aligned[4]) {
+		if Distance(atom.position, proteinAtoms(frames[0])[i].position) > 1e-9 {
+			t.Errorf("aligned atom %d at %v, want %v", atom.index, atom.position, proteinAtoms(frames[0])[i].position)
+		}
+	}
+	if moved := proteinAtoms(frames[4])[0].position; Distance(moved, proteinAtoms(aligned[4])[0].position) < 1e-3 {
+		t.Errorf("AlignFrames moved the input frame")
+	}
+
+	// the mirror image cannot be superimposed by a rotation
+	mirror := CopyProtein(reference)
+	for _, atom := range proteinAtoms(mirror) {
+		atom.position.z = -atom.position.z
+	}
+	if rmsd := Superimpose(mirror, reference); rmsd < 0.1 {
+		t.Errorf("Superimpose() of the mirror image = %v, want a proper rotation with a non-zero RMSD", rmsd)
+	}
+	if det := determinant3(kabschRotation([3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, -1}})); math.Abs(det-1) > 1e-12 {
+		t.Errorf("kabschRotation() determinant = %v, want 1", det)
+	}
+}
+
+func TestUnitSystemsTotalEnergy(t *testing.T) {
+	builder := NewProteinBuilder().AddResidue("MOL", 1, "A")
+	for i := 0; i < 6; i++ {
+		builder.AddAtom("C", "C", 0.7*float64(i), 1.2*float64(i%2), 0.3*float64(i%3))
+	}
+	protein := builder.Build()
+	atoms := protein.Residue[0].Atoms
+	for i, atom := range atoms {
+		atom.charge = 0.3 - 0.1*float64(i)
+		atom.velocity = TriTuple{x: 0.001 * float64(i), y: -0.002, z: 0.0005 * float64(i*i)}
+	}
+
+	gromacs := NewTopology(protein)
+	gromacs.AddBond(atoms[0], atoms[1], 0.1526, 259408)
+	amber := NewTopology(protein)
+	amber.AddBond(atoms[0], atoms[1], 1.526, 259408/(2*4.184*100))
+	// the same Lennard-Jones parameters, sigma 0.34 nm and epsilon 0.4184 kJ/mol or 3.4 Angstrom and 0.1 kcal/mol
+	nonbondedGROMACS := parameterDatabase{ljTypes: map[string]LJParam{"C": {Sigma: 0.34, Epsilon: 0.4184}}}
+	nonbondedAMBER := parameterDatabase{ljTypes: map[string]LJParam{"C": {Sigma: 3.4, Epsilon: 0.1}}}.WithUnits(AMBERUnits)
+
+	if UnbondedEnergyOnly(protein, nonbondedGROMACS) == 0 {
+		t.Fatal("the test system has no non-bonded energy")
+	}
+	if a, b := UnbondedEnergyOnly(protein, nonbondedGROMACS), UnbondedEnergyOnly(protein, nonbondedAMBER); math.Abs(a-b) > 1e-9*math.Abs(a) {
+		t.Errorf("non-bonded energy %v kJ/mol from GROMACS parameters, %v from AMBER parameters", a, b)
+	}
+	// and as C6 and C12 coefficients per pair
+	c12nm, c6nm := ljCoefficients(LJParam{Sigma: 0.34, Epsilon: 0.4184})
+	c12A, c6A := ljCoefficients(LJParam{Sigma: 3.4, Epsilon: 0.1})
+	pairGROMACS := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{c6nm, c12nm}}}}
+	pairAMBER := parameterDatabase{atomPair: []*parameterPair{{atomName: []string{"C", "C"}, Function: 1, parameter: []float64{c6A, c12A}}}}.WithUnits(AMBERUnits)
+	if a, b := UnbondedEnergyOnly(protein, pairGROMACS), UnbondedEnergyOnly(protein, pairAMBER); math.Abs(a-b) > 1e-9*math.Abs(a) {
+		t.Errorf("non-bonded energy %v kJ/mol from C6 and C12 in nm, %v from C6 and C12 in Angstrom", a, b)
+	}
+	if a, b := UnbondedEnergyOnly(protein, pairGROMACS), UnbondedEnergyOnly(protein, nonbondedGROMACS); math.Abs(a-b) > 1e-9*math.Abs(a) {
+		t.Errorf("non-bonded energy %v kJ/mol from C6 and C12, %v from sigma and epsilon", a, b)
+	}
+
+	energyGROMACS := CalculateTotalEnergy(gromacs, parameterDatabase{}, nonbondedGROMACS)
+	energyAMBER := CalculateTotalEnergy(amber, parameterDatabase{}.WithUnits(AMBERUnits), nonbondedAMBER)
+	if math.Abs(energyGROMACS/energyAMBER-4.184) > 1e-9 {
+		t.Errorf("CalculateTotalEnergy() = %v kJ/mol and %v kcal/mol, want a ratio of 4.184", energyGROMACS, energyAMBER)
+	}
+	evaluated, _ := EvaluateForces(amber, parameterDatabase{}.WithUnits(AMBERUnits), nonbondedAMBER)
+	if math.Abs(evaluated-energyAMBER) > 1e-9 {
+		t.Errorf("EvaluateForces() energy = %v kcal/mol, want %v", evaluated, energyAMBER)
+	}
+
+	if ratio := KineticEnergy(protein) / KineticEnergy(protein, AMBERUnits); math.Abs(ratio-4.184) > 1e-12 {
+		t.Errorf("KineticEnergy() ratio = %v, want 4.184", ratio)
+	}
+	if a, b := Temperature(protein), Temperature(protein, AMBERUnits); a <= 0 || math.Abs(a-b) > 1e-9*a {
+		t.Errorf("Temperature() = %v K with GROMACS units and %v K with AMBER units", a, b)
+	}
+	state := Thermodynamics(protein, amber, parameterDatabase{}.WithUnits(AMBERUnits), nonbondedAMBER, nil)
+	if want := energyAMBER + KineticEnergy(protein, AMBERUnits); math.Abs(state.TotalEnergy-want) > 1e-9 {
+		t.Errorf("Thermodynamics() total energy = %v kcal/mol, want %v", state.TotalEnergy, want)
+	}
+}
+
+func TestReadPDBElements(t *testing.T) {
+	protein, err := readProteinFromFile("Tests/ReadPDBElements/input/ions.pdb")
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	// the carbon alpha and the calcium ion share the name CA, the element columns tell them apart
+	want := map[int]struct {
+		element string
+		mass    float64
+	}{
+		2: {"C", massTable["C"]},
+		4: {"NA", massTable["NA"]},
+		5: {"CA", massTable["CA"]},
+		6: {"MG", massTable["MG"]},
+	}
+	for _, atom := range proteinAtoms(&protein) {
+		expected, exist := want[atom.index]
+		if !exist {
+			continue
+		}
+		if atomElement(atom) != expected.element || atom.mass != expected.mass {
+			t.Errorf("atom %d %s = %s with mass %v, want %s with mass %v", atom.index, atom.element, atomElement(atom), atom.mass, expected.element, expected.mass)
+		}
+	}
+
+	// written back, the element columns hold the element and not the atom name
+	path := t.TempDir() + "/ions.pdb"
+	if err := WriteProteinToPDB(&protein, path); err != nil {
+		t.Fatalf("WriteProteinToPDB() error = %v", err)
+	}
+	reread, err := readProteinFromFile(path)
+	if err != nil {
+		t.Fatalf("readProteinFromFile() error = %v", err)
+	}
+	for i, atom := range proteinAtoms(&reread) {
+		if original := proteinAtoms(&protein)[i]; atomElement(atom) != atomElement(original) || atom.mass != original.mass {
+			t.Errorf("atom %d reread as %s with mass %v, want %s with mass %v", atom.index, atomElement(atom), atom.mass, atomElement(original), original.mass)
+		}
+	}
+}
+
+func TestShiftItpPairs(t *testing.T) {
+	pairs, err := ReadItpPairs("Tests/ReadItpPairs/input/butanol.itp")
+	if err != nil {
+		t.Fatalf("ReadItpPairs() error: %v", err)
+	}
+	butanol := func(builder *ProteinBuilder) *ProteinBuilder {
+		return builder.AddResidue("BUT", 2, "A").
+			AddAtom("C1", "C", 0, 0, 0).
+			AddAtom("C2", "C", 1.5, 0, 0).
+			AddAtom("C3", "C", 2.0, 1.4, 0).
+			AddAtom("O4", "O", 1.2, 2.5, 0).
+			AddAtom("H5", "H", 0.3, 2.2, 0)
+	}
+	alone := butanol(NewProteinBuilder()).Build()
+	// a water far away comes first, the butanol atoms are 4 to 8
+	solvated := butanol(NewProteinBuilder().
+		AddResidue("SOL", 1, "A").
+		AddAtom("OW", "O", 50, 50, 50).
+		AddAtom("HW1", "H", 50.96, 50, 50).
+		AddAtom("HW2", "H", 49.76, 50.93, 50)).Build()
+	nonbonded := parameterDatabase{atomPair: []*parameterPair{
+		{atomName: []string{"C1", "H5"}, Function: 1, parameter: []float64{5e-3, 5e-6}},
+		{atomName: []string{"H5", "C1"}, Function: 1, parameter: []float64{5e-3, 5e-6}},
+		{atomName: []string{"C2", "H5"}, Function: 1, parameter: []float64{2e-3, 3e-6}},
+		{atomName: []string{"H5", "C2"}, Function: 1, parameter: []float64{2e-3, 3e-6}},
+	}}
+
+	shifted := ShiftItpPairs(pairs, 3)
+	want := []ItpPair{
+		{Atom1: 4, Atom2: 7, Function: 1, Parameter: []float64{1.1e-03, 1.2e-06}},
+		{Atom1: 5, Atom2: 8, Function: 1},
+	}
+	if !reflect.DeepEqual(shifted, want) {
+		t.Fatalf("ShiftItpPairs() = %+v, want %+v", shifted, want)
+	}
+	if pairs[0].Atom1 != 1 {
+		t.Errorf("ShiftItpPairs() changed its input to %+v", pairs)
+	}
+
+	energyAlone, _ := CalculateTotalUnbondedEnergyForce(alone, nonbonded.WithPairs(pairs, 0.5))
+	energySolvated, forceMap := CalculateTotalUnbondedEnergyForce(solvated, nonbonded.WithPairs(shifted, 0.5))
+	if math.Abs(energyAlone-energySolvated) > 1e-15 {
+		t.Errorf("energy with the shifted pairs = %v, want the energy of the butanol alone %v", energySolvated, energyAlone)
+	}
+	for index := 1; index <= 3; index++ {
+		if *forceMap[index] != (TriTuple{}) {
+			t.Errorf("water atom %d feels %v, want no force", index, *forceMap[index])
+		}
+	}
+}
+
+func TestAssignChargeGroupsTerminal(t *testing.T) {
+	protein := NewProteinBuilder().
+		AddResidue("ALA", 1, "A").
+		AddAtom("N", "N", 0, 0, 0).AddAtom("H1", "H", -0.5, 0.8, 0).AddAtom("CA", "C", 1.46, 0, 0).
+		AddAtom("CB", "C", 2, -1.4, 0).AddAtom("C", "C", 2, 1.4, 0).AddAtom("O", "O", 1.5, 2.4, 0).
+		AddResidue("ALA", 2, "A").
+		AddAtom("N", "N", 3.3, 1.5, 0).AddAtom("CA", "C", 4, 2.8, 0).AddAtom("CB", "C", 5.4, 2.6, 0).
+		AddAtom("C", "C", 3.6, 3.9, 0).AddAtom("O", "O", 4.2, 5, 0).
+		Build()
+	protein.MarkTermini()
+	protein.AssignChargeGroups(map[string]map[string]AtomChargeData{
+		// CB is ungrouped, N-terminal N, H1 and CA form one group apart from the plain entry's
+		"ALA":  {"N": {ChargeGroup: 1}, "CA": {ChargeGroup: 1}, "CB": {ChargeGroup: 0}, "C": {ChargeGroup: 2}, "O": {ChargeGroup: 2}},
+		"NALA": {"N": {ChargeGroup: 1}, "H1": {ChargeGroup: 1}, "CA": {ChargeGroup: 1}},
+	})
+
+	want := [][]int{{1, 1, 1, 0, 2, 2}, {3, 3, 0, 4, 4}}
+	for i, residue := range protein.Residue {
+		for j, atom := range residue.Atoms {
+			if atom.chargeGroup != want[i][j] {
+				t.Errorf("residue %d atom %s charge group = %d, want %d", residue.ID, atom.element, atom.chargeGroup, want[i][j])
+			}
+		}
+	}
+}
+
+func TestChargeGroupCentersPeriodic(t *testing.T) {
+	// a group split across the x boundary of a 20 Angstrom box
+	protein := NewProteinBuilder().
+		AddResidue("DIP", 1, "A").
+		AddAtom("Q1", "O", 19.5, 5, 5).AddAtom("Q2", "O", 0.5, 5, 5).
+		Build()
+	for _, atom := range proteinAtoms(protein) {
+		atom.chargeGroup = 1
+	}
+	box := Box{X: 20, Y: 20, Z: 20}
+	center := chargeGroupCenters(protein, &box)[1]
+	if PeriodicDistance(center, TriTuple{x: 0, y: 5, z: 5}, box) > 1e-12 {
+		t.Errorf("center of the split group = %v, want the boundary at x = 0", center)
+	}
+	if center := chargeGroupCenters(protein, nil)[1]; Distance(center, TriTuple{x: 10, y: 5, z: 5}) > 1e-12 {
+		t.Errorf("center without a box = %v, want (10, 5, 5)", center)
+	}
+}
+
+func TestChargeGroupsFromChargeFile(t *testing.T) {
+	protein, err := readProteinFromFile("../data/calmodulin_noCA.pdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chargeGroupData, err := parseChargeGroupFile("../data/OPLS_atom_charge.rtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chargeData, err := parseChargeFile("../data/OPLS_atom_charge.rtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chargeValues(chargeGroupData), chargeData) {
+		t.Errorf("chargeValues() of the charge group data differs from parseChargeFile()")
+	}
+
+	protein.AssignChargeGroups(chargeGroupData)
+	// a group stays within its residue
+	residueOf := make(map[int]*Residue)
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if atom.chargeGroup == 0 {
+				continue
+			}
+			if other, seen := residueOf[atom.chargeGroup]; seen && other != residue {
+				t.Errorf("charge group %d is in residues %d and %d", atom.chargeGroup, other.ID, residue.ID)
+			}
+			residueOf[atom.chargeGroup] = residue
+		}
+	}
+	if len(residueOf) <= len(protein.Residue) {
+		t.Errorf("calmodulin got %d charge groups for %d residues, want several per residue", len(residueOf), len(protein.Residue))
+	}
+}
+
 // //////////
 // Readtest area
 // //////////
@@ -3,11 +3,16 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
@@ -18,9 +23,30 @@ import (
 // ////These function are used for read protein from PDB
 // ///////////////
 
+// readOptions holds the optional inputs of readProteinFromFile
+type readOptions struct {
+	velocityFile string
+}
+
+// ReadOption configures readProteinFromFile
+type ReadOption func(*readOptions)
+
+// WithVelocityFile makes readProteinFromFile read the velocities of the atoms
+// from a companion file with one "vx vy vz" line per atom in index order
+func WithVelocityFile(path string) ReadOption {
+	return func(o *readOptions) {
+		o.velocityFile = path
+	}
+}
+
 // readProteinFromFile take a fileName as example
 // return the Protein structure using the informtion of file
-func readProteinFromFile(filepath string) (Protein, error) {
+func readProteinFromFile(filepath string, opts ...ReadOption) (Protein, error) {
+	var options readOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	file, err := os.Open(filepath)
 	if err != nil {
 		return Protein{}, err
@@ -29,11 +55,31 @@ func readProteinFromFile(filepath string) (Protein, error) {
 
 	var protein Protein
 	var currentResidue *Residue
+	// CONECT records refer to atoms by their serial in the file
+	serials := make(map[int]*Atom)
+	var conectLines []string
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if strings.HasPrefix(line, "ATOM") {
+		// TER closes the current chain, the next atom always starts a new residue
+		if strings.HasPrefix(line, "TER") {
+			currentResidue = nil
+			continue
+		}
+		if strings.HasPrefix(line, "CONECT") {
+			conectLines = append(conectLines, line)
+			continue
+		}
+		if strings.HasPrefix(line, "CRYST1") {
+			box, err := parseCryst1(line)
+			if err != nil {
+				return Protein{}, err
+			}
+			protein.Box = box
+			continue
+		}
+		if strings.HasPrefix(line, "ATOM") || strings.HasPrefix(line, "HETATM") {
 			parts := strings.Fields(line)
 			if len(parts) < 11 {
 				continue
@@ -48,7 +94,7 @@ func readProteinFromFile(filepath string) (Protein, error) {
 			y, _ := strconv.ParseFloat(parts[7], 64)
 			z, _ := strconv.ParseFloat(parts[8], 64)
 
-			if currentResidue == nil || currentResidue.ID != residueID {
+			if currentResidue == nil || currentResidue.ID != residueID || currentResidue.ChainID != chainID {
 				currentResidue = &Residue{
 					Name:    residueName,
 					ID:      residueID,
@@ -62,8 +108,11 @@ func readProteinFromFile(filepath string) (Protein, error) {
 				index:    atomIndex,
 				position: TriTuple{x: x, y: y, z: z},
 				element:  element,
+				// element symbol of columns 77-78, when the record has one
+				symbol: strings.ToUpper(strings.TrimSpace(fixedColumn(line, 76, 78))),
 			}
 			currentResidue.Atoms = append(currentResidue.Atoms, atom)
+			serials[atomIndex] = atom
 		}
 	}
 
@@ -71,22 +120,210 @@ func readProteinFromFile(filepath string) (Protein, error) {
 		return Protein{}, err
 	}
 
+	for _, line := range conectLines {
+		bonds, err := parseConect(line, serials)
+		if err != nil {
+			return Protein{}, err
+		}
+		protein.addExplicitBonds(bonds)
+	}
+
+	protein.MarkTermini()
+	protein.MarkVariants()
+
 	// upload weight of each atoms
 	protein.UpdateMasses(massTable)
 
+	if options.velocityFile != "" {
+		if err := protein.readVelocities(options.velocityFile); err != nil {
+			return Protein{}, err
+		}
+	}
+
 	return protein, nil
 }
 
+// parseCryst1 take a CRYST1 record and return the periodic box it describes,
+// or nil for the 1 x 1 x 1 placeholder cell.
+// Only orthorhombic cells are supported, other cell angles are an error.
+func parseCryst1(line string) (*Box, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("invalid CRYST1 record: %s", line)
+	}
+
+	var values [6]float64
+	for i := range values {
+		value, err := strconv.ParseFloat(fields[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s' in CRYST1 record: %s", fields[i+1], line)
+		}
+		values[i] = value
+	}
+	for _, angle := range values[3:] {
+		if math.Abs(angle-90) > 1e-3 {
+			return nil, fmt.Errorf("non-orthorhombic cell (angles %v, %v, %v) is not supported", values[3], values[4], values[5])
+		}
+	}
+
+	// structures not solved by crystallography carry a unitary cell
+	if values[0] == 1 && values[1] == 1 && values[2] == 1 {
+		return nil, nil
+	}
+
+	return &Box{X: values[0], Y: values[1], Z: values[2]}, nil
+}
+
+// parseConect take a CONECT record and the atoms by serial
+// and return the bonds between the first atom and the following ones
+func parseConect(line string, serials map[int]*Atom) ([][2]*Atom, error) {
+	// serials are in fixed columns of width 5 starting at column 7
+	var numbers []int
+	for start := 6; start < len(line); start += 5 {
+		end := min(start+5, len(line))
+		field := strings.TrimSpace(line[start:end])
+		if field == "" {
+			continue
+		}
+		serial, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid serial '%s' in CONECT record: %s", field, line)
+		}
+		numbers = append(numbers, serial)
+	}
+	if len(numbers) < 2 {
+		return nil, nil
+	}
+
+	atom1, exist := serials[numbers[0]]
+	if !exist {
+		return nil, fmt.Errorf("CONECT record refers to unknown atom %d: %s", numbers[0], line)
+	}
+	var bonds [][2]*Atom
+	for _, serial := range numbers[1:] {
+		atom2, exist := serials[serial]
+		if !exist {
+			return nil, fmt.Errorf("CONECT record refers to unknown atom %d: %s", serial, line)
+		}
+		bonds = append(bonds, [2]*Atom{atom1, atom2})
+	}
+	return bonds, nil
+}
+
+// addExplicitBonds adds bonds to the protein, skipping the ones it already has
+// in either direction (CONECT usually lists every bond from both ends)
+func (p *Protein) addExplicitBonds(bonds [][2]*Atom) {
+	for _, bond := range bonds {
+		known := false
+		for _, existing := range p.ExplicitBonds {
+			if (existing[0] == bond[0] && existing[1] == bond[1]) || (existing[0] == bond[1] && existing[1] == bond[0]) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			p.ExplicitBonds = append(p.ExplicitBonds, bond)
+		}
+	}
+}
+
+// readVelocities take a velocity file with one "vx vy vz" line per atom
+// and set the velocity of every atom of the protein in order
+func (p *Protein) readVelocities(filepath string) error {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var velocities []TriTuple
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid velocity line: %s", line)
+		}
+		var values [3]float64
+		for i, field := range fields {
+			values[i], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				return fmt.Errorf("invalid velocity '%s' in line: %s", field, line)
+			}
+		}
+		velocities = append(velocities, TriTuple{x: values[0], y: values[1], z: values[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, residue := range p.Residue {
+		count += len(residue.Atoms)
+	}
+	if count != len(velocities) {
+		return fmt.Errorf("velocity file %s has %d entries but the protein has %d atoms", filepath, len(velocities), count)
+	}
+
+	i := 0
+	for _, residue := range p.Residue {
+		for _, atom := range residue.Atoms {
+			atom.velocity = velocities[i]
+			i++
+		}
+	}
+
+	return nil
+}
+
+// LoadProteinsConcurrent reads the PDB files in paths with a pool of workers
+// and return the proteins and the errors in the same order as the paths
+func LoadProteinsConcurrent(paths []string, workers int) ([]*Protein, []error) {
+	proteins := make([]*Protein, len(paths))
+	errs := make([]error, len(paths))
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				protein, err := readProteinFromFile(paths[i])
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				proteins[i] = &protein
+			}
+		}()
+	}
+
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return proteins, errs
+}
+
 func (p *Protein) UpdateMasses(massTable map[string]float64) {
 	for _, residue := range p.Residue {
 		for _, atom := range residue.Atoms {
-			// Extract the first character of the element to match in the mass table
-			baseElement := string(atom.element[0])
+			// atom.element holds the atom name, the element comes from the file when it has one
+			baseElement := atomElement(atom)
 
 			if mass, found := massTable[baseElement]; found {
 				atom.mass = mass
 			} else {
-				fmt.Printf("Warning: Mass not found for element %s (using base element %s)\n", atom.element, baseElement)
+				logger.Printf("Warning: Mass not found for element %s (using base element %s)", atom.element, baseElement)
 				atom.mass = 0.0 //
 			}
 		}
@@ -95,14 +332,211 @@ func (p *Protein) UpdateMasses(massTable map[string]float64) {
 
 // the mass table for the common atoms in protein
 var massTable = map[string]float64{
-	"H": 1.0079,
-	"C": 12.0107,
-	"N": 14.0067,
-	"O": 15.9994,
-	"S": 32.065,
+	"H":  1.0079,
+	"C":  12.0107,
+	"N":  14.0067,
+	"O":  15.9994,
+	"S":  32.065,
+	"P":  30.974,
+	"CL": 35.453,
+	"MG": 24.305,
+	"FE": 55.845,
+	"ZN": 65.38,
+	"AR": 39.948,
+	"F":  18.998,
+	"BR": 79.904,
+	"I":  126.904,
+	"SE": 78.971,
+	"NA": 22.990,
+	"K":  39.098,
+	"CA": 40.078,
+	"MN": 54.938,
+	"CU": 63.546,
+	"CD": 112.414,
+	"HG": 200.592,
 	// Add more elements as needed
 }
 
+// the van der Waals radii (in Angstrom) of the common atoms in protein
+var vdwRadii = map[string]float64{
+	"H":  1.20,
+	"C":  1.70,
+	"N":  1.55,
+	"O":  1.52,
+	"S":  1.80,
+	"P":  1.80,
+	"CL": 1.75,
+	"MG": 1.73,
+	"FE": 1.94,
+	"ZN": 1.39,
+}
+
+// VdwRadius returns the van der Waals radius of the element of an atom
+// and 0 if the element is unknown
+func VdwRadius(atom *Atom) float64 {
+	return vdwRadii[atomElement(atom)]
+}
+
+// largestVdwRadius return the largest radius of vdwRadii
+func largestVdwRadius() float64 {
+	largest := 0.0
+	for _, radius := range vdwRadii {
+		largest = math.Max(largest, radius)
+	}
+	return largest
+}
+
+// atomElement returns the element symbol of an atom in upper case: the one read
+// with the atom when there is one, inferred from its name with ElementFromAtomName otherwise
+func atomElement(atom *Atom) string {
+	if atom.symbol != "" {
+		return atom.symbol
+	}
+	return ElementFromAtomName(atom.element)
+}
+
+// elements that appear in protein atom names followed by a remote indicator
+// (CA = carbon alpha, NE = nitrogen epsilon, HG = hydrogen gamma, ...)
+var organicElements = "CNOHS"
+
+// greek remote indicators used in PDB atom names
+var remoteIndicators = "ABGDEZH"
+
+// two-letter element symbols recognised in atom names
+var twoLetterElements = map[string]bool{
+	"CL": true,
+	"BR": true,
+	"FE": true,
+	"MG": true,
+	"ZN": true,
+	"MN": true,
+	"CU": true,
+	"NI": true,
+}
+
+// ElementFromAtomName takes a PDB atom name such as "CA", "HB1" or "1HG2"
+// and returns its element symbol in upper case.
+// Leading digits are stripped. A name that starts with C, N, O, H or S followed
+// by a remote indicator is read as that single-letter element, so "CA" is
+// carbon alpha rather than calcium and "NA" is nitrogen alpha rather than sodium.
+// Otherwise a known two-letter symbol (CL, MG, FE, ...) wins over the first letter.
+// Ions named like an organic atom are only told apart by the element columns of
+// their PDB record, which atomElement prefers over the name.
+func ElementFromAtomName(name string) string {
+	name = strings.ToUpper(strings.TrimLeft(strings.TrimSpace(name), "0123456789"))
+	if name == "" {
+		return ""
+	}
+
+	if len(name) >= 2 {
+		if strings.IndexByte(organicElements, name[0]) >= 0 && strings.IndexByte(remoteIndicators, name[1]) >= 0 {
+			return name[:1]
+		}
+		if twoLetterElements[name[:2]] {
+			return name[:2]
+		}
+	}
+
+	return name[:1]
+}
+
+// ///////////////
+// ////These function are used for read ligands from MOL/SDF
+// ///////////////
+
+// ReadMolFile take a MOL file, or the first record of an SDF file, in the V2000 format
+// and return its atoms as a single-residue protein together with its bonds and their orders.
+// Atoms are named by element and number (C1, C2, ...) and indexed from 1 as in the file,
+// they keep the element of the atom block, which sets their mass. The bonds are also
+// recorded as the explicit bonds of the protein.
+func ReadMolFile(path string) (*Protein, []Bond, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "M  END") || strings.HasPrefix(line, "$$$$") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// three header lines, then the counts line "aaabbb...V2000"
+	if len(lines) < 4 {
+		return nil, nil, fmt.Errorf("%s: missing MOL header", path)
+	}
+	counts := lines[3]
+	if strings.Contains(counts, "V3000") {
+		return nil, nil, fmt.Errorf("%s: V3000 MOL files are not supported", path)
+	}
+	atomCount, err1 := strconv.Atoi(strings.TrimSpace(fixedColumn(counts, 0, 3)))
+	bondCount, err2 := strconv.Atoi(strings.TrimSpace(fixedColumn(counts, 3, 6)))
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("%s: invalid counts line %q", path, counts)
+	}
+	if len(lines) < 4+atomCount+bondCount {
+		return nil, nil, fmt.Errorf("%s: %d atoms and %d bonds announced, %d lines found", path, atomCount, bondCount, len(lines)-4)
+	}
+
+	residue := &Residue{Name: "LIG", ID: 1, ChainID: "A"}
+	protein := &Protein{Name: strings.TrimSpace(lines[0]), Residue: []*Residue{residue}}
+	for i, line := range lines[4 : 4+atomCount] {
+		// xxxxx.xxxxyyyyy.yyyyzzzzz.zzzz aaa, the coordinates may run into each other
+		var position [3]float64
+		for j := range position {
+			if position[j], err = strconv.ParseFloat(strings.TrimSpace(fixedColumn(line, 10*j, 10*j+10)), 64); err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid atom line %q: %v", path, line, err)
+			}
+		}
+		symbol := strings.TrimSpace(fixedColumn(line, 31, 34))
+		if symbol == "" {
+			return nil, nil, fmt.Errorf("%s: atom line without element %q", path, line)
+		}
+		residue.Atoms = append(residue.Atoms, &Atom{
+			index:    i + 1,
+			position: TriTuple{x: position[0], y: position[1], z: position[2]},
+			element:  fmt.Sprintf("%s%d", symbol, i+1),
+			symbol:   strings.ToUpper(symbol),
+		})
+	}
+
+	var bonds []Bond
+	for _, line := range lines[4+atomCount : 4+atomCount+bondCount] {
+		atom1, err1 := strconv.Atoi(strings.TrimSpace(fixedColumn(line, 0, 3)))
+		atom2, err2 := strconv.Atoi(strings.TrimSpace(fixedColumn(line, 3, 6)))
+		order, err3 := strconv.Atoi(strings.TrimSpace(fixedColumn(line, 6, 9)))
+		if err1 != nil || err2 != nil || err3 != nil || atom1 < 1 || atom1 > atomCount || atom2 < 1 || atom2 > atomCount {
+			return nil, nil, fmt.Errorf("%s: invalid bond line %q", path, line)
+		}
+		bonds = append(bonds, Bond{Atom1: residue.Atoms[atom1-1], Atom2: residue.Atoms[atom2-1], Order: order})
+	}
+
+	explicit := make([][2]*Atom, len(bonds))
+	for i, bond := range bonds {
+		explicit[i] = [2]*Atom{bond.Atom1, bond.Atom2}
+	}
+	protein.addExplicitBonds(explicit)
+	protein.UpdateMasses(massTable)
+
+	return protein, bonds, nil
+}
+
+// fixedColumn return the columns [start, end) of a fixed-width line, cut short at its end
+func fixedColumn(line string, start, end int) string {
+	if start >= len(line) {
+		return ""
+	}
+	return line[start:min(end, len(line))]
+}
+
 // ///////////////
 // ////These function are used for read parameter for MDsimulation
 // ///////////////
@@ -218,11 +652,173 @@ func GetFirstLine(filePath string) (string, error) {
 	return "", fmt.Errorf("file does not have any lines")
 }
 
+// ///////////////
+// ////These function are used for serialising a parameterDatabase as JSON
+// ///////////////
+
+type parameterPairJSON struct {
+	AtomNames  []string  `json:"atoms"`
+	Function   int       `json:"function"`
+	Parameters []float64 `json:"parameters"`
+}
+
+type parameterDatabaseJSON struct {
+	Pairs         []parameterPairJSON `json:"pairs"`
+	LJTypes       map[string]LJParam  `json:"ljTypes,omitempty"`
+	CombiningRule CombiningRule       `json:"combiningRule"`
+	LJExceptions  []ljExceptionJSON   `json:"ljExceptions,omitempty"`
+	Units         *UnitSystem         `json:"units,omitempty"`
+	CutoffScheme  CutoffScheme        `json:"cutoffScheme"`
+	ExplicitPairs []ItpPair           `json:"explicitPairs,omitempty"`
+	FudgeQQ       float64             `json:"fudgeQQ,omitempty"`
+}
+
+// ljExceptionJSON is one pair exception, JSON objects cannot be keyed on a type pair
+type ljExceptionJSON struct {
+	Types   [2]string `json:"types"`
+	Sigma   float64   `json:"sigma"`
+	Epsilon float64   `json:"epsilon"`
+}
+
+// MarshalJSON writes the atom names, function type and parameters of every pair,
+// with the Lennard-Jones types, the units, the cutoff scheme and the explicit 1-4 pairs
+func (db parameterDatabase) MarshalJSON() ([]byte, error) {
+	out := parameterDatabaseJSON{
+		Pairs:         make([]parameterPairJSON, len(db.atomPair)),
+		LJTypes:       db.ljTypes,
+		CombiningRule: db.combiningRule,
+		CutoffScheme:  db.cutoffScheme,
+		ExplicitPairs: db.pairs,
+		FudgeQQ:       db.fudgeQQ,
+	}
+	if db.units != (UnitSystem{}) {
+		units := db.units
+		out.Units = &units
+	}
+	for i, pair := range db.atomPair {
+		out.Pairs[i] = parameterPairJSON{AtomNames: pair.atomName, Function: pair.Function, Parameters: pair.parameter}
+	}
+	for types, param := range db.ljExceptions {
+		out.LJExceptions = append(out.LJExceptions, ljExceptionJSON{Types: types, Sigma: param.Sigma, Epsilon: param.Epsilon})
+	}
+	// map order is random, keep the file stable
+	sort.Slice(out.LJExceptions, func(i, j int) bool {
+		a, b := out.LJExceptions[i].Types, out.LJExceptions[j].Types
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads a database written by MarshalJSON
+func (db *parameterDatabase) UnmarshalJSON(data []byte) error {
+	var in parameterDatabaseJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	db.atomPair = make([]*parameterPair, len(in.Pairs))
+	for i, pair := range in.Pairs {
+		db.atomPair[i] = &parameterPair{atomName: pair.AtomNames, Function: pair.Function, parameter: pair.Parameters}
+	}
+	db.ljTypes = in.LJTypes
+	db.combiningRule = in.CombiningRule
+	db.units = UnitSystem{}
+	if in.Units != nil {
+		db.units = *in.Units
+	}
+	db.cutoffScheme = in.CutoffScheme
+	db.pairs = in.ExplicitPairs
+	db.fudgeQQ = in.FudgeQQ
+	db.ljExceptions = nil
+	if len(in.LJExceptions) > 0 {
+		db.ljExceptions = make(map[[2]string]LJParam)
+		for _, exception := range in.LJExceptions {
+			db.ljExceptions[ljExceptionKey(exception.Types[0], exception.Types[1])] = LJParam{Sigma: exception.Sigma, Epsilon: exception.Epsilon}
+		}
+	}
+	return nil
+}
+
+// WriteParameterJSON writes a parameterDatabase to a JSON file
+func WriteParameterJSON(db parameterDatabase, filePath string) error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+// ReadParameterJSON reads a parameterDatabase written by WriteParameterJSON
+func ReadParameterJSON(filePath string) (parameterDatabase, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return parameterDatabase{}, err
+	}
+
+	var db parameterDatabase
+	if err := json.Unmarshal(data, &db); err != nil {
+		return parameterDatabase{}, err
+	}
+	return db, nil
+}
+
+// parameterCacheSuffix is appended to the path of a parameter file to name its cache
+const parameterCacheSuffix = ".cache.json"
+
+// LoadParametersCached reads a parameter file like ReadParameterFile and keeps the
+// parsed database as JSON next to it (path + parameterCacheSuffix), or in the temporary
+// directory when the directory of the file is not writable. Later calls read the cache
+// as long as the source file was not modified after it was written.
+func LoadParametersCached(path string) (parameterDatabase, error) {
+	source, err := os.Stat(path)
+	if err != nil {
+		return parameterDatabase{}, err
+	}
+
+	cachePaths := []string{path + parameterCacheSuffix, parameterTempCache(path)}
+	for _, cachePath := range cachePaths {
+		cache, err := os.Stat(cachePath)
+		if err != nil || source.ModTime().After(cache.ModTime()) {
+			continue
+		}
+		if db, err := ReadParameterJSON(cachePath); err == nil {
+			return db, nil
+		}
+	}
+
+	db, err := ReadParameterFile(path)
+	if err != nil {
+		return parameterDatabase{}, err
+	}
+	for _, cachePath := range cachePaths {
+		if err := WriteParameterJSON(db, cachePath); err == nil {
+			return db, nil
+		}
+	}
+	logger.Printf("Warning: could not write a parameter cache for %s", path)
+	return db, nil
+}
+
+// parameterTempCache return the cache path of a parameter file in the temporary directory,
+// named after its absolute path so that files of the same name do not share a cache
+func parameterTempCache(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		absolute = path
+	}
+	name := strings.NewReplacer(string(filepath.Separator), "_", ":", "_").Replace(absolute)
+	return filepath.Join(os.TempDir(), "gomad"+name+parameterCacheSuffix)
+}
+
 // ///////////////
 // ////These function are used for read parameter for aminoacids.rtp
 // ///////////////
 
 // ****highest level function****
+// ReadAminoAcidsPara reads every residue entry of an rtp file keyed by its name, so the
+// terminal (NALA, CALA) and protonation (HID, HIE, HIP, HISD, HISE, HISH, ...) variants
+// are loaded as entries of their own next to the base residue. The charge and charge
+// group of an atom are kept in the x and y of its atoms entry.
 func ReadAminoAcidsPara(fileName string) (map[string]residueParameter, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -304,18 +900,301 @@ func ReadAminoAcidsPara(fileName string) (map[string]residueParameter, error) {
 	return residues, nil
 }
 
+// RtpCharges takes the residues read by ReadAminoAcidsPara
+// and return the charge of every atom by residue entry and atom name, variants included,
+// in the form AssignChargesToProtein takes
+func RtpCharges(residues map[string]residueParameter) map[string]map[string]float64 {
+	charges := make(map[string]map[string]float64, len(residues))
+	for name, residue := range residues {
+		charges[name] = make(map[string]float64, len(residue.atoms))
+		for _, atom := range residue.atoms {
+			charges[name][atom.atoms[0]] = atom.x
+		}
+	}
+	return charges
+}
+
+// ///////////////
+// ////These function are used for read the [ atoms ] section of a GROMACS .itp topology
+// ///////////////
+
+// ItpAtom is one line of the [ atoms ] section of an .itp file
+type ItpAtom struct {
+	Index         int
+	Type          string
+	ResidueNumber int
+	Residue       string
+	Name          string
+	ChargeGroup   int
+	Charge        float64
+	Mass          float64
+}
+
+// ReadItpAtoms take an .itp file
+// and return the atoms of its [ atoms ] section. The mass column is optional
+// and left at 0 when missing.
+func ReadItpAtoms(path string) ([]ItpAtom, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var atoms []ItpAtom
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// drop comments
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != "atoms" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("invalid [ atoms ] line: %s", line)
+		}
+
+		var atom ItpAtom
+		var errs [5]error
+		atom.Index, errs[0] = strconv.Atoi(fields[0])
+		atom.Type = fields[1]
+		atom.ResidueNumber, errs[1] = strconv.Atoi(fields[2])
+		atom.Residue = fields[3]
+		atom.Name = fields[4]
+		atom.ChargeGroup, errs[2] = strconv.Atoi(fields[5])
+		atom.Charge, errs[3] = strconv.ParseFloat(fields[6], 64)
+		if len(fields) >= 8 {
+			atom.Mass, errs[4] = strconv.ParseFloat(fields[7], 64)
+		}
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("invalid [ atoms ] line %q: %v", line, err)
+			}
+		}
+		atoms = append(atoms, atom)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return atoms, nil
+}
+
+// ReadNonbondParams take a GROMACS topology file
+// and return the pair exceptions (NBFIX) of its [ nonbond_params ] section, "i j func sigma epsilon"
+// as written for combination rules 2 and 3, for use with WithLJExceptions
+func ReadNonbondParams(path string) (map[[2]string]LJParam, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	exceptions := make(map[[2]string]LJParam)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// drop comments
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != "nonbond_params" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("invalid [ nonbond_params ] line: %s", line)
+		}
+		sigma, errSigma := strconv.ParseFloat(fields[3], 64)
+		epsilon, errEpsilon := strconv.ParseFloat(fields[4], 64)
+		if errSigma != nil || errEpsilon != nil {
+			return nil, fmt.Errorf("invalid [ nonbond_params ] line: %s", line)
+		}
+		exceptions[ljExceptionKey(fields[0], fields[1])] = LJParam{Sigma: sigma, Epsilon: epsilon}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return exceptions, nil
+}
+
+// ItpPair is one line of the [ pairs ] section of an .itp file: an explicit 1-4 pair
+// given by the indices of its atoms and, when listed, its own [c6 c12] parameters
+type ItpPair struct {
+	Atom1     int
+	Atom2     int
+	Function  int
+	Parameter []float64
+}
+
+// ReadItpPairs take an .itp file
+// and return the 1-4 pairs of its [ pairs ] section. Pairs without parameters
+// take the ones of the non-bonded database. The atom indices are those of the
+// .itp, counted from 1 within the molecule, ShiftItpPairs moves them to the
+// indices of the molecule in a protein.
+func ReadItpPairs(path string) ([]ItpPair, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pairs []ItpPair
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// drop comments
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != "pairs" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid [ pairs ] line: %s", line)
+		}
+
+		var pair ItpPair
+		var errs [3]error
+		pair.Atom1, errs[0] = strconv.Atoi(fields[0])
+		pair.Atom2, errs[1] = strconv.Atoi(fields[1])
+		pair.Function, errs[2] = strconv.Atoi(fields[2])
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("invalid [ pairs ] line %q: %v", line, err)
+			}
+		}
+		for _, field := range fields[3:] {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid [ pairs ] line %q: %v", line, err)
+			}
+			pair.Parameter = append(pair.Parameter, value)
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// ShiftItpPairs takes the pairs of a molecule and the number of atoms before it in the
+// protein and return a copy of the pairs with both atom indices shifted by offset, so
+// that the pairs of an .itp apply to the molecule whose first atom has index offset+1
+func ShiftItpPairs(pairs []ItpPair, offset int) []ItpPair {
+	shifted := make([]ItpPair, len(pairs))
+	for i, pair := range pairs {
+		shifted[i] = pair
+		shifted[i].Atom1 += offset
+		shifted[i].Atom2 += offset
+	}
+	return shifted
+}
+
+// ApplyItpAtoms sets the charge, the charge group, and the mass when given, of every atom of the protein
+// from the .itp atoms in order. The atom names must match.
+func (p *Protein) ApplyItpAtoms(itpAtoms []ItpAtom) error {
+	i := 0
+	for _, residue := range p.Residue {
+		for _, atom := range residue.Atoms {
+			if i >= len(itpAtoms) {
+				return fmt.Errorf("the topology has %d atoms but the protein has more", len(itpAtoms))
+			}
+			if itpAtoms[i].Name != atom.element {
+				return fmt.Errorf("atom %d is %s in the protein but %s in the topology", atom.index, atom.element, itpAtoms[i].Name)
+			}
+			atom.charge = itpAtoms[i].Charge
+			atom.chargeGroup = itpAtoms[i].ChargeGroup
+			if itpAtoms[i].Mass > 0 {
+				atom.mass = itpAtoms[i].Mass
+			}
+			i++
+		}
+	}
+	if i != len(itpAtoms) {
+		return fmt.Errorf("the topology has %d atoms but the protein has %d", len(itpAtoms), i)
+	}
+
+	return nil
+}
+
 // ///////////////
 // ////These function are used for read parameter for charge
 // ///////////////
 // ****highest level function****
 func parseChargeFile(filename string) (map[string]map[string]float64, error) {
+	chargeGroupData, err := parseChargeGroupFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return chargeValues(chargeGroupData), nil
+}
+
+// chargeValues takes the data of parseChargeGroupFile
+// and return only the charge of every atom, as parseChargeFile does
+func chargeValues(chargeGroupData map[string]map[string]AtomChargeData) map[string]map[string]float64 {
+	chargeData := make(map[string]map[string]float64)
+	for residue, atoms := range chargeGroupData {
+		chargeData[residue] = make(map[string]float64)
+		for atomName, data := range atoms {
+			chargeData[residue][atomName] = data.AtomCharge
+		}
+	}
+	return chargeData
+}
+
+// parseChargeGroupFile reads the same file as parseChargeFile but keeps the atom type
+// and the charge group (4th column, 0 when missing) of every atom
+func parseChargeGroupFile(filename string) (map[string]map[string]AtomChargeData, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	chargeData := make(map[string]map[string]float64)
+	chargeData := make(map[string]map[string]AtomChargeData)
 	scanner := bufio.NewScanner(file)
 	var currentResidue string
 
@@ -330,7 +1209,7 @@ func parseChargeFile(filename string) (map[string]map[string]float64, error) {
 		// Check for residue header lines like "[ ALA ]"
 		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
 			currentResidue = strings.TrimSpace(line[1 : len(line)-1])
-			chargeData[currentResidue] = make(map[string]float64)
+			chargeData[currentResidue] = make(map[string]AtomChargeData)
 			continue
 		}
 
@@ -350,12 +1229,18 @@ func parseChargeFile(filename string) (map[string]map[string]float64, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid atom charge '%s' in line: %s", atomChargeStr, line)
 		}
+		chargeGroup := 0
+		if len(fields) >= 4 {
+			if chargeGroup, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("invalid charge group '%s' in line: %s", fields[3], line)
+			}
+		}
 
 		// Store the charge data
 		if currentResidue == "" {
 			return nil, fmt.Errorf("atom data without residue header: %s", line)
 		}
-		chargeData[currentResidue][atomName] = atomCharge
+		chargeData[currentResidue][atomName] = AtomChargeData{AtomType: fields[1], AtomCharge: atomCharge, ChargeGroup: chargeGroup}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -401,12 +1286,29 @@ func WriteProteinToPDB(protein *Protein, filename string) error {
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
+	if err := writePDBHeader(writer, protein); err != nil {
+		return err
+	}
+	if err := writePDBAtoms(writer, protein); err != nil {
+		return err
+	}
 
-	// Write the title section
-	if _, err := writer.WriteString(fmt.Sprintf("HEADER    %s\n", protein.Name)); err != nil {
+	// Write the termination line
+	if _, err := writer.WriteString("END\n"); err != nil {
 		return err
 	}
 
+	return writer.Flush()
+}
+
+// writePDBHeader writes the title section of WriteProteinToPDB
+func writePDBHeader(writer *bufio.Writer, protein *Protein) error {
+	_, err := writer.WriteString(fmt.Sprintf("HEADER    %s\n", protein.Name))
+	return err
+}
+
+// writePDBAtoms writes one ATOM record per atom of the protein, numbered from 1
+func writePDBAtoms(writer *bufio.Writer, protein *Protein) error {
 	atomIndex := 1
 	for _, residue := range protein.Residue {
 		for _, atom := range residue.Atoms {
@@ -419,7 +1321,7 @@ func WriteProteinToPDB(protein *Protein, filename string) error {
 				residue.ChainID,                                   // Chain identifier
 				residue.ID,                                        // Residue sequence number
 				atom.position.x, atom.position.y, atom.position.z, // Atom coordinates
-				atom.element, // Element symbol
+				atomElement(atom), // Element symbol
 			))
 			if err != nil {
 				return err
@@ -427,13 +1329,7 @@ func WriteProteinToPDB(protein *Protein, filename string) error {
 			atomIndex++
 		}
 	}
-
-	// Write the termination line
-	if _, err := writer.WriteString("END\n"); err != nil {
-		return err
-	}
-
-	return writer.Flush()
+	return nil
 }
 
 // writeRMSD writes a slice of float64 values to a CSV file.
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// SymmetricEigen3 diagonalises a symmetric 3x3 matrix with cyclic Jacobi rotations
+// and return its eigenvalues in ascending order together with the eigenvectors,
+// eigenvectors[k] belonging to eigenvalues[k]. The eigenvectors are the columns of
+// a product of rotations, so they stay orthonormal when eigenvalues are degenerate.
+func SymmetricEigen3(m [3][3]float64) ([3]float64, [3][3]float64) {
+	a := m
+	v := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+	for sweep := 0; sweep < 50; sweep++ {
+		offDiagonal := a[0][1]*a[0][1] + a[0][2]*a[0][2] + a[1][2]*a[1][2]
+		if offDiagonal < 1e-30 {
+			break
+		}
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				// rotation angle that zeroes a[p][q]
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p] = c*akp - s*akq
+					a[k][q] = s*akp + c*akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k] = c*apk - s*aqk
+					a[q][k] = s*apk + c*aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p] = c*vkp - s*vkq
+					v[k][q] = s*vkp + c*vkq
+				}
+			}
+		}
+	}
+
+	order := []int{0, 1, 2}
+	sort.Slice(order, func(i, j int) bool { return a[order[i]][order[i]] < a[order[j]][order[j]] })
+
+	var eigenvalues [3]float64
+	var eigenvectors [3][3]float64
+	for k, column := range order {
+		eigenvalues[k] = a[column][column]
+		for i := 0; i < 3; i++ {
+			eigenvectors[k][i] = v[i][column]
+		}
+	}
+
+	return eigenvalues, eigenvectors
+}
+
+// rotate takes a rotation matrix and a vector
+// and return the rotated vector
+func rotate(rotation [3][3]float64, v TriTuple) TriTuple {
+	return TriTuple{
+		x: rotation[0][0]*v.x + rotation[0][1]*v.y + rotation[0][2]*v.z,
+		y: rotation[1][0]*v.x + rotation[1][1]*v.y + rotation[1][2]*v.z,
+		z: rotation[2][0]*v.x + rotation[2][1]*v.y + rotation[2][2]*v.z,
+	}
+}
+
+// axisRotation return the matrix of the right-handed rotation by angle (radians) about the unit axis
+func axisRotation(axis TriTuple, angle float64) [3][3]float64 {
+	c, s := math.Cos(angle), math.Sin(angle)
+	t := 1 - c
+	x, y, z := axis.x, axis.y, axis.z
+	return [3][3]float64{
+		{t*x*x + c, t*x*y - s*z, t*x*z + s*y},
+		{t*x*y + s*z, t*y*y + c, t*y*z - s*x},
+		{t*x*z - s*y, t*y*z + s*x, t*z*z + c},
+	}
+}
+
+// determinant3 return the determinant of a 3x3 matrix
+func determinant3(m [3][3]float64) float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
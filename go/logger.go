@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// logger receives the diagnostic messages of the package (missing masses,
+// missing charges, ...) so that they do not end up mixed with program output
+var logger = log.New(os.Stderr, "", 0)
+
+// SetLogOutput redirects the diagnostic messages to w, use io.Discard to silence them
+func SetLogOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
+// SetLogger replaces the logger used for diagnostic messages
+func SetLogger(l *log.Logger) {
+	logger = l
+}
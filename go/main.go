@@ -14,18 +14,16 @@ func main() {
 	time := 1.0
 	protein, err := readProteinFromFile(filepath)
 	Check(err)
-	for _, residue := range protein.Residue {
-		fmt.Println(residue.ID)
-	}
 
-	// Parse the charge data file
-	chargeData, err := parseChargeFile("../data/OPLS_atom_charge.rtp")
+	// Parse the charge data file, with the charge group of every atom
+	chargeGroupData, err := parseChargeGroupFile("../data/OPLS_atom_charge.rtp")
 	Check(err)
 
-	// Assign charges to the protein's atoms
-	(&protein).AssignChargesToProtein(chargeData)
+	// Assign charges and charge groups to the protein's atoms
+	(&protein).AssignChargesToProtein(chargeValues(chargeGroupData))
+	(&protein).AssignChargeGroups(chargeGroupData)
 	// Check if the assigned charges are correct
-	// CheckAssignedCharges(&protein, chargeData)
+	// CheckAssignedCharges(&protein, chargeValues(chargeGroupData))
 
 	residueParameterBondValue, error := ReadAminoAcidsPara("../data/aminoacids_revised.rtp")
 	Check(error)
@@ -42,15 +40,12 @@ func main() {
 	pairtypesParameter, error := ReadParameterFile("../data/ffnonbonded_pairtypes.itp")
 	Check(error)
 
-	initialProtein := PerformEnergyMinimization(&protein, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondedParameter, pairtypesParameter)
+	initialProtein := PerformEnergyMinimization(&protein, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondedParameter, pairtypesParameter, nil)
 	timepoints := SimulateMD(*initialProtein, time, residueParameterBondValue, residueParameterOtherValue, bondParameter, angleParameter, dihedralParameter, nonbondedParameter, pairtypesParameter)
 	RMSD := CalculateRMSD(timepoints)
 	TemporaryPlot(RMSD, time)
 	writeRMSD(RMSD)
 	WriteProteinToPDB(&timepoints[len(timepoints)-1], "result/output.pdb")
-	for _, residue := range timepoints[len(timepoints)-1].Residue {
-		fmt.Println(residue.ID)
-	}
 }
 
 func Check(err error) {
@@ -94,7 +89,7 @@ func CheckAssignedCharges(protein *Protein, chargeData map[string]map[string]flo
 		residueChargeData, residueExists := chargeData[residueName]
 
 		if !residueExists {
-			fmt.Printf("Warning: No charge data found for residue %s\n", residueName)
+			logger.Printf("Warning: No charge data found for residue %s", residueName)
 			continue
 		}
 
@@ -104,13 +99,13 @@ func CheckAssignedCharges(protein *Protein, chargeData map[string]map[string]flo
 			// Try to get the charge data for this atom
 			expectedCharge, atomExists := residueChargeData[atomName]
 			if !atomExists {
-				fmt.Printf("Warning: No charge data found for atom %s in residue %s\n", atomName, residueName)
+				logger.Printf("Warning: No charge data found for atom %s in residue %s", atomName, residueName)
 				continue
 			}
 
 			// Check if the assigned charge matches the expected charge
 			if atom.charge != expectedCharge {
-				fmt.Printf("Discrepancy found: Residue %s, Atom %s, Assigned Charge: %f, Expected Charge: %f\n",
+				logger.Printf("Warning: discrepancy found: Residue %s, Atom %s, Assigned Charge: %f, Expected Charge: %f",
 					residueName, atomName, atom.charge, expectedCharge)
 			}
 		}
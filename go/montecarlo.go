@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// ///////////////
+// ////Metropolis Monte Carlo sampling
+// ///////////////
+
+// MCMove changes the protein in place by a random trial move. Moves must be symmetric
+// (proposing B from A as likely as A from B) for the Metropolis criterion to hold.
+type MCMove func(protein *Protein, rng *rand.Rand)
+
+// MCResult summarizes a Monte Carlo run
+type MCResult struct {
+	Accepted int
+	Rejected int
+	// energy of the protein after every step
+	Energies []float64
+}
+
+// AcceptanceRatio return the fraction of the proposed moves that were accepted
+func (result MCResult) AcceptanceRatio() float64 {
+	if result.Accepted+result.Rejected == 0 {
+		return 0.0
+	}
+	return float64(result.Accepted) / float64(result.Accepted+result.Rejected)
+}
+
+// DisplaceAtomMove return a move shifting one random atom by up to maxStep (Angstrom) along each axis
+func DisplaceAtomMove(maxStep float64) MCMove {
+	return func(protein *Protein, rng *rand.Rand) {
+		atoms := proteinAtoms(protein)
+		if len(atoms) == 0 {
+			return
+		}
+		atom := atoms[rng.Intn(len(atoms))]
+		atom.position.x += maxStep * (2*rng.Float64() - 1)
+		atom.position.y += maxStep * (2*rng.Float64() - 1)
+		atom.position.z += maxStep * (2*rng.Float64() - 1)
+	}
+}
+
+// RotateDihedralMove return a move turning one random chi dihedral of a random
+// side chain by up to maxAngle degrees either way
+func RotateDihedralMove(maxAngle float64) MCMove {
+	return func(protein *Protein, rng *rand.Rand) {
+		var residues []*Residue
+		for _, residue := range protein.Residue {
+			if len(chiAtoms[residue.Name]) > 0 {
+				residues = append(residues, residue)
+			}
+		}
+		if len(residues) == 0 {
+			return
+		}
+		residue := residues[rng.Intn(len(residues))]
+		definitions := chiAtoms[residue.Name]
+		k := rng.Intn(len(definitions))
+
+		var atoms [4]*Atom
+		for i, name := range definitions[k] {
+			if atoms[i] = FindAtomByName(residue, name); atoms[i] == nil {
+				return
+			}
+		}
+		chi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3])
+		setChi(residue, definitions[k], k, chi+maxAngle*(2*rng.Float64()-1))
+	}
+}
+
+// RunMonteCarlo takes a protein, an energy function (kJ/mol), the trial moves, a number of
+// steps, a temperature (K) and a random number generator, and samples the protein with the
+// Metropolis criterion: every step applies a random move and accepts it with probability
+// min(1, exp(-dE/kT)), a rejected move is undone. The protein ends in the last accepted state.
+func RunMonteCarlo(protein *Protein, energyFunc func(*Protein) float64, moves []MCMove, steps int, temperature float64, rng *rand.Rand) MCResult {
+	return runMonteCarlo(protein, energyFunc, nil, moves, steps, boltzmann*temperature, rng)
+}
+
+// RunMonteCarloForceField works like RunMonteCarlo with CalculateTotalEnergy of the topology
+// of the protein as the energy, in the energy unit of the bonded parameters. A move that
+// displaces a single atom, like DisplaceAtomMove, is scored by DeltaEnergyForMove from the
+// bonded terms and the neighbours of that atom, other moves by a full evaluation.
+func RunMonteCarloForceField(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase, moves []MCMove, steps int, temperature float64, rng *rand.Rand) MCResult {
+	energyFunc := func(*Protein) float64 {
+		return CalculateTotalEnergy(topology, bonded, nonbonded)
+	}
+	return runMonteCarlo(protein, energyFunc, newMoveEnergy(topology, bonded, nonbonded), moves, steps, bonded.unitSystem().Boltzmann()*temperature, rng)
+}
+
+// runMonteCarlo runs the Metropolis sampling of RunMonteCarlo at the thermal energy kT,
+// scoring the single-atom moves with incremental when it is given
+func runMonteCarlo(protein *Protein, energyFunc func(*Protein) float64, incremental *moveEnergy, moves []MCMove, steps int, kT float64, rng *rand.Rand) MCResult {
+	var result MCResult
+	if len(moves) == 0 {
+		return result
+	}
+
+	atoms := proteinAtoms(protein)
+	previous := make([]TriTuple, len(atoms))
+	energy := energyFunc(protein)
+	for step := 0; step < steps; step++ {
+		for i, atom := range atoms {
+			previous[i] = atom.position
+		}
+		moves[rng.Intn(len(moves))](protein, rng)
+
+		// the atom a single-atom move displaced, -1 for any other move
+		moved := -1
+		if incremental != nil {
+			for i, atom := range atoms {
+				if atom.position == previous[i] {
+					continue
+				}
+				if moved >= 0 {
+					moved = -1
+					break
+				}
+				moved = i
+			}
+		}
+		var trialEnergy float64
+		if moved >= 0 {
+			trialEnergy = energy + incremental.delta(atoms[moved], previous[moved])
+		} else {
+			trialEnergy = energyFunc(protein)
+		}
+
+		delta := trialEnergy - energy
+		if delta <= 0 || (kT > 0 && rng.Float64() < math.Exp(-delta/kT)) {
+			energy = trialEnergy
+			result.Accepted++
+			if moved >= 0 {
+				incremental.neighbors.Move(atoms[moved], previous[moved])
+			} else if incremental != nil {
+				incremental.neighbors.Rebuild()
+			}
+		} else {
+			for i, atom := range atoms {
+				atom.position = previous[i]
+			}
+			result.Rejected++
+		}
+		result.Energies = append(result.Energies, energy)
+	}
+	return result
+}
+
+// GenerateConformers takes a protein, the bonded and non-bonded parameters, a number of
+// trials, a largest displacement (Angstrom), an energy cutoff and a random number generator
+// and return the copies, out of n randomly perturbed ones, whose energy is less than
+// energyCutoff above the energy of the protein. The energy is CalculateTotalEnergy, in the
+// energy unit of the bonded parameters, on the terms of BuildTopology for the protein: every
+// copy keeps those terms, a bond stretched past the detection distance included. Use
+// GenerateConformersWith for another energy function. Every atom of a copy is moved by
+// Gaussian noise of standard deviation maxDisplacement/3 per axis, shortened to maxDisplacement.
+func GenerateConformers(protein *Protein, bonded, nonbonded parameterDatabase, n int, maxDisplacement, energyCutoff float64, rng *rand.Rand) []*Protein {
+	topology := BuildTopology(protein)
+	energyFunc := func(p *Protein) float64 {
+		return CalculateTotalEnergy(topology.onProtein(p), bonded, nonbonded)
+	}
+	return GenerateConformersWith(protein, energyFunc, n, maxDisplacement, energyCutoff, rng)
+}
+
+// GenerateConformersWith works like GenerateConformers with the energy given by energyFunc
+func GenerateConformersWith(protein *Protein, energyFunc func(*Protein) float64, n int, maxDisplacement, energyCutoff float64, rng *rand.Rand) []*Protein {
+	reference := energyFunc(protein)
+	sigma := maxDisplacement / 3
+
+	var conformers []*Protein
+	for i := 0; i < n; i++ {
+		conformer := CopyProtein(protein)
+		for _, atom := range proteinAtoms(conformer) {
+			shift := TriTuple{sigma * rng.NormFloat64(), sigma * rng.NormFloat64(), sigma * rng.NormFloat64()}
+			if length := magnitude(shift); length > maxDisplacement {
+				shift = scaleVector(shift, maxDisplacement/length)
+			}
+			atom.position = addVectors(atom.position, shift)
+		}
+		if energyFunc(conformer)-reference < energyCutoff {
+			conformers = append(conformers, conformer)
+		}
+	}
+	return conformers
+}
+
+// proteinAtoms return the atoms of the protein in residue order
+func proteinAtoms(protein *Protein) []*Atom {
+	var atoms []*Atom
+	for _, residue := range protein.Residue {
+		atoms = append(atoms, residue.Atoms...)
+	}
+	return atoms
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// L-BFGS settings: Wolfe constants of the line search, largest move of a coordinate
+// in one step (Angstrom) and the gradient (energy unit per Angstrom) below which the minimizer stops
+const (
+	lbfgsArmijo      = 1e-4
+	lbfgsCurvature   = 0.9
+	lbfgsMaxStep     = 0.2
+	lbfgsGradientTol = 1e-3
+	lbfgsLineSteps   = 20
+)
+
+// ///////////////
+// ////Flat position and gradient vectors for generic optimizers
+// ///////////////
+
+// PositionsToSlice takes a protein and return the positions of its atoms in residue
+// order flattened to x1, y1, z1, x2, ... (Angstrom)
+func PositionsToSlice(protein *Protein) []float64 {
+	var positions []float64
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			positions = append(positions, atom.position.x, atom.position.y, atom.position.z)
+		}
+	}
+	return positions
+}
+
+// SetPositionsFromSlice takes a protein and a flat slice laid out as PositionsToSlice
+// and moves the atoms of the protein to these positions
+func SetPositionsFromSlice(protein *Protein, positions []float64) error {
+	i := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if i+3 > len(positions) {
+				return fmt.Errorf("%d coordinates for more than %d atoms", len(positions), i/3)
+			}
+			atom.position = TriTuple{x: positions[i], y: positions[i+1], z: positions[i+2]}
+			i += 3
+		}
+	}
+	if i != len(positions) {
+		return fmt.Errorf("%d coordinates for %d atoms", len(positions), i/3)
+	}
+	return nil
+}
+
+// EnergyGradient takes a protein, its topology and the bonded and non-bonded parameters
+// and return the gradient of CalculateTotalEnergy with respect to the positions,
+// minus the forces of EvaluateForces in the energy unit of the bonded UnitSystem per
+// Angstrom, in the order of PositionsToSlice
+func EnergyGradient(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase) []float64 {
+	_, gradient := energyAndGradient(protein, topology, bonded, nonbonded)
+	return gradient
+}
+
+// energyAndGradient return the energy of EvaluateForces with the gradient of EnergyGradient
+func energyAndGradient(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase) (float64, []float64) {
+	energy, forceMap := EvaluateForces(topology, bonded, nonbonded)
+	// the forces are in kJ/mol/Angstrom whatever the units of the energy
+	toGradient := -1 / (forceUnit * bonded.unitSystem().KJPerMolPerEnergy)
+
+	var gradient []float64
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			force, exist := forceMap[atom.index]
+			if !exist {
+				gradient = append(gradient, 0, 0, 0)
+				continue
+			}
+			gradient = append(gradient, force.x*toGradient, force.y*toGradient, force.z*toGradient)
+		}
+	}
+	return energy, gradient
+}
+
+// MinimizeLBFGS takes a protein, its topology, the bonded and non-bonded parameters, an
+// iteration cap and the number of position/gradient differences to keep, and minimizes
+// CalculateTotalEnergy with limited memory BFGS. The search direction comes from the
+// two-loop recursion over the last history steps and the step length from a line search
+// satisfying the strong Wolfe conditions. The atoms of the protein are moved in place
+// and the protein is returned. Atoms whose index is set in frozen keep their positions,
+// but they still take part in the energy seen by the mobile atoms.
+func MinimizeLBFGS(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase, maxIter int, history int, frozen map[int]bool) *Protein {
+	minimizeLBFGS(protein, topology, bonded, nonbonded, maxIter, history, frozen)
+	return protein
+}
+
+// minimizeLBFGS runs MinimizeLBFGS and return the number of energy evaluations it made
+func minimizeLBFGS(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase, maxIter int, history int, frozen map[int]bool) int {
+	// with no gradient along the coordinates of the frozen atoms neither the search
+	// directions nor the position and gradient differences ever move them
+	var frozenCoordinates []int
+	for i, atom := range proteinAtoms(protein) {
+		if frozen[atom.index] {
+			frozenCoordinates = append(frozenCoordinates, 3*i, 3*i+1, 3*i+2)
+		}
+	}
+
+	evaluations := 0
+	evaluate := func(x []float64) (float64, []float64) {
+		SetPositionsFromSlice(protein, x)
+		evaluations++
+		energy, gradient := energyAndGradient(protein, topology, bonded, nonbonded)
+		for _, i := range frozenCoordinates {
+			gradient[i] = 0
+		}
+		return energy, gradient
+	}
+
+	x := PositionsToSlice(protein)
+	energy, gradient := evaluate(x)
+	var steps, changes [][]float64 // s = x_k+1 - x_k and y = g_k+1 - g_k
+
+	for iteration := 0; iteration < maxIter; iteration++ {
+		if maxAbs(gradient) < lbfgsGradientTol {
+			break
+		}
+
+		direction := lbfgsDirection(gradient, steps, changes)
+		if dot(direction, gradient) >= 0 {
+			// not a descent direction, start over from steepest descent
+			steps, changes = nil, nil
+			direction = scaleSlice(gradient, -1)
+		}
+
+		// the first trial step is the full quasi-Newton step, capped to lbfgsMaxStep per coordinate
+		alpha := math.Min(1, lbfgsMaxStep/maxAbs(direction))
+		newX, newEnergy, newGradient, ok := wolfeLineSearch(evaluate, x, energy, gradient, direction, alpha)
+		if !ok {
+			if len(steps) == 0 {
+				break
+			}
+			steps, changes = nil, nil
+			continue
+		}
+
+		s := make([]float64, len(x))
+		y := make([]float64, len(x))
+		for i := range x {
+			s[i] = newX[i] - x[i]
+			y[i] = newGradient[i] - gradient[i]
+		}
+		// keep the pair only when it preserves a positive definite Hessian approximation
+		if dot(s, y) > 1e-12 {
+			steps = append(steps, s)
+			changes = append(changes, y)
+			if len(steps) > history {
+				steps, changes = steps[1:], changes[1:]
+			}
+		}
+		x, energy, gradient = newX, newEnergy, newGradient
+	}
+
+	SetPositionsFromSlice(protein, x)
+	return evaluations
+}
+
+// lbfgsDirection return -H*gradient with H the L-BFGS inverse Hessian built by the two-loop recursion
+func lbfgsDirection(gradient []float64, steps, changes [][]float64) []float64 {
+	q := append([]float64(nil), gradient...)
+	alphas := make([]float64, len(steps))
+	for i := len(steps) - 1; i >= 0; i-- {
+		alphas[i] = dot(steps[i], q) / dot(changes[i], steps[i])
+		for j := range q {
+			q[j] -= alphas[i] * changes[i][j]
+		}
+	}
+
+	// initial inverse Hessian gamma*I scaled by the latest pair
+	if last := len(steps) - 1; last >= 0 {
+		q = scaleSlice(q, dot(steps[last], changes[last])/dot(changes[last], changes[last]))
+	}
+
+	for i := range steps {
+		beta := dot(changes[i], q) / dot(changes[i], steps[i])
+		for j := range q {
+			q[j] += (alphas[i] - beta) * steps[i][j]
+		}
+	}
+	return scaleSlice(q, -1)
+}
+
+// wolfeLineSearch searches along the direction from x for a step satisfying the strong
+// Wolfe conditions, starting from the trial step alpha (Nocedal and Wright, algorithm 3.5).
+// It return the new point with its energy and gradient, and false when no step was found.
+func wolfeLineSearch(evaluate func([]float64) (float64, []float64), x []float64, energy float64, gradient, direction []float64, alpha float64) ([]float64, float64, []float64, bool) {
+	slope := dot(gradient, direction)
+	at := func(step float64) ([]float64, float64, []float64, float64) {
+		trial := make([]float64, len(x))
+		for i := range x {
+			trial[i] = x[i] + step*direction[i]
+		}
+		trialEnergy, trialGradient := evaluate(trial)
+		return trial, trialEnergy, trialGradient, dot(trialGradient, direction)
+	}
+
+	// zoom shrinks [low, high] around a step satisfying both conditions
+	zoom := func(low, lowEnergy, high float64) ([]float64, float64, []float64, bool) {
+		for i := 0; i < lbfgsLineSteps; i++ {
+			step := 0.5 * (low + high)
+			trial, trialEnergy, trialGradient, trialSlope := at(step)
+			if trialEnergy > energy+lbfgsArmijo*step*slope || trialEnergy >= lowEnergy {
+				high = step
+				continue
+			}
+			if math.Abs(trialSlope) <= -lbfgsCurvature*slope {
+				return trial, trialEnergy, trialGradient, true
+			}
+			if trialSlope*(high-low) >= 0 {
+				high = low
+			}
+			low, lowEnergy = step, trialEnergy
+		}
+		return nil, 0, nil, false
+	}
+
+	previous, previousEnergy := 0.0, energy
+	for i := 0; i < lbfgsLineSteps; i++ {
+		trial, trialEnergy, trialGradient, trialSlope := at(alpha)
+		if math.IsNaN(trialEnergy) || trialEnergy > energy+lbfgsArmijo*alpha*slope || (i > 0 && trialEnergy >= previousEnergy) {
+			return zoom(previous, previousEnergy, alpha)
+		}
+		if math.Abs(trialSlope) <= -lbfgsCurvature*slope {
+			return trial, trialEnergy, trialGradient, true
+		}
+		if trialSlope >= 0 {
+			return zoom(alpha, trialEnergy, previous)
+		}
+		previous, previousEnergy = alpha, trialEnergy
+		alpha *= 2
+	}
+	return nil, 0, nil, false
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func scaleSlice(a []float64, factor float64) []float64 {
+	scaled := make([]float64, len(a))
+	for i := range a {
+		scaled[i] = a[i] * factor
+	}
+	return scaled
+}
+
+func maxAbs(a []float64) float64 {
+	largest := 0.0
+	for _, value := range a {
+		largest = math.Max(largest, math.Abs(value))
+	}
+	return largest
+}
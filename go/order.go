@@ -0,0 +1,36 @@
+package main
+
+import "sort"
+
+// ///////////////
+// ////These function give a deterministic order to map-keyed data,
+// ////so floating-point sums and reports do not depend on map iteration
+// ///////////////
+
+// ForceEntry is the force on the atom with the given index, one entry of a force map
+type ForceEntry struct {
+	Index int
+	Force TriTuple
+}
+
+// OrderedAtoms takes a protein
+// and return all its atoms sorted by ascending index
+func OrderedAtoms(protein *Protein) []*Atom {
+	atoms := proteinAtoms(protein)
+	sort.SliceStable(atoms, func(i, j int) bool { return atoms[i].index < atoms[j].index })
+	return atoms
+}
+
+// OrderedForceEntries takes a force map
+// and return its entries sorted by ascending atom index, nil forces are left out
+func OrderedForceEntries(forceMap map[int]*TriTuple) []ForceEntry {
+	entries := make([]ForceEntry, 0, len(forceMap))
+	for index, force := range forceMap {
+		if force == nil {
+			continue
+		}
+		entries = append(entries, ForceEntry{Index: index, Force: *force})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	return entries
+}
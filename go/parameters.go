@@ -0,0 +1,97 @@
+package main
+
+import "math"
+
+// ///////////////
+// ////Typed bonded parameters, the only place where the columns of a parameter row are interpreted
+// ///////////////
+
+// BondParam is a harmonic bond, R0 in the length unit of the parameters
+type BondParam struct {
+	K  float64
+	R0 float64
+}
+
+// AngleParam is a harmonic angle (or improper), Theta0 in radians
+type AngleParam struct {
+	K      float64
+	Theta0 float64
+}
+
+// DihedralParam is a periodic dihedral 0.5*Kd*(1 + cos(Pn*phi - Phase)), Phase in radians
+type DihedralParam struct {
+	Kd    float64
+	Pn    float64
+	Phase float64
+}
+
+// bondParam reads a [b0 kb] row, it reports false when the row is too short
+func bondParam(parameter []float64) (BondParam, bool) {
+	if len(parameter) < 2 {
+		return BondParam{}, false
+	}
+	return BondParam{K: parameter[1], R0: parameter[0]}, true
+}
+
+// angleParam reads a [theta0 k] row with theta0 in degrees, impropers use the same [xi0 k] layout
+func angleParam(parameter []float64) (AngleParam, bool) {
+	if len(parameter) < 2 {
+		return AngleParam{}, false
+	}
+	return AngleParam{K: parameter[1], Theta0: parameter[0] / 180 * math.Pi}, true
+}
+
+// dihedralParam reads a [phase kd pn] row with the phase in degrees
+func dihedralParam(parameter []float64) (DihedralParam, bool) {
+	if len(parameter) < 3 {
+		return DihedralParam{}, false
+	}
+	return DihedralParam{Kd: parameter[1], Pn: parameter[2], Phase: parameter[0] / 180 * math.Pi}, true
+}
+
+// BondParam return the row as bond parameters
+func (pair *parameterPair) BondParam() (BondParam, bool) {
+	return bondParam(pair.parameter)
+}
+
+// AngleParam return the row as angle parameters
+func (pair *parameterPair) AngleParam() (AngleParam, bool) {
+	return angleParam(pair.parameter)
+}
+
+// DihedralParam return the row as dihedral parameters
+func (pair *parameterPair) DihedralParam() (DihedralParam, bool) {
+	return dihedralParam(pair.parameter)
+}
+
+// Energy takes a bond length in Angstrom and return h*K*(r/L - R0)^2 in the energy unit
+func (p BondParam) Energy(r float64, units UnitSystem) float64 {
+	d := r/units.AngstromPerLength - p.R0
+	return units.HarmonicFactor * p.K * d * d
+}
+
+// Derivative takes a bond length in Angstrom and return dE/dr in energy unit per Angstrom
+func (p BondParam) Derivative(r float64, units UnitSystem) float64 {
+	return 2 * units.HarmonicFactor * p.K * (r/units.AngstromPerLength - p.R0) / units.AngstromPerLength
+}
+
+// Energy takes an angle in radians and return h*K*(theta - Theta0)^2 in the energy unit
+func (p AngleParam) Energy(theta float64, units UnitSystem) float64 {
+	d := theta - p.Theta0
+	return units.HarmonicFactor * p.K * d * d
+}
+
+// Derivative takes an angle in radians and return dE/dtheta in energy unit per radian
+func (p AngleParam) Derivative(theta float64, units UnitSystem) float64 {
+	return 2 * units.HarmonicFactor * p.K * (theta - p.Theta0)
+}
+
+// Energy takes a dihedral angle in radians and return 0.5*Kd*(1 + cos(Pn*phi - Phase))
+func (p DihedralParam) Energy(phi float64) float64 {
+	return 0.5 * p.Kd * (1 + math.Cos(p.Pn*phi-p.Phase))
+}
+
+// Derivative takes a dihedral angle in radians and return dE/dphi
+func (p DihedralParam) Derivative(phi float64) float64 {
+	return -0.5 * p.Kd * p.Pn * math.Sin(p.Pn*phi-p.Phase)
+}
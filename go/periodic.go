@@ -0,0 +1,77 @@
+package main
+
+import "math"
+
+// Box is an orthorhombic periodic cell with its origin at (0, 0, 0)
+type Box struct {
+	X float64
+	Y float64
+	Z float64
+}
+
+// Volume returns the volume of the box
+func (box Box) Volume() float64 {
+	return box.X * box.Y * box.Z
+}
+
+// MinimumImage takes a displacement vector and a box
+// and return the shortest periodic image of the vector
+func MinimumImage(vector TriTuple, box Box) TriTuple {
+	vector.x -= box.X * math.Round(vector.x/box.X)
+	vector.y -= box.Y * math.Round(vector.y/box.Y)
+	vector.z -= box.Z * math.Round(vector.z/box.Z)
+	return vector
+}
+
+// PeriodicDistance is the minimum-image version of Distance
+func PeriodicDistance(p1, p2 TriTuple, box Box) float64 {
+	return magnitude(MinimumImage(TriTuple{x: p1.x - p2.x, y: p1.y - p2.y, z: p1.z - p2.z}, box))
+}
+
+// WrapIntoBox maps the position of every atom back into [0, L) in each dimension
+func WrapIntoBox(protein *Protein, box Box) {
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			atom.position = wrapPosition(atom.position, box)
+		}
+	}
+}
+
+// WrapWhole wraps the protein molecule by molecule so that no bond is split
+// across the boundary: each molecule is first made whole around its first atom,
+// then translated so that this reference atom lies in the box
+func WrapWhole(topology *Topology, box Box) {
+	neighbors := topology.neighbors()
+
+	for _, molecule := range Fragments(topology) {
+		// rebuild the molecule from the reference atom following the bonds
+		placed := map[*Atom]bool{molecule[0]: true}
+		for _, atom := range molecule {
+			for _, next := range neighbors[atom] {
+				if placed[next] {
+					continue
+				}
+				bond := MinimumImage(CalculateVector(atom, next), box)
+				next.position = TriTuple{x: atom.position.x + bond.x, y: atom.position.y + bond.y, z: atom.position.z + bond.z}
+				placed[next] = true
+			}
+		}
+
+		reference := molecule[0].position
+		wrapped := wrapPosition(reference, box)
+		shift := TriTuple{x: wrapped.x - reference.x, y: wrapped.y - reference.y, z: wrapped.z - reference.z}
+		for _, atom := range molecule {
+			atom.position.x += shift.x
+			atom.position.y += shift.y
+			atom.position.z += shift.z
+		}
+	}
+}
+
+func wrapPosition(position TriTuple, box Box) TriTuple {
+	return TriTuple{
+		x: position.x - box.X*math.Floor(position.x/box.X),
+		y: position.y - box.Y*math.Floor(position.y/box.Y),
+		z: position.z - box.Z*math.Floor(position.z/box.Z),
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+// ///////////////
+// ////Progress and ETA reports of long simulations
+// ///////////////
+
+// ProgressReporter writes the progress of a run to the logger every Every steps:
+// the current step, the elapsed wall time and the time left at the average step rate
+type ProgressReporter struct {
+	Every int
+	// clock of the reporter, time.Now when nil (a fake clock can replace it in tests)
+	Now   func() time.Time
+	start time.Time
+	total int
+}
+
+// NewProgressReporter returns a reporter writing every given number of steps
+func NewProgressReporter(every int) *ProgressReporter {
+	return &ProgressReporter{Every: every, Now: time.Now}
+}
+
+// Start records the beginning of a run of total steps
+func (r *ProgressReporter) Start(total int) {
+	r.total = total
+	r.start = r.now()
+}
+
+// now return the time of the clock of the reporter
+func (r *ProgressReporter) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// Step reports step (counted from 1) when it is a multiple of Every or the last step,
+// other steps cost a single modulo
+func (r *ProgressReporter) Step(step int) {
+	if r.Every <= 0 || (step%r.Every != 0 && step != r.total) {
+		return
+	}
+	elapsed, eta := r.Estimate(step)
+	logger.Printf("step %d/%d, %v elapsed, ETA %v", step, r.total, elapsed.Round(time.Second), eta.Round(time.Second))
+}
+
+// Estimate return the wall time elapsed since Start and the time the remaining
+// steps will take at the average rate of the first step ones
+func (r *ProgressReporter) Estimate(step int) (elapsed, eta time.Duration) {
+	elapsed = r.now().Sub(r.start)
+	if step <= 0 {
+		return elapsed, 0
+	}
+	perStep := elapsed / time.Duration(step)
+	return elapsed, perStep * time.Duration(max(r.total-step, 0))
+}
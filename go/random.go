@@ -0,0 +1,12 @@
+package main
+
+import "math/rand"
+
+// Every stochastic function of the package (velocity initialization, thermostats,
+// Monte Carlo moves, surface sampling, ...) takes an rng *rand.Rand argument instead
+// of using the global source, so that a run is reproducible from its seed.
+
+// NewRNG returns a random number generator seeded with seed
+func NewRNG(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
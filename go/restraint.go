@@ -0,0 +1,155 @@
+package main
+
+import "math"
+
+// ///////////////
+// ////Biasing restraints added on top of the force field (umbrella sampling)
+// ///////////////
+
+// DistanceRestraint holds the distance between two atoms near R0 (Angstrom) with the
+// harmonic bias 0.5*K*(r-R0)^2, K in kJ/mol/Angstrom^2. Unlike a bond of the topology
+// it is not part of the force field, it is given to a simulation as an ExternalForce.
+type DistanceRestraint struct {
+	AtomI, AtomJ int
+	K, R0        float64
+}
+
+// CenterOfMassRestraint is the DistanceRestraint between the centers of mass of two
+// selections of atom indices, the force on a group is shared by its atoms by mass
+type CenterOfMassRestraint struct {
+	GroupI, GroupJ []int
+	K, R0          float64
+}
+
+// DihedralRestraint keeps the dihedral angle I-J-K-L within [Lower, Upper] (degrees) with
+// the flat-bottom bias 0.5*K*d^2, d the angle (radians) outside the window and K in
+// kJ/mol/rad^2. The window goes from Lower up to Upper, so Lower 150 and Upper -150
+// is the 60 degrees window across 180, and Lower -180 and Upper 180 restrains nothing.
+type DihedralRestraint struct {
+	AtomI, AtomJ, AtomK, AtomL int
+	Lower, Upper, K            float64
+}
+
+// EnergyForce adds the restraint forces to the force map and return its energy in kJ/mol.
+// A restraint naming an atom that is not in the protein does nothing.
+func (d DistanceRestraint) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	atoms, ok := restrainedAtoms(protein, d.AtomI, d.AtomJ)
+	if !ok {
+		return 0.0
+	}
+	atomI, atomJ := atoms[0], atoms[1]
+
+	energy, force := harmonicRestraint(atomI.position, atomJ.position, d.K, d.R0)
+	addForce(forceMap, atomI, force)
+	addForce(forceMap, atomJ, scaleVector(force, -1))
+	return energy
+}
+
+// EnergyForce adds the restraint forces to the force map and return its energy in kJ/mol.
+// A restraint with an empty or massless group does nothing.
+func (c CenterOfMassRestraint) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	groupI, groupJ := selectAtoms(protein, c.GroupI), selectAtoms(protein, c.GroupJ)
+	centerI, okI := centerOfMass(groupI)
+	centerJ, okJ := centerOfMass(groupJ)
+	if !okI || !okJ {
+		return 0.0
+	}
+
+	energy, force := harmonicRestraint(centerI, centerJ, c.K, c.R0)
+	addGroupForce(forceMap, groupI, force)
+	addGroupForce(forceMap, groupJ, scaleVector(force, -1))
+	return energy
+}
+
+// EnergyForce adds the restraint forces, torques about the J-K axis, to the force map and
+// return its energy in kJ/mol. A restraint naming an atom that is not in the protein does nothing.
+func (d DihedralRestraint) EnergyForce(protein *Protein, forceMap map[int]*TriTuple) float64 {
+	atoms, ok := restrainedAtoms(protein, d.AtomI, d.AtomJ, d.AtomK, d.AtomL)
+	if !ok {
+		return 0.0
+	}
+	phi := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3])
+
+	// a window of a full turn or more, such as -180 to 180, leaves every angle free
+	if d.Upper-d.Lower >= 360 {
+		return 0.0
+	}
+	// distance to the middle of the window, taken within 180 degrees across the wraparound
+	width := math.Mod(d.Upper-d.Lower+360, 360)
+	deviation := math.Remainder(phi-(d.Lower+width/2), 360)
+	excess := (math.Abs(deviation) - width/2) / 180 * math.Pi
+	if excess <= 0 {
+		return 0.0
+	}
+
+	dEdPhi := math.Copysign(d.K*excess, deviation)
+	addDihedralForces(forceMap, dEdPhi, dihedralTerm{atom1: atoms[0], atom2: atoms[1], atom3: atoms[2], atom4: atoms[3]})
+	return 0.5 * d.K * excess * excess
+}
+
+// Apply adds the restraint forces, so that the restraint can be given to SimulationConfig.External
+func (d DistanceRestraint) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	d.EnergyForce(protein, forceMap)
+}
+
+// Apply adds the restraint forces, so that the restraint can be given to SimulationConfig.External
+func (c CenterOfMassRestraint) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	c.EnergyForce(protein, forceMap)
+}
+
+// Apply adds the restraint forces, so that the restraint can be given to SimulationConfig.External
+func (d DihedralRestraint) Apply(forceMap map[int]*TriTuple, protein *Protein) {
+	d.EnergyForce(protein, forceMap)
+}
+
+// restrainedAtoms return the atoms of the protein with the given indices, in their order,
+// and false when one of them is not in the protein
+func restrainedAtoms(protein *Protein, indices ...int) ([]*Atom, bool) {
+	atoms := make([]*Atom, len(indices))
+	for i, index := range indices {
+		atom, exist := protein.AtomByIndex(index)
+		if !exist {
+			return nil, false
+		}
+		atoms[i] = atom
+	}
+	return atoms, true
+}
+
+// harmonicRestraint return the energy 0.5*k*(r-r0)^2 of two points and the force on the
+// first one, the second one gets the opposite force
+func harmonicRestraint(pointI, pointJ TriTuple, k, r0 float64) (float64, TriTuple) {
+	r := Distance(pointI, pointJ)
+	energy := 0.5 * k * (r - r0) * (r - r0)
+	if r == 0 {
+		return energy, TriTuple{}
+	}
+	direction := TriTuple{(pointI.x - pointJ.x) / r, (pointI.y - pointJ.y) / r, (pointI.z - pointJ.z) / r}
+	return energy, scaleVector(direction, -k*(r-r0))
+}
+
+// selectAtoms return the atoms of the protein whose index is in indices
+func selectAtoms(protein *Protein, indices []int) []*Atom {
+	selected := make(map[int]bool, len(indices))
+	for _, index := range indices {
+		selected[index] = true
+	}
+	var atoms []*Atom
+	for _, atom := range proteinAtoms(protein) {
+		if selected[atom.index] {
+			atoms = append(atoms, atom)
+		}
+	}
+	return atoms
+}
+
+// addGroupForce shares a force on the center of mass of the atoms by their masses
+func addGroupForce(forceMap map[int]*TriTuple, atoms []*Atom, force TriTuple) {
+	totalMass := 0.0
+	for _, atom := range atoms {
+		totalMass += atom.mass
+	}
+	for _, atom := range atoms {
+		addForce(forceMap, atom, scaleVector(force, atom.mass/totalMass))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ///////////////
+// ////Side-chain rotamers
+// ///////////////
+
+// Rotamer is a side-chain conformation given by its chi dihedrals in degrees, chi1 first
+type Rotamer struct {
+	Name string
+	Chi  []float64
+}
+
+// RotamerLibrary holds the rotamers of every residue name
+type RotamerLibrary map[string][]Rotamer
+
+// RotamerScore is the non-bonded energy of a residue in one rotamer, as reported by ScoreRotamers
+type RotamerScore struct {
+	Rotamer Rotamer
+	Energy  float64
+}
+
+// the four atoms defining each chi dihedral of the side chains, chi1 first
+var chiAtoms = map[string][][4]string{
+	"SER": {{"N", "CA", "CB", "OG"}},
+	"CYS": {{"N", "CA", "CB", "SG"}},
+	"THR": {{"N", "CA", "CB", "OG1"}},
+	"VAL": {{"N", "CA", "CB", "CG1"}},
+	"ILE": {{"N", "CA", "CB", "CG1"}, {"CA", "CB", "CG1", "CD1"}},
+	"LEU": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD1"}},
+	"ASP": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "OD1"}},
+	"ASN": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "OD1"}},
+	"HIS": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "ND1"}},
+	"PHE": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD1"}},
+	"TYR": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD1"}},
+	"TRP": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD1"}},
+	"MET": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "SD"}, {"CB", "CG", "SD", "CE"}},
+	"GLU": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD"}, {"CB", "CG", "CD", "OE1"}},
+	"GLN": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD"}, {"CB", "CG", "CD", "OE1"}},
+	"LYS": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD"}, {"CB", "CG", "CD", "CE"}, {"CG", "CD", "CE", "NZ"}},
+	"ARG": {{"N", "CA", "CB", "CG"}, {"CA", "CB", "CG", "CD"}, {"CB", "CG", "CD", "NE"}, {"CG", "CD", "NE", "CZ"}},
+}
+
+// ApplyRotamer takes a residue and a rotamer and sets every chi dihedral of the residue
+// to the one of the rotamer, rotating the side-chain atoms beyond each chi bond about it.
+// Chi values beyond the ones the residue has are ignored.
+func ApplyRotamer(residue *Residue, rotamer Rotamer) error {
+	definitions, exist := chiAtoms[residue.Name]
+	if !exist {
+		return fmt.Errorf("no chi dihedrals known for residue %s", residue.Name)
+	}
+
+	for k, chi := range rotamer.Chi {
+		if k >= len(definitions) {
+			break
+		}
+		if err := setChi(residue, definitions[k], k, chi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setChi sets the chi dihedral of the residue defined by the four atom names to chi (degrees),
+// k is the zero-based number of the dihedral used in error messages
+func setChi(residue *Residue, names [4]string, k int, chi float64) error {
+	var atoms [4]*Atom
+	for i, name := range names {
+		if atoms[i] = FindAtomByName(residue, name); atoms[i] == nil {
+			return fmt.Errorf("residue %s %d has no atom %s for chi%d", residue.Name, residue.ID, name, k+1)
+		}
+	}
+
+	current := CalculateSignedDihedralAngle(atoms[0], atoms[1], atoms[2], atoms[3])
+	axis := CalculateVector(atoms[1], atoms[2])
+	length := magnitude(axis)
+	if length == 0 {
+		return fmt.Errorf("residue %s %d has a zero length chi%d bond", residue.Name, residue.ID, k+1)
+	}
+	rotation := axisRotation(scaleVector(axis, 1/length), math.Remainder(chi-current, 360)/180*math.Pi)
+
+	origin := atoms[2].position
+	for _, atom := range downstreamAtoms(residue, atoms[1], atoms[2]) {
+		shifted := addVectors(atom.position, scaleVector(origin, -1))
+		atom.position = addVectors(rotate(rotation, shifted), origin)
+	}
+	return nil
+}
+
+// downstreamAtoms return the atoms of the residue reached from atom without going
+// through from, following bonds detected by distance, atom itself included
+func downstreamAtoms(residue *Residue, from, atom *Atom) []*Atom {
+	visited := map[*Atom]bool{from: true, atom: true}
+	downstream := []*Atom{atom}
+	for i := 0; i < len(downstream); i++ {
+		for _, next := range residue.Atoms {
+			if !visited[next] && BondedByDistance(downstream[i], next) {
+				visited[next] = true
+				downstream = append(downstream, next)
+			}
+		}
+	}
+	return downstream
+}
+
+// ScoreRotamers takes a protein, the ID of one of its residues, a rotamer library and the
+// non-bonded parameters, and return the rotamers of the library for that residue sorted by
+// energy, lowest first. The energy of a rotamer is the non-bonded energy between the side-chain
+// atoms (beyond the chi1 bond) and the atoms of the other residues, a residue without CA or CB
+// has no scores. The protein is not modified.
+func ScoreRotamers(protein *Protein, residueID int, library RotamerLibrary, nonbonded parameterDatabase) []RotamerScore {
+	position := -1
+	for i, residue := range protein.Residue {
+		if residue.ID == residueID {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		logger.Printf("Warning: no residue %d to score rotamers for", residueID)
+		return nil
+	}
+
+	if FindAtomByName(protein.Residue[position], "CA") == nil || FindAtomByName(protein.Residue[position], "CB") == nil {
+		logger.Printf("Warning: residue %d has no CA or CB to score rotamers for", residueID)
+		return nil
+	}
+
+	var scores []RotamerScore
+	for _, rotamer := range library[protein.Residue[position].Name] {
+		trial := CopyProtein(protein)
+		residue := trial.Residue[position]
+		if err := ApplyRotamer(residue, rotamer); err != nil {
+			logger.Printf("Warning: rotamer %s not applied: %v", rotamer.Name, err)
+			continue
+		}
+
+		ca, cb := FindAtomByName(residue, "CA"), FindAtomByName(residue, "CB")
+		energy := 0.0
+		for _, atom := range downstreamAtoms(residue, ca, cb) {
+			for i, other := range trial.Residue {
+				if i == position {
+					continue
+				}
+				for _, partner := range other.Atoms {
+					energy += pairEnergy(atom, partner, nonbonded)
+				}
+			}
+		}
+		scores = append(scores, RotamerScore{Rotamer: rotamer, Energy: energy})
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Energy < scores[j].Energy })
+	return scores
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ///////////////
+// ////High level simulation workflow: minimization, velocities and a thermostatted run
+// ///////////////
+
+// SimulationConfig gathers the parameters of a simulation run
+type SimulationConfig struct {
+	// parameters as read by main, the minimizer uses all of them and the
+	// dynamics use the bond, angle, dihedral and non-bonded databases
+	ResidueBonds       map[string]residueParameter
+	ResidueOther       map[string]residueParameter
+	BondParameter      parameterDatabase
+	AngleParameter     parameterDatabase
+	DihedralParameter  parameterDatabase
+	NonbondedParameter parameterDatabase
+	PairtypesParameter parameterDatabase
+
+	Timestep    float64 // fs
+	Steps       int
+	Temperature float64 // K
+	// Berendsen coupling time in fs, 0 runs without thermostat
+	TauT float64
+	Seed int64
+	// atoms held fixed during minimization and dynamics
+	Frozen map[int]bool
+	// overlap fraction of the van der Waals radii below which a minimized pair is a clash
+	ClashOverlap float64
+	// when set, RunSimulation writes every TrajectoryInterval-th step to it, subject to its stride
+	Trajectory *TrajectoryWriter
+	// when set, RunSimulation calls it with the energies of every EnergyLogInterval-th step
+	EnergyLog func(step int, state ThermoState)
+	// when set, RunSimulation writes the energies of the same steps to it
+	CSVLog *CSVLogger
+	// steps between two trajectory frames and two energy logs, 0 or 1 is every step
+	TrajectoryInterval int
+	EnergyLogInterval  int
+	// when set, RunSimulation reports its progress through it
+	Progress *ProgressReporter
+	// what to do with atoms without a positive mass, e.g. of an unrecognized element
+	Massless MasslessPolicy
+	// forces added to the force field at every step of RunSimulation
+	External []ExternalForce
+}
+
+// MasslessPolicy selects how a simulation treats atoms whose mass is zero, negative or NaN,
+// dividing their force by the mass would fill the trajectory with NaN
+type MasslessPolicy int
+
+const (
+	// FixMassless holds massless atoms in place, like frozen atoms (virtual sites, dummies)
+	FixMassless MasslessPolicy = iota
+	// RejectMassless makes the simulation fail before the first step
+	RejectMassless
+)
+
+// masslessAtoms return the indices of the atoms of the protein without a positive mass,
+// or an error naming them when the policy rejects them
+func (cfg SimulationConfig) masslessAtoms(protein *Protein) (map[int]bool, error) {
+	massless := make(map[int]bool)
+	var names []string
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if !(atom.mass > 0) {
+				massless[atom.index] = true
+				names = append(names, fmt.Sprintf("%s %d (%s %d)", atom.element, atom.index, residue.Name, residue.ID))
+			}
+		}
+	}
+	if len(names) > 0 && cfg.Massless == RejectMassless {
+		return nil, fmt.Errorf("%d atoms have no mass: %s", len(names), strings.Join(names, ", "))
+	}
+	return massless, nil
+}
+
+// bondedParameters merges the bond, angle and dihedral databases for EvaluateForces
+func (cfg SimulationConfig) bondedParameters() parameterDatabase {
+	bonded := cfg.BondParameter
+	bonded.atomPair = nil
+	for _, db := range []parameterDatabase{cfg.BondParameter, cfg.AngleParameter, cfg.DihedralParameter} {
+		bonded.atomPair = append(bonded.atomPair, db.atomPair...)
+	}
+	return bonded
+}
+
+// PrepareAndEquilibrate takes a protein and a configuration and return an equilibrated copy:
+// the protein is minimized with PerformEnergyMinimization, given Maxwell-Boltzmann
+// velocities at cfg.Temperature and run for cfg.Steps with RunSimulation.
+// It fails when the minimized structure still has clashes, pairs of atoms that are neither
+// bonded nor 1-3 in the topology of the dynamics, or non-finite positions.
+func PrepareAndEquilibrate(protein *Protein, cfg SimulationConfig) (*Protein, error) {
+	if _, err := cfg.masslessAtoms(protein); err != nil {
+		return nil, err
+	}
+	minimized := PerformEnergyMinimization(CopyProtein(protein), cfg.ResidueBonds, cfg.ResidueOther, cfg.BondParameter, cfg.AngleParameter, cfg.DihedralParameter, cfg.NonbondedParameter, cfg.PairtypesParameter, cfg.Frozen)
+	if err := checkFinite(minimized); err != nil {
+		return nil, fmt.Errorf("minimization failed: %w", err)
+	}
+
+	overlap := cfg.ClashOverlap
+	if overlap == 0 {
+		overlap = defaultClashOverlap
+	}
+	// FindClashes excludes the bonds and angles of BuildTopology, which RunSimulation also runs on
+	if clashes := FindClashes(minimized, overlap); len(clashes) > 0 {
+		clash := clashes[0]
+		return nil, fmt.Errorf("%d clashes left after minimization, atoms %d and %d are %.3f Angstrom apart", len(clashes), clash.Atom1.index, clash.Atom2.index, clash.Distance)
+	}
+
+	InitializeVelocities(minimized, cfg.Temperature, NewRNG(cfg.Seed))
+	for _, residue := range minimized.Residue {
+		for _, atom := range residue.Atoms {
+			if cfg.Frozen[atom.index] {
+				atom.velocity = TriTuple{}
+			}
+		}
+	}
+
+	return RunSimulation(minimized, cfg)
+}
+
+// RunSimulation takes a protein and a configuration and return a copy of the protein
+// after cfg.Steps velocity Verlet steps of cfg.Timestep. The forces come from
+// EvaluateForces on the topology of the protein plus cfg.External and, when cfg.TauT
+// is set, the velocities are coupled to cfg.Temperature by a Berendsen thermostat.
+// Steps are numbered from 1 when written to cfg.Trajectory, cfg.EnergyLog or cfg.CSVLog,
+// the potential energy, and the pressure of a protein in a box, are only computed for
+// the steps that are logged. The potential energy includes that of the external forces
+// that are an ExternalEnergy, such as the restraints.
+// Atoms without mass are held fixed or make it fail, as cfg.Massless says.
+// It fails as soon as a position stops being finite.
+func RunSimulation(protein *Protein, cfg SimulationConfig) (*Protein, error) {
+	massless, err := cfg.masslessAtoms(protein)
+	if err != nil {
+		return nil, err
+	}
+	fixed := func(atom *Atom) bool { return cfg.Frozen[atom.index] || massless[atom.index] }
+
+	current := CopyProtein(protein)
+	topology := BuildTopology(current)
+	bonded := cfg.bondedParameters()
+	buffer := NewForceBuffer(current)
+
+	// the run needs no energy, only forces are evaluated
+	_, forceMap := evaluateForces(topology, bonded, cfg.NonbondedParameter, false, buffer)
+	applyExternalForces(forceMap, current, cfg.External)
+	UpdateAccelerations(current, forceMap)
+
+	dt := cfg.Timestep
+	if cfg.Progress != nil {
+		cfg.Progress.Start(cfg.Steps)
+	}
+	for step := 0; step < cfg.Steps; step++ {
+		for _, atom := range topology.atoms() {
+			if fixed(atom) {
+				continue
+			}
+			atom.position = UpdatePosition(atom, atom.accelerated, atom.velocity, dt)
+		}
+
+		logEnergy := (cfg.EnergyLog != nil || cfg.CSVLog != nil) && onInterval(step+1, cfg.EnergyLogInterval)
+		var potential float64
+		potential, forceMap = evaluateForces(topology, bonded, cfg.NonbondedParameter, logEnergy, buffer)
+		potential += bonded.unitSystem().FromKJPerMol(applyExternalForces(forceMap, current, cfg.External))
+		for _, atom := range topology.atoms() {
+			oldAcceleration := atom.accelerated
+			force, exist := forceMap[atom.index]
+			if !exist || fixed(atom) {
+				atom.accelerated = TriTuple{}
+			} else {
+				atom.accelerated = UpdateAcceleration(force, atom)
+			}
+			if !fixed(atom) {
+				atom.velocity = UpdateVelocity(atom, oldAcceleration, dt)
+			}
+		}
+
+		if cfg.TauT > 0 {
+			BerendsenRescale(current, cfg.Temperature, dt, cfg.TauT)
+		}
+		if err := checkFinite(current); err != nil {
+			return nil, fmt.Errorf("step %d: %w", step+1, err)
+		}
+		if logEnergy {
+			state := ThermoState{PotentialEnergy: potential, KineticEnergy: KineticEnergy(current, bonded.unitSystem()), Temperature: Temperature(current, bonded.unitSystem())}
+			state.TotalEnergy = state.PotentialEnergy + state.KineticEnergy
+			if current.Box != nil {
+				state.Pressure = ScalarPressure(CalculateVirialTensor(current, forceMap), current.Box.Volume()) * barPerPressureUnit
+			}
+			if cfg.EnergyLog != nil {
+				cfg.EnergyLog(step+1, state)
+			}
+			if cfg.CSVLog != nil {
+				if err := cfg.CSVLog.logState(step+1, float64(step+1)*dt, state, bonded.unitSystem()); err != nil {
+					return nil, fmt.Errorf("step %d: %w", step+1, err)
+				}
+			}
+		}
+		if cfg.Trajectory != nil && onInterval(step+1, cfg.TrajectoryInterval) {
+			if err := cfg.Trajectory.WriteFrame(current, step+1); err != nil {
+				return nil, fmt.Errorf("step %d: %w", step+1, err)
+			}
+		}
+		if cfg.Progress != nil {
+			cfg.Progress.Step(step + 1)
+		}
+	}
+
+	return current, nil
+}
+
+// onInterval reports whether the step is a multiple of the interval, always when it is 0 or 1
+func onInterval(step, interval int) bool {
+	return interval <= 1 || step%interval == 0
+}
+
+// BerendsenRescale scales the velocities of the protein by
+// sqrt(1 + dt/tau*(target/T - 1)), coupling its temperature to target (K) with time constant tau (fs)
+func BerendsenRescale(protein *Protein, target, timestep, tau float64) {
+	temperature := Temperature(protein)
+	if temperature == 0 {
+		return
+	}
+	lambda := math.Sqrt(math.Max(0, 1+timestep/tau*(target/temperature-1)))
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			atom.velocity = scaleVector(atom.velocity, lambda)
+		}
+	}
+}
+
+// checkFinite return an error naming the first atom with a NaN or infinite position
+func checkFinite(protein *Protein) error {
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			position := atom.position
+			if math.IsNaN(position.x+position.y+position.z) || math.IsInf(position.x+position.y+position.z, 0) {
+				return fmt.Errorf("atom %d has position %v", atom.index, position)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// SpatialHash bins the atoms of a protein into cubic cells so that spatial queries
+// only visit nearby cells. Build it once and share it between the features that
+// need neighbours, and Rebuild it after the atoms move.
+type SpatialHash struct {
+	CellSize float64
+	atoms    []*Atom
+	cells    map[[3]int][]*Atom
+}
+
+// NewSpatialHash takes a protein and the edge length of a cell
+// and return the spatial hash of all its atoms
+func NewSpatialHash(protein *Protein, cellSize float64) *SpatialHash {
+	h := &SpatialHash{CellSize: cellSize}
+	for _, residue := range protein.Residue {
+		h.atoms = append(h.atoms, residue.Atoms...)
+	}
+	h.Rebuild()
+	return h
+}
+
+// Rebuild bins the atoms again at their current positions
+func (h *SpatialHash) Rebuild() {
+	h.cells = make(map[[3]int][]*Atom)
+	for _, atom := range h.atoms {
+		key := h.cellOf(atom.position)
+		h.cells[key] = append(h.cells[key], atom)
+	}
+}
+
+// Move bins again one atom that moved from the given position, the other atoms stay in their cells
+func (h *SpatialHash) Move(atom *Atom, from TriTuple) {
+	key := h.cellOf(from)
+	cell := h.cells[key]
+	for i, binned := range cell {
+		if binned == atom {
+			h.cells[key] = append(cell[:i], cell[i+1:]...)
+			break
+		}
+	}
+	key = h.cellOf(atom.position)
+	h.cells[key] = append(h.cells[key], atom)
+}
+
+// cellOf return the cell containing a position
+func (h *SpatialHash) cellOf(position TriTuple) [3]int {
+	return [3]int{
+		int(math.Floor(position.x / h.CellSize)),
+		int(math.Floor(position.y / h.CellSize)),
+		int(math.Floor(position.z / h.CellSize)),
+	}
+}
+
+// Query return the atoms closer than radius to center, ordered by atom index
+func (h *SpatialHash) Query(center TriTuple, radius float64) []*Atom {
+	var result []*Atom
+	if radius <= 0 {
+		return result
+	}
+
+	reach := int(math.Ceil(radius / h.CellSize))
+	origin := h.cellOf(center)
+	for i := origin[0] - reach; i <= origin[0]+reach; i++ {
+		for j := origin[1] - reach; j <= origin[1]+reach; j++ {
+			for k := origin[2] - reach; k <= origin[2]+reach; k++ {
+				for _, atom := range h.cells[[3]int{i, j, k}] {
+					if Distance(center, atom.position) < radius {
+						result = append(result, atom)
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(a, b int) bool { return result[a].index < result[b].index })
+	return result
+}
+
+// Pairs calls fn once for every pair of atoms closer than cutoff, with a before b in residue order
+func (h *SpatialHash) Pairs(cutoff float64, fn func(a, b *Atom, r float64)) {
+	if cutoff <= 0 {
+		return
+	}
+	order := make(map[*Atom]int, len(h.atoms))
+	for i, atom := range h.atoms {
+		order[atom] = i
+	}
+	for i, a := range h.atoms {
+		for _, b := range h.Query(a.position, cutoff) {
+			if order[b] > i {
+				fn(a, b, Distance(a.position, b.position))
+			}
+		}
+	}
+}
+
+// AtomsWithin takes a protein, a point, a radius and optionally a spatial hash of the protein
+// and return every atom whose distance to the point is below the radius. Without a hash
+// one is built for the call, pass one to share it between many queries; it must be up to
+// date with the positions of the atoms.
+func AtomsWithin(protein *Protein, center TriTuple, radius float64, hash ...*SpatialHash) []*Atom {
+	if radius <= 0 {
+		return nil
+	}
+	if len(hash) > 0 && hash[0] != nil {
+		return hash[0].Query(center, radius)
+	}
+	return NewSpatialHash(protein, radius).Query(center, radius)
+}
+
+// ForEachPairWithin calls fn once for every pair of atoms closer than cutoff, with a
+// before b in residue order. With a box the distances are minimum-image distances
+// (the cutoff should not exceed half the box), with a nil box they are plain distances.
+func ForEachPairWithin(protein *Protein, cutoff float64, box *Box, fn func(a, b *Atom, r float64)) {
+	if cutoff <= 0 {
+		return
+	}
+	if box == nil {
+		NewSpatialHash(protein, cutoff).Pairs(cutoff, fn)
+		return
+	}
+
+	order := make(map[*Atom]int)
+	var atoms []*Atom
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			order[atom] = len(atoms)
+			atoms = append(atoms, atom)
+		}
+	}
+
+	// periodic grid of at least cutoff wide cells, neighbouring cells wrap around
+	counts := [3]int{cellCount(box.X, cutoff), cellCount(box.Y, cutoff), cellCount(box.Z, cutoff)}
+	sizes := [3]float64{box.X / float64(counts[0]), box.Y / float64(counts[1]), box.Z / float64(counts[2])}
+	cellOf := func(position TriTuple) [3]int {
+		wrapped := wrapPosition(position, *box)
+		coordinates := [3]float64{wrapped.x, wrapped.y, wrapped.z}
+		var key [3]int
+		for d := range key {
+			key[d] = min(int(coordinates[d]/sizes[d]), counts[d]-1)
+		}
+		return key
+	}
+
+	cells := make(map[[3]int][]*Atom)
+	for _, atom := range atoms {
+		key := cellOf(atom.position)
+		cells[key] = append(cells[key], atom)
+	}
+
+	for i, a := range atoms {
+		origin := cellOf(a.position)
+		// with fewer than three cells along a side the wrapped neighbours repeat
+		visited := make(map[[3]int]bool)
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				for dz := -1; dz <= 1; dz++ {
+					key := [3]int{
+						(origin[0] + dx + counts[0]) % counts[0],
+						(origin[1] + dy + counts[1]) % counts[1],
+						(origin[2] + dz + counts[2]) % counts[2],
+					}
+					if visited[key] {
+						continue
+					}
+					visited[key] = true
+
+					for _, b := range cells[key] {
+						if order[b] <= i {
+							continue
+						}
+						if r := PeriodicDistance(a.position, b.position, *box); r < cutoff {
+							fn(a, b, r)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// cellCount return how many cells at least cutoff wide fit along a box side
+func cellCount(length, cutoff float64) int {
+	return max(1, int(length/cutoff))
+}
@@ -0,0 +1,402 @@
+package main
+
+// ///////////////
+// ////These function are used for editing the structure of a protein
+// ///////////////
+
+// MarkTermini flags the first and last amino acid of every chain as N- and C-terminal.
+// A chain is a run of residues with the same chain ID, an amino acid a residue with a
+// backbone N or C atom, so ligands and waters at the end of a chain are passed over.
+func (p *Protein) MarkTermini() {
+	for start := 0; start < len(p.Residue); {
+		end := start
+		for end < len(p.Residue) && p.Residue[end].ChainID == p.Residue[start].ChainID {
+			end++
+		}
+
+		var aminoAcids []*Residue
+		for _, residue := range p.Residue[start:end] {
+			residue.IsNTerminal, residue.IsCTerminal = false, false
+			if FindAtomByName(residue, "N") != nil || FindAtomByName(residue, "C") != nil {
+				aminoAcids = append(aminoAcids, residue)
+			}
+		}
+		if len(aminoAcids) > 0 {
+			aminoAcids[0].IsNTerminal = true
+			aminoAcids[len(aminoAcids)-1].IsCTerminal = true
+		}
+		start = end
+	}
+}
+
+// templateName return the name of the template of the residue in templates: the terminal
+// variant NXXX or CXXX for a terminal residue when templates has it, otherwise the
+// baseTemplateName of the residue
+func templateName[T any](residue *Residue, templates map[string]T) string {
+	base := baseTemplateName(residue, templates)
+	if residue.IsNTerminal {
+		if _, exist := templates["N"+base]; exist {
+			return "N" + base
+		}
+	}
+	if residue.IsCTerminal {
+		if _, exist := templates["C"+base]; exist {
+			return "C" + base
+		}
+	}
+	return base
+}
+
+// baseTemplateName return the protonation variant of the residue, or the first of its
+// variantAliases, when templates has it, otherwise the residue name
+func baseTemplateName[T any](residue *Residue, templates map[string]T) string {
+	if residue.Variant != "" {
+		for _, name := range append([]string{residue.Variant}, variantAliases[residue.Variant]...) {
+			if _, exist := templates[name]; exist {
+				return name
+			}
+		}
+	}
+	return residue.Name
+}
+
+// variantAliases lists the names the force fields give the AMBER protonation variants:
+// GROMOS (aminoacids.rtp) HISA/HISB/HISH, the revised entries HISD/HISE/HISH, CHARMM HSD/HSE/HSP
+var variantAliases = map[string][]string{
+	"HID": {"HISD", "HISA", "HSD"},
+	"HIE": {"HISE", "HISB", "HSE"},
+	"HIP": {"HISH", "HISP", "HSP"},
+}
+
+// MarkVariants sets the Variant of every histidine whose protonation state HistidineVariant
+// recognizes, the other residues keep theirs
+func (p *Protein) MarkVariants() {
+	for _, residue := range p.Residue {
+		if variant := HistidineVariant(residue); variant != "" {
+			residue.Variant = variant
+		}
+	}
+}
+
+// HistidineVariant return the AMBER name of the protonation state of a histidine from
+// its ring hydrogens: HID with HD1 only, HIE with HE2 only and HIP with both.
+// It return "" for other residues and a histidine without ring hydrogens.
+func HistidineVariant(residue *Residue) string {
+	if residue.Name != "HIS" {
+		return ""
+	}
+	hd1, he2 := FindAtomByName(residue, "HD1") != nil, FindAtomByName(residue, "HE2") != nil
+	switch {
+	case hd1 && he2:
+		return "HIP"
+	case hd1:
+		return "HID"
+	case he2:
+		return "HIE"
+	}
+	return ""
+}
+
+// FilterAtoms takes a protein and a predicate
+// and return a copy holding only the atoms for which keep is true.
+// Residues left without atoms are dropped and the atoms are renumbered from 1
+// so that force maps keyed by index stay consistent.
+func FilterAtoms(protein *Protein, keep func(*Atom) bool) *Protein {
+	copied := CopyProtein(protein)
+
+	var residues []*Residue
+	for _, residue := range copied.Residue {
+		var atoms []*Atom
+		for _, atom := range residue.Atoms {
+			if keep(atom) {
+				atoms = append(atoms, atom)
+			}
+		}
+		if len(atoms) == 0 {
+			continue
+		}
+		residue.Atoms = atoms
+		residues = append(residues, residue)
+	}
+	copied.Residue = residues
+
+	copied.pruneExplicitBonds()
+	copied.Reindex()
+	return copied
+}
+
+// RemoveHydrogens returns a copy of the protein without its hydrogen atoms
+func RemoveHydrogens(protein *Protein) *Protein {
+	return FilterAtoms(protein, func(atom *Atom) bool {
+		return atomElement(atom) != "H"
+	})
+}
+
+// Reindex numbers the atoms of the protein contiguously from 1 in residue order
+func (p *Protein) Reindex() {
+	index := 1
+	for _, residue := range p.Residue {
+		for _, atom := range residue.Atoms {
+			atom.index = index
+			index++
+		}
+	}
+	p.InvalidateAtomIndex()
+}
+
+// AtomByIndex return the atom of the protein with the given index from a map built on
+// the first call. Reindex, FilterAtoms, DeduplicateAtoms and the ProteinBuilder drop the
+// map when they change the atoms, code adding, removing or renumbering atoms by hand must
+// call InvalidateAtomIndex. It is not safe for concurrent use on the same protein.
+func (p *Protein) AtomByIndex(index int) (*Atom, bool) {
+	if p.atomByIndex == nil {
+		p.atomByIndex = make(map[int]*Atom)
+		for _, residue := range p.Residue {
+			for _, atom := range residue.Atoms {
+				p.atomByIndex[atom.index] = atom
+			}
+		}
+	}
+	atom, exist := p.atomByIndex[index]
+	return atom, exist
+}
+
+// InvalidateAtomIndex drops the map of AtomByIndex, the next call builds it again
+func (p *Protein) InvalidateAtomIndex() {
+	p.atomByIndex = nil
+}
+
+// DeduplicateAtoms removes atoms that lie within tol of an earlier atom with the same name,
+// keeping the first copy. Residues left without atoms are dropped and the atoms are
+// renumbered from 1. It return the number of atoms removed.
+func DeduplicateAtoms(protein *Protein, tol float64) int {
+	if tol <= 0 {
+		return 0
+	}
+
+	cells := NewSpatialHash(protein, tol)
+	duplicate := make(map[*Atom]bool)
+	order := make(map[*Atom]int)
+	position := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			order[atom] = position
+			position++
+		}
+	}
+
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if duplicate[atom] {
+				continue
+			}
+			for _, other := range cells.Query(atom.position, tol) {
+				if other != atom && other.element == atom.element && order[other] > order[atom] {
+					duplicate[other] = true
+				}
+			}
+		}
+	}
+	if len(duplicate) == 0 {
+		return 0
+	}
+
+	var residues []*Residue
+	for _, residue := range protein.Residue {
+		var atoms []*Atom
+		for _, atom := range residue.Atoms {
+			if !duplicate[atom] {
+				atoms = append(atoms, atom)
+			}
+		}
+		if len(atoms) == 0 {
+			continue
+		}
+		residue.Atoms = atoms
+		residues = append(residues, residue)
+	}
+	protein.Residue = residues
+
+	protein.pruneExplicitBonds()
+	protein.Reindex()
+	return len(duplicate)
+}
+
+// pruneExplicitBonds drops the explicit bonds to atoms that are no longer in the protein
+func (p *Protein) pruneExplicitBonds() {
+	if len(p.ExplicitBonds) == 0 {
+		return
+	}
+
+	present := make(map[*Atom]bool)
+	for _, residue := range p.Residue {
+		for _, atom := range residue.Atoms {
+			present[atom] = true
+		}
+	}
+
+	var bonds [][2]*Atom
+	for _, bond := range p.ExplicitBonds {
+		if present[bond[0]] && present[bond[1]] {
+			bonds = append(bonds, bond)
+		}
+	}
+	p.ExplicitBonds = bonds
+}
+
+// CGBead is one coarse-grained bead, made of the atoms of a residue with the listed names.
+// A bead with no names takes every atom not claimed by another bead.
+type CGBead struct {
+	Name  string
+	Atoms []string
+}
+
+// CGScheme lists the beads every residue is mapped to
+type CGScheme struct {
+	Beads []CGBead
+}
+
+// BackboneSidechainScheme maps each residue to a backbone bead BB and a side chain bead SC
+var BackboneSidechainScheme = CGScheme{Beads: []CGBead{
+	{Name: "BB", Atoms: []string{"N", "H", "H1", "H2", "H3", "CA", "HA", "HA1", "HA2", "HA3", "C", "O", "OXT"}},
+	{Name: "SC"},
+}}
+
+// CoarseGrain takes a protein and a mapping scheme
+// and return a new protein with one atom per bead and residue, at the mass-weighted
+// center of its atoms and with their summed mass and charge. Beads without atoms
+// (the side chain of glycine) are left out and the beads are numbered from 1.
+func CoarseGrain(protein *Protein, scheme CGScheme) *Protein {
+	coarse := &Protein{Name: protein.Name}
+	if protein.Box != nil {
+		box := *protein.Box
+		coarse.Box = &box
+	}
+
+	for _, residue := range protein.Residue {
+		bead := make(map[string]int)
+		rest := -1
+		for i, b := range scheme.Beads {
+			if len(b.Atoms) == 0 {
+				rest = i
+			}
+			for _, name := range b.Atoms {
+				bead[name] = i
+			}
+		}
+
+		members := make([][]*Atom, len(scheme.Beads))
+		for _, atom := range residue.Atoms {
+			i, found := bead[atom.element]
+			if !found {
+				if rest < 0 {
+					continue
+				}
+				i = rest
+			}
+			members[i] = append(members[i], atom)
+		}
+
+		coarseResidue := &Residue{Name: residue.Name, ID: residue.ID, ChainID: residue.ChainID}
+		for i, atoms := range members {
+			if len(atoms) == 0 {
+				continue
+			}
+			coarseResidue.Atoms = append(coarseResidue.Atoms, collapseAtoms(scheme.Beads[i].Name, atoms))
+		}
+		if len(coarseResidue.Atoms) > 0 {
+			coarse.Residue = append(coarse.Residue, coarseResidue)
+		}
+	}
+
+	coarse.Reindex()
+	return coarse
+}
+
+// collapseAtoms return a single bead at the center of mass of the atoms,
+// the plain centroid if they have no mass
+func collapseAtoms(name string, atoms []*Atom) *Atom {
+	bead := &Atom{element: name}
+	for _, atom := range atoms {
+		bead.mass += atom.mass
+		bead.charge += atom.charge
+	}
+
+	for _, atom := range atoms {
+		weight := 1.0 / float64(len(atoms))
+		if bead.mass > 0 {
+			weight = atom.mass / bead.mass
+		}
+		bead.position.x += weight * atom.position.x
+		bead.position.y += weight * atom.position.y
+		bead.position.z += weight * atom.position.z
+	}
+	return bead
+}
+
+// Disulfide is a pair of cysteines whose SG atoms are close enough to be bonded
+type Disulfide struct {
+	Residue1 *Residue
+	Residue2 *Residue
+	SG1      *Atom
+	SG2      *Atom
+	Distance float64
+}
+
+// FindDisulfides takes a protein and a distance cutoff (Angstrom, about 2.2)
+// and return every pair of cysteines (CYS or CYX) whose SG atoms are closer than maxDist,
+// in residue order
+func FindDisulfides(protein *Protein, maxDist float64) []Disulfide {
+	var cysteines []*Residue
+	for _, residue := range protein.Residue {
+		if (residue.Name == "CYS" || residue.Name == "CYX") && FindAtomByName(residue, "SG") != nil {
+			cysteines = append(cysteines, residue)
+		}
+	}
+
+	var disulfides []Disulfide
+	for i := 0; i < len(cysteines); i++ {
+		for j := i + 1; j < len(cysteines); j++ {
+			sg1, sg2 := FindAtomByName(cysteines[i], "SG"), FindAtomByName(cysteines[j], "SG")
+			if r := Distance(sg1.position, sg2.position); r < maxDist {
+				disulfides = append(disulfides, Disulfide{Residue1: cysteines[i], Residue2: cysteines[j], SG1: sg1, SG2: sg2, Distance: r})
+			}
+		}
+	}
+	return disulfides
+}
+
+// AddDisulfides adds the SG-SG bond of every disulfide to the topology, with the given
+// bond parameters if any. Bonds the topology already has (e.g. found by distance) are kept as they are.
+func (t *Topology) AddDisulfides(disulfides []Disulfide, parameter ...float64) {
+	neighbors := t.neighbors()
+	for _, disulfide := range disulfides {
+		bonded := false
+		for _, neighbor := range neighbors[disulfide.SG1] {
+			bonded = bonded || neighbor == disulfide.SG2
+		}
+		if !bonded {
+			t.AddBond(disulfide.SG1, disulfide.SG2, parameter...)
+			neighbors[disulfide.SG1] = append(neighbors[disulfide.SG1], disulfide.SG2)
+			neighbors[disulfide.SG2] = append(neighbors[disulfide.SG2], disulfide.SG1)
+		}
+	}
+}
+
+// Renumber takes a protein, a first residue ID and a chain mapping, relabels the chain of every
+// residue found in chainMap (old label to new label, other chains keep theirs) and then numbers
+// the residues of each chain from startResidueID in the order they appear
+func Renumber(protein *Protein, startResidueID int, chainMap map[string]string) {
+	next := make(map[string]int)
+	for _, residue := range protein.Residue {
+		if chain, exist := chainMap[residue.ChainID]; exist {
+			residue.ChainID = chain
+		}
+		id, seen := next[residue.ChainID]
+		if !seen {
+			id = startResidueID
+		}
+		residue.ID = id
+		next[residue.ChainID] = id + 1
+	}
+}
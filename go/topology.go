@@ -0,0 +1,318 @@
+package main
+
+import "math"
+
+// Topology lists the bonded terms of a protein. The parameters of a term are
+// given in the same column order as the force field files ([b0 kb] for bonds,
+// [theta0 k] for angles, [phase kd pn] for dihedrals), a term without
+// parameters is looked up in the parameter databases when it is evaluated.
+type Topology struct {
+	Protein   *Protein
+	bonds     []bondTerm
+	angles    []angleTerm
+	dihedrals []dihedralTerm
+	impropers []dihedralTerm
+}
+
+type bondTerm struct {
+	atom1, atom2 *Atom
+	parameter    []float64
+}
+
+type angleTerm struct {
+	atom1, atom2, atom3 *Atom
+	parameter           []float64
+}
+
+type dihedralTerm struct {
+	atom1, atom2, atom3, atom4 *Atom
+	parameter                  []float64
+}
+
+// NewTopology returns an empty topology for the protein
+func NewTopology(protein *Protein) *Topology {
+	return &Topology{Protein: protein}
+}
+
+// AddBond adds a bond between two atoms
+func (t *Topology) AddBond(atom1, atom2 *Atom, parameter ...float64) {
+	t.bonds = append(t.bonds, bondTerm{atom1: atom1, atom2: atom2, parameter: parameter})
+}
+
+// AddAngle adds an angle atom1-atom2-atom3 with atom2 at the vertex
+func (t *Topology) AddAngle(atom1, atom2, atom3 *Atom, parameter ...float64) {
+	t.angles = append(t.angles, angleTerm{atom1: atom1, atom2: atom2, atom3: atom3, parameter: parameter})
+}
+
+// AddDihedral adds a proper dihedral atom1-atom2-atom3-atom4
+func (t *Topology) AddDihedral(atom1, atom2, atom3, atom4 *Atom, parameter ...float64) {
+	t.dihedrals = append(t.dihedrals, dihedralTerm{atom1: atom1, atom2: atom2, atom3: atom3, atom4: atom4, parameter: parameter})
+}
+
+// AddImproper adds an improper dihedral with atom1 as the central atom
+func (t *Topology) AddImproper(atom1, atom2, atom3, atom4 *Atom, parameter ...float64) {
+	t.impropers = append(t.impropers, dihedralTerm{atom1: atom1, atom2: atom2, atom3: atom3, atom4: atom4, parameter: parameter})
+}
+
+// ForEachBond calls fn with the atoms and parameters of every bond
+func (t *Topology) ForEachBond(fn func(atom1, atom2 *Atom, parameter []float64)) {
+	for _, bond := range t.bonds {
+		fn(bond.atom1, bond.atom2, bond.parameter)
+	}
+}
+
+// ForEachAngle calls fn with the atoms and parameters of every angle, atom2 at the vertex
+func (t *Topology) ForEachAngle(fn func(atom1, atom2, atom3 *Atom, parameter []float64)) {
+	for _, angle := range t.angles {
+		fn(angle.atom1, angle.atom2, angle.atom3, angle.parameter)
+	}
+}
+
+// ForEachDihedral calls fn with the atoms and parameters of every proper dihedral
+func (t *Topology) ForEachDihedral(fn func(atom1, atom2, atom3, atom4 *Atom, parameter []float64)) {
+	for _, dihedral := range t.dihedrals {
+		fn(dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4, dihedral.parameter)
+	}
+}
+
+// ForEachImproper calls fn with the atoms and parameters of every improper dihedral
+func (t *Topology) ForEachImproper(fn func(atom1, atom2, atom3, atom4 *Atom, parameter []float64)) {
+	for _, improper := range t.impropers {
+		fn(improper.atom1, improper.atom2, improper.atom3, improper.atom4, improper.parameter)
+	}
+}
+
+// BuildTopology takes a protein
+// and return a topology with a bond between every pair of atoms close enough
+// to be bonded (BondedByDistance) and the angles and dihedrals derived from them.
+// The explicit bonds of the protein (CONECT records) are authoritative: an atom they
+// mention gets exactly those bonds and none found by distance.
+func BuildTopology(protein *Protein) *Topology {
+	topology := NewTopology(protein)
+
+	explicit := make(map[*Atom]bool)
+	for _, bond := range protein.ExplicitBonds {
+		explicit[bond[0]] = true
+		explicit[bond[1]] = true
+		topology.AddBond(bond[0], bond[1])
+	}
+
+	// no two atoms further apart than this are bonded by BondedByDistance
+	cutoff := 2 * largestVdwRadius() * bondDetectionFactor
+	NewSpatialHash(protein, cutoff).Pairs(cutoff, func(atom1, atom2 *Atom, r float64) {
+		if !explicit[atom1] && !explicit[atom2] && BondedByDistance(atom1, atom2) {
+			topology.AddBond(atom1, atom2)
+		}
+	})
+
+	topology.deriveAnglesAndDihedrals()
+	return topology
+}
+
+// deriveAnglesAndDihedrals adds every angle and proper dihedral of the bond graph
+func (t *Topology) deriveAnglesAndDihedrals() {
+	neighbors := t.neighbors()
+	atoms := t.atoms()
+
+	// angles a-b-c around every central atom b
+	for _, b := range atoms {
+		for i := 0; i < len(neighbors[b])-1; i++ {
+			for j := i + 1; j < len(neighbors[b]); j++ {
+				t.AddAngle(neighbors[b][i], b, neighbors[b][j])
+			}
+		}
+	}
+
+	// dihedrals a-b-c-d around every bond b-c
+	for _, bond := range t.bonds {
+		b, c := bond.atom1, bond.atom2
+		for _, a := range neighbors[b] {
+			if a == c {
+				continue
+			}
+			for _, d := range neighbors[c] {
+				if d == b || d == a {
+					continue
+				}
+				t.AddDihedral(a, b, c, d)
+			}
+		}
+	}
+}
+
+// onProtein return a topology with the same terms on the atoms of another protein
+// that have the same indices, such as a copy made by CopyProtein
+func (t *Topology) onProtein(protein *Protein) *Topology {
+	atoms := make(map[int]*Atom)
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			atoms[atom.index] = atom
+		}
+	}
+
+	mapped := NewTopology(protein)
+	for _, bond := range t.bonds {
+		mapped.AddBond(atoms[bond.atom1.index], atoms[bond.atom2.index], bond.parameter...)
+	}
+	for _, angle := range t.angles {
+		mapped.AddAngle(atoms[angle.atom1.index], atoms[angle.atom2.index], atoms[angle.atom3.index], angle.parameter...)
+	}
+	for _, dihedral := range t.dihedrals {
+		mapped.AddDihedral(atoms[dihedral.atom1.index], atoms[dihedral.atom2.index], atoms[dihedral.atom3.index], atoms[dihedral.atom4.index], dihedral.parameter...)
+	}
+	for _, improper := range t.impropers {
+		mapped.AddImproper(atoms[improper.atom1.index], atoms[improper.atom2.index], atoms[improper.atom3.index], atoms[improper.atom4.index], improper.parameter...)
+	}
+	return mapped
+}
+
+// atoms returns the atoms of the protein in residue order
+func (t *Topology) atoms() []*Atom {
+	var atoms []*Atom
+	for _, residue := range t.Protein.Residue {
+		atoms = append(atoms, residue.Atoms...)
+	}
+	return atoms
+}
+
+// neighbors returns the bonded neighbors of every atom
+func (t *Topology) neighbors() map[*Atom][]*Atom {
+	neighbors := make(map[*Atom][]*Atom)
+	for _, bond := range t.bonds {
+		neighbors[bond.atom1] = append(neighbors[bond.atom1], bond.atom2)
+		neighbors[bond.atom2] = append(neighbors[bond.atom2], bond.atom1)
+	}
+	return neighbors
+}
+
+// excludedPairs returns the 1-2 and 1-3 pairs of the topology, the atoms joined by a bond
+// or by the two ends of an angle, keyed in both orders
+func (t *Topology) excludedPairs() map[[2]*Atom]bool {
+	excluded := make(map[[2]*Atom]bool)
+	for _, bond := range t.bonds {
+		excluded[[2]*Atom{bond.atom1, bond.atom2}] = true
+		excluded[[2]*Atom{bond.atom2, bond.atom1}] = true
+	}
+	for _, angle := range t.angles {
+		excluded[[2]*Atom{angle.atom1, angle.atom3}] = true
+		excluded[[2]*Atom{angle.atom3, angle.atom1}] = true
+	}
+	return excluded
+}
+
+// Fragments takes a topology
+// and return the connected components of its bond graph, i.e. the separate molecules
+// (protein, ligand, ions, water, ...). Fragments come in the residue order of their
+// first atom and the atoms of each in the order of a breadth-first search from it.
+func Fragments(topology *Topology) [][]*Atom {
+	neighbors := topology.neighbors()
+	visited := make(map[*Atom]bool)
+
+	var fragments [][]*Atom
+	for _, start := range topology.atoms() {
+		if visited[start] {
+			continue
+		}
+		visited[start] = true
+		fragment := []*Atom{start}
+		for i := 0; i < len(fragment); i++ {
+			for _, next := range neighbors[fragment[i]] {
+				if !visited[next] {
+					visited[next] = true
+					fragment = append(fragment, next)
+				}
+			}
+		}
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments
+}
+
+// CalculateTotalEnergy takes a topology and the bonded and non-bonded parameters
+// and return the potential energy of its protein: the bonds, angles, dihedrals and
+// impropers of the topology plus the non-bonded energy of UnbondedEnergyOnly,
+// all in the energy unit of the bonded UnitSystem (kJ/mol by default).
+// bonded may hold bond, angle and dihedral entries together, a term is matched
+// against the entries with the same number of atoms.
+func CalculateTotalEnergy(topology *Topology, bonded, nonbonded parameterDatabase) float64 {
+	return topology.bondedEnergy(bonded) + bonded.unitSystem().FromKJPerMol(UnbondedEnergyOnly(topology.Protein, nonbonded))
+}
+
+// bondedEnergy return the energy of the bonded terms
+func (t *Topology) bondedEnergy(bonded parameterDatabase) float64 {
+	energy := 0.0
+	t.forEachTermEnergy(bonded, func(kind string, atoms []*Atom, termEnergy float64) {
+		energy += termEnergy
+	})
+	return energy
+}
+
+// forEachTermEnergy calls fn with the kind ("bond", "angle", "dihedral" or "improper"),
+// the atoms and the energy of every bonded term that has parameters
+func (t *Topology) forEachTermEnergy(bonded parameterDatabase, fn func(kind string, atoms []*Atom, energy float64)) {
+	bondParameter := bonded.withAtomCount(2)
+	angleParameter := bonded.withAtomCount(3)
+	dihedralParameter := bonded.withAtomCount(4)
+	units := bonded.unitSystem()
+
+	for _, bond := range t.bonds {
+		parameter, ok := bondParam(termParameter(bond.parameter, bondParameter, bond.atom1, bond.atom2))
+		if !ok {
+			continue
+		}
+		fn("bond", []*Atom{bond.atom1, bond.atom2}, parameter.Energy(Distance(bond.atom1.position, bond.atom2.position), units))
+	}
+
+	for _, angle := range t.angles {
+		parameter, ok := angleParam(termParameter(angle.parameter, angleParameter, angle.atom1, angle.atom2, angle.atom3))
+		if !ok {
+			continue
+		}
+		fn("angle", []*Atom{angle.atom1, angle.atom2, angle.atom3}, parameter.Energy(CalculateAngle(angle.atom1, angle.atom2, angle.atom3)/180*math.Pi, units))
+	}
+
+	for _, dihedral := range t.dihedrals {
+		parameter, ok := dihedralParam(termParameter(dihedral.parameter, dihedralParameter, dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4))
+		if !ok {
+			continue
+		}
+		phi := CalculateSignedDihedralAngle(dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4) / 180 * math.Pi
+		fn("dihedral", []*Atom{dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4}, parameter.Energy(phi))
+	}
+
+	for _, improper := range t.impropers {
+		parameter, ok := angleParam(termParameter(improper.parameter, dihedralParameter, improper.atom1, improper.atom2, improper.atom3, improper.atom4))
+		if !ok {
+			continue
+		}
+		// harmonic in the improper angle, same form as the angle term
+		fn("improper", []*Atom{improper.atom1, improper.atom2, improper.atom3, improper.atom4}, parameter.Energy(improperAngle(improper, parameter), units))
+	}
+}
+
+// improperAngle return the improper angle of the term in radians, taken within pi of xi0
+func improperAngle(improper dihedralTerm, parameter AngleParam) float64 {
+	xi := CalculateSignedDihedralAngle(improper.atom1, improper.atom2, improper.atom3, improper.atom4) / 180 * math.Pi
+	return parameter.Theta0 + math.Remainder(xi-parameter.Theta0, 2*math.Pi)
+}
+
+// termParameter return the parameters given with a term, or the ones found in db
+func termParameter(parameter []float64, db parameterDatabase, atoms ...*Atom) []float64 {
+	if len(parameter) > 0 {
+		return parameter
+	}
+	return SearchParameter(len(atoms), db, atoms...)
+}
+
+// withAtomCount return the entries of the database that name count atoms
+func (db parameterDatabase) withAtomCount(count int) parameterDatabase {
+	filtered := db
+	filtered.atomPair = nil
+	for _, pair := range db.atomPair {
+		if len(pair.atomName) == count {
+			filtered.atomPair = append(filtered.atomPair, pair)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// decimals of the coordinates written by TrajectoryWriter when Precision is not set
+const defaultTrajectoryPrecision = 6
+
+// TrajectoryFormat selects the file format of a TrajectoryWriter
+type TrajectoryFormat int
+
+const (
+	// XYZTrajectory writes the number of atoms, a comment line holding the step,
+	// then one "name x y z" line per atom
+	XYZTrajectory TrajectoryFormat = iota
+	// PDBTrajectory writes the ATOM records of WriteProteinToPDB wrapped in MODEL/ENDMDL,
+	// models numbered from 1, with the header before the first model only
+	PDBTrajectory
+)
+
+// TrajectoryWriter writes frames in the XYZ format, or as PDB models
+type TrajectoryWriter struct {
+	w *bufio.Writer
+	// only the steps that are a multiple of Stride are written, 0 or 1 writes every step
+	Stride int
+	// decimals of the XYZ coordinates, 0 uses defaultTrajectoryPrecision, PDB has 3
+	Precision int
+	Format    TrajectoryFormat
+	// frames written so far
+	frames int
+}
+
+// NewTrajectoryWriter returns a writer of XYZ frames to w
+func NewTrajectoryWriter(w io.Writer) *TrajectoryWriter {
+	return &TrajectoryWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteFrame writes the atoms of the protein as the frame of the given step,
+// steps that are not a multiple of the stride are skipped
+func (tw *TrajectoryWriter) WriteFrame(protein *Protein, step int) error {
+	if tw.Stride > 1 && step%tw.Stride != 0 {
+		return nil
+	}
+	tw.frames++
+	if tw.Format == PDBTrajectory {
+		return tw.writePDBModel(protein)
+	}
+	precision := tw.Precision
+	if precision <= 0 {
+		precision = defaultTrajectoryPrecision
+	}
+
+	count := 0
+	for _, residue := range protein.Residue {
+		count += len(residue.Atoms)
+	}
+
+	fmt.Fprintf(tw.w, "%d\n", count)
+	fmt.Fprintf(tw.w, "step=%d\n", step)
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			fmt.Fprintf(tw.w, "%s %.*f %.*f %.*f\n", atom.element, precision, atom.position.x, precision, atom.position.y, precision, atom.position.z)
+		}
+	}
+
+	return tw.w.Flush()
+}
+
+// writePDBModel writes the protein as the next MODEL, after the header for the first one
+func (tw *TrajectoryWriter) writePDBModel(protein *Protein) error {
+	if tw.frames == 1 {
+		if err := writePDBHeader(tw.w, protein); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(tw.w, "MODEL     %4d\n", tw.frames)
+	if err := writePDBAtoms(tw.w, protein); err != nil {
+		return err
+	}
+	fmt.Fprintf(tw.w, "ENDMDL\n")
+	return tw.w.Flush()
+}
+
+// TrajectoryFrame is one frame read back from an XYZ trajectory
+type TrajectoryFrame struct {
+	Step      int
+	Names     []string
+	Positions []TriTuple
+}
+
+// TrajectoryReader reads the frames written by TrajectoryWriter one at a time
+type TrajectoryReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewTrajectoryReader returns a reader of XYZ frames from r
+func NewTrajectoryReader(r io.Reader) *TrajectoryReader {
+	return &TrajectoryReader{scanner: bufio.NewScanner(r)}
+}
+
+// nextLine return the next line of the input, or io.EOF
+func (tr *TrajectoryReader) nextLine() (string, error) {
+	if !tr.scanner.Scan() {
+		if err := tr.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	tr.line++
+	return tr.scanner.Text(), nil
+}
+
+// ReadFrame returns the next frame, or io.EOF when there are no more frames
+func (tr *TrajectoryReader) ReadFrame() (*TrajectoryFrame, error) {
+	// skip blank lines between frames
+	line, err := tr.nextLine()
+	for err == nil && strings.TrimSpace(line) == "" {
+		line, err = tr.nextLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("line %d: invalid atom count: %s", tr.line, line)
+	}
+
+	comment, err := tr.nextLine()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: missing comment line", tr.line)
+	}
+	frame := &TrajectoryFrame{}
+	for _, field := range strings.Fields(comment) {
+		if value, found := strings.CutPrefix(field, "step="); found {
+			frame.Step, _ = strconv.Atoi(value)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		line, err := tr.nextLine()
+		if err != nil {
+			return nil, fmt.Errorf("frame has %d of %d atoms", i, count)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: invalid atom line: %s", tr.line, line)
+		}
+		var coordinates [3]float64
+		for j := range coordinates {
+			coordinates[j], err = strconv.ParseFloat(fields[j+1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid coordinate '%s'", tr.line, fields[j+1])
+			}
+		}
+		frame.Names = append(frame.Names, fields[0])
+		frame.Positions = append(frame.Positions, TriTuple{x: coordinates[0], y: coordinates[1], z: coordinates[2]})
+	}
+
+	return frame, nil
+}
+
+// Protein return the frame as a protein of one residue "FRM", its atoms numbered
+// from 1 in frame order with the names of the frame and masses from their elements
+func (frame *TrajectoryFrame) Protein() *Protein {
+	residue := &Residue{Name: "FRM", ID: 1}
+	for i, name := range frame.Names {
+		residue.Atoms = append(residue.Atoms, &Atom{index: i + 1, element: name, position: frame.Positions[i]})
+	}
+	protein := &Protein{Residue: []*Residue{residue}}
+	protein.UpdateMasses(massTable)
+	return protein
+}
+
+// ReduceTrajectory folds step over the frames of the reader, read one at a time, starting
+// from init: acc = step(acc, frame) for every frame. Only one frame is held in memory,
+// e.g. the mean of an observable sums it frame by frame. It return the value reached at
+// the end of the trajectory, or at the frame that could not be read together with the error.
+func ReduceTrajectory[T any](reader *TrajectoryReader, init T, step func(acc T, frame *Protein) T) (T, error) {
+	acc := init
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			return acc, nil
+		}
+		if err != nil {
+			return acc, err
+		}
+		acc = step(acc, frame.Protein())
+	}
+}
+
+// EvaluateTrajectoryEnergies takes a trajectory reader, the topology of the system and its
+// parameters and return the total energy (CalculateTotalEnergy) of every frame.
+// The coordinates of a frame are given to the topology atoms in order; the original
+// positions of the topology protein are restored afterwards.
+func EvaluateTrajectoryEnergies(reader *TrajectoryReader, topology *Topology, bonded, nonbonded parameterDatabase) ([]float64, error) {
+	atoms := topology.atoms()
+	original := make([]TriTuple, len(atoms))
+	for i, atom := range atoms {
+		original[i] = atom.position
+	}
+	defer func() {
+		for i, atom := range atoms {
+			atom.position = original[i]
+		}
+	}()
+
+	var energies []float64
+	for {
+		frame, err := reader.ReadFrame()
+		if err == io.EOF {
+			return energies, nil
+		}
+		if err != nil {
+			return energies, err
+		}
+		if len(frame.Positions) != len(atoms) {
+			return energies, fmt.Errorf("frame at step %d has %d atoms but the topology has %d", frame.Step, len(frame.Positions), len(atoms))
+		}
+
+		for i, atom := range atoms {
+			atom.position = frame.Positions[i]
+		}
+		energies = append(energies, CalculateTotalEnergy(topology, bonded, nonbonded))
+	}
+}
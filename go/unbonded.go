@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"math"
 )
 
@@ -39,9 +40,42 @@ func NewVerletList() *VerletList {
 	}
 }
 
-func (v *VerletList) BuildVerlet(protein *Protein) {
-	cutoffPlusBuffer := v.Cutoff + v.Buffer
+// NewPeriodicVerletList returns a Verlet list using minimum-image distances in the box,
+// or an error if the default cutoff and buffer do not fit in it (see Validate)
+func NewPeriodicVerletList(box Box) (*VerletList, error) {
+	v := NewVerletList()
+	v.Box = &box
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Validate checks that Cutoff + Buffer is at most half the smallest side of the box,
+// beyond that an atom would see more than one image of its neighbours
+func (v *VerletList) Validate() error {
+	if v.Box == nil {
+		return nil
+	}
+	smallest := math.Min(v.Box.X, math.Min(v.Box.Y, v.Box.Z))
+	if v.Cutoff+v.Buffer > smallest/2 {
+		return fmt.Errorf("cutoff %.3f + buffer %.3f exceeds half the smallest box side %.3f", v.Cutoff, v.Buffer, smallest)
+	}
+	return nil
+}
+
+// BuildVerlet fills the neighbour list of every atom of the protein,
+// or return the error of Validate and leaves the list empty
+func (v *VerletList) BuildVerlet(protein *Protein) error {
 	v.Neighbors = make(map[*Atom][]*Atom)
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	cutoffPlusBuffer := v.Cutoff + v.Buffer
+	var centers map[int]TriTuple
+	if v.Scheme == GroupCutoff {
+		centers = chargeGroupCenters(protein, v.Box)
+	}
 
 	for _, residue := range protein.Residue {
 		for _, atom := range residue.Atoms {
@@ -55,7 +89,14 @@ func (v *VerletList) BuildVerlet(protein *Protein) {
 					if otherAtom.index >= atom.index-3 && otherAtom.index <= atom.index+3 {
 						continue
 					}
-					distance := Distance(atom.position, otherAtom.position)
+					position, otherPosition := atom.position, otherAtom.position
+					if centers != nil {
+						position, otherPosition = groupCenter(atom, centers), groupCenter(otherAtom, centers)
+					}
+					distance := Distance(position, otherPosition)
+					if v.Box != nil {
+						distance = PeriodicDistance(position, otherPosition, *v.Box)
+					}
 					if distance <= cutoffPlusBuffer {
 						v.Neighbors[atom] = append(v.Neighbors[atom], otherAtom)
 					}
@@ -63,18 +104,103 @@ func (v *VerletList) BuildVerlet(protein *Protein) {
 			}
 		}
 	}
+	return nil
 }
 
-func (protein *Protein) AssignChargesToProtein(chargeData map[string]map[string]float64) {
+// chargeGroupCenters return the geometric center of every charge group of the protein.
+// In a box the atoms of a group are taken at their minimum image from its first atom,
+// so that a group split across the boundary is centered where its atoms are.
+func chargeGroupCenters(protein *Protein, box *Box) map[int]TriTuple {
+	first := make(map[int]TriTuple)
+	sums := make(map[int]TriTuple)
+	counts := make(map[int]int)
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if atom.chargeGroup == 0 {
+				continue
+			}
+			reference, seen := first[atom.chargeGroup]
+			if !seen {
+				reference = atom.position
+				first[atom.chargeGroup] = reference
+			}
+			offset := addVectors(atom.position, scaleVector(reference, -1))
+			if box != nil {
+				offset = MinimumImage(offset, *box)
+			}
+			sums[atom.chargeGroup] = addVectors(sums[atom.chargeGroup], offset)
+			counts[atom.chargeGroup]++
+		}
+	}
+	centers := make(map[int]TriTuple, len(sums))
+	for group, sum := range sums {
+		centers[group] = addVectors(first[group], scaleVector(sum, 1/float64(counts[group])))
+	}
+	return centers
+}
+
+// groupCenter return the center of the charge group of the atom, or its position when it has none
+func groupCenter(atom *Atom, centers map[int]TriTuple) TriTuple {
+	if center, exist := centers[atom.chargeGroup]; exist {
+		return center
+	}
+	return atom.position
+}
+
+// AssignChargeGroups numbers the charge groups of the protein from the per residue
+// charge data, the atoms of a residue sharing a ChargeGroup form one group.
+// Groups are numbered from 1 over the whole protein, atoms missing from the data or
+// with ChargeGroup 0 get none. Like AssignChargesToProtein a terminal residue takes
+// the atoms its terminal entry lists from it and the others from the plain entry,
+// the groups of the two entries are kept apart.
+func (protein *Protein) AssignChargeGroups(chargeData map[string]map[string]AtomChargeData) {
+	next := 1
 	for _, residue := range protein.Residue {
-		residueName := residue.Name
+		residueChargeData := chargeData[baseTemplateName(residue, chargeData)]
+		terminalChargeData := chargeData[templateName(residue, chargeData)]
+		// keyed on the entry the group comes from and its number there
+		groups := make(map[[2]int]int)
+		for _, atom := range residue.Atoms {
+			data, exist := terminalChargeData[atom.element]
+			entry := 1
+			if !exist {
+				data, exist = residueChargeData[atom.element]
+				entry = 0
+			}
+			if !exist || data.ChargeGroup == 0 {
+				atom.chargeGroup = 0
+				continue
+			}
+			key := [2]int{entry, data.ChargeGroup}
+			if _, seen := groups[key]; !seen {
+				groups[key] = next
+				next++
+			}
+			atom.chargeGroup = groups[key]
+		}
+	}
+}
 
+// AssignChargesToProtein sets the charge of every atom from the charge data by residue
+// and atom name. An N- or C-terminal residue uses the entry of its terminal variant
+// (NALA, CALA, ... as in AMBER) for the atoms it lists and the plain entry for the others,
+// a residue with a Variant uses the entries of its variant (HID, NHID, ...) when there are.
+func (protein *Protein) AssignChargesToProtein(chargeData map[string]map[string]float64) {
+	for _, residue := range protein.Residue {
 		// Get the charge data for this residue, if it exists
-		residueChargeData, residueExists := chargeData[residueName]
+		residueChargeData, residueExists := chargeData[baseTemplateName(residue, chargeData)]
+		// terminal residues take their charges from the terminal entry when there is one
+		terminalChargeData, terminalExists := chargeData[templateName(residue, chargeData)]
 
 		for _, atom := range residue.Atoms {
 			atomName := atom.element
 
+			if terminalExists {
+				if atomCharge, atomExists := terminalChargeData[atomName]; atomExists {
+					atom.charge = atomCharge
+					continue
+				}
+			}
 			if residueExists {
 				// Try to get the charge data for this atom
 				atomCharge, atomExists := residueChargeData[atomName]
@@ -91,16 +217,105 @@ func (protein *Protein) AssignChargesToProtein(chargeData map[string]map[string]
 	}
 }
 
+// TotalCharge returns the sum of the charges of all atoms of the protein
+func TotalCharge(protein *Protein) float64 {
+	total := 0.0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			total += atom.charge
+		}
+	}
+	return total
+}
+
+// CheckNetCharge warns when the net charge of the protein is further than tolerance
+// from an integer, which usually means some atoms were left without a charge by
+// AssignChargesToProtein. It returns whether the net charge is integral.
+func CheckNetCharge(protein *Protein, tolerance float64) bool {
+	total := TotalCharge(protein)
+	if deviation := math.Abs(total - math.Round(total)); deviation > tolerance {
+		logger.Printf("Warning: net charge %.4f is not an integer (off by %.4f), check the assigned charges", total, deviation)
+		return false
+	}
+	return true
+}
+
 func CalculateTotalUnbondedEnergyForce(p *Protein, nonbondedParameter parameterDatabase) (float64, map[int]*TriTuple) {
+	totalEnergy, forceMap, _ := CalculateTotalUnbondedEnergyForcePairs(p, nonbondedParameter)
+	return totalEnergy, forceMap
+}
+
+// UnbondedPair holds the displacement (atom1 - atom2), the force acting on
+// atom1 due to atom2 and the energy (kJ/mol) of one non-bonded pair, the part of
+// the total non-bonded energy it accounts for so that the energies of the pairs sum to it
+type UnbondedPair struct {
+	Atom1        *Atom
+	Atom2        *Atom
+	Displacement TriTuple
+	Force        TriTuple
+	Energy       float64
+}
+
+// CalculateTotalUnbondedEnergyForcePairs works like CalculateTotalUnbondedEnergyForce
+// but also reports every interacting pair once (atom1.index < atom2.index),
+// which is what the pair form of the virial needs
+func CalculateTotalUnbondedEnergyForcePairs(p *Protein, nonbondedParameter parameterDatabase) (float64, map[int]*TriTuple, []UnbondedPair) {
+	forceMap := make(map[int]*TriTuple)
+	totalEnergy, pairs := addUnbondedForces(p, nonbondedParameter, forceMap, unbondedTerms{energy: true, forces: true, pairs: true})
+	return totalEnergy, forceMap, pairs
+}
+
+// UnbondedForcesOnly return the force map of CalculateTotalUnbondedEnergyForce
+// without the energy arithmetic, for the steps of a run that do not log energies
+func UnbondedForcesOnly(p *Protein, nonbondedParameter parameterDatabase) map[int]*TriTuple {
 	forceMap := make(map[int]*TriTuple)
+	addUnbondedForces(p, nonbondedParameter, forceMap, unbondedTerms{forces: true})
+	return forceMap
+}
+
+// UnbondedEnergyOnly return the energy of CalculateTotalUnbondedEnergyForce
+// without computing any force, as Monte Carlo needs
+func UnbondedEnergyOnly(p *Protein, nonbondedParameter parameterDatabase) float64 {
+	energy, _ := addUnbondedForces(p, nonbondedParameter, nil, unbondedTerms{energy: true})
+	return energy
+}
+
+// unbondedTerms selects what addUnbondedForces computes,
+// the pairs are only collected together with the forces
+type unbondedTerms struct {
+	energy bool
+	forces bool
+	pairs  bool
+}
+
+// addUnbondedForces sets the entry of every atom of the force map to its non-bonded force,
+// reusing the entries already in the map, and return the non-bonded energy together
+// with the interacting pairs, each only when selected by terms. The force map may be nil
+// when the forces are not selected.
+func addUnbondedForces(p *Protein, nonbondedParameter parameterDatabase, forceMap map[int]*TriTuple, terms unbondedTerms) (float64, []UnbondedPair) {
+	var pairs []UnbondedPair
 	totalEnergy := 0.0
 	verletList := NewVerletList()
-	verletList.BuildVerlet(p)
+	verletList.Scheme = nonbondedParameter.cutoffScheme
+	if err := verletList.BuildVerlet(p); err != nil {
+		logger.Printf("Warning: no non-bonded energy: %v", err)
+	}
+	explicitPairs := make(map[[2]int]bool)
+	for _, pair := range nonbondedParameter.pairs {
+		explicitPairs[[2]int{pair.Atom1, pair.Atom2}] = true
+		explicitPairs[[2]int{pair.Atom2, pair.Atom1}] = true
+	}
 
 	for _, residue := range p.Residue {
 		for _, atom1 := range residue.Atoms {
 			// Initialize force for atom1
-			forceMap[atom1.index] = &TriTuple{0.0, 0.0, 0.0}
+			if terms.forces {
+				if force, exist := forceMap[atom1.index]; exist {
+					*force = TriTuple{}
+				} else {
+					forceMap[atom1.index] = &TriTuple{0.0, 0.0, 0.0}
+				}
+			}
 
 			// Access the Neighbors map using the dereferenced verletList
 			neighbors, exists := verletList.Neighbors[atom1]
@@ -109,41 +324,374 @@ func CalculateTotalUnbondedEnergyForce(p *Protein, nonbondedParameter parameterD
 			}
 
 			for _, atom2 := range neighbors {
+				// the explicit 1-4 pairs are added below with their own parameters
+				if explicitPairs[[2]int{atom1.index, atom2.index}] {
+					continue
+				}
 				// Compute the distance between atom1 and atom2
 				r := Distance(atom1.position, atom2.position)
+				var pairForce TriTuple
+				pairEnergy := 0.0
 
 				// Calculate the Lennard-Jones potential energy between atom1 and atom2
-				parameterList := SearchParameter(2, nonbondedParameter, atom1, atom2)
-				if len(parameterList) == 2 {
-					LJPotentialEnergy := CalculateLJPotentialEnergy(parameterList[0], parameterList[1], r)
-					totalEnergy += LJPotentialEnergy
+				parameterList := nonbondedParameter.ljParameters(atom1, atom2)
+				if len(parameterList) == 2 && terms.energy {
+					pairEnergy += CalculateLJPotentialEnergy(parameterList[0], parameterList[1], r)
+				}
+				if len(parameterList) == 2 && terms.forces {
 					// Calculate the Lennard-Jones force between atom1 and atom2
 					LJForce := CalculateLJForce(atom1, atom2, parameterList[0], parameterList[1], r)
 					// Update the force map for atom1
 					forceMap[atom1.index].x += LJForce.x
 					forceMap[atom1.index].y += LJForce.y
 					forceMap[atom1.index].z += LJForce.z
+					pairForce = LJForce
 				}
 
-				if atom1.charge == 0.0 || atom2.charge == 0.0 {
-					continue
+				if atom1.charge != 0.0 && atom2.charge != 0.0 && terms.energy {
+					// Calculate the electric potential energy between atom1 and atom2
+					pairEnergy += CalculateElectricPotentialEnergy(atom1, atom2, r)
 				}
+				totalEnergy += pairEnergy
+				if atom1.charge != 0.0 && atom2.charge != 0.0 && terms.forces {
+					// Calculate the electric force between atom1 and atom2
+					electricForce := CalculateElectricForce(atom1, atom2, r)
 
-				// Calculate the electric potential energy between atom1 and atom2
-				electricPotentialEnergy := CalculateElectricPotentialEnergy(atom1, atom2, r)
-				totalEnergy += electricPotentialEnergy
-				// Calculate the electric force between atom1 and atom2
-				electricForce := CalculateElectricForce(atom1, atom2, r)
+					// Update the force map for atom1
+					forceMap[atom1.index].x += electricForce.x
+					forceMap[atom1.index].y += electricForce.y
+					forceMap[atom1.index].z += electricForce.z
+					pairForce.x += electricForce.x
+					pairForce.y += electricForce.y
+					pairForce.z += electricForce.z
+				}
 
-				// Update the force map for atom1
-				forceMap[atom1.index].x += electricForce.x
-				forceMap[atom1.index].y += electricForce.y
-				forceMap[atom1.index].z += electricForce.z
+				if terms.pairs && terms.forces && atom1.index < atom2.index {
+					// the total counts the pair from both of its atoms
+					pairs = append(pairs, UnbondedPair{
+						Atom1:        atom1,
+						Atom2:        atom2,
+						Displacement: CalculateVector(atom2, atom1),
+						Force:        pairForce,
+						Energy:       2 * pairEnergy,
+					})
+				}
 			}
 		}
 	}
 
-	return totalEnergy, forceMap
+	explicitEnergy, explicit := addPairForces(p, nonbondedParameter, forceMap, terms)
+	if !terms.energy {
+		explicitEnergy = 0.0
+	}
+	return totalEnergy + explicitEnergy, append(pairs, explicit...)
+}
+
+// addPairForces adds the forces of the explicit 1-4 pairs of the database to both of
+// their atoms and return their energy, each pair counted once, together with the
+// pairs, as selected by terms. A pair without parameters takes the non-bonded ones.
+func addPairForces(p *Protein, nonbondedParameter parameterDatabase, forceMap map[int]*TriTuple, terms unbondedTerms) (float64, []UnbondedPair) {
+	if len(nonbondedParameter.pairs) == 0 {
+		return 0.0, nil
+	}
+	atoms := make(map[int]*Atom)
+	for _, atom := range proteinAtoms(p) {
+		atoms[atom.index] = atom
+	}
+
+	var pairs []UnbondedPair
+	totalEnergy := 0.0
+	for _, pair := range nonbondedParameter.pairs {
+		atom1, atom2 := atoms[pair.Atom1], atoms[pair.Atom2]
+		if atom1 == nil || atom2 == nil || atom1 == atom2 {
+			continue
+		}
+		energy, force := explicitPairEnergyForce(atom1, atom2, pair, nonbondedParameter)
+		totalEnergy += energy
+		if !terms.forces {
+			continue
+		}
+
+		for _, atom := range []*Atom{atom1, atom2} {
+			if _, exist := forceMap[atom.index]; !exist {
+				forceMap[atom.index] = &TriTuple{}
+			}
+		}
+		*forceMap[atom1.index] = addVectors(*forceMap[atom1.index], force)
+		*forceMap[atom2.index] = addVectors(*forceMap[atom2.index], scaleVector(force, -1))
+
+		if terms.pairs {
+			if atom1.index > atom2.index {
+				atom1, atom2, force = atom2, atom1, scaleVector(force, -1)
+			}
+			pairs = append(pairs, UnbondedPair{Atom1: atom1, Atom2: atom2, Displacement: CalculateVector(atom2, atom1), Force: force, Energy: energy})
+		}
+	}
+
+	return totalEnergy, pairs
+}
+
+// explicitPairEnergyForce return the energy of an explicit 1-4 pair and the force on atom1
+func explicitPairEnergyForce(atom1, atom2 *Atom, pair ItpPair, nonbondedParameter parameterDatabase) (float64, TriTuple) {
+	r := Distance(atom1.position, atom2.position)
+	energy := 0.0
+	var force TriTuple
+
+	parameterList := nonbondedParameter.toKJPerMol(pair.Parameter)
+	if len(parameterList) != 2 {
+		parameterList = nonbondedParameter.ljParameters(atom1, atom2)
+	}
+	if len(parameterList) == 2 {
+		energy += CalculateLJPotentialEnergy(parameterList[0], parameterList[1], r)
+		force = CalculateLJForce(atom1, atom2, parameterList[0], parameterList[1], r)
+	}
+	if atom1.charge != 0.0 && atom2.charge != 0.0 {
+		energy += nonbondedParameter.fudgeQQ * CalculateElectricPotentialEnergy(atom1, atom2, r)
+		force = addVectors(force, scaleVector(CalculateElectricForce(atom1, atom2, r), nonbondedParameter.fudgeQQ))
+	}
+	return energy, force
+}
+
+// DeltaEnergyForMove takes a topology in whose protein the atom of the given index has
+// just moved from oldPos, and the bonded and non-bonded parameters, and return the change
+// of CalculateTotalEnergy caused by the move, in the energy unit of the bonded parameters.
+// Only the bonded terms of the moved atom and its pairs with the atoms of its neighbour
+// list are evaluated, RunMonteCarloForceField keeps that list between moves.
+// The atom based cutoff is assumed: with GroupCutoff moving one atom shifts the center
+// of its group and the full non-bonded energies are compared instead.
+func DeltaEnergyForMove(topology *Topology, movedAtomIndex int, oldPos TriTuple, bonded, nonbonded parameterDatabase) float64 {
+	moves := newMoveEnergy(topology, bonded, nonbonded)
+	moved, exist := moves.atoms[movedAtomIndex]
+	if !exist {
+		return 0.0
+	}
+	return moves.delta(moved, oldPos)
+}
+
+// moveEnergy scores single-atom moves: it holds the bonded terms of every atom and a
+// spatial hash of the atoms as the neighbour list, which must follow the accepted moves
+type moveEnergy struct {
+	bonded    parameterDatabase
+	nonbonded parameterDatabase
+	protein   *Protein
+	atoms     map[int]*Atom
+	neighbors *SpatialHash
+	terms     map[*Atom]*Topology
+	explicit  map[int][]ItpPair
+}
+
+// newMoveEnergy indexes the terms and pairs of the topology by atom
+func newMoveEnergy(topology *Topology, bonded, nonbonded parameterDatabase) *moveEnergy {
+	m := &moveEnergy{
+		bonded:    bonded,
+		nonbonded: nonbonded,
+		protein:   topology.Protein,
+		atoms:     make(map[int]*Atom),
+		neighbors: NewSpatialHash(topology.Protein, verletCutOff+verletBuffer),
+		terms:     make(map[*Atom]*Topology),
+		explicit:  make(map[int][]ItpPair),
+	}
+	for _, atom := range topology.atoms() {
+		m.atoms[atom.index] = atom
+		m.terms[atom] = NewTopology(topology.Protein)
+	}
+	for _, bond := range topology.bonds {
+		for _, atom := range []*Atom{bond.atom1, bond.atom2} {
+			m.terms[atom].AddBond(bond.atom1, bond.atom2, bond.parameter...)
+		}
+	}
+	for _, angle := range topology.angles {
+		for _, atom := range []*Atom{angle.atom1, angle.atom2, angle.atom3} {
+			m.terms[atom].AddAngle(angle.atom1, angle.atom2, angle.atom3, angle.parameter...)
+		}
+	}
+	for _, dihedral := range topology.dihedrals {
+		for _, atom := range []*Atom{dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4} {
+			m.terms[atom].AddDihedral(dihedral.atom1, dihedral.atom2, dihedral.atom3, dihedral.atom4, dihedral.parameter...)
+		}
+	}
+	for _, improper := range topology.impropers {
+		for _, atom := range []*Atom{improper.atom1, improper.atom2, improper.atom3, improper.atom4} {
+			m.terms[atom].AddImproper(improper.atom1, improper.atom2, improper.atom3, improper.atom4, improper.parameter...)
+		}
+	}
+	for _, pair := range nonbonded.pairs {
+		m.explicit[pair.Atom1] = append(m.explicit[pair.Atom1], pair)
+		if pair.Atom2 != pair.Atom1 {
+			m.explicit[pair.Atom2] = append(m.explicit[pair.Atom2], pair)
+		}
+	}
+	return m
+}
+
+// delta return the energy change of the atom moving from oldPos to its position, the
+// neighbour list must hold the other atoms where they are, wherever it holds this one
+func (m *moveEnergy) delta(atom *Atom, oldPos TriTuple) float64 {
+	newPos := atom.position
+	bondedNew := m.terms[atom].bondedEnergy(m.bonded)
+	unbondedNew := m.unbondedEnergy(atom)
+	atom.position = oldPos
+	bondedOld := m.terms[atom].bondedEnergy(m.bonded)
+	unbondedOld := m.unbondedEnergy(atom)
+	atom.position = newPos
+	return bondedNew - bondedOld + m.bonded.unitSystem().FromKJPerMol(unbondedNew-unbondedOld)
+}
+
+// unbondedEnergy return the part of the energy of CalculateTotalUnbondedEnergyForce that
+// involves the atom: its explicit pairs once and, like the Verlet list, its other pairs
+// within the cutoff and more than 3 indices apart from each side. With GroupCutoff it
+// return the whole non-bonded energy.
+func (m *moveEnergy) unbondedEnergy(atom *Atom) float64 {
+	if m.nonbonded.cutoffScheme == GroupCutoff {
+		return UnbondedEnergyOnly(m.protein, m.nonbonded)
+	}
+
+	energy := 0.0
+	paired := make(map[*Atom]bool)
+	for _, pair := range m.explicit[atom.index] {
+		atom1, atom2 := m.atoms[pair.Atom1], m.atoms[pair.Atom2]
+		if atom1 == nil || atom2 == nil {
+			continue
+		}
+		pairEnergy, _ := explicitPairEnergyForce(atom1, atom2, pair, m.nonbonded)
+		energy += pairEnergy
+		paired[atom1], paired[atom2] = true, true
+	}
+
+	// the Verlet list keeps the pairs at exactly the cutoff, the hash query is strict
+	reach := math.Nextafter(verletCutOff+verletBuffer, math.Inf(1))
+	for _, other := range m.neighbors.Query(atom.position, reach) {
+		if other == atom || paired[other] {
+			continue
+		}
+		if other.index >= atom.index-3 && other.index <= atom.index+3 {
+			continue
+		}
+		energy += pairEnergy(atom, other, m.nonbonded) + pairEnergy(other, atom, m.nonbonded)
+	}
+	return energy
+}
+
+// pairEnergy return the non-bonded energy of one pair of atoms, the Lennard-Jones
+// and Coulomb terms of CalculateTotalUnbondedEnergyForce without cutoff or exclusions
+func pairEnergy(atom1, atom2 *Atom, nonbondedParameter parameterDatabase) float64 {
+	lj, coulomb := pairEnergies(atom1, atom2, nonbondedParameter)
+	return lj + coulomb
+}
+
+// pairEnergies return the Lennard-Jones and Coulomb terms of pairEnergy separately
+func pairEnergies(atom1, atom2 *Atom, nonbondedParameter parameterDatabase) (float64, float64) {
+	r := Distance(atom1.position, atom2.position)
+	lj, coulomb := 0.0, 0.0
+	if parameterList := nonbondedParameter.ljParameters(atom1, atom2); len(parameterList) == 2 {
+		lj = CalculateLJPotentialEnergy(parameterList[0], parameterList[1], r)
+	}
+	if atom1.charge != 0.0 && atom2.charge != 0.0 {
+		coulomb = CalculateElectricPotentialEnergy(atom1, atom2, r)
+	}
+	return lj, coulomb
+}
+
+// InteractionEnergy takes two disjoint sets of atoms, e.g. a ligand and its pocket, and the
+// non-bonded parameters, and return the Lennard-Jones and Coulomb energies between the sets,
+// summed over every pair with one atom in each set. Pairs inside a set are left out.
+// Like CalculateTotalUnbondedEnergyForce only the pairs within the cutoff count, with
+// GroupCutoff the centers of the charge groups are taken over the atoms of both sets.
+func InteractionEnergy(selA, selB []*Atom, nonbonded parameterDatabase) (lj, coulomb float64) {
+	cutoffPlusBuffer := verletCutOff + verletBuffer
+	var centers map[int]TriTuple
+	if nonbonded.cutoffScheme == GroupCutoff {
+		atoms := append(append([]*Atom{}, selA...), selB...)
+		centers = chargeGroupCenters(&Protein{Residue: []*Residue{{Atoms: atoms}}}, nil)
+	}
+
+	for _, atom1 := range selA {
+		for _, atom2 := range selB {
+			if atom1 == atom2 {
+				continue
+			}
+			position1, position2 := atom1.position, atom2.position
+			if centers != nil {
+				position1, position2 = groupCenter(atom1, centers), groupCenter(atom2, centers)
+			}
+			if Distance(position1, position2) > cutoffPlusBuffer {
+				continue
+			}
+			pairLJ, pairCoulomb := pairEnergies(atom1, atom2, nonbonded)
+			lj += pairLJ
+			coulomb += pairCoulomb
+		}
+	}
+	return lj, coulomb
+}
+
+// CombineLJ takes two atom types and the per type Lennard-Jones parameters
+// and return the A (r^-12) and B (r^-6) coefficients of the pair using the
+// Lorentz-Berthelot rules sigma_ij = (sigma_i+sigma_j)/2, epsilon_ij = sqrt(epsilon_i*epsilon_j)
+func CombineLJ(typeI, typeJ string, perTypeParams map[string]LJParam) (A, B float64) {
+	return CombineLJWithRule(typeI, typeJ, perTypeParams, LorentzBerthelot)
+}
+
+// CombineLJWithRule is CombineLJ with a selectable mixing rule
+func CombineLJWithRule(typeI, typeJ string, perTypeParams map[string]LJParam, rule CombiningRule) (A, B float64) {
+	return ljCoefficients(rule.Combine(perTypeParams[typeI], perTypeParams[typeJ]))
+}
+
+// ljCoefficients return the A (r^-12) and B (r^-6) coefficients of a sigma and epsilon
+func ljCoefficients(param LJParam) (A, B float64) {
+	sigma6 := math.Pow(param.Sigma, 6)
+	return 4 * param.Epsilon * sigma6 * sigma6, 4 * param.Epsilon * sigma6
+}
+
+// Combine returns the sigma and epsilon of the pair i-j under the rule
+func (rule CombiningRule) Combine(paramI, paramJ LJParam) LJParam {
+	var sigma float64
+	switch rule {
+	case Geometric:
+		sigma = math.Sqrt(paramI.Sigma * paramJ.Sigma)
+	default:
+		sigma = (paramI.Sigma + paramJ.Sigma) / 2
+	}
+
+	return LJParam{Sigma: sigma, Epsilon: math.Sqrt(paramI.Epsilon * paramJ.Epsilon)}
+}
+
+// ljParameters returns the [B, A] coefficients for a pair of atoms converted from the
+// unit system of the database to kJ/mol and Angstrom, see ljParametersInUnits
+func (db parameterDatabase) ljParameters(atom1, atom2 *Atom) []float64 {
+	return db.toKJPerMol(db.ljParametersInUnits(atom1, atom2))
+}
+
+// toKJPerMol return the [B, A] coefficients in kJ/mol*Angstrom^6 and kJ/mol*Angstrom^12,
+// the coefficients are given in the energy and length units of the database
+func (db parameterDatabase) toKJPerMol(parameterList []float64) []float64 {
+	units := db.unitSystem()
+	if len(parameterList) != 2 || (units.KJPerMolPerEnergy == 1 && units.AngstromPerLength == 1) {
+		return parameterList
+	}
+	length6 := math.Pow(units.AngstromPerLength, 6)
+	return []float64{parameterList[0] * units.KJPerMolPerEnergy * length6, parameterList[1] * units.KJPerMolPerEnergy * length6 * length6}
+}
+
+// ljParametersInUnits returns the [B, A] coefficients for a pair of atoms, combined from
+// the per type parameters when the database has them and looked up per pair otherwise.
+// A pair exception (NBFIX) of the two types is preferred over the combining rule.
+func (db parameterDatabase) ljParametersInUnits(atom1, atom2 *Atom) []float64 {
+	if exception, exist := db.ljExceptions[ljExceptionKey(atom1.element, atom2.element)]; exist {
+		A, B := ljCoefficients(exception)
+		return []float64{B, A}
+	}
+	if db.ljTypes == nil {
+		return SearchParameter(2, db, atom1, atom2)
+	}
+
+	_, exist1 := db.ljTypes[atom1.element]
+	_, exist2 := db.ljTypes[atom2.element]
+	if !exist1 || !exist2 {
+		return []float64{0.0}
+	}
+	A, B := CombineLJWithRule(atom1.element, atom2.element, db.ljTypes, db.combiningRule)
+	return []float64{B, A}
 }
 
 func CalculateElectricForce(a1, a2 *Atom, r float64) TriTuple {
@@ -184,3 +732,79 @@ func CalculateLJForce(a1, a2 *Atom, B, A, r float64) TriTuple {
 		z: forceMagnitude * unitVector.z,
 	}
 }
+
+// softCoreSigma is the sigma of the soft-core radius for pairs without dispersion (B = 0),
+// the 0.3 nm default of GROMACS sc-sigma in the length unit of the parameters
+const softCoreSigma = 0.3
+
+// CalculateSoftCoreLJPotentialEnergy return the soft-core Lennard-Jones energy
+// lambda * (A/s^2 - B/s) with s = alpha*sigma^6*(1-lambda) + r^6 and sigma^6 = A/B,
+// which is the plain LJ at lambda = 1 and vanishes without a singularity as lambda goes
+// to 0 (Beutler et al. 1994). Unlike CalculateLJPotentialEnergy the energy is signed,
+// so that CalculateSoftCoreLJForce is its exact derivative.
+func CalculateSoftCoreLJPotentialEnergy(B, A, r, lambda, alpha float64) float64 {
+	s := softCoreR6(B, A, r, lambda, alpha)
+	return lambda * (A/(s*s) - B/s)
+}
+
+// CalculateSoftCoreLJForce return the force of CalculateSoftCoreLJPotentialEnergy on a1,
+// along a2 - a1 like CalculateLJForce. It stays finite at r = 0 for lambda < 1.
+func CalculateSoftCoreLJForce(a1, a2 *Atom, B, A, r, lambda, alpha float64) TriTuple {
+	if r == 0 {
+		return TriTuple{}
+	}
+	s := softCoreR6(B, A, r, lambda, alpha)
+	// dV/dr = lambda * (-2A/s^3 + B/s^2) * 6r^5
+	dVdr := lambda * (-2*A/(s*s*s) + B/(s*s)) * 6 * math.Pow(r, 5)
+	return scaleVector(CalculateVector(a1, a2), dVdr/r)
+}
+
+// softCoreR6 return the soft-core r^6, alpha*sigma^6*(1-lambda) + r^6
+func softCoreR6(B, A, r, lambda, alpha float64) float64 {
+	sigma6 := math.Pow(softCoreSigma, 6)
+	if B > 0 && A > 0 {
+		sigma6 = A / B
+	}
+	return alpha*sigma6*(1-lambda) + math.Pow(r, 6)
+}
+
+// LJTailCorrection takes a protein in a periodic box, the non-bonded cutoff and the
+// Lennard-Jones parameters and return the long-range dispersion correction
+// -2/3 pi N rho <C6> / rc^3 for the interactions truncated at the cutoff.
+// <C6> is averaged over all atom pairs, assuming a uniform density beyond the cutoff.
+func LJTailCorrection(protein *Protein, box Box, cutoff float64, nonbondedParameter parameterDatabase) float64 {
+	// one representative atom per type is enough to look the pairs up
+	count := make(map[string]int)
+	representative := make(map[string]*Atom)
+	var types []string
+	total := 0
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			if _, exist := representative[atom.element]; !exist {
+				representative[atom.element] = atom
+				types = append(types, atom.element)
+			}
+			count[atom.element]++
+			total++
+		}
+	}
+	if total == 0 || cutoff <= 0 {
+		return 0.0
+	}
+
+	averageC6 := 0.0
+	for _, typeI := range types {
+		for _, typeJ := range types {
+			parameterList := nonbondedParameter.ljParameters(representative[typeI], representative[typeJ])
+			if len(parameterList) != 2 {
+				continue
+			}
+			averageC6 += float64(count[typeI]*count[typeJ]) * parameterList[0]
+		}
+	}
+	averageC6 /= float64(total * total)
+
+	n := float64(total)
+	density := n / box.Volume()
+	return -2.0 / 3.0 * math.Pi * n * density * averageC6 / math.Pow(cutoff, 3)
+}
@@ -0,0 +1,94 @@
+package main
+
+// CalculateVirialTensor takes a protein and the force on each atom (keyed by atom index)
+// and returns the 3x3 tensor sum(m * v (x) v) + sum(r (x) F).
+// For an isolated system with pairwise forces the second term equals the pair
+// virial sum(r_ij (x) F_ij), see PairVirialTensor.
+// Dividing by the volume gives the pressure tensor, and the average of its
+// diagonal is the scalar pressure.
+func CalculateVirialTensor(protein *Protein, forceMap map[int]*TriTuple) [3][3]float64 {
+	var tensor [3][3]float64
+
+	for _, residue := range protein.Residue {
+		for _, atom := range residue.Atoms {
+			// kinetic contribution
+			v := [3]float64{atom.velocity.x, atom.velocity.y, atom.velocity.z}
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					tensor[a][b] += atom.mass * v[a] * v[b]
+				}
+			}
+
+			force, exist := forceMap[atom.index]
+			if !exist {
+				continue
+			}
+			r := [3]float64{atom.position.x, atom.position.y, atom.position.z}
+			f := [3]float64{force.x, force.y, force.z}
+			for a := 0; a < 3; a++ {
+				for b := 0; b < 3; b++ {
+					tensor[a][b] += r[a] * f[b]
+				}
+			}
+		}
+	}
+
+	return tensor
+}
+
+// PairVirialTensor returns sum(r_ij (x) F_ij) over the pairs reported by
+// CalculateTotalUnbondedEnergyForcePairs
+func PairVirialTensor(pairs []UnbondedPair) [3][3]float64 {
+	var tensor [3][3]float64
+
+	for _, pair := range pairs {
+		r := [3]float64{pair.Displacement.x, pair.Displacement.y, pair.Displacement.z}
+		f := [3]float64{pair.Force.x, pair.Force.y, pair.Force.z}
+		for a := 0; a < 3; a++ {
+			for b := 0; b < 3; b++ {
+				tensor[a][b] += r[a] * f[b]
+			}
+		}
+	}
+
+	return tensor
+}
+
+// ScalarPressure takes a virial tensor and the volume of the system
+// and returns the average of the diagonal of the pressure tensor
+func ScalarPressure(tensor [3][3]float64, volume float64) float64 {
+	return (tensor[0][0] + tensor[1][1] + tensor[2][2]) / (3 * volume)
+}
+
+// barPerPressureUnit converts the g/mol/(Angstrom*fs^2) of ScalarPressure,
+// with the velocities in Angstrom/fs and the forces of EvaluateForces, to bar
+const barPerPressureUnit = 1.66053906660e8
+
+// ThermoState gathers the instantaneous observables of a system,
+// the energies are in the energy unit of the bonded parameters, kJ/mol by default
+type ThermoState struct {
+	PotentialEnergy float64
+	KineticEnergy   float64
+	TotalEnergy     float64
+	Temperature     float64 // K
+	Pressure        float64 // bar, zero without a box
+}
+
+// Thermodynamics takes a protein, its topology, the parameters and an optional box
+// and return its potential, kinetic and total energy, temperature and, with a box,
+// the virial pressure
+func Thermodynamics(protein *Protein, topology *Topology, bonded, nonbonded parameterDatabase, box *Box) ThermoState {
+	potential, forceMap := EvaluateForces(topology, bonded, nonbonded)
+
+	state := ThermoState{
+		PotentialEnergy: potential,
+		KineticEnergy:   KineticEnergy(protein, bonded.unitSystem()),
+		Temperature:     Temperature(protein, bonded.unitSystem()),
+	}
+	state.TotalEnergy = state.PotentialEnergy + state.KineticEnergy
+
+	if box != nil {
+		state.Pressure = ScalarPressure(CalculateVirialTensor(protein, forceMap), box.Volume()) * barPerPressureUnit
+	}
+	return state
+}